@@ -0,0 +1,158 @@
+package sphinx
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// AuditRecord holds the shared secrets of a selected set of hops of an onion
+// packet, sealed to an auditor. With the shared secret of a hop, the auditor
+// is able to peel the layer of the packet destined for that hop, and decrypt
+// errors sent back by it, but none of the other layers.
+type AuditRecord struct {
+	// EphemeralKey is the public key the secrets are sealed with, in
+	// combination with the auditor's key. It's unrelated to the session
+	// key of the packet.
+	EphemeralKey *btcec.PublicKey
+
+	// SealedSecrets maps the index of each audited hop within the route
+	// to its shared secret, encrypted using ChaCha20-Poly1305 under a key
+	// unique to the hop.
+	SealedSecrets map[int][]byte
+}
+
+// NewAuditableOnionPacket creates a new onion packet exactly like
+// NewOnionPacket, and additionally returns an AuditRecord which reveals the
+// shared secrets of the hops at the passed indexes within the route to the
+// holder of the private key matching auditorKey.
+//
+// WARNING: This reduces the privacy of the payment. Anyone holding the
+// auditor's key, and obtaining the record, learns the payloads destined for
+// the audited hops, and is able to link the packet at each of them. It's only
+// meant for compliance sandboxes, and must never be used unless explicitly
+// opted into by the sender.
+//
+// The packet itself is identical to the one NewOnionPacket creates for the
+// same session key, so it can't be told apart from any other packet, and the
+// privacy of senders not using this function is unaffected. Deriving the hop
+// keys from a secret escrowed with the auditor instead would have produced
+// the same packets, but it would reveal every hop of every packet to the
+// auditor, rather than only the ones selected by the sender. Any marker within
+// the packet itself would have made auditable packets stand out to all
+// hops. It's up to the sender to hand the record to the auditor out of band.
+func NewAuditableOnionPacket(paymentPath *PaymentPath,
+	sessionKey *btcec.PrivateKey, assocData []byte,
+	auditorKey *btcec.PublicKey, auditedHops []int,
+	opts ...OnionPacketOption) (*OnionPacket, *AuditRecord, error) {
+
+	if auditorKey == nil {
+		return nil, nil, fmt.Errorf("no auditor key passed in")
+	}
+
+	numHops := paymentPath.TrueRouteLength()
+	if len(auditedHops) == 0 {
+		return nil, nil, fmt.Errorf("no hops to audit passed in")
+	}
+	audited := make(map[int]struct{}, len(auditedHops))
+	for _, hop := range auditedHops {
+		if hop < 0 || hop >= numHops {
+			return nil, nil, fmt.Errorf("audited hop %d not "+
+				"within route of %d hops", hop, numHops)
+		}
+		if _, ok := audited[hop]; ok {
+			return nil, nil, fmt.Errorf("hop %d audited twice", hop)
+		}
+		audited[hop] = struct{}{}
+	}
+
+	pkt, err := NewOnionPacket(paymentPath, sessionKey, assocData, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sharedSecrets, err := GenerateSharedSecrets(
+		paymentPath.NodeKeys(), sessionKey,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		for i := range sharedSecrets {
+			zero(sharedSecrets[i][:])
+		}
+	}()
+
+	ephemeralKey, err := readSessionKey(newOnionPacketCfg(opts).rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealSecret := generateSharedSecret(auditorKey, ephemeralKey)
+	defer zero(sealSecret[:])
+
+	record := &AuditRecord{
+		EphemeralKey:  ephemeralKey.PubKey(),
+		SealedSecrets: make(map[int][]byte, len(auditedHops)),
+	}
+	for _, hop := range auditedHops {
+		hopKey := auditHopKey(&sealSecret, hop)
+		record.SealedSecrets[hop] = EncryptBlindedData(
+			hopKey, sharedSecrets[hop][:],
+		)
+		zero(hopKey[:])
+	}
+
+	return pkt, record, nil
+}
+
+// Open recovers the shared secrets sealed within the audit record using the
+// private key of the auditor, keyed by the index of their hop within the
+// route. An error wrapping ErrInvalidBlindedData is returned if any of them
+// fails to decrypt, for instance as the record was sealed to another auditor.
+func (a *AuditRecord) Open(auditorKey *btcec.PrivateKey) (map[int]Hash256,
+	error) {
+
+	if a.EphemeralKey == nil {
+		return nil, fmt.Errorf("audit record lacks an ephemeral key")
+	}
+
+	sealSecret := generateSharedSecret(a.EphemeralKey, auditorKey)
+	defer zero(sealSecret[:])
+
+	hops := make([]int, 0, len(a.SealedSecrets))
+	for hop := range a.SealedSecrets {
+		hops = append(hops, hop)
+	}
+	sort.Ints(hops)
+
+	secrets := make(map[int]Hash256, len(hops))
+	for _, hop := range hops {
+		hopKey := auditHopKey(&sealSecret, hop)
+		secret, err := DecryptBlindedData(hopKey, a.SealedSecrets[hop])
+		zero(hopKey[:])
+		if err != nil {
+			return nil, fmt.Errorf("unable to open secret of hop "+
+				"%d: %w", hop, err)
+		}
+		if len(secret) != len(Hash256{}) {
+			return nil, fmt.Errorf("%w: secret of hop %d is %d "+
+				"bytes", ErrInvalidBlindedData, hop,
+				len(secret))
+		}
+
+		var sharedSecret Hash256
+		copy(sharedSecret[:], secret)
+		zero(secret)
+		secrets[hop] = sharedSecret
+	}
+
+	return secrets, nil
+}
+
+// auditHopKey derives the key the shared secret of the hop at the passed index
+// is sealed with. As every hop is sealed under a distinct key, the zero nonce
+// used by EncryptBlindedData is never reused.
+func auditHopKey(sealSecret *Hash256, hop int) [32]byte {
+	return generateKey(fmt.Sprintf("audit%d", hop), sealSecret)
+}
@@ -0,0 +1,92 @@
+package sphinx
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// TestAuditableOnionPacket asserts that an auditable onion packet is identical
+// to a regular one, and that the auditor recovers the shared secrets of the
+// audited hops only.
+func TestAuditableOnionPacket(t *testing.T) {
+	nodes, route, _, fwdMsg, err := newTestRoute(4)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	auditorKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate auditor key: %v", err)
+	}
+
+	auditedHops := []int{1, 3}
+	pkt, record, err := NewAuditableOnionPacket(
+		route, sessionKey, nil, auditorKey.PubKey(), auditedHops,
+	)
+	if err != nil {
+		t.Fatalf("unable to create auditable packet: %v", err)
+	}
+	if !pkt.Equal(fwdMsg) {
+		t.Fatalf("auditable packet differs from regular packet")
+	}
+	if record.EphemeralKey.IsEqual(sessionKey.PubKey()) {
+		t.Fatalf("audit record reveals the session key")
+	}
+
+	secrets, err := record.Open(auditorKey)
+	if err != nil {
+		t.Fatalf("unable to open audit record: %v", err)
+	}
+	if len(secrets) != len(auditedHops) {
+		t.Fatalf("expected %d secrets, got %d", len(auditedHops),
+			len(secrets))
+	}
+
+	// The recovered secrets are the ones the audited hops derive, while
+	// the other hops aren't revealed.
+	for i, node := range nodes {
+		processed, err := node.ReconstructOnionPacket(pkt, nil)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		secret, ok := secrets[i]
+		audited := i == 1 || i == 3
+		switch {
+		case ok != audited:
+			t.Fatalf("hop %d: expected audited %v", i, audited)
+
+		case ok && secret != processed.SharedSecret:
+			t.Fatalf("hop %d: recovered wrong shared secret", i)
+		}
+
+		pkt = processed.NextPacket
+	}
+
+	// Another auditor's key doesn't open the record.
+	otherKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	if _, err := record.Open(otherKey); !errors.Is(
+		err, ErrInvalidBlindedData,
+	) {
+		t.Fatalf("expected ErrInvalidBlindedData, got: %v", err)
+	}
+
+	// Hops outside of the route, or audited twice, are rejected.
+	for _, hops := range [][]int{nil, {4}, {-1}, {2, 2}} {
+		_, _, err := NewAuditableOnionPacket(
+			route, sessionKey, nil, auditorKey.PubKey(), hops,
+		)
+		if err == nil {
+			t.Fatalf("expected audited hops %v to be rejected",
+				hops)
+		}
+	}
+}
@@ -92,6 +92,20 @@ func (b *Batch) ForEach(fn func(seqNum uint16, hashPrefix *HashPrefix, cltv uint
 	return nil
 }
 
+// expiry returns the highest CLTV expiry among the entries of the batch, or
+// zero if it has none. Once it has passed, all of the entries are stale, and
+// so is the replay set recorded for the batch.
+func (b *Batch) expiry() uint32 {
+	var expiry uint32
+	for _, entry := range b.entries {
+		if entry.cltv > expiry {
+			expiry = entry.cltv
+		}
+	}
+
+	return expiry
+}
+
 // batchEntry is a tuple of a secret's hash prefix and the corresponding CLTV at
 // which the onion blob from which the secret was derived expires.
 type batchEntry struct {
@@ -2,7 +2,13 @@ package sphinx
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/btcsuite/btcd/btcec"
 )
@@ -21,7 +27,7 @@ func BenchmarkPathPacketConstruction(b *testing.B) {
 		route        PaymentPath
 	)
 
-	for i := 0; i < NumMaxHops; i++ {
+	for i := 0; i < testLegacyRouteNumHops; i++ {
 		privKey, err := btcec.NewPrivateKey(btcec.S256())
 		if err != nil {
 			b.Fatalf("unable to generate key: %v", privKey)
@@ -34,9 +40,14 @@ func BenchmarkPathPacketConstruction(b *testing.B) {
 		}
 		copy(hopData.NextAddress[:], bytes.Repeat([]byte{byte(i)}, 8))
 
+		hopPayload, err := NewHopPayload(&hopData, nil)
+		if err != nil {
+			b.Fatalf("unable to create new hop payload: %v", err)
+		}
+
 		route[i] = OnionHop{
-			NodePub: *privKey.PubKey(),
-			HopData: hopData,
+			NodePub:    *privKey.PubKey(),
+			HopPayload: hopPayload,
 		}
 	}
 
@@ -79,15 +90,279 @@ func BenchmarkProcessPacket(b *testing.B) {
 		b.StopTimer()
 		router := path[0]
 		router.log.Stop()
-		path[0] = &Router{
-			nodeID:   router.nodeID,
-			nodeAddr: router.nodeAddr,
-			onionKey: router.onionKey,
-			log:      NewMemoryReplayLog(),
+		router.log = NewMemoryReplayLog()
+		router.log.Start()
+		b.StartTimer()
+	}
+
+	p = pkt
+}
+
+func BenchmarkPacketEncode(b *testing.B) {
+	_, _, _, sphinxPacket, err := newTestRoute(1)
+	if err != nil {
+		b.Fatalf("unable to create test route: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := sphinxPacket.Encode(ioutil.Discard); err != nil {
+			b.Fatalf("unable to encode packet: %v", err)
 		}
-		path[0].log.Start()
+	}
+}
+
+// benchHopCounts are the route lengths the per-hop benchmarks are run with.
+var benchHopCounts = []int{1, 10, testLegacyRouteNumHops}
+
+func BenchmarkProcessOnionPacket(b *testing.B) {
+	for _, numHops := range benchHopCounts {
+		numHops := numHops
+		b.Run(fmt.Sprintf("hops=%d", numHops), func(b *testing.B) {
+			benchmarkProcessOnionPacket(b, numHops)
+		})
+	}
+}
+
+func benchmarkProcessOnionPacket(b *testing.B, numHops int) {
+	path, _, _, sphinxPacket, err := newTestRoute(numHops)
+	if err != nil {
+		b.Fatalf("unable to create test route: %v", err)
+	}
+
+	// As every packet is logged, a fresh replay log is swapped in for each
+	// iteration, such that the packet isn't rejected as a replay.
+	router := path[0]
+	router.log.Start()
+
+	var pkt *ProcessedPacket
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pkt, err = router.ProcessOnionPacket(sphinxPacket, nil, uint32(i))
+		if err != nil {
+			b.Fatalf("unable to process packet %d: %v", i, err)
+		}
+
+		b.StopTimer()
+		router.log.Stop()
+		router.log = NewMemoryReplayLog()
+		router.log.Start()
 		b.StartTimer()
 	}
 
+	router.log.Stop()
 	p = pkt
 }
+
+func BenchmarkNewOnionPacket(b *testing.B) {
+	for _, numHops := range benchHopCounts {
+		numHops := numHops
+		b.Run(fmt.Sprintf("hops=%d", numHops), func(b *testing.B) {
+			benchmarkNewOnionPacket(b, numHops)
+		})
+	}
+}
+
+func benchmarkNewOnionPacket(b *testing.B, numHops int) {
+	_, route, _, _, err := newTestRoute(numHops)
+	if err != nil {
+		b.Fatalf("unable to create test route: %v", err)
+	}
+
+	d, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{'A'}, 32))
+
+	var sphinxPacket *OnionPacket
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		sphinxPacket, err = NewOnionPacket(route, d, nil)
+		if err != nil {
+			b.Fatalf("unable to create packet: %v", err)
+		}
+	}
+
+	s = sphinxPacket
+}
+
+// BenchmarkNewOnionPacketTLV benchmarks constructing a packet through a route
+// of testLegacyRouteNumHops hops carrying TLV payloads, which are layered onto
+// the routing info following their var-int length.
+func BenchmarkNewOnionPacketTLV(b *testing.B) {
+	_, route, _, _, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		b.Fatalf("unable to create test route: %v", err)
+	}
+	for i := 0; i < testLegacyRouteNumHops; i++ {
+		route[i].HopPayload, err = NewHopPayload(
+			nil, bytes.Repeat([]byte{byte(i)}, 20),
+		)
+		if err != nil {
+			b.Fatalf("unable to create hop payload: %v", err)
+		}
+	}
+
+	d, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{'A'}, 32))
+
+	var sphinxPacket *OnionPacket
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		sphinxPacket, err = NewOnionPacket(route, d, nil)
+		if err != nil {
+			b.Fatalf("unable to create packet: %v", err)
+		}
+	}
+
+	s = sphinxPacket
+}
+
+// BenchmarkWriteOnionPacket benchmarks constructing a packet through a route
+// of testLegacyRouteNumHops hops, and writing it out right away, which is
+// done without materializing an OnionPacket.
+func BenchmarkWriteOnionPacket(b *testing.B) {
+	_, route, _, _, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		b.Fatalf("unable to create test route: %v", err)
+	}
+
+	payloads := make([]HopPayload, testLegacyRouteNumHops)
+	for i := range payloads {
+		payloads[i] = route[i].HopPayload
+	}
+
+	d, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{'A'}, 32))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := WriteOnionPacket(
+			ioutil.Discard, route.NodeKeys(), d, payloads, nil,
+		)
+		if err != nil {
+			b.Fatalf("unable to write packet: %v", err)
+		}
+	}
+}
+
+// BenchmarkCipherStream compares encrypting a routing info sized buffer by
+// XOR'ing it with an allocated stream, against XOR'ing the stream into it in
+// place.
+func BenchmarkCipherStream(b *testing.B) {
+	var key [keyLen]byte
+	buf := make([]byte, 2*routingInfoSize)
+
+	b.Run("generate", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			streamBytes := generateCipherStream(key, uint(len(buf)))
+			xor(buf, buf, streamBytes)
+		}
+	})
+
+	b.Run("in-place", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			xorCipherStream(buf, buf, key)
+		}
+	})
+}
+
+func BenchmarkEncodeDecode(b *testing.B) {
+	for _, numHops := range benchHopCounts {
+		numHops := numHops
+		b.Run(fmt.Sprintf("hops=%d", numHops), func(b *testing.B) {
+			benchmarkEncodeDecode(b, numHops)
+		})
+	}
+}
+
+func benchmarkEncodeDecode(b *testing.B, numHops int) {
+	_, _, _, sphinxPacket, err := newTestRoute(numHops)
+	if err != nil {
+		b.Fatalf("unable to create test route: %v", err)
+	}
+
+	var (
+		buf     bytes.Buffer
+		decoded OnionPacket
+	)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := sphinxPacket.Encode(&buf); err != nil {
+			b.Fatalf("unable to encode packet: %v", err)
+		}
+		if err := decoded.Decode(&buf); err != nil {
+			b.Fatalf("unable to decode packet: %v", err)
+		}
+	}
+
+	s = &decoded
+}
+
+// BenchmarkReplayLogPut compares the throughput of adding prefixes to a
+// BoltReplayLog directly, with that of a BufferedReplayLog on top of it.
+func BenchmarkReplayLogPut(b *testing.B) {
+	logs := []struct {
+		name string
+		wrap func(*BoltReplayLog) ReplayLog
+	}{
+		{
+			name: "bolt",
+			wrap: func(rl *BoltReplayLog) ReplayLog {
+				return rl
+			},
+		},
+		{
+			name: "buffered",
+			wrap: func(rl *BoltReplayLog) ReplayLog {
+				return NewBufferedReplayLog(
+					rl, 1000, 100*time.Millisecond,
+				)
+			},
+		},
+	}
+
+	for _, test := range logs {
+		test := test
+		b.Run(test.name, func(b *testing.B) {
+			tempDir, err := ioutil.TempDir("", "sphinxreplaylog")
+			if err != nil {
+				b.Fatalf("unable to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			rl := test.wrap(
+				NewBoltReplayLog(filepath.Join(tempDir, "replay.db")),
+			)
+			if err := rl.Start(); err != nil {
+				b.Fatalf("unable to start replay log: %v", err)
+			}
+			defer rl.Stop()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			var hashPrefix HashPrefix
+			for i := 0; i < b.N; i++ {
+				binary.BigEndian.PutUint64(hashPrefix[:], uint64(i))
+				if err := rl.Put(&hashPrefix, 1); err != nil {
+					b.Fatalf("unable to put entry: %v", err)
+				}
+			}
+		})
+	}
+}
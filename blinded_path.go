@@ -0,0 +1,434 @@
+package sphinx
+
+import (
+	"crypto/elliptic"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/btcsuite/btcd/btcec"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// MaxBlindedPathHops is the maximum number of hops that can be encoded within
+// a serialized BlindedPath, as the number of hops is written as a single byte.
+const MaxBlindedPathHops = math.MaxUint8
+
+// BlindedPath represents a route which hides the real identities of all but
+// the first node from the sender. The creator of the path (usually the
+// recipient) hands it out to a payer, who can then route towards the
+// introduction point and use the blinded node IDs beyond it. The packet is
+// built as a single onion, through the payer's own hops to the introduction
+// point followed by the blinded hops, so the two legs need no splicing. For a
+// second leg pre-built by the recipient instead, see NewPartialOnion.
+type BlindedPath struct {
+	// IntroductionPoint is the real, unblinded, public key of the first
+	// node in the path.
+	IntroductionPoint *btcec.PublicKey
+
+	// BlindingPoint is the ephemeral public key E_0 which the
+	// introduction point uses to derive its shared secret, and by
+	// extension the ephemeral keys of all subsequent hops.
+	BlindingPoint *btcec.PublicKey
+
+	// BlindedHops houses the blinded node ID and encrypted recipient data
+	// of each hop in the path, in order.
+	BlindedHops []*BlindedHop
+}
+
+// BlindedHop is a single hop within a BlindedPath.
+type BlindedHop struct {
+	// BlindedNodePub is the blinded node ID of this hop, computed as
+	// B_i = HMAC256("blinded_node_id", ss_i) * N_i.
+	BlindedNodePub *btcec.PublicKey
+
+	// CipherText is the recipient data destined for this hop, encrypted
+	// with ChaCha20-Poly1305 under the rho key derived from ss_i.
+	CipherText []byte
+}
+
+// NewBlindedPath creates a new blinded path through the passed route, with
+// the i-th payload encrypted such that only the i-th node is able to decrypt
+// it. The ephemeral keys used to blind each hop are derived from the session
+// key, with the blinding factor chained across hops as:
+//
+//	E_0 = e_0 * G
+//	ss_i = SHA256(e_i * N_i)
+//	e_{i+1} = SHA256(E_i || ss_i) * e_i
+//
+// Which is the same construction used for the ephemeral keys of an onion
+// packet.
+func NewBlindedPath(route []*btcec.PublicKey, sessionKey *btcec.PrivateKey,
+	payloads [][]byte) (*BlindedPath, error) {
+
+	switch {
+	case len(route) == 0:
+		return nil, fmt.Errorf("route of length zero passed in")
+
+	case len(route) > MaxBlindedPathHops:
+		return nil, fmt.Errorf("route of %d hops exceeds maximum of %d",
+			len(route), MaxBlindedPathHops)
+
+	case len(payloads) != len(route):
+		return nil, fmt.Errorf("route of %d hops has %d payloads",
+			len(route), len(payloads))
+	}
+
+	sharedSecrets := generateSharedSecrets(route, sessionKey)
+	defer func() {
+		for i := range sharedSecrets {
+			zero(sharedSecrets[i][:])
+		}
+	}()
+
+	blindedHops := make([]*BlindedHop, len(route))
+	for i, nodePub := range route {
+		blindedNodePub := blindNodeID(
+			sessionKey.Curve, nodePub, &sharedSecrets[i],
+		)
+
+		cipherText, err := encryptBlindedHopData(
+			defaultKeyTags.Rho, &sharedSecrets[i], payloads[i],
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		blindedHops[i] = &BlindedHop{
+			BlindedNodePub: blindedNodePub,
+			CipherText:     cipherText,
+		}
+	}
+
+	return &BlindedPath{
+		IntroductionPoint: route[0],
+		BlindingPoint:     sessionKey.PubKey(),
+		BlindedHops:       blindedHops,
+	}, nil
+}
+
+// NewBlindedOnionPacket creates a new onion packet routing through the passed
+// hops, chosen by the sender, towards the introduction point of the blinded
+// path, after which it continues through the blinded hops of the path, with
+// the i-th of blindedPayloads delivered to the i-th blinded hop. As the sender
+// doesn't know the real node IDs beyond the introduction point, the layers of
+// the blinded hops, including the introduction point itself, are encrypted to
+// their blinded node IDs, which each of them processes using the blinding
+// point handed to it through the WithBlindingPoint option.
+//
+// NOTE: The introduction point learns the blinding point of the path from the
+// previous hop, so it's up to the caller to include BlindingPoint within the
+// payload of the last of the passed hops, or hand it directly to the
+// introduction point if no hops are passed. Likewise, the CipherText of each
+// blinded hop should be included within its payload.
+func NewBlindedOnionPacket(hops []OnionHop, blindedPath *BlindedPath,
+	blindedPayloads []HopPayload, sessionKey *btcec.PrivateKey,
+	assocData []byte, opts ...OnionPacketOption) (*OnionPacket, error) {
+
+	paymentPath, err := blindedPaymentPath(
+		hops, blindedPath, blindedPayloads,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewOnionPacket(paymentPath, sessionKey, assocData, opts...)
+}
+
+// blindedPaymentPath assembles the payment path of an onion packet from the
+// hops leading to the introduction point of a blinded path, followed by the
+// blinded node IDs of the path.
+func blindedPaymentPath(hops []OnionHop, blindedPath *BlindedPath,
+	blindedPayloads []HopPayload) (*PaymentPath, error) {
+
+	switch {
+	case blindedPath == nil || len(blindedPath.BlindedHops) == 0:
+		return nil, fmt.Errorf("blinded path of length zero passed in")
+
+	case len(blindedPayloads) != len(blindedPath.BlindedHops):
+		return nil, fmt.Errorf("blinded path of %d hops has %d "+
+			"payloads", len(blindedPath.BlindedHops),
+			len(blindedPayloads))
+
+	case len(hops)+len(blindedPath.BlindedHops) > NumMaxHops:
+		return nil, fmt.Errorf("route of %d hops exceeds maximum of %d",
+			len(hops)+len(blindedPath.BlindedHops), NumMaxHops)
+	}
+
+	var paymentPath PaymentPath
+	for i, hop := range hops {
+		if hop.IsEmpty() {
+			return nil, fmt.Errorf("hop %d lacks a node key", i)
+		}
+		paymentPath[i] = hop
+	}
+	for i, hop := range blindedPath.BlindedHops {
+		if hop.BlindedNodePub == nil {
+			return nil, fmt.Errorf("blinded hop %d lacks a node "+
+				"key", i)
+		}
+		paymentPath[len(hops)+i] = OnionHop{
+			NodePub:    *hop.BlindedNodePub,
+			HopPayload: blindedPayloads[i],
+		}
+	}
+
+	return &paymentPath, nil
+}
+
+// Encode serializes the blinded path into the passed io.Writer. The encoding
+// is the introduction point, the blinding point and the number of hops,
+// followed by the blinded node ID and length prefixed cipher text of each hop.
+func (b *BlindedPath) Encode(w io.Writer) error {
+	if len(b.BlindedHops) > MaxBlindedPathHops {
+		return fmt.Errorf("blinded path of %d hops exceeds maximum "+
+			"of %d", len(b.BlindedHops), MaxBlindedPathHops)
+	}
+
+	if _, err := w.Write(b.IntroductionPoint.SerializeCompressed()); err != nil {
+		return err
+	}
+	if _, err := w.Write(b.BlindingPoint.SerializeCompressed()); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{uint8(len(b.BlindedHops))}); err != nil {
+		return err
+	}
+
+	var scratch [2]byte
+	for _, hop := range b.BlindedHops {
+		if len(hop.CipherText) > math.MaxUint16 {
+			return fmt.Errorf("blinded hop cipher text of %d bytes "+
+				"exceeds maximum of %d", len(hop.CipherText),
+				math.MaxUint16)
+		}
+
+		_, err := w.Write(hop.BlindedNodePub.SerializeCompressed())
+		if err != nil {
+			return err
+		}
+
+		binary.BigEndian.PutUint16(scratch[:], uint16(len(hop.CipherText)))
+		if _, err := w.Write(scratch[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(hop.CipherText); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Decode fully populates the target BlindedPath from the raw bytes encoded
+// within the io.Reader.
+func (b *BlindedPath) Decode(r io.Reader) error {
+	var err error
+	if b.IntroductionPoint, err = readPubKey(r); err != nil {
+		return err
+	}
+	if b.BlindingPoint, err = readPubKey(r); err != nil {
+		return err
+	}
+
+	var numHops [1]byte
+	if _, err := io.ReadFull(r, numHops[:]); err != nil {
+		return err
+	}
+	if numHops[0] == 0 {
+		return fmt.Errorf("%w: no hops", ErrInvalidBlindedPath)
+	}
+
+	var scratch [2]byte
+	b.BlindedHops = make([]*BlindedHop, numHops[0])
+	for i := range b.BlindedHops {
+		var hop BlindedHop
+		if hop.BlindedNodePub, err = readPubKey(r); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(r, scratch[:]); err != nil {
+			return err
+		}
+		hop.CipherText = make([]byte, binary.BigEndian.Uint16(scratch[:]))
+		if _, err := io.ReadFull(r, hop.CipherText); err != nil {
+			return err
+		}
+
+		b.BlindedHops[i] = &hop
+	}
+
+	return nil
+}
+
+// readPubKey reads a compressed public key from the passed io.Reader,
+// ensuring that it lies on the secp256k1 curve.
+func readPubKey(r io.Reader) (*btcec.PublicKey, error) {
+	var b [btcec.PubKeyBytesLenCompressed]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+
+	return btcec.ParsePubKey(b[:], btcec.S256())
+}
+
+// blindNodeID blinds the node ID of a hop using the shared secret for that
+// hop: B_i = HMAC256("blinded_node_id", ss_i) * N_i.
+func blindNodeID(curve elliptic.Curve, nodePub *btcec.PublicKey,
+	sharedSecret *Hash256) *btcec.PublicKey {
+
+	blindingFactor := generateKey("blinded_node_id", sharedSecret)
+	defer zero(blindingFactor[:])
+
+	return blindGroupElement(curve, nodePub, blindingFactor[:])
+}
+
+// blindingSecret derives the shared secret ss_i between the passed onion key
+// of the router and the blinding point E_i of a blinded path.
+func (r *Router) blindingSecret(onionKey ECDHer,
+	blindingPoint *btcec.PublicKey) (Hash256, error) {
+
+	if !r.curve.IsOnCurve(blindingPoint.X, blindingPoint.Y) {
+		return Hash256{}, ErrInvalidBlindingPoint
+	}
+
+	return onionKey.ECDH(blindingPoint)
+}
+
+// generateBlindedSharedSecret generates the shared secret for an onion packet
+// sent to the router through a blinded path, using the passed onion key. As
+// the sender only knows our blinded node ID, the ECDH is performed using the
+// onion key tweaked by the same factor used to blind it:
+// HMAC256("blinded_node_id", ss_i) * k. As the router may not have access to
+// the private key itself, the tweak is applied to the ephemeral key of the
+// packet instead, which yields the same point. The blinding point to hand to
+// the next hop, E_{i+1} = SHA256(E_i || ss_i) * E_i, is returned along with
+// the shared secret.
+func (r *Router) generateBlindedSharedSecret(onionKey ECDHer, dhKey,
+	blindingPoint *btcec.PublicKey) (Hash256, *btcec.PublicKey, error) {
+
+	var sharedSecret Hash256
+	if err := validateEphemeralKey(r.curve, dhKey); err != nil {
+		return sharedSecret, nil, err
+	}
+
+	blindingSecret, err := r.blindingSecret(onionKey, blindingPoint)
+	if err != nil {
+		return sharedSecret, nil, err
+	}
+	defer zero(blindingSecret[:])
+
+	blindingFactor := generateKey("blinded_node_id", &blindingSecret)
+	defer zero(blindingFactor[:])
+
+	sharedSecret, err = onionKey.ECDH(
+		blindGroupElement(r.curve, dhKey, blindingFactor[:]),
+	)
+	if err != nil {
+		return sharedSecret, nil, err
+	}
+
+	nextBlindingFactor := computeBlindingFactor(
+		blindingPoint, blindingSecret[:],
+	)
+	nextBlindingPoint := blindGroupElement(
+		r.curve, blindingPoint, nextBlindingFactor[:],
+	)
+
+	return sharedSecret, nextBlindingPoint, nil
+}
+
+// DecryptBlindedHopData decrypts the recipient data that the creator of a
+// blinded path encrypted for this router, given the blinding point it was
+// handed for the path.
+func (r *Router) DecryptBlindedHopData(blindingPoint *btcec.PublicKey,
+	cipherText []byte) ([]byte, error) {
+
+	blindingSecret, err := r.blindingSecret(r.onionKey, blindingPoint)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(blindingSecret[:])
+
+	return decryptBlindedHopData(
+		r.keyTags.Rho, &blindingSecret, cipherText,
+	)
+}
+
+// EncryptBlindedData encrypts the recipient data of a hop within a blinded
+// path using ChaCha20-Poly1305, keyed by the rho key derived from the shared
+// secret between the creator of the path and the hop. This is the encryption
+// NewBlindedPath applies to the payload of each hop, exposed for callers that
+// assemble blinded paths themselves.
+func EncryptBlindedData(sharedSecret [32]byte, plaintext []byte) []byte {
+	ss := Hash256(sharedSecret)
+	defer zero(ss[:])
+
+	cipherText, err := encryptBlindedHopData(
+		defaultKeyTags.Rho, &ss, plaintext,
+	)
+	if err != nil {
+		// The rho key is always of the size ChaCha20-Poly1305
+		// expects, so this can't happen.
+		panic(err)
+	}
+
+	return cipherText
+}
+
+// DecryptBlindedData decrypts and authenticates recipient data encrypted with
+// EncryptBlindedData under the same shared secret. Data that was tampered
+// with, or encrypted for another hop, is rejected with an error wrapping
+// ErrInvalidBlindedData. Routers processing packets of a blinded path can use
+// DecryptBlindedHopData instead, which derives the shared secret from the
+// blinding point.
+func DecryptBlindedData(sharedSecret [32]byte, ciphertext []byte) ([]byte,
+	error) {
+
+	ss := Hash256(sharedSecret)
+	defer zero(ss[:])
+
+	return decryptBlindedHopData(defaultKeyTags.Rho, &ss, ciphertext)
+}
+
+// encryptBlindedHopData encrypts the recipient data of a blinded hop using
+// ChaCha20-Poly1305 keyed by the rho key derived from the hop's shared secret
+// using the passed tag. As a key is only ever used for a single message, a
+// zero nonce is used.
+func encryptBlindedHopData(rhoTag string, sharedSecret *Hash256,
+	plainText []byte) ([]byte, error) {
+
+	rhoKey := generateKey(rhoTag, sharedSecret)
+	defer zero(rhoKey[:])
+
+	aead, err := chacha20poly1305.New(rhoKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Seal(nil, nonce[:], plainText, nil), nil
+}
+
+// decryptBlindedHopData decrypts and authenticates the recipient data of a
+// blinded hop which was previously encrypted with encryptBlindedHopData.
+func decryptBlindedHopData(rhoTag string, sharedSecret *Hash256,
+	cipherText []byte) ([]byte, error) {
+
+	rhoKey := generateKey(rhoTag, sharedSecret)
+	defer zero(rhoKey[:])
+
+	aead, err := chacha20poly1305.New(rhoKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	plainText, err := aead.Open(nil, nonce[:], cipherText, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBlindedData, err)
+	}
+
+	return plainText, nil
+}
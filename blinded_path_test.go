@@ -0,0 +1,630 @@
+package sphinx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// TestBlindedPath asserts that every hop in a blinded path is able to derive
+// its blinded node ID and decrypt its recipient data, using only its own
+// private key and the ephemeral key handed to it by the previous hop.
+func TestBlindedPath(t *testing.T) {
+	const numHops = 4
+
+	var (
+		nodeKeys = make([]*btcec.PrivateKey, numHops)
+		route    = make([]*btcec.PublicKey, numHops)
+		payloads = make([][]byte, numHops)
+	)
+	for i := 0; i < numHops; i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+
+		nodeKeys[i] = privKey
+		route[i] = privKey.PubKey()
+		payloads[i] = []byte(fmt.Sprintf("recipient data for hop %d", i))
+	}
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+
+	path, err := NewBlindedPath(route, sessionKey, payloads)
+	if err != nil {
+		t.Fatalf("unable to create blinded path: %v", err)
+	}
+
+	if !path.IntroductionPoint.IsEqual(route[0]) {
+		t.Fatalf("introduction point doesn't match first hop")
+	}
+	if len(path.BlindedHops) != numHops {
+		t.Fatalf("expected %d blinded hops, got %d", numHops,
+			len(path.BlindedHops))
+	}
+
+	ephemeralKey := path.BlindingPoint
+	for i, hop := range path.BlindedHops {
+		sharedSecret := generateSharedSecret(ephemeralKey, nodeKeys[i])
+
+		if hop.BlindedNodePub.IsEqual(route[i]) {
+			t.Fatalf("hop %d node ID wasn't blinded", i)
+		}
+		blindedNodePub := blindNodeID(
+			btcec.S256(), route[i], &sharedSecret,
+		)
+		if !hop.BlindedNodePub.IsEqual(blindedNodePub) {
+			t.Fatalf("hop %d blinded node ID mismatch", i)
+		}
+
+		plainText, err := decryptBlindedHopData(
+			defaultKeyTags.Rho, &sharedSecret, hop.CipherText,
+		)
+		if err != nil {
+			t.Fatalf("hop %d unable to decrypt data: %v", i, err)
+		}
+		if !bytes.Equal(plainText, payloads[i]) {
+			t.Fatalf("hop %d payload mismatch: expected %q, got %q",
+				i, payloads[i], plainText)
+		}
+
+		// The data of any other hop must not be decryptable using
+		// this hop's shared secret.
+		if i > 0 {
+			_, err := decryptBlindedHopData(
+				defaultKeyTags.Rho, &sharedSecret,
+				path.BlindedHops[i-1].CipherText,
+			)
+			if err == nil {
+				t.Fatalf("hop %d decrypted data of hop %d", i, i-1)
+			}
+		}
+
+		blindingFactor := computeBlindingFactor(
+			ephemeralKey, sharedSecret[:],
+		)
+		ephemeralKey = blindGroupElement(
+			btcec.S256(), ephemeralKey, blindingFactor[:],
+		)
+	}
+}
+
+// TestBlindedData tests that recipient data encrypted for a blinded hop
+// decrypts back to the original plaintext under the same shared secret, and
+// that tampering or decrypting under another secret is detected.
+func TestBlindedData(t *testing.T) {
+	var sharedSecret, otherSecret [32]byte
+	for i := range sharedSecret {
+		sharedSecret[i] = byte(i)
+		otherSecret[i] = byte(i + 1)
+	}
+
+	plaintexts := [][]byte{{}, []byte("next hop: 700000x1234x1")}
+	for _, plaintext := range plaintexts {
+		ciphertext := EncryptBlindedData(sharedSecret, plaintext)
+
+		decrypted, err := DecryptBlindedData(sharedSecret, ciphertext)
+		if err != nil {
+			t.Fatalf("unable to decrypt data: %v", err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("expected plaintext %q, got %q", plaintext,
+				decrypted)
+		}
+
+		// The data must match what NewBlindedPath encrypts for a hop
+		// with the same shared secret.
+		ss := Hash256(sharedSecret)
+		expected, err := encryptBlindedHopData(
+			defaultKeyTags.Rho, &ss, plaintext,
+		)
+		if err != nil {
+			t.Fatalf("unable to encrypt data: %v", err)
+		}
+		if !bytes.Equal(ciphertext, expected) {
+			t.Fatalf("ciphertext doesn't match that of blinded " +
+				"paths")
+		}
+
+		_, err = DecryptBlindedData(otherSecret, ciphertext)
+		if !errors.Is(err, ErrInvalidBlindedData) {
+			t.Fatalf("expected invalid blinded data for other "+
+				"secret, got %v", err)
+		}
+
+		// Flipping any single bit, including in the tag, must be
+		// detected.
+		for i := range ciphertext {
+			tampered := append([]byte(nil), ciphertext...)
+			tampered[i] ^= 0x01
+
+			_, err := DecryptBlindedData(sharedSecret, tampered)
+			if !errors.Is(err, ErrInvalidBlindedData) {
+				t.Fatalf("expected tampering with byte %d to "+
+					"be detected, got %v", i, err)
+			}
+		}
+
+		_, err = DecryptBlindedData(sharedSecret, ciphertext[1:])
+		if !errors.Is(err, ErrInvalidBlindedData) {
+			t.Fatalf("expected truncation to be detected, got %v",
+				err)
+		}
+	}
+}
+
+// TestBlindedPathEncodeDecode tests that a blinded path survives a
+// serialization round trip.
+func TestBlindedPathEncodeDecode(t *testing.T) {
+	nodes, _, _, _, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	route := make([]*btcec.PublicKey, len(nodes))
+	payloads := make([][]byte, len(nodes))
+	for i, node := range nodes {
+		route[i] = node.onionPub
+		payloads[i] = bytes.Repeat([]byte{byte(i)}, i*10)
+	}
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+
+	path, err := NewBlindedPath(route, sessionKey, payloads)
+	if err != nil {
+		t.Fatalf("unable to create blinded path: %v", err)
+	}
+
+	var b bytes.Buffer
+	if err := path.Encode(&b); err != nil {
+		t.Fatalf("unable to encode blinded path: %v", err)
+	}
+
+	var decoded BlindedPath
+	if err := decoded.Decode(bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatalf("unable to decode blinded path: %v", err)
+	}
+
+	if !reflect.DeepEqual(path, &decoded) {
+		t.Fatalf("decoded blinded path doesn't match original: "+
+			"expected %v, got %v", path, &decoded)
+	}
+
+	// A path without any hops is rejected. The hop count directly follows
+	// the introduction and blinding points.
+	noHops := b.Bytes()[:2*btcec.PubKeyBytesLenCompressed+1]
+	noHops[len(noHops)-1] = 0
+	err = decoded.Decode(bytes.NewReader(noHops))
+	if !errors.Is(err, ErrInvalidBlindedPath) {
+		t.Fatalf("expected invalid blinded path, got: %v", err)
+	}
+}
+
+// TestBlindedPathInvalidParams tests that blinded paths aren't created from
+// empty routes, or routes without a payload for each hop.
+func TestBlindedPathInvalidParams(t *testing.T) {
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+
+	if _, err := NewBlindedPath(nil, sessionKey, nil); err == nil {
+		t.Fatalf("expected failure for empty route")
+	}
+
+	route := []*btcec.PublicKey{sessionKey.PubKey()}
+	if _, err := NewBlindedPath(route, sessionKey, nil); err == nil {
+		t.Fatalf("expected failure for missing payloads")
+	}
+}
+
+// TestSphinxBlindedPathForwarding tests that an onion packet sent through a
+// blinded path can be processed by each of the blinded hops, given the
+// blinding point handed to them by the previous hop.
+func TestSphinxBlindedPathForwarding(t *testing.T) {
+	const numHops = 3
+
+	nodes, _, _, _, err := newTestRoute(numHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	route := make([]*btcec.PublicKey, numHops)
+	payloads := make([][]byte, numHops)
+	for i, node := range nodes {
+		route[i] = node.onionPub
+		payloads[i] = []byte(fmt.Sprintf("next hop for hop %d", i))
+	}
+
+	blindingKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate blinding key: %v", err)
+	}
+	blindedPath, err := NewBlindedPath(route, blindingKey, payloads)
+	if err != nil {
+		t.Fatalf("unable to create blinded path: %v", err)
+	}
+
+	// The sender only knows the blinded node IDs of each hop, so they're
+	// used in place of the real node IDs to construct the onion.
+	var paymentPath PaymentPath
+	for i, hop := range blindedPath.BlindedHops {
+		hopPayload, err := NewHopPayload(nil, []byte{byte(i + 1)})
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+
+		paymentPath[i] = OnionHop{
+			NodePub:    *hop.BlindedNodePub,
+			HopPayload: hopPayload,
+		}
+	}
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+	fwdMsg, err := NewOnionPacket(&paymentPath, sessionKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	// Without the blinding point, the introduction point isn't able to
+	// derive the correct shared secret.
+	_, err = nodes[0].ReconstructOnionPacket(fwdMsg, nil)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected ErrInvalidOnionHMAC, got: %v", err)
+	}
+
+	blindingPoint := blindedPath.BlindingPoint
+	for i, node := range nodes {
+		node.log.Start()
+		defer node.log.Stop()
+
+		pkt, err := node.ProcessOnionPacket(
+			fwdMsg, nil, uint32(i), WithBlindingPoint(blindingPoint),
+		)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		if !bytes.Equal(pkt.Payload.Payload, []byte{byte(i + 1)}) {
+			t.Fatalf("node %d received wrong payload: %x", i,
+				pkt.Payload.Payload)
+		}
+
+		hopData, err := node.DecryptBlindedHopData(
+			blindingPoint, blindedPath.BlindedHops[i].CipherText,
+		)
+		if err != nil {
+			t.Fatalf("node %d unable to decrypt hop data: %v", i, err)
+		}
+		if !bytes.Equal(hopData, payloads[i]) {
+			t.Fatalf("node %d decrypted wrong hop data: %q", i,
+				hopData)
+		}
+
+		expectedAction := ProcessCode(MoreHops)
+		if i == numHops-1 {
+			expectedAction = ExitNode
+		}
+		if pkt.Action != expectedAction {
+			t.Fatalf("node %d expected action %v, got %v", i,
+				expectedAction, pkt.Action)
+		}
+
+		if pkt.NextBlindingPoint == nil {
+			t.Fatalf("node %d didn't return next blinding point", i)
+		}
+
+		blindingPoint = pkt.NextBlindingPoint
+		fwdMsg = pkt.NextPacket
+	}
+}
+
+// TestSphinxBlindedPathTwoLegs tests that a sender can route an onion packet
+// through hops of its own choosing to the introduction point of a blinded
+// path, after which it continues through the blinded hops chosen by the
+// recipient, all within a single onion packet.
+func TestSphinxBlindedPathTwoLegs(t *testing.T) {
+	const (
+		numSenderHops  = 2
+		numBlindedHops = 3
+	)
+
+	nodes, _, _, _, err := newTestRoute(numSenderHops + numBlindedHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	senderNodes := nodes[:numSenderHops]
+	blindedNodes := nodes[numSenderHops:]
+
+	// The recipient creates a blinded path through the second leg of the
+	// route, and hands it out to the sender.
+	route := make([]*btcec.PublicKey, numBlindedHops)
+	payloads := make([][]byte, numBlindedHops)
+	for i, node := range blindedNodes {
+		route[i] = node.onionPub
+		payloads[i] = []byte{byte(i)}
+	}
+	blindingKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate blinding key: %v", err)
+	}
+	blindedPath, err := NewBlindedPath(route, blindingKey, payloads)
+	if err != nil {
+		t.Fatalf("unable to create blinded path: %v", err)
+	}
+
+	// The sender prepends its own leg towards the introduction point to
+	// the blinded hops.
+	var paymentPath PaymentPath
+	for i, node := range senderNodes {
+		paymentPath[i].NodePub = *node.onionPub
+	}
+	for i, hop := range blindedPath.BlindedHops {
+		paymentPath[numSenderHops+i].NodePub = *hop.BlindedNodePub
+	}
+	for i := range nodes {
+		hopPayload, err := NewHopPayload(nil, []byte{byte(i + 1)})
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+		paymentPath[i].HopPayload = hopPayload
+	}
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+	fwdMsg, err := NewOnionPacket(&paymentPath, sessionKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	// The hops of the sender's leg process the packet as usual. The last
+	// of them hands the blinding point of the path, which the sender would
+	// include in its payload, to the introduction point.
+	var blindingPoint *btcec.PublicKey
+	for i, node := range nodes {
+		var opts []ProcessOnionOpt
+		if i == numSenderHops {
+			blindingPoint = blindedPath.BlindingPoint
+		}
+		if blindingPoint != nil {
+			opts = append(opts, WithBlindingPoint(blindingPoint))
+		}
+
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, nil, opts...)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+		if !bytes.Equal(pkt.Payload.Payload, []byte{byte(i + 1)}) {
+			t.Fatalf("node %d received wrong payload: %x", i,
+				pkt.Payload.Payload)
+		}
+
+		expectedAction := ProcessCode(MoreHops)
+		if i == len(nodes)-1 {
+			expectedAction = ExitNode
+		}
+		if pkt.Action != expectedAction {
+			t.Fatalf("node %d expected action %v, got %v", i,
+				expectedAction, pkt.Action)
+		}
+
+		blindingPoint = pkt.NextBlindingPoint
+		fwdMsg = pkt.NextPacket
+	}
+}
+
+// TestSphinxBlindedOnionPacket tests that a packet constructed from the
+// sender's hops towards the introduction point and a blinded tail is
+// processable end to end, with the blinding point delivered to the
+// introduction point by the last of the sender's hops, and the recipient data
+// of each blinded hop carried within its payload.
+func TestSphinxBlindedOnionPacket(t *testing.T) {
+	for _, numSenderHops := range []int{0, 1, 2} {
+		numSenderHops := numSenderHops
+		name := fmt.Sprintf("%d sender hops", numSenderHops)
+		t.Run(name, func(t *testing.T) {
+			testSphinxBlindedOnionPacket(t, numSenderHops)
+		})
+	}
+}
+
+func testSphinxBlindedOnionPacket(t *testing.T, numSenderHops int) {
+	const numBlindedHops = 3
+
+	nodes, _, _, _, err := newTestRoute(numSenderHops + numBlindedHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	route := make([]*btcec.PublicKey, numBlindedHops)
+	recipientData := make([][]byte, numBlindedHops)
+	for i, node := range nodes[numSenderHops:] {
+		route[i] = node.onionPub
+		recipientData[i] = []byte(fmt.Sprintf("blinded hop %d", i))
+	}
+	blindingKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate blinding key: %v", err)
+	}
+	blindedPath, err := NewBlindedPath(route, blindingKey, recipientData)
+	if err != nil {
+		t.Fatalf("unable to create blinded path: %v", err)
+	}
+
+	// The last of the sender's hops carries the blinding point of the
+	// path, while each blinded hop carries its recipient data.
+	hops := make([]OnionHop, numSenderHops)
+	for i, node := range nodes[:numSenderHops] {
+		payload := []byte{byte(i + 1)}
+		if i == numSenderHops-1 {
+			payload = blindedPath.BlindingPoint.SerializeCompressed()
+		}
+		hopPayload, err := NewHopPayload(nil, payload)
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+		hops[i] = OnionHop{
+			NodePub:    *node.onionPub,
+			HopPayload: hopPayload,
+		}
+	}
+	blindedPayloads := make([]HopPayload, numBlindedHops)
+	for i, hop := range blindedPath.BlindedHops {
+		blindedPayloads[i], err = NewHopPayload(nil, hop.CipherText)
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+	}
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+	fwdMsg, err := NewBlindedOnionPacket(
+		hops, blindedPath, blindedPayloads, sessionKey, nil,
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	var blindingPoint *btcec.PublicKey
+	if numSenderHops == 0 {
+		blindingPoint = blindedPath.BlindingPoint
+	}
+	for i, node := range nodes {
+		var opts []ProcessOnionOpt
+		if blindingPoint != nil {
+			opts = append(opts, WithBlindingPoint(blindingPoint))
+		}
+
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, nil, opts...)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		expectedAction := ProcessCode(MoreHops)
+		if i == len(nodes)-1 {
+			expectedAction = ExitNode
+		}
+		if pkt.Action != expectedAction {
+			t.Fatalf("node %d expected action %v, got %v", i,
+				expectedAction, pkt.Action)
+		}
+
+		switch {
+		// The last of the sender's hops hands the blinding point it
+		// received to the introduction point.
+		case i == numSenderHops-1:
+			blindingPoint, err = btcec.ParsePubKey(
+				pkt.Payload.Payload, btcec.S256(),
+			)
+			if err != nil {
+				t.Fatalf("unable to parse blinding point: %v",
+					err)
+			}
+			if !blindingPoint.IsEqual(blindedPath.BlindingPoint) {
+				t.Fatalf("received wrong blinding point")
+			}
+
+		case i < numSenderHops:
+			payload := pkt.Payload.Payload
+			if !bytes.Equal(payload, []byte{byte(i + 1)}) {
+				t.Fatalf("node %d received wrong payload: %x",
+					i, payload)
+			}
+
+		// The blinded hops decrypt their recipient data from their
+		// payload, and hand the next blinding point along.
+		default:
+			hopData, err := node.DecryptBlindedHopData(
+				blindingPoint, pkt.Payload.Payload,
+			)
+			if err != nil {
+				t.Fatalf("node %d unable to decrypt hop data: "+
+					"%v", i, err)
+			}
+			expected := recipientData[i-numSenderHops]
+			if !bytes.Equal(hopData, expected) {
+				t.Fatalf("node %d decrypted wrong hop data: %q",
+					i, hopData)
+			}
+			blindingPoint = pkt.NextBlindingPoint
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+}
+
+// TestBlindedOnionPacketInvalidParams asserts that blinded onion packets with
+// missing or excess hops are rejected.
+func TestBlindedOnionPacketInvalidParams(t *testing.T) {
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+	blindedPath, err := NewBlindedPath(
+		[]*btcec.PublicKey{sessionKey.PubKey()}, sessionKey,
+		[][]byte{nil},
+	)
+	if err != nil {
+		t.Fatalf("unable to create blinded path: %v", err)
+	}
+	payloads := make([]HopPayload, 1)
+	hop := OnionHop{NodePub: *sessionKey.PubKey()}
+
+	tests := []struct {
+		name        string
+		hops        []OnionHop
+		blindedPath *BlindedPath
+		payloads    []HopPayload
+	}{
+		{
+			name:     "no blinded path",
+			payloads: payloads,
+		},
+		{
+			name:        "missing payloads",
+			blindedPath: blindedPath,
+		},
+		{
+			name:        "empty hop",
+			hops:        []OnionHop{{}},
+			blindedPath: blindedPath,
+			payloads:    payloads,
+		},
+		{
+			name:        "too many hops",
+			hops:        make([]OnionHop, NumMaxHops),
+			blindedPath: blindedPath,
+			payloads:    payloads,
+		},
+	}
+	for i := range tests[3].hops {
+		tests[3].hops[i] = hop
+	}
+
+	for _, test := range tests {
+		_, err := NewBlindedOnionPacket(
+			test.hops, test.blindedPath, test.payloads, sessionKey,
+			nil,
+		)
+		if err == nil {
+			t.Fatalf("%s: expected failure", test.name)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package sphinx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// dbPermissions sets the database permissions to user
+	// write-and-readable.
+	dbPermissions = 0600
+
+	// dbOpenTimeout is the maximum amount of time we'll wait to obtain the
+	// file lock on the database before giving up.
+	dbOpenTimeout = time.Second
+)
+
+var (
+	// sharedHashBucket is a bucket which houses the first HashPrefixSize
+	// bytes of a received HTLC's hashed shared secret as the key and the
+	// HTLC's CLTV expiry as the value.
+	sharedHashBucket = []byte("shared-hash")
+
+	// batchReplayBucket is a bucket that maps batch identifiers to
+	// serialized ReplaySets. This is used to give idempotency in the event
+	// that a batch is processed more than once.
+	batchReplayBucket = []byte("batch-replay")
+
+	// batchExpiryBucket is a bucket that maps batch identifiers to the
+	// highest CLTV expiry among the entries of the batch, such that its
+	// replay set is pruned once all of them are stale. Batches committed
+	// before the bucket was introduced have no expiry, and are kept.
+	batchExpiryBucket = []byte("batch-expiry")
+)
+
+// BoltReplayLog is a ReplayLog implementation backed by a bolt database. All
+// hash prefixes and committed batches are persisted to disk, such that replay
+// protection survives a restart of the process.
+//
+// A log may be confined to a namespace within the database, in which case its
+// buckets are nested within a top-level bucket named after the namespace. This
+// allows several logs, for instance one per Router, to share a single database
+// while keeping their replay state fully isolated.
+type BoltReplayLog struct {
+	dbPath string
+
+	// sharedDB is the database handed to NewBoltReplayLogFromDB, if any.
+	// Such a database is owned by the caller, and thus never opened or
+	// closed by the log.
+	sharedDB *bolt.DB
+
+	// namespace is the name of the top-level bucket the buckets of the
+	// log are nested within. If empty, they're top-level buckets instead.
+	namespace []byte
+
+	db *bolt.DB
+}
+
+// NewBoltReplayLog creates a new BoltReplayLog which will store its contents
+// within the database found at dbPath. The database is created if it does not
+// exist once the log is started.
+func NewBoltReplayLog(dbPath string) *BoltReplayLog {
+	return &BoltReplayLog{
+		dbPath: dbPath,
+	}
+}
+
+// NewBoltReplayLogFromDB creates a new BoltReplayLog which stores its contents
+// within the passed, already opened, database, confined to the passed
+// namespace. Logs using distinct namespaces never observe each other's
+// entries, so the same packet can be processed once under each of them. The
+// database remains owned by the caller, and isn't closed when the log is
+// stopped.
+func NewBoltReplayLogFromDB(db *bolt.DB, namespace []byte) *BoltReplayLog {
+	return &BoltReplayLog{
+		sharedDB:  db,
+		namespace: namespace,
+	}
+}
+
+// Start opens the database and creates the buckets required by the log if
+// they don't already exist.
+func (rl *BoltReplayLog) Start() error {
+	if rl.db != nil {
+		return errReplayLogAlreadyStarted
+	}
+
+	db := rl.sharedDB
+	if db == nil {
+		var err error
+		db, err = bolt.Open(rl.dbPath, dbPermissions, &bolt.Options{
+			Timeout: dbOpenTimeout,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		var parent bucketCreator = tx
+		if len(rl.namespace) != 0 {
+			ns, err := tx.CreateBucketIfNotExists(rl.namespace)
+			if err != nil {
+				return err
+			}
+			parent = ns
+		}
+
+		_, err := parent.CreateBucketIfNotExists(sharedHashBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = parent.CreateBucketIfNotExists(batchReplayBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = parent.CreateBucketIfNotExists(batchExpiryBucket)
+		return err
+	})
+	if err != nil {
+		if rl.sharedDB == nil {
+			db.Close()
+		}
+		return err
+	}
+
+	rl.db = db
+
+	return nil
+}
+
+// Stop closes the underlying database, unless it was handed to
+// NewBoltReplayLogFromDB.
+func (rl *BoltReplayLog) Stop() error {
+	if rl.db == nil {
+		return errReplayLogNotStarted
+	}
+
+	var err error
+	if rl.sharedDB == nil {
+		err = rl.db.Close()
+	}
+	rl.db = nil
+
+	return err
+}
+
+// bucketCreator is implemented by both bolt transactions and buckets, allowing
+// the buckets of a log to be created either at the top-level or nested within
+// its namespace.
+type bucketCreator interface {
+	CreateBucketIfNotExists(name []byte) (*bolt.Bucket, error)
+}
+
+// bucket returns the log's bucket of the passed name within the transaction.
+func (rl *BoltReplayLog) bucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	if len(rl.namespace) == 0 {
+		return tx.Bucket(name)
+	}
+
+	return tx.Bucket(rl.namespace).Bucket(name)
+}
+
+// Get retrieves an entry from the log given its hash prefix. It returns the
+// value stored and an error if one occurs. It returns ErrLogEntryNotFound
+// if the entry is not in the log.
+func (rl *BoltReplayLog) Get(hash *HashPrefix) (uint32, error) {
+	if rl.db == nil {
+		return 0, errReplayLogNotStarted
+	}
+
+	var cltv uint32
+	err := rl.db.View(func(tx *bolt.Tx) error {
+		v := rl.bucket(tx, sharedHashBucket).Get(hash[:])
+		if v == nil {
+			return ErrLogEntryNotFound
+		}
+
+		cltv = binary.BigEndian.Uint32(v)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return cltv, nil
+}
+
+// Put stores an entry into the log given its hash prefix and an accompanying
+// purposefully general type. It returns ErrReplayedPacket if the provided hash
+// prefix already exists in the log.
+func (rl *BoltReplayLog) Put(hash *HashPrefix, cltv uint32) error {
+	if rl.db == nil {
+		return errReplayLogNotStarted
+	}
+
+	return rl.db.Update(func(tx *bolt.Tx) error {
+		return putSharedHash(rl.bucket(tx, sharedHashBucket), hash, cltv)
+	})
+}
+
+// Delete deletes an entry from the log given its hash prefix.
+func (rl *BoltReplayLog) Delete(hash *HashPrefix) error {
+	if rl.db == nil {
+		return errReplayLogNotStarted
+	}
+
+	return rl.db.Update(func(tx *bolt.Tx) error {
+		return rl.bucket(tx, sharedHashBucket).Delete(hash[:])
+	})
+}
+
+// DeleteStale deletes all entries from the log of which the stored CLTV expiry
+// is below the passed height, along with the batches all of whose entries are
+// stale. It returns the number of entries deleted. All entries are deleted
+// within a single database transaction.
+func (rl *BoltReplayLog) DeleteStale(height uint32) (int, error) {
+	if rl.db == nil {
+		return 0, errReplayLogNotStarted
+	}
+
+	var numDeleted int
+	err := rl.db.Update(func(tx *bolt.Tx) error {
+		sharedHashes := rl.bucket(tx, sharedHashBucket)
+
+		// Gather the stale entries first, as the bucket can't be
+		// modified while iterating over it.
+		var staleHashes [][]byte
+		err := sharedHashes.ForEach(func(k, v []byte) error {
+			if binary.BigEndian.Uint32(v) < height {
+				staleHashes = append(
+					staleHashes, append([]byte(nil), k...),
+				)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range staleHashes {
+			if err := sharedHashes.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		numDeleted = len(staleHashes)
+		return rl.deleteStaleBatches(tx, height)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return numDeleted, nil
+}
+
+// deleteStaleBatches deletes the replay sets of the batches of which the
+// recorded expiry is below the passed height within the transaction.
+func (rl *BoltReplayLog) deleteStaleBatches(tx *bolt.Tx, height uint32) error {
+	batchReplays := rl.bucket(tx, batchReplayBucket)
+	batchExpiries := rl.bucket(tx, batchExpiryBucket)
+
+	var staleIDs [][]byte
+	err := batchExpiries.ForEach(func(k, v []byte) error {
+		if binary.BigEndian.Uint32(v) < height {
+			staleIDs = append(staleIDs, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range staleIDs {
+		if err := batchReplays.Delete(id); err != nil {
+			return err
+		}
+		if err := batchExpiries.Delete(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PutBatch stores a batch of sphinx packets into the log given their hash
+// prefixes and accompanying values. Returns the set of entries in the batch
+// that are replays and an error if one occurs. The batch is written within a
+// single database transaction, such that either all or none of its entries are
+// persisted.
+func (rl *BoltReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	if rl.db == nil {
+		return nil, errReplayLogNotStarted
+	}
+
+	var replays *ReplaySet
+	err := rl.db.Update(func(tx *bolt.Tx) error {
+		sharedHashes := rl.bucket(tx, sharedHashBucket)
+		batchReplays := rl.bucket(tx, batchReplayBucket)
+
+		// If this batch has already been committed, return the replay
+		// set recorded at that time to provide idempotence.
+		replays = NewReplaySet()
+		if v := batchReplays.Get(batch.ID); v != nil {
+			return replays.Decode(bytes.NewReader(v))
+		}
+
+		err := batch.ForEach(func(seqNum uint16, hashPrefix *HashPrefix,
+			cltv uint32) error {
+
+			err := putSharedHash(sharedHashes, hashPrefix, cltv)
+			if err == ErrReplayedPacket {
+				replays.Add(seqNum)
+				return nil
+			}
+
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		// Merge the replays detected within the batch itself, and
+		// record the final replay set under the batch's ID. Batches
+		// without an ID can't be looked up again, so there's no need
+		// to record them.
+		replays.Merge(batch.ReplaySet)
+		if len(batch.ID) == 0 {
+			return nil
+		}
+
+		var b bytes.Buffer
+		if err := replays.Encode(&b); err != nil {
+			return err
+		}
+
+		if err := batchReplays.Put(batch.ID, b.Bytes()); err != nil {
+			return err
+		}
+
+		var expiry [4]byte
+		binary.BigEndian.PutUint32(expiry[:], batch.expiry())
+
+		return rl.bucket(tx, batchExpiryBucket).Put(batch.ID, expiry[:])
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	batch.ReplaySet = replays
+	batch.IsCommitted = true
+
+	return replays, nil
+}
+
+// Stats returns the number of entries stored in the log, along with the lowest
+// CLTV expiry among them. As the entries are keyed by their hash prefix, this
+// iterates over all of them within a single read transaction.
+func (rl *BoltReplayLog) Stats() (int, uint32, error) {
+	if rl.db == nil {
+		return 0, 0, errReplayLogNotStarted
+	}
+
+	var (
+		count      int
+		oldestCLTV uint32
+	)
+	err := rl.db.View(func(tx *bolt.Tx) error {
+		sharedHashes := rl.bucket(tx, sharedHashBucket)
+		return sharedHashes.ForEach(func(k, v []byte) error {
+			cltv := binary.BigEndian.Uint32(v)
+			if count == 0 || cltv < oldestCLTV {
+				oldestCLTV = cltv
+			}
+			count++
+
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return count, oldestCLTV, nil
+}
+
+// ForEach calls the passed function with the hash prefix and CLTV expiry of
+// each entry stored in the log, in the order of their hash prefixes, within a
+// single read transaction. It stops at the first error the function returns.
+func (rl *BoltReplayLog) ForEach(fn func(hash *HashPrefix,
+	cltv uint32) error) error {
+
+	if rl.db == nil {
+		return errReplayLogNotStarted
+	}
+
+	return rl.db.View(func(tx *bolt.Tx) error {
+		sharedHashes := rl.bucket(tx, sharedHashBucket)
+		return sharedHashes.ForEach(func(k, v []byte) error {
+			var hash HashPrefix
+			copy(hash[:], k)
+
+			return fn(&hash, binary.BigEndian.Uint32(v))
+		})
+	})
+}
+
+// putSharedHash writes the hash prefix and CLTV to the passed bucket,
+// returning ErrReplayedPacket if the hash prefix is already present.
+func putSharedHash(bucket *bolt.Bucket, hash *HashPrefix, cltv uint32) error {
+	if bucket.Get(hash[:]) != nil {
+		return ErrReplayedPacket
+	}
+
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], cltv)
+
+	return bucket.Put(hash[:], scratch[:])
+}
+
+// A compile time asserting *BoltReplayLog implements the RelayLog interface.
+var _ ReplayLog = (*BoltReplayLog)(nil)
@@ -0,0 +1,416 @@
+package sphinx
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestBoltReplayLog creates a BoltReplayLog backed by a database within a
+// fresh temporary directory. The returned cleanup closure removes the
+// directory.
+func newTestBoltReplayLog(t *testing.T) (*BoltReplayLog, func()) {
+	tempDir, err := ioutil.TempDir("", "sphinxreplaylog")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+
+	rl := NewBoltReplayLog(filepath.Join(tempDir, "replay.db"))
+
+	return rl, func() {
+		os.RemoveAll(tempDir)
+	}
+}
+
+// TestBoltReplayLogStorageAndRetrieval tests that the non-batch methods on
+// BoltReplayLog work as expected, and that entries survive a restart of the
+// log.
+func TestBoltReplayLogStorageAndRetrieval(t *testing.T) {
+	rl, cleanup := newTestBoltReplayLog(t)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+
+	var hashPrefix HashPrefix
+	hashPrefix[0] = 1
+
+	var cltv1 uint32 = 1
+
+	// Attempt to lookup unknown sphinx packet.
+	_, err := rl.Get(&hashPrefix)
+	if err != ErrLogEntryNotFound {
+		t.Fatalf("Get failed - received unexpected error upon Get: %v", err)
+	}
+
+	// Log incoming sphinx packet.
+	err = rl.Put(&hashPrefix, cltv1)
+	if err != nil {
+		t.Fatalf("Put failed - received unexpected error upon Put: %v", err)
+	}
+
+	// Attempt to replay sphinx packet.
+	err = rl.Put(&hashPrefix, cltv1)
+	if err != ErrReplayedPacket {
+		t.Fatalf("Put failed - received unexpected error upon Put: %v", err)
+	}
+
+	// Restart the log, the entry should still be present.
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to restart replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	cltv, err := rl.Get(&hashPrefix)
+	if err != nil {
+		t.Fatalf("Get failed - received unexpected error upon Get: %v", err)
+	}
+	if cltv != cltv1 {
+		t.Fatalf("Get returned wrong value: expected %v, got %v", cltv1, cltv)
+	}
+
+	err = rl.Put(&hashPrefix, cltv1)
+	if err != ErrReplayedPacket {
+		t.Fatalf("Put failed - received unexpected error upon Put: %v", err)
+	}
+
+	// Delete sphinx packet from log.
+	err = rl.Delete(&hashPrefix)
+	if err != nil {
+		t.Fatalf("Delete failed - received unexpected error upon Delete: %v", err)
+	}
+
+	// Attempt to lookup deleted sphinx packet.
+	_, err = rl.Get(&hashPrefix)
+	if err != ErrLogEntryNotFound {
+		t.Fatalf("Get failed - received unexpected error upon Get: %v", err)
+	}
+}
+
+// TestBoltReplayLogPutBatch tests that the batch adding of packets to a
+// BoltReplayLog works as expected, and that committed batches remain
+// idempotent across restarts.
+func TestBoltReplayLogPutBatch(t *testing.T) {
+	rl, cleanup := newTestBoltReplayLog(t)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+
+	var hashPrefix1, hashPrefix2 HashPrefix
+	hashPrefix1[0] = 1
+	hashPrefix2[0] = 2
+
+	// Create a batch with a duplicated packet.
+	batch1 := NewBatch([]byte{1})
+	if err := batch1.Put(1, &hashPrefix1, 1); err != nil {
+		t.Fatalf("Unexpected error adding entry to batch: %v", err)
+	}
+	if err := batch1.Put(1, &hashPrefix1, 1); err != nil {
+		t.Fatalf("Unexpected error adding entry to batch: %v", err)
+	}
+
+	replays, err := rl.PutBatch(batch1)
+	if err != nil {
+		t.Fatalf("unable to put batch 1: %v", err)
+	}
+	if replays.Size() != 1 || !replays.Contains(1) {
+		t.Fatalf("Unexpected replay set after adding batch 1 to log")
+	}
+
+	// Create a batch with one replayed packet and one valid one.
+	batch2 := NewBatch([]byte{2})
+	if err := batch2.Put(1, &hashPrefix1, 1); err != nil {
+		t.Fatalf("Unexpected error adding entry to batch: %v", err)
+	}
+	if err := batch2.Put(2, &hashPrefix2, 2); err != nil {
+		t.Fatalf("Unexpected error adding entry to batch: %v", err)
+	}
+
+	replays, err = rl.PutBatch(batch2)
+	if err != nil {
+		t.Fatalf("unable to put batch 2: %v", err)
+	}
+	if replays.Size() != 1 || !replays.Contains(1) {
+		t.Fatalf("Unexpected replay set after adding batch 2 to log")
+	}
+
+	// Restart the log and reprocess batch 2, which should be idempotent.
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to restart replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	replays, err = rl.PutBatch(batch2)
+	if err != nil {
+		t.Fatalf("unable to put batch 2: %v", err)
+	}
+	if replays.Size() != 1 || !replays.Contains(1) {
+		t.Fatalf("Unexpected replay set after re-adding batch 2 to log")
+	}
+}
+
+// TestBoltReplayLogDeleteStale tests that stale entries are pruned from a
+// BoltReplayLog by their CLTV expiry.
+func TestBoltReplayLogDeleteStale(t *testing.T) {
+	rl, cleanup := newTestBoltReplayLog(t)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	testReplayLogDeleteStale(t, rl)
+}
+
+// TestBoltReplayLogDeleteStaleBatches tests that the replay sets of expired
+// batches are pruned from a BoltReplayLog, along with their expiries.
+func TestBoltReplayLogDeleteStaleBatches(t *testing.T) {
+	rl, cleanup := newTestBoltReplayLog(t)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	testReplayLogDeleteStaleBatches(t, rl)
+
+	// Only the records of the live batch and the stale one committed
+	// again are left.
+	err := rl.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{
+			batchReplayBucket, batchExpiryBucket,
+		} {
+			n := rl.bucket(tx, name).Stats().KeyN
+			if n != 2 {
+				t.Fatalf("expected 2 records in bucket %s, "+
+					"got %d", name, n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to inspect database: %v", err)
+	}
+}
+
+// TestBoltReplayLogMigration tests migrating from a MemoryReplayLog into a
+// BoltReplayLog.
+func TestBoltReplayLogMigration(t *testing.T) {
+	rl, cleanup := newTestBoltReplayLog(t)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	src := NewMemoryReplayLog()
+	src.Start()
+	defer src.Stop()
+
+	testReplayLogMigration(t, src, rl)
+}
+
+// TestBoltReplayLogStats tests the stats reported by a BoltReplayLog.
+func TestBoltReplayLogStats(t *testing.T) {
+	rl, cleanup := newTestBoltReplayLog(t)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	testReplayLogStats(t, rl)
+}
+
+// TestSphinxNodeReplayAfterRestart asserts that a router backed by a
+// BoltReplayLog rejects a replayed packet even after its log was restarted.
+func TestSphinxNodeReplayAfterRestart(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	rl, cleanup := newTestBoltReplayLog(t)
+	defer cleanup()
+
+	router := NewRouterWithECDH(
+		nodes[0].onionPub, nodes[0].onionKey, &chaincfg.MainNetParams,
+		rl,
+	)
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router: %v", err)
+	}
+
+	// Allow the node to process the initial packet, this should proceed
+	// without any failures.
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process sphinx packet: %v", err)
+	}
+
+	// Simulate a restart of the node, then process the same packet again.
+	// This should be detected as a replay using the persisted state.
+	router.Stop()
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to restart router: %v", err)
+	}
+	defer router.Stop()
+
+	_, err = router.ProcessOnionPacket(fwdMsg, nil, 1)
+	if !errors.Is(err, ErrReplayedPacket) {
+		t.Fatalf("sphinx packet replay should be rejected, instead "+
+			"error is %v", err)
+	}
+}
+
+// TestBoltReplayLogNamespaces asserts that routers backed by logs in distinct
+// namespaces of the same database keep independent replay state.
+func TestBoltReplayLogNamespaces(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "sphinxreplaylog")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, err := bolt.Open(filepath.Join(tempDir, "replay.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("unable to open db: %v", err)
+	}
+	defer db.Close()
+
+	routers := make([]*Router, 2)
+	for i, namespace := range []string{"test", "prod"} {
+		routers[i] = NewRouterWithECDH(
+			nodes[0].onionPub, nodes[0].onionKey,
+			&chaincfg.MainNetParams,
+			NewBoltReplayLogFromDB(db, []byte(namespace)),
+		)
+		if err := routers[i].Start(); err != nil {
+			t.Fatalf("unable to start router: %v", err)
+		}
+	}
+
+	// The same packet should be accepted once by each of the routers,
+	// while being rejected as a replay by each of them afterwards.
+	for i, router := range routers {
+		if _, err := router.ProcessOnionPacket(fwdMsg, nil, 1); err != nil {
+			t.Fatalf("router %d unable to process packet: %v", i,
+				err)
+		}
+	}
+	for i, router := range routers {
+		_, err := router.ProcessOnionPacket(fwdMsg, nil, 1)
+		if !errors.Is(err, ErrReplayedPacket) {
+			t.Fatalf("router %d should reject replay, instead "+
+				"error is %v", i, err)
+		}
+	}
+
+	// Stopping one of the logs shouldn't close the shared database, nor
+	// affect the other log.
+	routers[0].Stop()
+	defer routers[1].Stop()
+
+	_, err = routers[1].ProcessOnionPacket(fwdMsg, nil, 1)
+	if !errors.Is(err, ErrReplayedPacket) {
+		t.Fatalf("router should reject replay, instead error is %v", err)
+	}
+}
+
+// TestBoltReplayLogNamespaceDeleteStale tests that stale entries are pruned
+// from a namespaced BoltReplayLog by their CLTV expiry.
+func TestBoltReplayLogNamespaceDeleteStale(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sphinxreplaylog")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, err := bolt.Open(filepath.Join(tempDir, "replay.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("unable to open db: %v", err)
+	}
+	defer db.Close()
+
+	rl := NewBoltReplayLogFromDB(db, []byte("namespace"))
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	testReplayLogDeleteStale(t, rl)
+}
+
+// TestSphinxRouterStop asserts that stopping a router flushes its buffered
+// replay log, and that packets can't be processed until it's started again.
+func TestSphinxRouterStop(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	rl, cleanup := newTestBoltReplayLog(t)
+	defer cleanup()
+
+	router := NewRouterWithECDH(
+		nodes[0].onionPub, nodes[0].onionKey, &chaincfg.MainNetParams,
+		NewBufferedReplayLog(rl, 0, 0),
+	)
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router: %v", err)
+	}
+
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process sphinx packet: %v", err)
+	}
+
+	if err := router.Stop(); err != nil {
+		t.Fatalf("unable to stop router: %v", err)
+	}
+	if err := router.Stop(); err != ErrRouterStopped {
+		t.Fatalf("expected ErrRouterStopped, got: %v", err)
+	}
+
+	_, err = router.ProcessOnionPacket(fwdMsg, nil, 1)
+	if err != ErrRouterStopped {
+		t.Fatalf("expected ErrRouterStopped, got: %v", err)
+	}
+	if _, err := router.DeleteStaleEntries(1000); err != ErrRouterStopped {
+		t.Fatalf("expected ErrRouterStopped, got: %v", err)
+	}
+
+	// The entry buffered before stopping should have been flushed to the
+	// underlying log, so the packet is rejected once restarted.
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to restart router: %v", err)
+	}
+	defer router.Stop()
+
+	_, err = router.ProcessOnionPacket(fwdMsg, nil, 1)
+	if !errors.Is(err, ErrReplayedPacket) {
+		t.Fatalf("sphinx packet replay should be rejected, instead "+
+			"error is %v", err)
+	}
+}
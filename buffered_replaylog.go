@@ -0,0 +1,495 @@
+package sphinx
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// BufferedReplayLog is a ReplayLog which wraps another, persistent, ReplayLog,
+// and defers writing newly added hash prefixes to it. Rather than committing
+// each prefix in a transaction of its own, prefixes are accumulated in memory
+// and flushed in a single batch once a set number of them is pending, or once
+// the flush interval elapses. For a BoltReplayLog each flush is then a single
+// transaction, which is fsync'd upon commit.
+//
+// Flushes are performed by a background goroutine, and write to the wrapped
+// log without holding the mutex guarding the pending prefixes, so Put doesn't
+// wait for the disk. Prefixes being flushed are consulted before the wrapped
+// log along with the pending ones, such that replays are still caught if they
+// arrive before the prefix was written.
+//
+// NOTE: Durability is only achieved once a prefix has been flushed. If the
+// process crashes before that, the pending prefixes are lost, and packets
+// received within the last flush interval could be processed again, including
+// when replayed by an attacker. Callers unable to accept that should use the
+// wrapped log directly.
+type BufferedReplayLog struct {
+	log ReplayLog
+
+	maxPending    int
+	flushInterval time.Duration
+
+	// flushMtx serializes flushes, along with the operations that must not
+	// overlap with one, such as deleting entries. It must be acquired
+	// before mu.
+	flushMtx sync.Mutex
+
+	mu      sync.Mutex
+	started bool
+
+	// pending holds the prefixes that have yet to be flushed, while
+	// flushing holds those that are being written by the current flush.
+	pending  map[HashPrefix]uint32
+	flushing map[HashPrefix]uint32
+
+	// commits counts the writes of flushed prefixes to the wrapped log,
+	// which allows Put to detect that a prefix may have been written
+	// while it was looking it up.
+	commits uint64
+
+	flushSignal chan struct{}
+	flushErrors chan error
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewBufferedReplayLog creates a new BufferedReplayLog on top of the passed
+// log, which flushes pending prefixes once maxPending of them accumulated, or
+// once flushInterval elapsed since the last flush. A non-positive value
+// disables the respective trigger.
+func NewBufferedReplayLog(log ReplayLog, maxPending int,
+	flushInterval time.Duration) *BufferedReplayLog {
+
+	return &BufferedReplayLog{
+		log:           log,
+		maxPending:    maxPending,
+		flushInterval: flushInterval,
+		flushErrors:   make(chan error, 1),
+	}
+}
+
+// A compile time check to ensure BufferedReplayLog adheres to the ReplayLog
+// interface.
+var _ ReplayLog = (*BufferedReplayLog)(nil)
+
+// FlushErrors returns a channel on which errors encountered by background
+// flushes are delivered. The prefixes of a failed flush remain pending, and
+// are retried by the next one. Errors are dropped while the channel holds an
+// error that has yet to be received.
+func (rl *BufferedReplayLog) FlushErrors() <-chan error {
+	return rl.flushErrors
+}
+
+// Start starts the wrapped log, along with the goroutine flushing pending
+// prefixes.
+func (rl *BufferedReplayLog) Start() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.started {
+		return errReplayLogAlreadyStarted
+	}
+
+	if err := rl.log.Start(); err != nil {
+		return err
+	}
+
+	rl.started = true
+	rl.pending = make(map[HashPrefix]uint32)
+	rl.flushing = make(map[HashPrefix]uint32)
+	rl.flushSignal = make(chan struct{}, 1)
+	rl.quit = make(chan struct{})
+
+	if rl.flushInterval > 0 || rl.maxPending > 0 {
+		rl.wg.Add(1)
+		go rl.flusher(rl.quit)
+	}
+
+	return nil
+}
+
+// Stop flushes any pending prefixes, then stops the wrapped log.
+func (rl *BufferedReplayLog) Stop() error {
+	rl.mu.Lock()
+	if !rl.started {
+		rl.mu.Unlock()
+		return errReplayLogNotStarted
+	}
+	rl.started = false
+	close(rl.quit)
+	rl.mu.Unlock()
+
+	rl.wg.Wait()
+
+	rl.flushMtx.Lock()
+	flushErr := rl.flush()
+	rl.mu.Lock()
+	rl.pending = nil
+	rl.flushing = nil
+	rl.mu.Unlock()
+	rl.flushMtx.Unlock()
+
+	if err := rl.log.Stop(); err != nil {
+		return err
+	}
+
+	return flushErr
+}
+
+// flusher flushes the pending prefixes every flush interval, or once signalled
+// that the maximum number of them is pending, until the quit channel is
+// closed. Errors are reported through the flush errors channel.
+//
+// NOTE: This method must be run as a goroutine.
+func (rl *BufferedReplayLog) flusher(quit chan struct{}) {
+	defer rl.wg.Done()
+
+	var tick <-chan time.Time
+	if rl.flushInterval > 0 {
+		ticker := time.NewTicker(rl.flushInterval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+		case <-rl.flushSignal:
+		case <-quit:
+			return
+		}
+
+		rl.flushMtx.Lock()
+		err := rl.flush()
+		rl.flushMtx.Unlock()
+
+		if err != nil {
+			select {
+			case rl.flushErrors <- err:
+			default:
+			}
+		}
+	}
+}
+
+// Flush synchronously writes all pending prefixes to the wrapped log.
+func (rl *BufferedReplayLog) Flush() error {
+	rl.flushMtx.Lock()
+	defer rl.flushMtx.Unlock()
+
+	rl.mu.Lock()
+	started := rl.started
+	rl.mu.Unlock()
+
+	if !started {
+		return errReplayLogNotStarted
+	}
+
+	return rl.flush()
+}
+
+// flush moves the pending prefixes to the set being flushed, and writes them
+// to the wrapped log in as few batches as possible, without holding the mutex
+// guarding the pending prefixes. Prefixes are only removed from the set being
+// flushed once written, and returned to the pending set if writing fails, so
+// they're retried upon the next flush.
+//
+// NOTE: This method must be called with the flush mutex held.
+func (rl *BufferedReplayLog) flush() error {
+	rl.mu.Lock()
+	for hashPrefix, cltv := range rl.pending {
+		rl.flushing[hashPrefix] = cltv
+	}
+	rl.pending = make(map[HashPrefix]uint32)
+	toWrite := make(map[HashPrefix]uint32, len(rl.flushing))
+	for hashPrefix, cltv := range rl.flushing {
+		toWrite[hashPrefix] = cltv
+	}
+	rl.mu.Unlock()
+
+	for len(toWrite) > 0 {
+		// As the entries of a batch are indexed by a uint16, a single
+		// batch can hold at most MaxUint16+1 of them.
+		batch := NewBatch(nil)
+		written := make([]HashPrefix, 0, len(toWrite))
+		for hashPrefix, cltv := range toWrite {
+			if len(written) > math.MaxUint16 {
+				break
+			}
+
+			hashPrefix := hashPrefix
+			seqNum := uint16(len(written))
+			if err := batch.Put(seqNum, &hashPrefix, cltv); err != nil {
+				rl.abortFlush()
+				return err
+			}
+			written = append(written, hashPrefix)
+		}
+
+		// Any replays reported while flushing were already accepted
+		// when added to the pending set, so they're only of concern if
+		// another writer shares the wrapped log.
+		if _, err := rl.log.PutBatch(batch); err != nil {
+			rl.abortFlush()
+			return err
+		}
+
+		rl.mu.Lock()
+		for i := range written {
+			delete(rl.flushing, written[i])
+			delete(toWrite, written[i])
+		}
+		rl.commits++
+		rl.mu.Unlock()
+	}
+
+	return nil
+}
+
+// abortFlush returns the prefixes that failed to be flushed to the pending
+// set.
+func (rl *BufferedReplayLog) abortFlush() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for hashPrefix, cltv := range rl.flushing {
+		rl.pending[hashPrefix] = cltv
+	}
+	rl.flushing = make(map[HashPrefix]uint32)
+}
+
+// buffered returns the CLTV expiry of the passed prefix if it's either pending
+// or being flushed.
+//
+// NOTE: This method must be called with the log's mutex held.
+func (rl *BufferedReplayLog) buffered(hash *HashPrefix) (uint32, bool) {
+	if cltv, ok := rl.pending[*hash]; ok {
+		return cltv, true
+	}
+	cltv, ok := rl.flushing[*hash]
+
+	return cltv, ok
+}
+
+// Get retrieves an entry from the log given its hash prefix, either from the
+// buffered prefixes or the wrapped log. It returns ErrLogEntryNotFound if the
+// entry is not in the log.
+func (rl *BufferedReplayLog) Get(hash *HashPrefix) (uint32, error) {
+	rl.mu.Lock()
+	if !rl.started {
+		rl.mu.Unlock()
+		return 0, errReplayLogNotStarted
+	}
+	cltv, ok := rl.buffered(hash)
+	rl.mu.Unlock()
+
+	if ok {
+		return cltv, nil
+	}
+
+	return rl.log.Get(hash)
+}
+
+// Put adds the hash prefix to the set of pending prefixes, returning
+// ErrReplayedPacket if it's already pending, being flushed or present in the
+// wrapped log. If this fills up the pending set, the flusher is signalled to
+// flush it, without waiting for it to do so.
+func (rl *BufferedReplayLog) Put(hash *HashPrefix, cltv uint32) error {
+	for {
+		rl.mu.Lock()
+		if !rl.started {
+			rl.mu.Unlock()
+			return errReplayLogNotStarted
+		}
+		if _, ok := rl.buffered(hash); ok {
+			rl.mu.Unlock()
+			return ErrReplayedPacket
+		}
+		commits := rl.commits
+		rl.mu.Unlock()
+
+		// The wrapped log is consulted without holding the mutex, so
+		// flushes aren't blocked on the lookup.
+		switch _, err := rl.log.Get(hash); {
+		case err == nil:
+			return ErrReplayedPacket
+
+		case err != ErrLogEntryNotFound:
+			return err
+		}
+
+		rl.mu.Lock()
+		if !rl.started {
+			rl.mu.Unlock()
+			return errReplayLogNotStarted
+		}
+
+		// Should a flush have been written in the meantime, it may
+		// have included the prefix after we looked it up, so we'll
+		// look it up once more.
+		if rl.commits != commits {
+			rl.mu.Unlock()
+			continue
+		}
+		if _, ok := rl.buffered(hash); ok {
+			rl.mu.Unlock()
+			return ErrReplayedPacket
+		}
+
+		rl.pending[*hash] = cltv
+		if rl.maxPending > 0 && len(rl.pending) >= rl.maxPending {
+			select {
+			case rl.flushSignal <- struct{}{}:
+			default:
+			}
+		}
+		rl.mu.Unlock()
+
+		return nil
+	}
+}
+
+// Delete deletes an entry from the log given its hash prefix, whether it's
+// pending or already written to the wrapped log. It waits for any flush in
+// progress to finish, so the entry isn't written after being deleted.
+func (rl *BufferedReplayLog) Delete(hash *HashPrefix) error {
+	rl.flushMtx.Lock()
+	defer rl.flushMtx.Unlock()
+
+	rl.mu.Lock()
+	if !rl.started {
+		rl.mu.Unlock()
+		return errReplayLogNotStarted
+	}
+	delete(rl.pending, *hash)
+	rl.mu.Unlock()
+
+	return rl.log.Delete(hash)
+}
+
+// DeleteStale flushes the pending prefixes, then deletes all entries from the
+// wrapped log of which the stored CLTV expiry is below the passed height. It
+// returns the number of entries deleted.
+func (rl *BufferedReplayLog) DeleteStale(height uint32) (int, error) {
+	rl.flushMtx.Lock()
+	defer rl.flushMtx.Unlock()
+
+	if err := rl.checkStarted(); err != nil {
+		return 0, err
+	}
+
+	if err := rl.flush(); err != nil {
+		return 0, err
+	}
+
+	return rl.log.DeleteStale(height)
+}
+
+// PutBatch flushes the pending prefixes, then synchronously writes the batch
+// to the wrapped log, such that its idempotence is preserved. Returns the set
+// of entries in the batch that are replays and an error if one occurs.
+func (rl *BufferedReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	rl.flushMtx.Lock()
+	defer rl.flushMtx.Unlock()
+
+	if err := rl.checkStarted(); err != nil {
+		return nil, err
+	}
+
+	if err := rl.flush(); err != nil {
+		return nil, err
+	}
+
+	// The prefixes of the batch are treated as being flushed while it's
+	// written, so a concurrent Put of any of them is caught as a replay.
+	rl.mu.Lock()
+	written := make([]HashPrefix, 0, len(batch.entries))
+	for _, entry := range batch.entries {
+		if _, ok := rl.flushing[entry.hashPrefix]; ok {
+			continue
+		}
+		rl.flushing[entry.hashPrefix] = entry.cltv
+		written = append(written, entry.hashPrefix)
+	}
+	rl.mu.Unlock()
+
+	replays, err := rl.log.PutBatch(batch)
+
+	rl.mu.Lock()
+	for i := range written {
+		delete(rl.flushing, written[i])
+	}
+	rl.commits++
+	rl.mu.Unlock()
+
+	return replays, err
+}
+
+// checkStarted returns an error if the log isn't started.
+func (rl *BufferedReplayLog) checkStarted() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if !rl.started {
+		return errReplayLogNotStarted
+	}
+
+	return nil
+}
+
+// Stats returns the number of entries stored in the log, both pending and
+// already written to the wrapped log, along with the lowest CLTV expiry among
+// them.
+func (rl *BufferedReplayLog) Stats() (int, uint32, error) {
+	rl.flushMtx.Lock()
+	defer rl.flushMtx.Unlock()
+
+	if err := rl.checkStarted(); err != nil {
+		return 0, 0, err
+	}
+
+	count, oldestCLTV, err := rl.log.Stats()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// As prefixes are only added to the pending set if they're absent from
+	// the wrapped log, and no flush is in progress that could write them
+	// meanwhile, the two never overlap.
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	numPending, oldestPending := entryStats(rl.pending)
+	if numPending > 0 && (count == 0 || oldestPending < oldestCLTV) {
+		oldestCLTV = oldestPending
+	}
+
+	return count + numPending, oldestCLTV, nil
+}
+
+// ForEach calls the passed function with the hash prefix and CLTV expiry of
+// each entry stored in the log, both already written to the wrapped log and
+// pending, stopping at the first error it returns. No prefixes are flushed
+// while iterating, so each entry is visited exactly once.
+func (rl *BufferedReplayLog) ForEach(fn func(hash *HashPrefix,
+	cltv uint32) error) error {
+
+	rl.flushMtx.Lock()
+	defer rl.flushMtx.Unlock()
+
+	if err := rl.checkStarted(); err != nil {
+		return err
+	}
+
+	if err := rl.log.ForEach(fn); err != nil {
+		return err
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return forEachEntry(rl.pending, fn)
+}
@@ -0,0 +1,260 @@
+package sphinx
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestBufferedReplayLogPut asserts that prefixes added to a BufferedReplayLog
+// are caught as replays while still pending, and are only written to the
+// wrapped log once flushed.
+func TestBufferedReplayLogPut(t *testing.T) {
+	bolt, cleanup := newTestBoltReplayLog(t)
+	defer cleanup()
+
+	rl := NewBufferedReplayLog(bolt, 0, 0)
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+
+	var hashPrefix HashPrefix
+	hashPrefix[0] = 1
+
+	if err := rl.Put(&hashPrefix, 1); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if err := rl.Put(&hashPrefix, 1); err != ErrReplayedPacket {
+		t.Fatalf("expected pending entry to be a replay, got: %v", err)
+	}
+	if _, err := bolt.Get(&hashPrefix); err != ErrLogEntryNotFound {
+		t.Fatalf("pending entry shouldn't be written yet: %v", err)
+	}
+
+	if err := rl.Flush(); err != nil {
+		t.Fatalf("unable to flush log: %v", err)
+	}
+	if _, err := bolt.Get(&hashPrefix); err != nil {
+		t.Fatalf("flushed entry should be written: %v", err)
+	}
+	if err := rl.Put(&hashPrefix, 1); err != ErrReplayedPacket {
+		t.Fatalf("expected flushed entry to be a replay, got: %v", err)
+	}
+
+	// Pending entries should be flushed upon stopping the log, such that
+	// they survive a restart.
+	var hashPrefix2 HashPrefix
+	hashPrefix2[0] = 2
+	if err := rl.Put(&hashPrefix2, 2); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to restart replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	cltv, err := rl.Get(&hashPrefix2)
+	if err != nil {
+		t.Fatalf("entry should survive restart: %v", err)
+	}
+	if cltv != 2 {
+		t.Fatalf("expected cltv 2, got %d", cltv)
+	}
+}
+
+// TestBufferedReplayLogFlushTriggers asserts that pending prefixes are flushed
+// once the maximum number of them is reached, and once the flush interval
+// elapses.
+func TestBufferedReplayLogFlushTriggers(t *testing.T) {
+	mem := NewMemoryReplayLog()
+	rl := NewBufferedReplayLog(mem, 2, 0)
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+
+	var hashPrefixes [3]HashPrefix
+	for i := range hashPrefixes {
+		hashPrefixes[i][0] = byte(i)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := rl.Put(&hashPrefixes[i], 1); err != nil {
+			t.Fatalf("unable to put entry %d: %v", i, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		waitForEntry(t, mem, &hashPrefixes[i])
+	}
+	rl.Stop()
+
+	rl = NewBufferedReplayLog(mem, 0, 10*time.Millisecond)
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	if err := rl.Put(&hashPrefixes[2], 1); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	waitForEntry(t, mem, &hashPrefixes[2])
+}
+
+// waitForEntry waits for the entry with the passed hash prefix to be written
+// to the log, failing the test if it isn't within a few seconds.
+func waitForEntry(t *testing.T, log ReplayLog, hashPrefix *HashPrefix) {
+	t.Helper()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		if _, err := log.Get(hashPrefix); err == nil {
+			return
+		}
+
+		select {
+		case <-deadline:
+			t.Fatalf("entry %x wasn't flushed in time",
+				hashPrefix[:])
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// blockingBatchLog is a MemoryReplayLog of which each batch write blocks
+// until it's released, and fails if an error is set, simulating a slow and
+// possibly failing backend.
+type blockingBatchLog struct {
+	*MemoryReplayLog
+
+	entered chan struct{}
+	release chan error
+}
+
+// PutBatch signals the write was entered, and writes the batch once released,
+// unless released with an error.
+func (rl *blockingBatchLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	rl.entered <- struct{}{}
+	if err := <-rl.release; err != nil {
+		return nil, err
+	}
+
+	return rl.MemoryReplayLog.PutBatch(batch)
+}
+
+// TestBufferedReplayLogSlowFlush asserts that a flush to a slow backend
+// doesn't block adding prefixes, that prefixes being flushed are still caught
+// as replays, and that flush errors are reported through the dedicated
+// channel rather than to an unrelated Put.
+func TestBufferedReplayLogSlowFlush(t *testing.T) {
+	backend := &blockingBatchLog{
+		MemoryReplayLog: NewMemoryReplayLog(),
+		entered:         make(chan struct{}),
+		release:         make(chan error),
+	}
+	rl := NewBufferedReplayLog(backend, 1, 0)
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+
+	var hashPrefixes [3]HashPrefix
+	for i := range hashPrefixes {
+		hashPrefixes[i][0] = byte(i + 1)
+	}
+
+	// Adding the first prefix triggers a flush, which blocks within the
+	// backend.
+	if err := rl.Put(&hashPrefixes[0], 1); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	<-backend.entered
+
+	// While the flush is in progress, the prefix being flushed is caught
+	// as a replay, while another one is accepted right away.
+	if err := rl.Put(&hashPrefixes[0], 1); err != ErrReplayedPacket {
+		t.Fatalf("expected flushing entry to be a replay, got: %v", err)
+	}
+	if _, err := rl.Get(&hashPrefixes[0]); err != nil {
+		t.Fatalf("unable to get flushing entry: %v", err)
+	}
+	if err := rl.Put(&hashPrefixes[1], 2); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+
+	// Failing the flush reports the error through the channel, while the
+	// prefix remains buffered, so it's caught and retried.
+	errFlush := errors.New("flush failed")
+	backend.release <- errFlush
+	select {
+	case err := <-rl.FlushErrors():
+		if err != errFlush {
+			t.Fatalf("expected flush error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("flush error wasn't reported")
+	}
+	if err := rl.Put(&hashPrefixes[0], 1); err != ErrReplayedPacket {
+		t.Fatalf("expected failed entry to be a replay, got: %v", err)
+	}
+
+	// The signalled retry covers both prefixes, and succeeds. Another Put
+	// isn't handed the earlier error.
+	<-backend.entered
+	backend.release <- nil
+	waitForEntry(t, backend.MemoryReplayLog, &hashPrefixes[0])
+	waitForEntry(t, backend.MemoryReplayLog, &hashPrefixes[1])
+
+	go func() {
+		for range backend.entered {
+			backend.release <- nil
+		}
+	}()
+	if err := rl.Put(&hashPrefixes[2], 3); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+	close(backend.entered)
+}
+
+// TestBufferedReplayLogDeleteStale tests that stale entries are pruned from a
+// BufferedReplayLog by their CLTV expiry, including pending ones.
+func TestBufferedReplayLogDeleteStale(t *testing.T) {
+	rl := NewBufferedReplayLog(NewMemoryReplayLog(), 0, 0)
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	testReplayLogDeleteStale(t, rl)
+}
+
+// TestBufferedReplayLogStats tests the stats reported by a BufferedReplayLog,
+// which cover both its pending entries and those already flushed.
+func TestBufferedReplayLogStats(t *testing.T) {
+	rl := NewBufferedReplayLog(NewMemoryReplayLog(), 0, 0)
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	testReplayLogStats(t, rl)
+
+	// The remaining entry was flushed by DeleteStale, so a pending entry
+	// with an earlier expiry is now to be reported as the oldest.
+	var hashPrefix HashPrefix
+	hashPrefix[0] = 0xaa
+	if err := rl.Put(&hashPrefix, 50); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	count, oldestCLTV, err := rl.Stats()
+	if err != nil {
+		t.Fatalf("unable to query stats: %v", err)
+	}
+	if count != 2 || oldestCLTV != 50 {
+		t.Fatalf("expected 2 entries with oldest cltv 50, got %d "+
+			"with oldest cltv %d", count, oldestCLTV)
+	}
+}
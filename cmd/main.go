@@ -37,15 +37,22 @@ func main() {
 				panic(err)
 			}
 
+			hopData := sphinx.HopData{
+				Realm:         [1]byte{0x00},
+				ForwardAmount: uint64(i),
+				OutgoingCltv:  uint32(i),
+			}
+			copy(hopData.NextAddress[:], bytes.Repeat([]byte{byte(i)}, 8))
+
+			hopPayload, err := sphinx.NewHopPayload(&hopData, nil)
+			if err != nil {
+				log.Fatalf("unable to create hop payload: %v", err)
+			}
+
 			path[i] = sphinx.OnionHop{
-				NodePub: *pubkey,
-				HopData: sphinx.HopData{
-					Realm:         [1]byte{0x00},
-					ForwardAmount: uint64(i),
-					OutgoingCltv:  uint32(i),
-				},
+				NodePub:    *pubkey,
+				HopPayload: hopPayload,
 			}
-			copy(path[i].HopData.NextAddress[:], bytes.Repeat([]byte{byte(i)}, 8))
 
 			fmt.Fprintf(os.Stderr, "Node %d pubkey %x\n", i, pubkey.SerializeCompressed())
 		}
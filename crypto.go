@@ -2,9 +2,10 @@ package sphinx
 
 import (
 	"bytes"
+	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/sha256"
-	"errors"
+	"crypto/subtle"
 	"fmt"
 
 	"github.com/aead/chacha20"
@@ -23,15 +24,46 @@ const (
 type Hash256 [sha256.Size]byte
 
 // zeroHMAC is the special HMAC value that allows the final node to determine
-// if it is the payment destination or not.
+// if it is the payment destination or not. Use isTerminalHMAC to check for it.
 var zeroHMAC [HMACSize]byte
 
+// isTerminalHMAC returns whether the HMAC peeled off for the next hop is the
+// all-zero terminal marker, signalling that we're the exit hop. The check is
+// performed in constant time.
+//
+// The marker can only be trusted once the header MAC of the packet has been
+// verified. The routing info is encrypted using a stream cipher, so anyone
+// knowing the HMAC handed to the next hop, such as the next hop itself, could
+// flip the corresponding routing info bits to turn it into the marker, and
+// have the packet terminate early. The header MAC covers the full routing
+// info, and can only be computed by the sender, so such tampering is caught
+// before the marker is examined. The sender, who is free to pick the length
+// of the route, remains the only party able to place the marker.
+func isTerminalHMAC(mac *[HMACSize]byte) bool {
+	return subtle.ConstantTimeCompare(mac[:], zeroHMAC[:]) == 1
+}
+
 // calcMac calculates HMAC-SHA-256 over the message using the passed secret key
 // as input to the HMAC.
 func calcMac(key [keyLen]byte, msg []byte) [HMACSize]byte {
+	return calcHeaderMac(key, msg, nil)
+}
+
+// calcHeaderMac calculates the HMAC-SHA-256 of an onion packet, computed over
+// the routing info followed by the associated data, using the passed secret
+// key. Both parts are fed to the HMAC in turn, so they never need to be
+// concatenated. As the HMAC consumes its input block by block, the associated
+// data may be arbitrarily large without being copied.
+func calcHeaderMac(key [keyLen]byte, routingInfo,
+	assocData []byte) [HMACSize]byte {
+
 	hmac := hmac.New(sha256.New, key[:])
-	hmac.Write(msg)
-	h := hmac.Sum(nil)
+	hmac.Write(routingInfo)
+	hmac.Write(assocData)
+
+	var h [sha256.Size]byte
+	hmac.Sum(h[:0])
+	defer zero(h[:])
 
 	var mac [HMACSize]byte
 	copy(mac[:], h[:HMACSize])
@@ -39,6 +71,36 @@ func calcMac(key [keyLen]byte, msg []byte) [HMACSize]byte {
 	return mac
 }
 
+// VerifyHMAC checks, in constant time, whether mac is the valid top-level HMAC
+// of an onion packet carrying the passed routing info and associated data,
+// given the shared secret derived for the packet by the processing hop. This
+// allows the integrity of a packet to be checked independently from
+// processing it. The mu key is derived using the default key tags.
+func VerifyHMAC(sharedSecret [32]byte, routingInfo []byte, assocData []byte,
+	mac [32]byte) bool {
+
+	secret := Hash256(sharedSecret)
+	defer zero(secret[:])
+
+	return verifyHMAC(defaultKeyTags.Mu, &secret, routingInfo, assocData, mac)
+}
+
+// verifyHMAC checks whether mac is the valid top-level HMAC of an onion packet
+// carrying the passed routing info and associated data, deriving the mu key
+// from the shared secret using the passed key tag. This is the check performed
+// when processing a packet. The MACs are compared using hmac.Equal, whose
+// running time doesn't depend on their contents, so a forged MAC can't be
+// refined byte by byte using a timing oracle.
+func verifyHMAC(muTag string, sharedSecret *Hash256, routingInfo,
+	assocData []byte, mac [HMACSize]byte) bool {
+
+	muKey := generateKey(muTag, sharedSecret)
+	defer zero(muKey[:])
+
+	calculatedMac := calcHeaderMac(muKey, routingInfo, assocData)
+	return hmac.Equal(mac[:], calculatedMac[:])
+}
+
 // xor computes the byte wise XOR of a and b, storing the result in dst. Only
 // the frist `min(len(a), len(b))` bytes will be xor'd.
 func xor(dst, a, b []byte) int {
@@ -52,6 +114,94 @@ func xor(dst, a, b []byte) int {
 	return n
 }
 
+// zero overwrites the passed byte slice with zeroes. It's used to wipe shared
+// secrets and the key material derived from them once they're no longer
+// needed. The function is never inlined, so the compiler is unable to prove
+// the writes are dead and elide them. This is a best effort measure, as the
+// runtime may still have copied the contents elsewhere beforehand.
+//
+//go:noinline
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// KeyTags are the personalization strings, passed to generateKey, that the
+// keys used to construct and process an onion packet, and to encrypt the
+// errors sent back for it, are derived with. Using tags other than the ones
+// defined by BOLT 4 separates the resulting packets into their own domain, as
+// they can only be processed using the same tags.
+//
+// NOTE: The filler of the routing info is encrypted using the Rho key as well,
+// as that's the stream each hop decrypts it with, and so is the recipient data
+// of the hops of a blinded path.
+type KeyTags struct {
+	// Rho is the tag of the key used to generate the cipher stream that
+	// encrypts the routing info.
+	Rho string
+
+	// Mu is the tag of the key used to compute the HMAC of the routing
+	// info and associated data.
+	Mu string
+
+	// Um is the tag of the key used to compute the HMAC of an error sent
+	// back for the packet.
+	Um string
+
+	// Ammag is the tag of the key used to generate the cipher stream that
+	// encrypts an error sent back for the packet.
+	Ammag string
+
+	// Pad is the tag of the key derived from the session key, of which
+	// the cipher stream is the initial contents of the routing info. If
+	// empty, as it is by default, the routing info starts out zeroed, as
+	// in the test vectors of BOLT 4. As it's only used by the sender,
+	// routers needn't agree on it.
+	Pad string
+}
+
+// defaultKeyTags are the key personalization strings defined by BOLT 4.
+var defaultKeyTags = KeyTags{
+	Rho:   "rho",
+	Mu:    "mu",
+	Um:    "um",
+	Ammag: "ammag",
+}
+
+// Validate checks that the key tags, other than the optional pad tag, are
+// non-empty, and that all of them are distinct, such that they yield
+// independent keys.
+func (t KeyTags) Validate() error {
+	if t.Rho == "" || t.Mu == "" || t.Um == "" || t.Ammag == "" {
+		return fmt.Errorf("key tags must not be empty")
+	}
+
+	tags := []string{t.Rho, t.Mu, t.Um, t.Ammag}
+	if t.Pad != "" {
+		tags = append(tags, t.Pad)
+	}
+	for i := range tags {
+		for _, other := range tags[i+1:] {
+			if tags[i] == other {
+				return fmt.Errorf("key tags must be distinct, "+
+					"%q is used twice", other)
+			}
+		}
+	}
+
+	return nil
+}
+
+// orDefault returns the key tags, or the default ones if they're unset.
+func (t KeyTags) orDefault() KeyTags {
+	if t == (KeyTags{}) {
+		return defaultKeyTags
+	}
+
+	return t
+}
+
 // generateKey generates a new key for usage in Sphinx packet
 // construction/processing based off of the denoted keyType. Within Sphinx
 // various keys are used within the same onion packet for padding generation,
@@ -60,6 +210,7 @@ func generateKey(keyType string, sharedKey *Hash256) [keyLen]byte {
 	mac := hmac.New(sha256.New, []byte(keyType))
 	mac.Write(sharedKey[:])
 	h := mac.Sum(nil)
+	defer zero(h)
 
 	var key [keyLen]byte
 	copy(key[:], h[:keyLen])
@@ -71,19 +222,29 @@ func generateKey(keyType string, sharedKey *Hash256) [keyLen]byte {
 // intended to be used to encrypt a message using a one-time-pad like
 // construction.
 func generateCipherStream(key [keyLen]byte, numBytes uint) []byte {
-	var (
-		nonce [8]byte
-	)
-	cipher, err := chacha20.NewCipher(nonce[:], key[:])
-	if err != nil {
-		panic(err)
-	}
 	output := make([]byte, numBytes)
-	cipher.XORKeyStream(output, output)
+	fillCipherStream(output, key)
 
 	return output
 }
 
+// fillCipherStream is identical to generateCipherStream, but writes the stream
+// into the passed buffer, overwriting its contents, rather than allocating a
+// new one.
+func fillCipherStream(dst []byte, key [keyLen]byte) {
+	zero(dst)
+	xorCipherStream(dst, dst, key)
+}
+
+// xorCipherStream XORs the stream generated by generateCipherStream for the
+// passed key with src, writing the result into dst. The stream is never
+// materialized, so no buffer is allocated for it, and dst and src may be the
+// same slice in order to encrypt in place.
+func xorCipherStream(dst, src []byte, key [keyLen]byte) {
+	var nonce [8]byte
+	chacha20.XORKeyStream(dst, src, nonce[:], key[:])
+}
+
 // computeBlindingFactor for the next hop given the ephemeral pubKey and
 // sharedSecret for this hop. The blinding factor is computed as the
 // sha-256(pubkey || sharedSecret).
@@ -99,20 +260,75 @@ func computeBlindingFactor(hopPubKey *btcec.PublicKey,
 	return hash
 }
 
-// blindGroupElement blinds the group element P by performing scalar
-// multiplication of the group element by blindingFactor: blindingFactor * P.
-func blindGroupElement(hopPubKey *btcec.PublicKey, blindingFactor []byte) *btcec.PublicKey {
-	newX, newY := btcec.S256().ScalarMult(hopPubKey.X, hopPubKey.Y, blindingFactor[:])
-	return &btcec.PublicKey{btcec.S256(), newX, newY}
+// blindGroupElement blinds the group element P of the passed curve by
+// performing scalar multiplication of the group element by blindingFactor:
+// blindingFactor * P.
+func blindGroupElement(curve elliptic.Curve, hopPubKey *btcec.PublicKey,
+	blindingFactor []byte) *btcec.PublicKey {
+
+	newX, newY := curve.ScalarMult(hopPubKey.X, hopPubKey.Y, blindingFactor[:])
+	return &btcec.PublicKey{Curve: curve, X: newX, Y: newY}
+}
+
+// ComputeBlindingFactor computes the blinding factor of the next hop from the
+// ephemeral public key and shared secret of the current hop, exactly as done
+// when constructing and processing an onion packet: sha-256(pubkey || secret).
+func ComputeBlindingFactor(pub *btcec.PublicKey, secret [32]byte) [32]byte {
+	return computeBlindingFactor(pub, secret[:])
 }
 
-// blindBaseElement blinds the groups's generator G by performing scalar base
-// multiplication using the blindingFactor: blindingFactor * G.
-func blindBaseElement(blindingFactor []byte) *btcec.PublicKey {
-	newX, newY := btcec.S256().ScalarBaseMult(blindingFactor)
-	return &btcec.PublicKey{btcec.S256(), newX, newY}
+// BlindGroupElement blinds the passed public key by multiplying it by the
+// blinding factor. Together with ComputeBlindingFactor, this yields the
+// ephemeral key of the next hop from that of the current hop, exactly as done
+// when processing an onion packet. The group operation is performed over the
+// curve of the public key, or secp256k1 if it doesn't specify one.
+func BlindGroupElement(pub *btcec.PublicKey,
+	blindingFactor [32]byte) *btcec.PublicKey {
+
+	curve := pub.Curve
+	if curve == nil {
+		curve = btcec.S256()
+	}
+
+	return blindGroupElement(curve, pub, blindingFactor[:])
 }
 
+// blindBaseElement blinds the generator G of the passed curve by performing
+// scalar base multiplication using the blindingFactor: blindingFactor * G.
+func blindBaseElement(curve elliptic.Curve,
+	blindingFactor []byte) *btcec.PublicKey {
+
+	newX, newY := curve.ScalarBaseMult(blindingFactor)
+	return &btcec.PublicKey{Curve: curve, X: newX, Y: newY}
+}
+
+// ECDHer is an interface that abstracts away the ECDH operation performed with
+// a node's onion key, such that the private key itself doesn't need to be
+// handed to the Router.
+type ECDHer interface {
+	// ECDH performs an ECDH operation between the passed public key and
+	// the underlying private key. The returned secret is the SHA256 of the
+	// compressed serialization of the resulting point.
+	ECDH(pub *btcec.PublicKey) ([32]byte, error)
+}
+
+// PrivKeyECDH is an ECDHer backed by an in-memory private key.
+type PrivKeyECDH struct {
+	// PrivKey is the private key used to perform the ECDH operations.
+	PrivKey *btcec.PrivateKey
+}
+
+// ECDH performs an ECDH operation between the passed public key and the
+// private key, returning the SHA256 of the resulting point.
+//
+// NOTE: This is part of the ECDHer interface.
+func (p *PrivKeyECDH) ECDH(pub *btcec.PublicKey) ([32]byte, error) {
+	return generateSharedSecret(pub, p.PrivKey), nil
+}
+
+// A compile time assertion that *PrivKeyECDH implements the ECDHer interface.
+var _ ECDHer = (*PrivKeyECDH)(nil)
+
 // sharedSecretGenerator is an interface that abstracts away exactly *how* the
 // shared secret for each hop is generated.
 //
@@ -127,14 +343,42 @@ type sharedSecretGenerator interface {
 func (r *Router) generateSharedSecret(dhKey *btcec.PublicKey) (Hash256, error) {
 	var sharedSecret Hash256
 
-	// Ensure that the public key is on our curve.
-	if !btcec.S256().IsOnCurve(dhKey.X, dhKey.Y) {
-		return sharedSecret, ErrInvalidOnionKey
+	// Ensure that the public key is a valid point on our curve.
+	if err := validateEphemeralKey(r.curve, dhKey); err != nil {
+		return sharedSecret, err
 	}
 
 	// Compute our shared secret.
-	sharedSecret = generateSharedSecret(dhKey, r.onionKey)
-	return sharedSecret, nil
+	return r.onionKey.ECDH(dhKey)
+}
+
+// validateEphemeralKey ensures that the ephemeral key of a packet is a valid
+// point on the passed curve, rejecting missing keys, the point at infinity and
+// coordinates outside of the field before any ECDH operation is performed
+// with it.
+func validateEphemeralKey(curve elliptic.Curve, key *btcec.PublicKey) error {
+	if key == nil || key.X == nil || key.Y == nil {
+		return ErrInvalidEphemeralKey
+	}
+
+	// The point at infinity has no affine coordinates, and is commonly
+	// represented by all zeroes.
+	if key.X.Sign() == 0 && key.Y.Sign() == 0 {
+		return ErrInvalidEphemeralKey
+	}
+
+	p := curve.Params().P
+	if key.X.Sign() < 0 || key.Y.Sign() < 0 ||
+		key.X.Cmp(p) >= 0 || key.Y.Cmp(p) >= 0 {
+
+		return ErrInvalidEphemeralKey
+	}
+
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return ErrInvalidEphemeralKey
+	}
+
+	return nil
 }
 
 // generateSharedSecret generates the shared secret for a particular hop. The
@@ -142,10 +386,11 @@ func (r *Router) generateSharedSecret(dhKey *btcec.PublicKey) (Hash256, error) {
 // mix-header, and performing an ECDH operation with the node's long term onion
 // key. We then take the _entire_ point generated by the ECDH operation,
 // serialize that using a compressed format, then feed the raw bytes through a
-// single SHA256 invocation.  The resulting value is the shared secret.
+// single SHA256 invocation.  The resulting value is the shared secret. The
+// operation is performed over the curve of the private key.
 func generateSharedSecret(pub *btcec.PublicKey, priv *btcec.PrivateKey) Hash256 {
 	s := &btcec.PublicKey{}
-	s.X, s.Y = btcec.S256().ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+	s.X, s.Y = priv.Curve.ScalarMult(pub.X, pub.Y, priv.D.Bytes())
 
 	return sha256.Sum256(s.SerializeCompressed())
 }
@@ -153,12 +398,13 @@ func generateSharedSecret(pub *btcec.PublicKey, priv *btcec.PrivateKey) Hash256
 // onionEncrypt obfuscates the data with compliance with BOLT#4. As we use a
 // stream cipher, calling onionEncrypt on an already encrypted piece of data
 // will decrypt it.
-func onionEncrypt(sharedSecret *Hash256, data []byte) []byte {
+func onionEncrypt(ammagTag string, sharedSecret *Hash256, data []byte) []byte {
 	p := make([]byte, len(data))
 
-	ammagKey := generateKey("ammag", sharedSecret)
-	streamBytes := generateCipherStream(ammagKey, uint(len(data)))
-	xor(p, data, streamBytes)
+	ammagKey := generateKey(ammagTag, sharedSecret)
+	defer zero(ammagKey[:])
+
+	xorCipherStream(p, data, ammagKey)
 
 	return p
 }
@@ -175,8 +421,8 @@ const onionErrorLength = 2 + 2 + 256 + sha256.Size
 func (o *OnionErrorDecrypter) DecryptError(encryptedData []byte) (*btcec.PublicKey, []byte, error) {
 	// Ensure the error message length is as expected.
 	if len(encryptedData) != onionErrorLength {
-		return nil, nil, fmt.Errorf("invalid error length: "+
-			"expected %v got %v", onionErrorLength,
+		return nil, nil, fmt.Errorf("%w: expected %v got %v",
+			ErrInvalidErrorLength, onionErrorLength,
 			len(encryptedData))
 	}
 
@@ -189,6 +435,7 @@ func (o *OnionErrorDecrypter) DecryptError(encryptedData []byte) (*btcec.PublicK
 		sender      *btcec.PublicKey
 		msg         []byte
 		dummySecret Hash256
+		keyTags     = o.keyTags.orDefault()
 	)
 	copy(dummySecret[:], bytes.Repeat([]byte{1}, 32))
 
@@ -210,7 +457,9 @@ func (o *OnionErrorDecrypter) DecryptError(encryptedData []byte) (*btcec.PublicK
 
 		// With the shared secret, we'll now strip off a layer of
 		// encryption from the encrypted error payload.
-		encryptedData = onionEncrypt(&sharedSecret, encryptedData)
+		encryptedData = onionEncrypt(
+			keyTags.Ammag, &sharedSecret, encryptedData,
+		)
 
 		// Next, we'll need to separate the data, from the MAC itself
 		// so we can reconstruct and verify it.
@@ -219,7 +468,7 @@ func (o *OnionErrorDecrypter) DecryptError(encryptedData []byte) (*btcec.PublicK
 
 		// With the data split, we'll now re-generate the MAC using its
 		// specified key.
-		umKey := generateKey("um", &sharedSecret)
+		umKey := generateKey(keyTags.Um, &sharedSecret)
 		h := hmac.New(sha256.New, umKey[:])
 		h.Write(data)
 
@@ -235,7 +484,7 @@ func (o *OnionErrorDecrypter) DecryptError(encryptedData []byte) (*btcec.PublicK
 	// If the sender pointer is still nil, then we haven't found the
 	// sender, meaning we've failed to decrypt.
 	if sender == nil {
-		return nil, nil, errors.New("unable to retrieve onion failure")
+		return nil, nil, ErrUnreadableFailure
 	}
 
 	return sender, msg, nil
@@ -253,13 +502,14 @@ func (o *OnionErrorDecrypter) DecryptError(encryptedData []byte) (*btcec.PublicK
 // away to the nodes in the payment path the information about the exact
 // failure and its origin.
 func (o *OnionErrorEncrypter) EncryptError(initial bool, data []byte) []byte {
+	keyTags := o.keyTags.orDefault()
 	if initial {
-		umKey := generateKey("um", &o.sharedSecret)
+		umKey := generateKey(keyTags.Um, &o.sharedSecret)
 		hash := hmac.New(sha256.New, umKey[:])
 		hash.Write(data)
 		h := hash.Sum(nil)
 		data = append(h, data...)
 	}
 
-	return onionEncrypt(&o.sharedSecret, data)
+	return onionEncrypt(keyTags.Ammag, &o.sharedSecret, data)
 }
@@ -21,7 +21,265 @@ var (
 	ErrInvalidOnionKey = fmt.Errorf("invalid onion key: pubkey isn't on " +
 		"secp256k1 curve")
 
+	// ErrInvalidEphemeralKey is returned during onion parsing process, when
+	// the ephemeral key of the packet is missing, the point at infinity, or
+	// otherwise not a valid point on the router's curve. It wraps
+	// ErrInvalidOnionKey, so callers matching the latter to send an
+	// invalid_onion_key failure keep doing so.
+	ErrInvalidEphemeralKey error = &refinedError{
+		msg: "invalid ephemeral key: pubkey isn't a valid " +
+			"curve point",
+		parent: ErrInvalidOnionKey,
+	}
+
+	// ErrInvalidBlindingPoint is returned during onion parsing process,
+	// when the blinding point of a blinded hop is invalid.
+	ErrInvalidBlindingPoint = fmt.Errorf("invalid blinding point: pubkey " +
+		"isn't on secp256k1 curve")
+
+	// ErrInvalidRoutingInfoSize is returned during onion parsing process,
+	// when the size of the received routing info doesn't match the size
+	// the router is configured for.
+	ErrInvalidRoutingInfoSize = fmt.Errorf("invalid routing info size")
+
+	// ErrPacketTooSmall is returned during decoding of the onion packet,
+	// when the reader doesn't supply enough bytes for a full packet.
+	ErrPacketTooSmall = fmt.Errorf("onion packet is too small")
+
+	// ErrPacketWrongSize is returned during decoding of the onion packet,
+	// when the reader holds more bytes than the expected packet size.
+	ErrPacketWrongSize = fmt.Errorf("onion packet has wrong size")
+
+	// ErrInvalidPaymentHashLength is returned when processing an onion
+	// packet using the ExpectPaymentHash option, when the associated data
+	// passed in isn't the size of a payment hash.
+	ErrInvalidPaymentHashLength = fmt.Errorf("associated data isn't a " +
+		"valid payment hash")
+
+	// ErrRouterStopped is returned when attempting to process onion
+	// packets using a router which was stopped.
+	ErrRouterStopped = fmt.Errorf("router stopped")
+
+	// ErrInvalidRouterOption is returned when starting a router created
+	// with an invalid option, and when processing onion packets using it.
+	ErrInvalidRouterOption = fmt.Errorf("invalid router option")
+
 	// ErrLogEntryNotFound is an error returned when a packet lookup in a replay
 	// log fails because it is missing.
 	ErrLogEntryNotFound = fmt.Errorf("sphinx packet is not in log")
+
+	// ErrReplayLogBusy is returned by a ThrottledReplayLog, when too many
+	// writes to the wrapped log are already in flight to accept another
+	// one. It's transient, so the packet can be processed again once the
+	// backlog of writes cleared.
+	ErrReplayLogBusy = fmt.Errorf("replay log busy")
+
+	// ErrMaxRoutingInfoSizeExceeded is returned during onion construction,
+	// when the combined size of the hop payloads doesn't fit within the
+	// routing info.
+	ErrMaxRoutingInfoSizeExceeded = fmt.Errorf(
+		"max routing info size of %v bytes exceeded", routingInfoSize)
+
+	// ErrPayloadTooLarge is returned during onion parsing process, when a
+	// hop payload claims to be larger than the routing info carrying it.
+	ErrPayloadTooLarge = fmt.Errorf("hop payload exceeds max payload "+
+		"size of %v bytes", MaxPayloadSize)
+
+	// ErrHopPayloadTooLarge is returned when constructing or processing an
+	// onion packet using a custom OnionPacketConfig, when a hop payload
+	// exceeds the payload size the config reserves for each hop.
+	ErrHopPayloadTooLarge = fmt.Errorf("hop payload exceeds per-hop " +
+		"payload size")
+
+	// ErrAmbiguousPayload is returned during onion parsing process by a
+	// router configured using WithAmbiguousPayloadRejection, when the
+	// framing of a hop payload parses both as a legacy payload and as an
+	// empty TLV payload, so it can't be told whether the packet is to be
+	// forwarded or terminates at this hop.
+	ErrAmbiguousPayload = fmt.Errorf("ambiguous hop payload framing")
+
+	// ErrInvalidTLVPayload is returned when decoding a TLV hop payload
+	// which isn't validly encoded, or lacks one of the required records.
+	ErrInvalidTLVPayload = fmt.Errorf("invalid tlv hop payload")
+
+	// ErrUnknownEvenTLVType is returned during onion parsing process by a
+	// router configured to validate TLV payloads using TLVStrict, when a
+	// payload carries a record of an even type it doesn't know. Such
+	// records must be understood by the hop, as even types are mandatory.
+	ErrUnknownEvenTLVType = fmt.Errorf("%w: unknown even record type",
+		ErrInvalidTLVPayload)
+
+	// ErrUnknownPayloadType is returned when parsing the forwarding info
+	// of a hop payload of an unknown type.
+	ErrUnknownPayloadType = fmt.Errorf("unknown payload type")
+
+	// ErrMissingShortChannelID is returned when parsing the forwarding
+	// info of an intermediate hop of which the TLV payload doesn't carry
+	// the short channel ID of the next hop.
+	ErrMissingShortChannelID = fmt.Errorf("tlv payload of intermediate " +
+		"hop lacks a short channel id")
+
+	// ErrInvalidRoute is returned when constructing an onion packet for a
+	// route which is empty, exceeds the maximum number of hops, or doesn't
+	// carry exactly one payload per hop.
+	ErrInvalidRoute = fmt.Errorf("invalid route")
+
+	// ErrInvalidRendezvous is returned when processing an onion packet of
+	// which the hop payload carries a malformed rendezvous record.
+	ErrInvalidRendezvous = fmt.Errorf("invalid rendezvous record")
+
+	// ErrSelfLoop is returned when processing an onion packet of which the
+	// packet for the next hop is addressed to ourselves, which would have
+	// us forward it to ourselves in a loop.
+	ErrSelfLoop = fmt.Errorf("onion packet loops back to us")
+
+	// ErrInvalidBatch is returned when processing a batch of onion
+	// packets which doesn't come with exactly one associated data entry
+	// and incoming CLTV per packet, or holds too many packets.
+	ErrInvalidBatch = fmt.Errorf("invalid batch of onion packets")
+
+	// ErrInvalidBlindedPath is returned when decoding a blinded path which
+	// isn't validly encoded.
+	ErrInvalidBlindedPath = fmt.Errorf("invalid blinded path")
+
+	// ErrInvalidBlindedData is returned when the recipient data of a hop
+	// within a blinded path fails to decrypt, as it was tampered with or
+	// encrypted for another hop.
+	ErrInvalidBlindedData = fmt.Errorf("invalid blinded hop data")
+
+	// ErrInvalidMessagePart is returned when creating, decoding or
+	// reassembling the parts of a message split across multiple onion
+	// packets which are inconsistent.
+	ErrInvalidMessagePart = fmt.Errorf("invalid message part")
+
+	// ErrInvalidErrorLength is returned when decrypting an onion error
+	// which isn't of the expected length.
+	ErrInvalidErrorLength = fmt.Errorf("invalid error length")
+
+	// ErrRouteMismatch is returned when validating an onion packet
+	// against the route it's expected to take, and the packet doesn't
+	// deliver the expected payloads to the nodes of the route.
+	ErrRouteMismatch = fmt.Errorf("onion packet doesn't match route")
+
+	// ErrUnreadableFailure is returned when an onion error couldn't be
+	// attributed to any of the hops in the route, as none of their
+	// shared secrets yields a valid HMAC.
+	ErrUnreadableFailure = fmt.Errorf("unable to retrieve onion failure")
+)
+
+// ProcessingStage denotes the stage of onion packet processing at which a
+// packet was rejected.
+type ProcessingStage uint8
+
+const (
+	// StageVersion denotes a packet rejected for being of an unknown
+	// version, or for not matching the geometry the router expects.
+	StageVersion ProcessingStage = iota
+
+	// StageECDH denotes a packet of which the shared secret couldn't be
+	// derived, for instance due to an invalid ephemeral key.
+	StageECDH
+
+	// StageHMAC denotes a packet of which the HMAC didn't match.
+	StageHMAC
+
+	// StageReplay denotes a packet which was rejected by the replay log,
+	// usually for being a replay of a previously processed packet.
+	StageReplay
+
+	// StagePayload denotes a packet of which the decrypted hop payload
+	// couldn't be parsed.
+	StagePayload
 )
+
+// String returns a human readable description of the processing stage.
+func (s ProcessingStage) String() string {
+	switch s {
+	case StageVersion:
+		return "version"
+	case StageECDH:
+		return "ecdh"
+	case StageHMAC:
+		return "hmac"
+	case StageReplay:
+		return "replay"
+	case StagePayload:
+		return "payload"
+	default:
+		return "unknown"
+	}
+}
+
+// refinedError is a sentinel error that refines a more general one, such that
+// errors.Is matches both, while carrying a message of its own.
+type refinedError struct {
+	msg    string
+	parent error
+}
+
+// Error returns the message of the refined error.
+func (e *refinedError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the more general error being refined.
+func (e *refinedError) Unwrap() error {
+	return e.parent
+}
+
+// ProcessingError is returned by the Router's packet processing methods, such
+// as ProcessOnionPacket, when a packet is rejected. It identifies the stage at
+// which processing failed, which allows callers to pick a matching failure
+// code, while the underlying cause can still be inspected using errors.Is.
+type ProcessingError struct {
+	// Stage is the stage of processing at which the packet was rejected.
+	Stage ProcessingStage
+
+	// Err is the underlying cause of the failure.
+	Err error
+}
+
+// Error returns a human readable description of the failure.
+func (e *ProcessingError) Error() string {
+	return fmt.Sprintf("onion processing failed at %v stage: %v", e.Stage,
+		e.Err)
+}
+
+// Unwrap returns the underlying cause of the failure.
+func (e *ProcessingError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned by ProcessOnionPackets when configured using
+// WithIsolatedBatchFailures, and some of the packets within the batch failed
+// processing while the remainder of the batch was processed.
+type BatchError struct {
+	// Errors is index-aligned with the batch, and holds the error each of
+	// the failed packets was rejected with. The entries of the packets
+	// that didn't fail are nil.
+	Errors []error
+}
+
+// Error returns a human readable description of the first failure.
+func (e *BatchError) Error() string {
+	var (
+		numFailed int
+		first     = -1
+	)
+	for i, err := range e.Errors {
+		if err == nil {
+			continue
+		}
+		if first == -1 {
+			first = i
+		}
+		numFailed++
+	}
+	if first == -1 {
+		return "no packets in batch failed processing"
+	}
+
+	return fmt.Sprintf("%d of %d packets in batch failed processing, "+
+		"packet %d: %v", numFailed, len(e.Errors), first,
+		e.Errors[first])
+}
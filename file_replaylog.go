@@ -0,0 +1,456 @@
+package sphinx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileReplayRecordSize is the size of a single record within the file of a
+// FileReplayLog: the hash prefix of a packet followed by its CLTV expiry.
+const fileReplayRecordSize = HashPrefixSize + 4
+
+// FileReplayLog is a ReplayLog implementation that keeps all hash prefixes in
+// memory, while appending each accepted prefix to a write-ahead log file. The
+// file is read back into memory when the log is started, such that replay
+// protection survives a restart of the process. This is a middle ground
+// between the MemoryReplayLog and the BoltReplayLog.
+//
+// Each record is the 20-byte hash prefix followed by the big-endian CLTV
+// expiry, and is fsync'd before Put returns. As records are only ever
+// appended, entries pruned by DeleteStale remain in the file until it grows
+// beyond the compaction threshold, at which point it's rewritten to hold the
+// non-expired entries only. Until then, pruned entries are read back upon a
+// restart, which is harmless as they're pruned again by the next call to
+// DeleteStale. Entries removed using Delete are persisted by rewriting the
+// file right away.
+//
+// NOTE: Only the hash prefixes are persisted. The replay sets of committed
+// batches are kept in memory, so a batch is only idempotent within a single
+// run. Reprocessing it after a restart flags all of its entries as replays.
+type FileReplayLog struct {
+	path string
+
+	// compactThreshold is the size in bytes beyond which the file is
+	// compacted. A non-positive value disables size based compaction.
+	compactThreshold int64
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	entries map[HashPrefix]uint32
+	batches map[string]batchRecord
+}
+
+// NewFileReplayLog creates a new FileReplayLog which appends its entries to
+// the file at path, compacting it once it grows beyond compactThreshold
+// bytes. The file is created if it does not exist once the log is started.
+func NewFileReplayLog(path string, compactThreshold int64) *FileReplayLog {
+	return &FileReplayLog{
+		path:             path,
+		compactThreshold: compactThreshold,
+	}
+}
+
+// A compile time check to ensure FileReplayLog adheres to the ReplayLog
+// interface.
+var _ ReplayLog = (*FileReplayLog)(nil)
+
+// Start opens the file, and reads the entries it contains into memory. A
+// truncated trailing record, as left behind by a crash during a write, is
+// discarded.
+func (rl *FileReplayLog) Start() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.file != nil {
+		return errReplayLogAlreadyStarted
+	}
+
+	file, err := os.OpenFile(
+		rl.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, dbPermissions,
+	)
+	if err != nil {
+		return err
+	}
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	entries := make(map[HashPrefix]uint32)
+	numRecords := len(contents) / fileReplayRecordSize
+	for i := 0; i < numRecords; i++ {
+		var hashPrefix HashPrefix
+		record := contents[i*fileReplayRecordSize:]
+		copy(hashPrefix[:], record[:HashPrefixSize])
+
+		// An entry that was pruned before the file was compacted may
+		// have been added again afterwards, in which case the latest
+		// record takes precedence.
+		entries[hashPrefix] = binary.BigEndian.Uint32(
+			record[HashPrefixSize:fileReplayRecordSize],
+		)
+	}
+
+	size := int64(numRecords * fileReplayRecordSize)
+	if size != int64(len(contents)) {
+		if err := file.Truncate(size); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	rl.file = file
+	rl.size = size
+	rl.entries = entries
+	rl.batches = make(map[string]batchRecord)
+
+	return nil
+}
+
+// Stop closes the file, and wipes the in-memory state of the log.
+func (rl *FileReplayLog) Stop() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.file == nil {
+		return errReplayLogNotStarted
+	}
+
+	err := rl.file.Close()
+	rl.file = nil
+	rl.entries = nil
+	rl.batches = nil
+
+	return err
+}
+
+// Get retrieves an entry from the log given its hash prefix. It returns the
+// value stored and an error if one occurs. It returns ErrLogEntryNotFound
+// if the entry is not in the log.
+func (rl *FileReplayLog) Get(hash *HashPrefix) (uint32, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.file == nil {
+		return 0, errReplayLogNotStarted
+	}
+
+	cltv, ok := rl.entries[*hash]
+	if !ok {
+		return 0, ErrLogEntryNotFound
+	}
+
+	return cltv, nil
+}
+
+// Put stores an entry into the log given its hash prefix and an accompanying
+// purposefully general type. It returns ErrReplayedPacket if the provided hash
+// prefix already exists in the log. The entry is only added once it has been
+// durably appended to the file. As the entry is recorded by then, a failure to
+// compact the file afterwards doesn't fail the write, and compaction is
+// retried upon the next append or call to DeleteStale.
+func (rl *FileReplayLog) Put(hash *HashPrefix, cltv uint32) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.file == nil {
+		return errReplayLogNotStarted
+	}
+
+	if _, ok := rl.entries[*hash]; ok {
+		return ErrReplayedPacket
+	}
+
+	var record [fileReplayRecordSize]byte
+	encodeFileReplayRecord(record[:], hash, cltv)
+	if err := rl.append(record[:]); err != nil {
+		return err
+	}
+	rl.entries[*hash] = cltv
+
+	// The entry was durably recorded, so failing the write now would
+	// have it rejected as a replay upon a retry.
+	_ = rl.maybeCompact()
+
+	return nil
+}
+
+// Delete deletes an entry from the log given its hash prefix. If rewriting the
+// file fails, the entry is kept, such that the log still matches the file.
+func (rl *FileReplayLog) Delete(hash *HashPrefix) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.file == nil {
+		return errReplayLogNotStarted
+	}
+
+	cltv, ok := rl.entries[*hash]
+	if !ok {
+		return nil
+	}
+	delete(rl.entries, *hash)
+
+	if err := rl.compact(); err != nil {
+		rl.entries[*hash] = cltv
+		return err
+	}
+
+	return nil
+}
+
+// DeleteStale deletes all entries from the log of which the stored CLTV expiry
+// is below the passed height, along with the batches all of whose entries are
+// stale, compacting the file if it grew beyond the compaction threshold. It
+// returns the number of entries deleted.
+func (rl *FileReplayLog) DeleteStale(height uint32) (int, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.file == nil {
+		return 0, errReplayLogNotStarted
+	}
+
+	var numDeleted int
+	for hash, cltv := range rl.entries {
+		if cltv < height {
+			delete(rl.entries, hash)
+			numDeleted++
+		}
+	}
+	deleteStaleBatches(rl.batches, height)
+
+	return numDeleted, rl.maybeCompact()
+}
+
+// PutBatch stores a batch of sphinx packets into the log given their hash
+// prefixes and accompanying values, appending all of them to the file in a
+// single write. Returns the set of entries in the batch that are replays and
+// an error if one occurs. Just like for Put, a failure to compact the file
+// once the batch was appended doesn't fail it.
+func (rl *FileReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.file == nil {
+		return nil, errReplayLogNotStarted
+	}
+
+	// Return the result when the batch was first processed to provide
+	// idempotence.
+	record, ok := rl.batches[string(batch.ID)]
+	if ok && len(batch.ID) != 0 {
+		batch.ReplaySet = record.replays
+		batch.IsCommitted = true
+
+		return record.replays, nil
+	}
+
+	replays := NewReplaySet()
+	var (
+		records bytes.Buffer
+		added   = make(map[HashPrefix]uint32)
+	)
+	err := batch.ForEach(func(seqNum uint16, hashPrefix *HashPrefix,
+		cltv uint32) error {
+
+		if _, ok := rl.entries[*hashPrefix]; ok {
+			replays.Add(seqNum)
+			return nil
+		}
+
+		var record [fileReplayRecordSize]byte
+		encodeFileReplayRecord(record[:], hashPrefix, cltv)
+		records.Write(record[:])
+		added[*hashPrefix] = cltv
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if records.Len() > 0 {
+		if err := rl.append(records.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	for hashPrefix, cltv := range added {
+		rl.entries[hashPrefix] = cltv
+	}
+
+	replays.Merge(batch.ReplaySet)
+	if len(batch.ID) != 0 {
+		rl.batches[string(batch.ID)] = batchRecord{
+			replays: replays,
+			expiry:  batch.expiry(),
+		}
+	}
+
+	batch.ReplaySet = replays
+	batch.IsCommitted = true
+
+	// The batch was durably recorded, so compaction is left to be retried
+	// upon a failure.
+	_ = rl.maybeCompact()
+
+	return replays, nil
+}
+
+// Stats returns the number of entries stored in the log, along with the lowest
+// CLTV expiry among them. Pruned entries still present in the file aren't
+// counted.
+func (rl *FileReplayLog) Stats() (int, uint32, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.file == nil {
+		return 0, 0, errReplayLogNotStarted
+	}
+
+	count, oldestCLTV := entryStats(rl.entries)
+	return count, oldestCLTV, nil
+}
+
+// ForEach calls the passed function with the hash prefix and CLTV expiry of
+// each entry stored in the log, stopping at the first error it returns.
+// Pruned entries still present in the file are skipped.
+func (rl *FileReplayLog) ForEach(fn func(hash *HashPrefix,
+	cltv uint32) error) error {
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.file == nil {
+		return errReplayLogNotStarted
+	}
+
+	return forEachEntry(rl.entries, fn)
+}
+
+// encodeFileReplayRecord writes the record for the passed entry into b, which
+// must be fileReplayRecordSize bytes long.
+func encodeFileReplayRecord(b []byte, hash *HashPrefix, cltv uint32) {
+	copy(b[:HashPrefixSize], hash[:])
+	binary.BigEndian.PutUint32(b[HashPrefixSize:], cltv)
+}
+
+// append durably appends the passed records to the file. If writing fails,
+// any partially written record is discarded again.
+//
+// NOTE: This method must be called with the log's mutex held.
+func (rl *FileReplayLog) append(records []byte) error {
+	if _, err := rl.file.Write(records); err != nil {
+		rl.file.Truncate(rl.size)
+		return err
+	}
+	if err := rl.file.Sync(); err != nil {
+		rl.file.Truncate(rl.size)
+		return err
+	}
+
+	rl.size += int64(len(records))
+
+	return nil
+}
+
+// maybeCompact compacts the file if it grew beyond the compaction threshold,
+// and holds records other than the live entries. Once the live entries alone
+// exceed the threshold, the file is only compacted again once entries were
+// pruned, which avoids rewriting it upon every append.
+//
+// NOTE: This method must be called with the log's mutex held.
+func (rl *FileReplayLog) maybeCompact() error {
+	if rl.compactThreshold <= 0 || rl.size <= rl.compactThreshold {
+		return nil
+	}
+	if rl.size == int64(len(rl.entries)*fileReplayRecordSize) {
+		return nil
+	}
+
+	return rl.compact()
+}
+
+// compact rewrites the file to hold only the live entries. The entries are
+// first written to a temporary file, which then atomically replaces the
+// current one, such that a crash during compaction leaves either file intact.
+// The temporary file is opened for appending up front, and kept open across
+// the rename, so the log never ends up without a file to append to. If the
+// temporary file can't be written or renamed, the current file is kept.
+//
+// NOTE: This method must be called with the log's mutex held.
+func (rl *FileReplayLog) compact() error {
+	tempPath := rl.path + ".tmp"
+	tempFile, err := os.OpenFile(
+		tempPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND,
+		dbPermissions,
+	)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tempFile)
+	err = writeFileReplayRecords(w, rl.entries)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tempPath, rl.path)
+	}
+	if err != nil {
+		tempFile.Close()
+		os.Remove(tempPath)
+		return err
+	}
+
+	// With the compacted file in place, continue appending to it.
+	rl.file.Close()
+	rl.file = tempFile
+	rl.size = int64(len(rl.entries) * fileReplayRecordSize)
+
+	// The rename is only durable once the directory holding the file has
+	// been synced as well.
+	return syncDir(filepath.Dir(rl.path))
+}
+
+// syncDir fsyncs the directory at the passed path, which persists the entries
+// of the files within it, such as those renamed into it.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// writeFileReplayRecords writes a record for each of the passed entries to w.
+func writeFileReplayRecords(w io.Writer, entries map[HashPrefix]uint32) error {
+	var record [fileReplayRecordSize]byte
+	for hashPrefix, cltv := range entries {
+		hashPrefix := hashPrefix
+		encodeFileReplayRecord(record[:], &hashPrefix, cltv)
+		if _, err := w.Write(record[:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,395 @@
+package sphinx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestFileReplayLog creates a FileReplayLog backed by a file within a
+// fresh temporary directory. The returned cleanup closure removes the
+// directory.
+func newTestFileReplayLog(t *testing.T,
+	compactThreshold int64) (*FileReplayLog, string, func()) {
+
+	tempDir, err := ioutil.TempDir("", "sphinxreplaylog")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+
+	path := filepath.Join(tempDir, "replay.log")
+	rl := NewFileReplayLog(path, compactThreshold)
+
+	return rl, path, func() {
+		os.RemoveAll(tempDir)
+	}
+}
+
+// fileSize returns the size of the file at path.
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unable to stat file: %v", err)
+	}
+
+	return info.Size()
+}
+
+// TestFileReplayLogRestart asserts that the entries of a FileReplayLog survive
+// a restart, and that a truncated trailing record is discarded.
+func TestFileReplayLogRestart(t *testing.T) {
+	rl, path, cleanup := newTestFileReplayLog(t, 0)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+
+	var hashPrefixes [3]HashPrefix
+	for i := range hashPrefixes {
+		hashPrefixes[i][0] = byte(i)
+	}
+
+	if err := rl.Put(&hashPrefixes[0], 10); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	batch := NewBatch([]byte{1})
+	batch.Put(0, &hashPrefixes[0], 10)
+	batch.Put(1, &hashPrefixes[1], 11)
+	replays, err := rl.PutBatch(batch)
+	if err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+	if replays.Size() != 1 || !replays.Contains(0) {
+		t.Fatalf("expected replay set to only contain index 0")
+	}
+
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+
+	// Simulate a crash midway through appending a record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("unable to open file: %v", err)
+	}
+	if _, err := f.Write(hashPrefixes[2][:5]); err != nil {
+		t.Fatalf("unable to write to file: %v", err)
+	}
+	f.Close()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to restart replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	if size := fileSize(t, path); size != 2*fileReplayRecordSize {
+		t.Fatalf("expected truncated record to be discarded, file "+
+			"is %d bytes", size)
+	}
+	for i, cltv := range []uint32{10, 11} {
+		stored, err := rl.Get(&hashPrefixes[i])
+		if err != nil {
+			t.Fatalf("entry %d should survive restart: %v", i, err)
+		}
+		if stored != cltv {
+			t.Fatalf("entry %d has cltv %d, expected %d", i, stored,
+				cltv)
+		}
+		err = rl.Put(&hashPrefixes[i], cltv)
+		if err != ErrReplayedPacket {
+			t.Fatalf("expected entry %d to be a replay, got: %v", i,
+				err)
+		}
+	}
+	if _, err := rl.Get(&hashPrefixes[2]); err != ErrLogEntryNotFound {
+		t.Fatalf("truncated entry shouldn't be present: %v", err)
+	}
+	if err := rl.Put(&hashPrefixes[2], 12); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+
+	// Deleting an entry should persist across a restart.
+	if err := rl.Delete(&hashPrefixes[0]); err != nil {
+		t.Fatalf("unable to delete entry: %v", err)
+	}
+	rl.Stop()
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to restart replay log: %v", err)
+	}
+	if _, err := rl.Get(&hashPrefixes[0]); err != ErrLogEntryNotFound {
+		t.Fatalf("deleted entry shouldn't be present: %v", err)
+	}
+}
+
+// TestFileReplayLogCompaction asserts that the file of a FileReplayLog is
+// rewritten to only hold the non-expired entries once it grows beyond the
+// compaction threshold.
+func TestFileReplayLogCompaction(t *testing.T) {
+	const threshold = 4 * fileReplayRecordSize
+
+	rl, path, cleanup := newTestFileReplayLog(t, threshold)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	var hashPrefixes [6]HashPrefix
+	for i := 0; i < 4; i++ {
+		hashPrefixes[i][0] = byte(i)
+		if err := rl.Put(&hashPrefixes[i], uint32(i)*10); err != nil {
+			t.Fatalf("unable to put entry %d: %v", i, err)
+		}
+	}
+
+	// Pruning the entries with a CLTV of 0 and 10 shouldn't rewrite the
+	// file yet, as it doesn't exceed the threshold.
+	if _, err := rl.DeleteStale(20); err != nil {
+		t.Fatalf("unable to delete stale entries: %v", err)
+	}
+	if size := fileSize(t, path); size != threshold {
+		t.Fatalf("expected file of %d bytes, got %d", threshold, size)
+	}
+
+	// Growing beyond the threshold should compact the file, leaving only
+	// the three live entries.
+	hashPrefixes[4][0] = 4
+	if err := rl.Put(&hashPrefixes[4], 40); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if size := fileSize(t, path); size != 3*fileReplayRecordSize {
+		t.Fatalf("expected compacted file of %d bytes, got %d",
+			3*fileReplayRecordSize, size)
+	}
+
+	// Appending continues on top of the compacted file, and all live
+	// entries survive a restart.
+	hashPrefixes[5][0] = 5
+	if err := rl.Put(&hashPrefixes[5], 50); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	rl.Stop()
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to restart replay log: %v", err)
+	}
+	for i := range hashPrefixes {
+		_, err := rl.Get(&hashPrefixes[i])
+		switch {
+		case i < 2 && err != ErrLogEntryNotFound:
+			t.Fatalf("entry %d should have been pruned: %v", i, err)
+		case i >= 2 && err != nil:
+			t.Fatalf("entry %d should have been kept: %v", i, err)
+		}
+	}
+}
+
+// TestFileReplayLogDeleteFailure asserts that an entry is kept if rewriting the
+// file to delete it fails, and that the log keeps working afterwards.
+func TestFileReplayLogDeleteFailure(t *testing.T) {
+	rl, path, cleanup := newTestFileReplayLog(t, 0)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	var hashPrefixes [2]HashPrefix
+	hashPrefixes[1][0] = 1
+	if err := rl.Put(&hashPrefixes[0], 10); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+
+	// A directory in place of the temporary file fails the rewrite.
+	if err := os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	if err := rl.Delete(&hashPrefixes[0]); err == nil {
+		t.Fatalf("expected delete to fail")
+	}
+	if _, err := rl.Get(&hashPrefixes[0]); err != nil {
+		t.Fatalf("entry lost after failed delete: %v", err)
+	}
+
+	// Once the rewrite succeeds, the entry is gone, and the log appends
+	// to the compacted file.
+	if err := os.Remove(path + ".tmp"); err != nil {
+		t.Fatalf("unable to remove directory: %v", err)
+	}
+	if err := rl.Delete(&hashPrefixes[0]); err != nil {
+		t.Fatalf("unable to delete entry: %v", err)
+	}
+	if err := rl.Put(&hashPrefixes[1], 11); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if size := fileSize(t, path); size != fileReplayRecordSize {
+		t.Fatalf("expected file of %d bytes, got %d",
+			fileReplayRecordSize, size)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+}
+
+// TestFileReplayLogCompactionFailure asserts that a failure to compact the
+// file after an entry was appended doesn't fail recording it, and that
+// compaction is retried upon the next append.
+func TestFileReplayLogCompactionFailure(t *testing.T) {
+	rl, path, cleanup := newTestFileReplayLog(t, fileReplayRecordSize)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	var hashPrefixes [4]HashPrefix
+	for i := range hashPrefixes {
+		hashPrefixes[i][0] = byte(i)
+	}
+
+	// Leave a pruned record behind, such that the next append exceeds the
+	// threshold and triggers compaction.
+	if err := rl.Put(&hashPrefixes[0], 1); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if _, err := rl.DeleteStale(5); err != nil {
+		t.Fatalf("unable to delete stale entries: %v", err)
+	}
+
+	// A directory in place of the temporary file fails the rewrite.
+	if err := os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	if err := rl.Put(&hashPrefixes[1], 10); err != nil {
+		t.Fatalf("put failed due to compaction: %v", err)
+	}
+	if _, err := rl.Get(&hashPrefixes[1]); err != nil {
+		t.Fatalf("entry not readable after failed compaction: %v", err)
+	}
+	if err := rl.Put(&hashPrefixes[1], 10); err != ErrReplayedPacket {
+		t.Fatalf("expected ErrReplayedPacket, got: %v", err)
+	}
+
+	batch := NewBatch([]byte{1})
+	if err := batch.Put(0, &hashPrefixes[2], 10); err != nil {
+		t.Fatalf("unable to add to batch: %v", err)
+	}
+	replays, err := rl.PutBatch(batch)
+	if err != nil {
+		t.Fatalf("batch failed due to compaction: %v", err)
+	}
+	if replays.Size() != 0 || !batch.IsCommitted {
+		t.Fatalf("expected batch to be committed without replays")
+	}
+
+	// Once the rewrite succeeds, the file holds the live entries only.
+	if err := os.Remove(path + ".tmp"); err != nil {
+		t.Fatalf("unable to remove directory: %v", err)
+	}
+	if err := rl.Put(&hashPrefixes[3], 10); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if size := fileSize(t, path); size != 3*fileReplayRecordSize {
+		t.Fatalf("expected file of %d bytes, got %d",
+			3*fileReplayRecordSize, size)
+	}
+
+	// All entries recorded while compaction failed survive a restart.
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to restart replay log: %v", err)
+	}
+	for _, hashPrefix := range hashPrefixes[1:] {
+		hashPrefix := hashPrefix
+		if _, err := rl.Get(&hashPrefix); err != nil {
+			t.Fatalf("entry lost after restart: %v", err)
+		}
+	}
+}
+
+// TestFileReplayLogDeleteStale tests that stale entries are pruned from a
+// FileReplayLog by their CLTV expiry.
+func TestFileReplayLogDeleteStale(t *testing.T) {
+	rl, _, cleanup := newTestFileReplayLog(t, 0)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	testReplayLogDeleteStale(t, rl)
+}
+
+// TestFileReplayLogDeleteStaleBatches tests that the replay sets of expired
+// batches are pruned from a FileReplayLog.
+func TestFileReplayLogDeleteStaleBatches(t *testing.T) {
+	rl, _, cleanup := newTestFileReplayLog(t, 0)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	testReplayLogDeleteStaleBatches(t, rl)
+	if len(rl.batches) != 2 {
+		t.Fatalf("expected 2 batch records, got %d", len(rl.batches))
+	}
+}
+
+// TestFileReplayLogStats tests the stats reported by a FileReplayLog.
+func TestFileReplayLogStats(t *testing.T) {
+	rl, _, cleanup := newTestFileReplayLog(t, 0)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	testReplayLogStats(t, rl)
+}
+
+// TestFileReplayLogMigration tests migrating from a MemoryReplayLog into a
+// FileReplayLog, the migrated entries of which survive a restart, and back.
+func TestFileReplayLogMigration(t *testing.T) {
+	rl, _, cleanup := newTestFileReplayLog(t, 0)
+	defer cleanup()
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	src := NewMemoryReplayLog()
+	src.Start()
+	defer src.Stop()
+
+	testReplayLogMigration(t, src, rl)
+
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to restart replay log: %v", err)
+	}
+
+	dst := NewMemoryReplayLog()
+	dst.Start()
+	defer dst.Stop()
+
+	migrated, err := MigrateReplayLog(rl, dst)
+	if err != nil {
+		t.Fatalf("unable to migrate replay log: %v", err)
+	}
+	if migrated != 4 {
+		t.Fatalf("expected 4 entries migrated, got %d", migrated)
+	}
+}
@@ -0,0 +1,204 @@
+package sphinx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// MessagePartType is the TLV type of the record carrying a part of a
+	// message split across multiple onion packets within the exit hop
+	// payload. It's even, as a recipient unable to reassemble the message
+	// mustn't act on a single part of it.
+	MessagePartType uint64 = 66102
+
+	// MaxMessageParts is the maximum number of parts a message can be
+	// split into, as the index and total of each part are encoded as
+	// 16-bit integers.
+	MaxMessageParts = math.MaxUint16
+
+	// messagePartHeaderSize is the size of the index and total preceding
+	// the data of a part within its record.
+	messagePartHeaderSize = 4
+)
+
+// MessagePart is a single part of a message split across multiple onion
+// packets, carried within the exit hop payload of one of them.
+type MessagePart struct {
+	// Index is the position of the part within the message, starting at
+	// zero.
+	Index uint16
+
+	// Total is the number of parts the message was split into.
+	Total uint16
+
+	// Data is the chunk of the message carried by this part.
+	Data []byte
+}
+
+// SplitMessage splits the passed message into consecutive parts of partSize
+// bytes, of which only the last may be shorter. A message which is an exact
+// multiple of partSize yields no trailing empty part, while an empty message
+// yields a single empty part, such that the recipient still learns of it. The
+// parts reference the passed message. This function panics if partSize isn't
+// positive.
+//
+// The parts are sent within separate onion packets using
+// NewMessagePartPayload, sized such that each fits within the exit payload,
+// see MaxPayloadCapacity. As the packets may take different routes, the
+// recipient is able to reassemble the message in any order of arrival using
+// ReassembleMessage.
+func SplitMessage(msg []byte, partSize int) [][]byte {
+	if partSize <= 0 {
+		panic(fmt.Sprintf("invalid message part size of %d", partSize))
+	}
+
+	if len(msg) == 0 {
+		return [][]byte{msg}
+	}
+
+	parts := make([][]byte, 0, (len(msg)+partSize-1)/partSize)
+	for len(msg) > partSize {
+		parts = append(parts, msg[:partSize:partSize])
+		msg = msg[partSize:]
+	}
+
+	return append(parts, msg)
+}
+
+// NewMessageParts splits the passed message like SplitMessage, and attaches
+// the index and total of each part, ready to be carried within an exit hop
+// payload using NewMessagePartPayload. An error is returned if the message
+// needs more than MaxMessageParts parts.
+func NewMessageParts(msg []byte, partSize int) ([]*MessagePart, error) {
+	chunks := SplitMessage(msg, partSize)
+	if len(chunks) > MaxMessageParts {
+		return nil, fmt.Errorf("%w: message of %d bytes needs %d "+
+			"parts, exceeding the maximum of %d",
+			ErrInvalidMessagePart, len(msg), len(chunks),
+			MaxMessageParts)
+	}
+
+	parts := make([]*MessagePart, len(chunks))
+	for i, chunk := range chunks {
+		parts[i] = &MessagePart{
+			Index: uint16(i),
+			Total: uint16(len(chunks)),
+			Data:  chunk,
+		}
+	}
+
+	return parts, nil
+}
+
+// NewMessagePartPayload creates a new TLV hop payload carrying the passed hop
+// data along with the message part, for the exit hop of one of the packets a
+// message is split across. The recipient recovers the part using
+// ProcessedPacket.MessagePart.
+func NewMessagePartPayload(hopData *TLVHopData,
+	part *MessagePart) (HopPayload, error) {
+
+	if part.Total == 0 || part.Index >= part.Total {
+		return HopPayload{}, fmt.Errorf("%w: part %d of %d",
+			ErrInvalidMessagePart, part.Index, part.Total)
+	}
+	if _, ok := hopData.ExtraRecords[MessagePartType]; ok {
+		return HopPayload{}, fmt.Errorf("hop data already carries a " +
+			"message part record")
+	}
+
+	record := make([]byte, messagePartHeaderSize+len(part.Data))
+	binary.BigEndian.PutUint16(record[:2], part.Index)
+	binary.BigEndian.PutUint16(record[2:4], part.Total)
+	copy(record[messagePartHeaderSize:], part.Data)
+
+	partHopData := *hopData
+	partHopData.ExtraRecords = make(
+		map[uint64][]byte, len(hopData.ExtraRecords)+1,
+	)
+	for typ, value := range hopData.ExtraRecords {
+		partHopData.ExtraRecords[typ] = value
+	}
+	partHopData.ExtraRecords[MessagePartType] = record
+
+	return NewTLVHopPayload(&partHopData)
+}
+
+// MessagePart recovers the message part carried within the TLV payload of the
+// processed packet, as created using NewMessagePartPayload. If the payload
+// doesn't carry a message part, then nil is returned.
+func (p *ProcessedPacket) MessagePart() (*MessagePart, error) {
+	hopData, err := p.Payload.TLVHopData()
+	if err != nil || hopData == nil {
+		return nil, err
+	}
+
+	record, ok := hopData.ExtraRecords[MessagePartType]
+	if !ok {
+		return nil, nil
+	}
+	if len(record) < messagePartHeaderSize {
+		return nil, fmt.Errorf("%w: record of %d bytes is too short",
+			ErrInvalidMessagePart, len(record))
+	}
+
+	part := &MessagePart{
+		Index: binary.BigEndian.Uint16(record[:2]),
+		Total: binary.BigEndian.Uint16(record[2:4]),
+		Data:  record[messagePartHeaderSize:],
+	}
+	if part.Total == 0 || part.Index >= part.Total {
+		return nil, fmt.Errorf("%w: part %d of %d",
+			ErrInvalidMessagePart, part.Index, part.Total)
+	}
+
+	return part, nil
+}
+
+// ReassembleMessage reassembles the message the passed parts were split from,
+// which may be passed in any order, such as the order their packets arrived
+// in. An error wrapping ErrInvalidMessagePart is returned unless the parts
+// agree on their total, and exactly one part is passed for each index.
+func ReassembleMessage(parts []*MessagePart) ([]byte, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("%w: no parts passed in",
+			ErrInvalidMessagePart)
+	}
+
+	total := parts[0].Total
+	if len(parts) != int(total) {
+		return nil, fmt.Errorf("%w: got %d of %d parts",
+			ErrInvalidMessagePart, len(parts), total)
+	}
+
+	sorted := make([]*MessagePart, len(parts))
+	copy(sorted, parts)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Index < sorted[j].Index
+	})
+
+	var size int
+	for i, part := range sorted {
+		switch {
+		case part.Total != total:
+			return nil, fmt.Errorf("%w: part %d claims %d parts, "+
+				"expected %d", ErrInvalidMessagePart,
+				part.Index, part.Total, total)
+
+		case int(part.Index) != i:
+			return nil, fmt.Errorf("%w: part %d is missing or "+
+				"duplicated", ErrInvalidMessagePart, i)
+		}
+
+		size += len(part.Data)
+	}
+
+	msg := make([]byte, 0, size)
+	for _, part := range sorted {
+		msg = append(msg, part.Data...)
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,211 @@
+package sphinx
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// TestSplitMessage asserts that messages are split into parts of the given
+// size, with only the last one shorter, and that they're reassembled into the
+// original message.
+func TestSplitMessage(t *testing.T) {
+	msg := []byte("the quick brown fox jumps over the lazy dog")
+
+	tests := []struct {
+		name     string
+		msg      []byte
+		partSize int
+		numParts int
+		lastSize int
+	}{
+		{
+			name:     "empty",
+			msg:      []byte{},
+			partSize: 10,
+			numParts: 1,
+			lastSize: 0,
+		},
+		{
+			name:     "single part",
+			msg:      msg,
+			partSize: len(msg),
+			numParts: 1,
+			lastSize: len(msg),
+		},
+		{
+			name:     "exact multiple",
+			msg:      msg[:40],
+			partSize: 8,
+			numParts: 5,
+			lastSize: 8,
+		},
+		{
+			name:     "remainder",
+			msg:      msg,
+			partSize: 8,
+			numParts: 6,
+			lastSize: 3,
+		},
+		{
+			name:     "single byte parts",
+			msg:      msg[:4],
+			partSize: 1,
+			numParts: 4,
+			lastSize: 1,
+		},
+	}
+
+	for _, test := range tests {
+		chunks := SplitMessage(test.msg, test.partSize)
+		if len(chunks) != test.numParts {
+			t.Fatalf("%s: expected %d parts, got %d", test.name,
+				test.numParts, len(chunks))
+		}
+		for i, chunk := range chunks[:len(chunks)-1] {
+			if len(chunk) != test.partSize {
+				t.Fatalf("%s: part %d is %d bytes", test.name,
+					i, len(chunk))
+			}
+		}
+		if last := chunks[len(chunks)-1]; len(last) != test.lastSize {
+			t.Fatalf("%s: expected last part of %d bytes, got %d",
+				test.name, test.lastSize, len(last))
+		}
+
+		parts, err := NewMessageParts(test.msg, test.partSize)
+		if err != nil {
+			t.Fatalf("%s: unable to create parts: %v", test.name,
+				err)
+		}
+		reassembled, err := ReassembleMessage(parts)
+		if err != nil {
+			t.Fatalf("%s: unable to reassemble: %v", test.name, err)
+		}
+		if !bytes.Equal(reassembled, test.msg) {
+			t.Fatalf("%s: reassembled %q", test.name, reassembled)
+		}
+	}
+}
+
+// TestReassembleMessage asserts that parts passed out of order are reassembled
+// into the original message, while missing, duplicated and inconsistent parts
+// are rejected.
+func TestReassembleMessage(t *testing.T) {
+	msg := []byte("the quick brown fox jumps over the lazy dog")
+	parts, err := NewMessageParts(msg, 10)
+	if err != nil {
+		t.Fatalf("unable to create parts: %v", err)
+	}
+
+	shuffled := []*MessagePart{parts[3], parts[0], parts[4], parts[2],
+		parts[1]}
+	reassembled, err := ReassembleMessage(shuffled)
+	if err != nil {
+		t.Fatalf("unable to reassemble: %v", err)
+	}
+	if !bytes.Equal(reassembled, msg) {
+		t.Fatalf("reassembled %q", reassembled)
+	}
+
+	inconsistent := *parts[2]
+	inconsistent.Total++
+
+	invalid := map[string][]*MessagePart{
+		"no parts":     nil,
+		"missing part": parts[1:],
+		"duplicate part": {
+			parts[0], parts[1], parts[1], parts[3], parts[4],
+		},
+		"inconsistent total": {
+			parts[0], parts[1], &inconsistent, parts[3], parts[4],
+		},
+	}
+	for name, parts := range invalid {
+		_, err := ReassembleMessage(parts)
+		if !errors.Is(err, ErrInvalidMessagePart) {
+			t.Fatalf("%s: expected ErrInvalidMessagePart, got: %v",
+				name, err)
+		}
+	}
+}
+
+// TestSphinxMessageParts tests that a message split across several onion
+// packets, with one part within the exit payload of each, is reassembled by
+// the recipient regardless of the order the packets arrive in.
+func TestSphinxMessageParts(t *testing.T) {
+	recipientKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	recipient := NewRouter(
+		recipientKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+	)
+	recipient.log.Start()
+	defer recipient.log.Stop()
+
+	msg := bytes.Repeat([]byte("message part "), 200)
+	parts, err := NewMessageParts(msg, 1000)
+	if err != nil {
+		t.Fatalf("unable to create parts: %v", err)
+	}
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(parts))
+	}
+
+	hopData := &TLVHopData{ForwardAmount: 1000, OutgoingCltv: 40}
+	packets := make([]*OnionPacket, len(parts))
+	for i, part := range parts {
+		hopPayload, err := NewMessagePartPayload(hopData, part)
+		if err != nil {
+			t.Fatalf("unable to create payload: %v", err)
+		}
+
+		route := PaymentPath{{
+			NodePub:    *recipientKey.PubKey(),
+			HopPayload: hopPayload,
+		}}
+		packets[i], _, err = NewOnionPacketWithRandomSession(
+			&route, nil,
+		)
+		if err != nil {
+			t.Fatalf("unable to create packet: %v", err)
+		}
+	}
+
+	var received []*MessagePart
+	for _, i := range []int{2, 0, 1} {
+		pkt, err := recipient.ProcessOnionPacket(packets[i], nil, 1)
+		if err != nil {
+			t.Fatalf("unable to process packet %d: %v", i, err)
+		}
+
+		part, err := pkt.MessagePart()
+		if err != nil {
+			t.Fatalf("unable to decode part %d: %v", i, err)
+		}
+		if part == nil || part.Index != uint16(i) {
+			t.Fatalf("packet %d carries wrong part: %v", i, part)
+		}
+		received = append(received, part)
+	}
+
+	reassembled, err := ReassembleMessage(received)
+	if err != nil {
+		t.Fatalf("unable to reassemble: %v", err)
+	}
+	if !bytes.Equal(reassembled, msg) {
+		t.Fatalf("reassembled message doesn't match")
+	}
+
+	// Parts which aren't within their total are rejected.
+	_, err = NewMessagePartPayload(
+		&TLVHopData{}, &MessagePart{Index: 1, Total: 1},
+	)
+	if !errors.Is(err, ErrInvalidMessagePart) {
+		t.Fatalf("expected ErrInvalidMessagePart, got: %v", err)
+	}
+}
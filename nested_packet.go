@@ -0,0 +1,77 @@
+package sphinx
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// NestedPacketType is the TLV type of the record carrying a nested onion
+// packet within a hop payload, as used by trampoline routing.
+const NestedPacketType uint64 = 66100
+
+// NewNestedPacketPayload creates a new TLV hop payload carrying the passed hop
+// data along with the serialized onion packet pkt. This allows a sender to
+// wrap an inner onion, destined for a trampoline node, as the payload of that
+// node within an outer onion. The trampoline node recovers the inner onion
+// from its exit payload using ProcessedPacket.NestedPacket.
+//
+// As the inner onion is carried within a single hop payload of the outer one,
+// it must be built with a smaller geometry. The serialized inner packet is
+// OnionPacketConfig.PacketSize() bytes, which along with the remaining records
+// and the TLV framing has to fit within the routing info of the outer packet,
+// alongside the payloads and HMACs of the other outer hops. For the default
+// outer geometry, an inner routing info of roughly 1100 bytes still leaves
+// room for a couple of outer hops with small TLV payloads. Packets that don't
+// fit are rejected with ErrMaxRoutingInfoSizeExceeded when constructing the
+// outer packet.
+func NewNestedPacketPayload(hopData *TLVHopData,
+	pkt *OnionPacket) (HopPayload, error) {
+
+	if _, ok := hopData.ExtraRecords[NestedPacketType]; ok {
+		return HopPayload{}, fmt.Errorf("hop data already carries a " +
+			"nested packet record")
+	}
+
+	var b bytes.Buffer
+	if err := pkt.Encode(&b); err != nil {
+		return HopPayload{}, err
+	}
+
+	nestedHopData := *hopData
+	nestedHopData.ExtraRecords = make(
+		map[uint64][]byte, len(hopData.ExtraRecords)+1,
+	)
+	for typ, value := range hopData.ExtraRecords {
+		nestedHopData.ExtraRecords[typ] = value
+	}
+	nestedHopData.ExtraRecords[NestedPacketType] = b.Bytes()
+
+	return NewTLVHopPayload(&nestedHopData)
+}
+
+// NestedPacket recovers the onion packet nested within the TLV payload of the
+// processed packet, as created using NewNestedPacketPayload. The packet is
+// decoded using the passed geometry, which must match the one the sender used
+// to construct it. If the payload doesn't carry a nested packet, then nil is
+// returned.
+func (p *ProcessedPacket) NestedPacket(
+	packetCfg OnionPacketConfig) (*OnionPacket, error) {
+
+	hopData, err := p.Payload.TLVHopData()
+	if err != nil || hopData == nil {
+		return nil, err
+	}
+
+	nested, ok := hopData.ExtraRecords[NestedPacketType]
+	if !ok {
+		return nil, nil
+	}
+
+	pkt := &OnionPacket{}
+	err = pkt.DecodeWithConfig(bytes.NewReader(nested), packetCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
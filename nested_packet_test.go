@@ -0,0 +1,152 @@
+package sphinx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// TestSphinxNestedPacket asserts that an inner onion wrapped as the payload of
+// a trampoline node within an outer onion can be recovered by the trampoline
+// node, and processed by the hops of the inner route.
+func TestSphinxNestedPacket(t *testing.T) {
+	innerCfg := OnionPacketConfig{NumMaxHops: 5, HopPayloadSize: 65}
+
+	// The sender first builds the inner onion, which routes from the
+	// trampoline node towards the final destination.
+	innerKeys := make([]*btcec.PrivateKey, 2)
+	var innerRoute PaymentPath
+	for i := range innerKeys {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		innerKeys[i] = privKey
+
+		hopPayload, err := NewHopPayload(nil, []byte{byte(10 + i)})
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+		innerRoute[i] = OnionHop{
+			NodePub:    *privKey.PubKey(),
+			HopPayload: hopPayload,
+		}
+	}
+	innerPkt, _, err := NewOnionPacketWithRandomSession(
+		&innerRoute, nil, WithPacketConfig(innerCfg),
+	)
+	if err != nil {
+		t.Fatalf("unable to create inner packet: %v", err)
+	}
+
+	// The inner onion is then wrapped as the payload of the trampoline
+	// node, which is the exit of the outer onion.
+	relayKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	relayPayload, err := NewTLVHopPayload(&TLVHopData{
+		ForwardAmount: 1000,
+		OutgoingCltv:  50,
+		NextAddress:   &[AddressSize]byte{1},
+	})
+	if err != nil {
+		t.Fatalf("unable to create hop payload: %v", err)
+	}
+	trampolineHopData := &TLVHopData{
+		ForwardAmount: 1000,
+		OutgoingCltv:  40,
+	}
+	trampolinePayload, err := NewNestedPacketPayload(
+		trampolineHopData, innerPkt,
+	)
+	if err != nil {
+		t.Fatalf("unable to create nested payload: %v", err)
+	}
+
+	outerRoute := PaymentPath{
+		{
+			NodePub:    *relayKey.PubKey(),
+			HopPayload: relayPayload,
+		},
+		{
+			NodePub:    *innerKeys[0].PubKey(),
+			HopPayload: trampolinePayload,
+		},
+	}
+	outerPkt, _, err := NewOnionPacketWithRandomSession(&outerRoute, nil)
+	if err != nil {
+		t.Fatalf("unable to create outer packet: %v", err)
+	}
+
+	// Route the outer onion to the trampoline node.
+	relay := NewRouter(
+		relayKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+	)
+	trampoline := NewRouter(
+		innerKeys[0], &chaincfg.MainNetParams, NewMemoryReplayLog(),
+	)
+	processed, err := relay.ReconstructOnionPacket(outerPkt, nil)
+	if err != nil {
+		t.Fatalf("relay unable to process packet: %v", err)
+	}
+	pkt, err := processed.NestedPacket(innerCfg)
+	if pkt != nil || err != nil {
+		t.Fatalf("relay payload shouldn't carry a nested packet: %v",
+			err)
+	}
+
+	processed, err = trampoline.ReconstructOnionPacket(
+		processed.NextPacket, nil,
+	)
+	if err != nil {
+		t.Fatalf("trampoline unable to process packet: %v", err)
+	}
+	if processed.Action != ExitNode {
+		t.Fatalf("expected trampoline to be the outer exit node")
+	}
+
+	hopData, err := processed.Payload.TLVHopData()
+	if err != nil {
+		t.Fatalf("unable to parse trampoline payload: %v", err)
+	}
+	if hopData.ForwardAmount != trampolineHopData.ForwardAmount ||
+		hopData.OutgoingCltv != trampolineHopData.OutgoingCltv {
+
+		t.Fatalf("trampoline payload mismatch: %v", hopData)
+	}
+
+	recovered, err := processed.NestedPacket(innerCfg)
+	if err != nil {
+		t.Fatalf("unable to recover nested packet: %v", err)
+	}
+
+	var want, got bytes.Buffer
+	innerPkt.Encode(&want)
+	recovered.Encode(&got)
+	if !bytes.Equal(want.Bytes(), got.Bytes()) {
+		t.Fatalf("recovered nested packet doesn't match")
+	}
+
+	// Finally, the inner onion should be processable by the hops of the
+	// inner route.
+	pkt = recovered
+	for i, key := range innerKeys {
+		router := NewRouter(
+			key, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+			WithOnionPacketConfig(innerCfg),
+		)
+		processed, err := router.ReconstructOnionPacket(pkt, nil)
+		if err != nil {
+			t.Fatalf("inner hop %d unable to process packet: %v",
+				i, err)
+		}
+		payload := processed.Payload.Payload
+		if !bytes.Equal(payload, []byte{byte(10 + i)}) {
+			t.Fatalf("inner hop %d payload mismatch", i)
+		}
+		pkt = processed.NextPacket
+	}
+}
@@ -10,11 +10,15 @@ import (
 // encryption as defined within BOLT0004.
 type OnionErrorEncrypter struct {
 	sharedSecret Hash256
+
+	// keyTags are the tags the error keys are derived with, which are the
+	// default ones if unset.
+	keyTags KeyTags
 }
 
 // NewOnionErrorEncrypter creates new instance of the onion encrypter backed by
 // the passed router, with encryption to be doing using the passed
-// ephemeralKey.
+// ephemeralKey. Errors are encrypted using the key tags of the router.
 func NewOnionErrorEncrypter(router *Router,
 	ephemeralKey *btcec.PublicKey) (*OnionErrorEncrypter, error) {
 
@@ -25,9 +29,34 @@ func NewOnionErrorEncrypter(router *Router,
 
 	return &OnionErrorEncrypter{
 		sharedSecret: sharedSecret,
+		keyTags:      router.keyTags,
 	}, nil
 }
 
+// NewOnionErrorEncrypterFromSecret creates a new instance of the onion
+// encrypter using a shared secret that was already derived while processing
+// the onion packet, such as ProcessedPacket.SharedSecret. Errors are encrypted
+// using the default key tags.
+func NewOnionErrorEncrypterFromSecret(sharedSecret Hash256) *OnionErrorEncrypter {
+	return &OnionErrorEncrypter{
+		sharedSecret: sharedSecret,
+		keyTags:      defaultKeyTags,
+	}
+}
+
+// NewOnionErrorEncrypterWithKeyTags creates a new instance of the onion
+// encrypter exactly like NewOnionErrorEncrypterFromSecret, but encrypting
+// errors using the keys derived with the passed tags, for packets processed
+// by a router configured using WithKeyTags.
+func NewOnionErrorEncrypterWithKeyTags(sharedSecret Hash256,
+	tags KeyTags) *OnionErrorEncrypter {
+
+	return &OnionErrorEncrypter{
+		sharedSecret: sharedSecret,
+		keyTags:      tags,
+	}
+}
+
 // Encode writes the encrypter's shared secret to the provided io.Writer.
 func (o *OnionErrorEncrypter) Encode(w io.Writer) error {
 	_, err := w.Write(o.sharedSecret[:])
@@ -116,6 +145,10 @@ func (c *Circuit) Encode(w io.Writer) error {
 // response to failed HTLC routing attempts according to BOLT#4.
 type OnionErrorDecrypter struct {
 	circuit *Circuit
+
+	// keyTags are the tags the error keys are derived with, which are the
+	// default ones if unset.
+	keyTags KeyTags
 }
 
 // NewOnionErrorDecrypter creates new instance of onion decrypter.
@@ -124,3 +157,15 @@ func NewOnionErrorDecrypter(circuit *Circuit) *OnionErrorDecrypter {
 		circuit: circuit,
 	}
 }
+
+// NewOnionErrorDecrypterWithKeyTags creates a new instance of the onion
+// decrypter, for errors sent back for a packet constructed using the
+// WithPacketKeyTags option with the passed tags.
+func NewOnionErrorDecrypterWithKeyTags(circuit *Circuit,
+	tags KeyTags) *OnionErrorDecrypter {
+
+	return &OnionErrorDecrypter{
+		circuit: circuit,
+		keyTags: tags,
+	}
+}
@@ -4,12 +4,70 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"reflect"
 	"testing"
 
 	"github.com/btcsuite/btcd/btcec"
 )
 
+// TestOnionFailureKeyTags checks that an onion error encrypted using custom key
+// tags can only be decrypted using the same tags.
+func TestOnionFailureKeyTags(t *testing.T) {
+	customTags := KeyTags{
+		Rho:   "experimental-rho",
+		Mu:    "experimental-mu",
+		Um:    "experimental-um",
+		Ammag: "experimental-ammag",
+	}
+
+	paymentPath := make([]*btcec.PublicKey, 3)
+	for i := 0; i < len(paymentPath); i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate random key: %v", err)
+		}
+		paymentPath[i] = privKey.PubKey()
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(),
+		bytes.Repeat([]byte{'A'}, 32))
+	sharedSecrets := generateSharedSecrets(paymentPath, sessionKey)
+
+	failureData := bytes.Repeat([]byte{'A'}, onionErrorLength-sha256.Size)
+	obfuscatedData := NewOnionErrorEncrypterWithKeyTags(
+		sharedSecrets[len(paymentPath)-1], customTags,
+	).EncryptError(true, failureData)
+	for i := len(paymentPath) - 2; i >= 0; i-- {
+		obfuscatedData = NewOnionErrorEncrypterWithKeyTags(
+			sharedSecrets[i], customTags,
+		).EncryptError(false, obfuscatedData)
+	}
+
+	circuit := &Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: paymentPath,
+	}
+	_, _, err := NewOnionErrorDecrypter(circuit).DecryptError(
+		obfuscatedData,
+	)
+	if !errors.Is(err, ErrUnreadableFailure) {
+		t.Fatalf("expected ErrUnreadableFailure, got: %v", err)
+	}
+
+	pubKey, data, err := NewOnionErrorDecrypterWithKeyTags(
+		circuit, customTags,
+	).DecryptError(obfuscatedData)
+	if err != nil {
+		t.Fatalf("unable to decrypt onion failure: %v", err)
+	}
+	if !pubKey.IsEqual(paymentPath[len(paymentPath)-1]) {
+		t.Fatalf("error attributed to wrong node")
+	}
+	if !bytes.Equal(data, failureData) {
+		t.Fatalf("failure data mismatch")
+	}
+}
+
 // TestOnionFailure checks the ability of sender of payment to decode the
 // obfuscated onion error.
 func TestOnionFailure(t *testing.T) {
@@ -273,3 +331,80 @@ func TestOnionFailureSpecVector(t *testing.T) {
 			"the path we received an error")
 	}
 }
+
+// TestOnionFailureRoute checks that an error created by an intermediate hop of
+// a real route, and obfuscated by each prior hop using encrypters derived from
+// the packets they processed, can be decrypted by the sender.
+func TestOnionFailureRoute(t *testing.T) {
+	nodes, route, _, fwdMsg, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	// Process the packet up until the failing hop, with each hop creating
+	// an encrypter from the ephemeral key of the packet it received.
+	const failingHop = 2
+	encrypters := make([]*OnionErrorEncrypter, failingHop+1)
+	for i := 0; i <= failingHop; i++ {
+		nodes[i].log.Start()
+		defer nodes[i].log.Stop()
+
+		encrypters[i], err = NewOnionErrorEncrypter(
+			nodes[i], fwdMsg.EphemeralKey,
+		)
+		if err != nil {
+			t.Fatalf("unable to create encrypter: %v", err)
+		}
+
+		pkt, err := nodes[i].ProcessOnionPacket(fwdMsg, nil, uint32(i))
+		if err != nil {
+			t.Fatalf("unable to process packet: %v", err)
+		}
+		fwdMsg = pkt.NextPacket
+	}
+
+	// The failing hop creates the initial error, which is then obfuscated
+	// on the way back to the sender.
+	failureData := bytes.Repeat([]byte{'A'}, onionErrorLength-sha256.Size)
+	obfuscatedData := encrypters[failingHop].EncryptError(true, failureData)
+	for i := failingHop - 1; i >= 0; i-- {
+		obfuscatedData = encrypters[i].EncryptError(false, obfuscatedData)
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	deobfuscator := NewOnionErrorDecrypter(&Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: route.NodeKeys(),
+	})
+
+	pubKey, deobfuscatedData, err := deobfuscator.DecryptError(obfuscatedData)
+	if err != nil {
+		t.Fatalf("unable to decrypt onion failure: %v", err)
+	}
+
+	if !pubKey.IsEqual(&route[failingHop].NodePub) {
+		t.Fatalf("expected error to originate from hop %v", failingHop)
+	}
+	if !bytes.Equal(deobfuscatedData, failureData) {
+		t.Fatalf("data not equals, expected: \"%v\", real: \"%v\"",
+			string(failureData), string(deobfuscatedData))
+	}
+
+	// An error that wasn't created by any hop in the route shouldn't be
+	// attributed to any of them.
+	_, _, err = deobfuscator.DecryptError(
+		bytes.Repeat([]byte{'B'}, onionErrorLength),
+	)
+	if !errors.Is(err, ErrUnreadableFailure) {
+		t.Fatalf("expected decryption of unknown error to fail, "+
+			"got: %v", err)
+	}
+
+	// As should an error that isn't of the expected length.
+	_, _, err = deobfuscator.DecryptError(obfuscatedData[1:])
+	if !errors.Is(err, ErrInvalidErrorLength) {
+		t.Fatalf("expected invalid error length, got: %v", err)
+	}
+}
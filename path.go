@@ -1,10 +1,311 @@
 package sphinx
 
-import "github.com/btcsuite/btcd/btcec"
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 
-// NumMaxHops is the maximum path length. This should be set to an estimate of
-// the upper limit of the diameter of the node graph.
-const NumMaxHops = 20
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// errInvalidPayloadPadding is returned when the padding of a padded exit
+// payload can't be stripped.
+var errInvalidPayloadPadding = errors.New("invalid exit payload padding")
+
+// NumMaxHops is the maximum path length. There is a maximum of 1300 bytes in
+// the routing info block. Legacy hop payloads are always 65 bytes, while TLV
+// payloads are at least 47 bytes (length 1, amount 2, timelock 2, next channel
+// 10, hmac 32) for the intermediate hops and 37 bytes (length 1, amount 2,
+// timelock 2, hmac 32) for the exit hop. The maximum path length can therefore
+// only be reached by using TLV payloads only. With that, the maximum number of
+// intermediate hops is: Floor((1300 - 37) / 47) = 26. Including the exit hop,
+// the maximum path length is 27 hops.
+const NumMaxHops = 27
+
+// PayloadType denotes the type of the payload included in the onion packet.
+// Serialization of a raw HopPayload will depend on the payload type, as some
+// include a varint length prefix, while others just encode the raw payload.
+type PayloadType uint8
+
+const (
+	// PayloadLegacy is the legacy payload type. It includes a fixed 32
+	// bytes, 12 of which are padding, and uses a "zero length" (the old
+	// realm) prefix.
+	PayloadLegacy PayloadType = iota
+
+	// PayloadTLV is the variable length payload type. This payload
+	// includes a set of opaque bytes with a varint length prefix.
+	PayloadTLV
+)
+
+// HopPayload is a slice of bytes and associated payload-type that are destined
+// for a specific hop in the PaymentPath. The payload itself is treated as an
+// opaque data field by the onion router. The included Type field informs the
+// serialization/deserialization of the raw payload.
+type HopPayload struct {
+	// Type is the type of the payload.
+	Type PayloadType
+
+	// Payload is the raw bytes of the per-hop payload for this hop.
+	// Depending on the type, this may be the regular legacy hop data, or a
+	// set of opaque bytes to be parsed by higher layers.
+	Payload []byte
+
+	// HMAC is an HMAC computed over the entire per-hop payload that also
+	// includes the higher-level (optional) associated data bytes.
+	HMAC [HMACSize]byte
+}
+
+// NewHopPayload creates a new hop payload given an optional set of forwarding
+// instructions for a hop, and a set of optional opaque extra onion bytes to
+// drop off at the target hop. Exactly one of the two must be specified, hop
+// data results in a legacy payload, while the extra onion bytes are carried
+// within a variable length payload.
+func NewHopPayload(hopData *HopData, eob []byte) (HopPayload, error) {
+	var (
+		h HopPayload
+		b bytes.Buffer
+	)
+
+	// We can't proceed if neither the hop data or the EOB has been
+	// specified by the caller.
+	switch {
+	case hopData == nil && len(eob) == 0:
+		return h, fmt.Errorf("either hop data or eob must " +
+			"be specified")
+
+	case hopData != nil && len(eob) > 0:
+		return h, fmt.Errorf("cannot provide both hop data AND an eob")
+	}
+
+	if hopData != nil {
+		if err := hopData.Encode(&b); err != nil {
+			return h, err
+		}
+
+		h.Type = PayloadLegacy
+		h.Payload = b.Bytes()
+	} else {
+		h.Type = PayloadTLV
+		h.Payload = eob
+	}
+
+	return h, nil
+}
+
+// padHopPayload returns a copy of the passed TLV hop payload with its payload
+// padded to exactly size bytes. The padded payload starts with the length of
+// the original payload as a 2 byte big-endian integer, followed by the original
+// payload and zeroes up to the target size, such that the original payload can
+// be unambiguously recovered using unpadPayload.
+func padHopPayload(hp HopPayload, size int) (HopPayload, error) {
+	if hp.Type != PayloadTLV {
+		return hp, fmt.Errorf("only tlv hop payloads can be padded")
+	}
+
+	if size < len(hp.Payload)+2 || size > MaxPayloadSize {
+		return hp, fmt.Errorf("padded payload size of %d must be "+
+			"between %d and %d", size, len(hp.Payload)+2,
+			MaxPayloadSize)
+	}
+
+	padded := make([]byte, size)
+	binary.BigEndian.PutUint16(padded, uint16(len(hp.Payload)))
+	copy(padded[2:], hp.Payload)
+
+	hp.Payload = padded
+
+	return hp, nil
+}
+
+// unpadPayload recovers the original payload from a payload padded by
+// padHopPayload. The padding must consist of zeroes only.
+func unpadPayload(padded []byte) ([]byte, error) {
+	if len(padded) < 2 {
+		return nil, errInvalidPayloadPadding
+	}
+
+	payloadLen := int(binary.BigEndian.Uint16(padded))
+	if payloadLen > len(padded)-2 {
+		return nil, errInvalidPayloadPadding
+	}
+
+	for _, b := range padded[2+payloadLen:] {
+		if b != 0 {
+			return nil, errInvalidPayloadPadding
+		}
+	}
+
+	return padded[2 : 2+payloadLen : 2+payloadLen], nil
+}
+
+// NumBytes returns the number of bytes it will take to serialize the full
+// payload. Depending on the payload type, this may include some additional
+// signalling bytes.
+func (hp *HopPayload) NumBytes() int {
+	// The base size is the size of the raw payload, and the size of the
+	// HMAC.
+	size := len(hp.Payload) + HMACSize
+
+	// If this is the TLV format, then we'll also accumulate the number of
+	// bytes that it would take to encode the size of the payload.
+	if hp.Type == PayloadTLV {
+		size += varIntSize(uint64(len(hp.Payload)))
+	}
+
+	return size
+}
+
+// Encode encodes the hop payload into the passed writer.
+func (hp *HopPayload) Encode(w io.Writer) error {
+	switch hp.Type {
+
+	// For the legacy payload, we don't need to add any additional bytes as
+	// our realm byte serves as our zero prefix byte.
+	case PayloadLegacy:
+		break
+
+	// For the TLV payload, we'll first prepend the length of the payload
+	// as a var-int.
+	case PayloadTLV:
+		var b [8]byte
+		err := writeVarInt(w, uint64(len(hp.Payload)), &b)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Finally, we'll write out the raw payload, then the HMAC in series.
+	if _, err := w.Write(hp.Payload); err != nil {
+		return err
+	}
+	if _, err := w.Write(hp.HMAC[:]); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// encodeTo encodes the hop payload exactly like Encode, but directly into the
+// passed buffer, which must be at least NumBytes bytes long. This avoids the
+// indirection of an io.Writer, which is significant when layering the hop
+// payloads of a packet one after the other.
+func (hp *HopPayload) encodeTo(b []byte) {
+	var n int
+	if hp.Type == PayloadTLV {
+		n = putVarInt(b, uint64(len(hp.Payload)))
+	}
+
+	n += copy(b[n:], hp.Payload)
+	copy(b[n:], hp.HMAC[:])
+}
+
+// byteScanReader is an io.Reader which also allows a single byte to be read
+// and then unread, such as a bytes.Reader or a bufio.Reader.
+type byteScanReader interface {
+	io.Reader
+	io.ByteScanner
+}
+
+// Decode unpacks an encoded HopPayload from the passed reader into the target
+// HopPayload.
+func (hp *HopPayload) Decode(r io.Reader) error {
+	// In order to properly parse the payload, we'll need to check the
+	// first byte. If the reader allows it, we'll read the byte and unread
+	// it right away. Otherwise, we'll use a bufio reader to peek at it
+	// without consuming it from the buffer.
+	bufReader, ok := r.(byteScanReader)
+	if !ok {
+		bufReader = bufio.NewReader(r)
+	}
+
+	firstByte, err := bufReader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if err := bufReader.UnreadByte(); err != nil {
+		return err
+	}
+
+	var payloadSize uint64
+	switch int(firstByte) {
+
+	// If the first byte is a zero (the realm), then this is the legacy
+	// payload. Our size is just the payload, without the HMAC.
+	case 0x00:
+		payloadSize = LegacyHopDataSize - HMACSize
+		hp.Type = PayloadLegacy
+
+	// Otherwise, this is the TLV based payload type, so we'll extract the
+	// payload length encoded as a var-int.
+	default:
+		var b [8]byte
+		payloadSize, err = readVarInt(bufReader, &b)
+		if err != nil {
+			return err
+		}
+
+		hp.Type = PayloadTLV
+	}
+
+	// A payload can't be larger than the routing info it is carried in,
+	// so we reject such lengths before allocating a buffer for it.
+	if payloadSize > MaxPayloadSize {
+		return ErrPayloadTooLarge
+	}
+
+	// Now that we know the payload size, we'll create a new buffer to
+	// read it out in full.
+	hp.Payload = make([]byte, payloadSize)
+	if _, err := io.ReadFull(bufReader, hp.Payload[:]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(bufReader, hp.HMAC[:]); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// isAmbiguous returns whether the framing of the decoded hop payload is
+// ambiguous in a network mixing legacy and TLV payloads. A zero first byte
+// signals a legacy payload, yet is also the var-int length of an empty TLV
+// payload. If the legacy payload consists of zeroes only, then the frame
+// parses as either: a legacy payload without any forwarding instructions
+// followed by the HMAC of the next hop, or an empty TLV payload followed by
+// the zero HMAC marking the exit hop.
+func (hp *HopPayload) isAmbiguous() bool {
+	if hp.Type != PayloadLegacy {
+		return false
+	}
+
+	for _, b := range hp.Payload {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// HopData attempts to extract a set of forwarding instructions from the target
+// HopPayload. If this isn't a legacy payload, then nil is returned, as the
+// payload is opaque to this package.
+func (hp *HopPayload) HopData() (*HopData, error) {
+	if hp.Type != PayloadLegacy {
+		return nil, nil
+	}
+
+	var hd HopData
+	if err := hd.Decode(bytes.NewReader(hp.Payload)); err != nil {
+		return nil, err
+	}
+
+	return &hd, nil
+}
 
 // PaymentPath represents a series of hops within the Lightning Network
 // starting at a sender and terminating at a receiver. Each hop contains a set
@@ -28,9 +329,9 @@ type OnionHop struct {
 	// internal packet to the next hop.
 	NodePub btcec.PublicKey
 
-	// HopData are the plaintext routing instructions that should be
-	// delivered to this hop.
-	HopData HopData
+	// HopPayload is the opaque payload provided to this node. Legacy
+	// forwarding instructions can be packed into it using NewHopPayload.
+	HopPayload HopPayload
 }
 
 // IsEmpty returns true if the hop isn't populated.
@@ -70,3 +371,89 @@ func (p *PaymentPath) TrueRouteLength() int {
 
 	return routeLength
 }
+
+// validate returns an error wrapping ErrInvalidRoute if the payment path
+// doesn't describe a route an onion packet can be constructed for, as it's
+// nil, empty, or has hops populated past its true length which would otherwise
+// be silently dropped. The true length of the route is returned otherwise.
+func (p *PaymentPath) validate() (int, error) {
+	if p == nil {
+		return 0, fmt.Errorf("%w: nil payment path", ErrInvalidRoute)
+	}
+
+	numHops := p.TrueRouteLength()
+	if numHops == 0 {
+		return 0, fmt.Errorf("%w: route of length zero passed in",
+			ErrInvalidRoute)
+	}
+
+	for i := numHops; i < len(p); i++ {
+		switch {
+		case !p[i].IsEmpty():
+			return 0, fmt.Errorf("%w: hop %d follows empty hop %d",
+				ErrInvalidRoute, i, numHops)
+
+		case p[i].HopPayload.Payload != nil:
+			return 0, fmt.Errorf("%w: route of %d hops has payload "+
+				"for hop %d", ErrInvalidRoute, numHops, i)
+		}
+	}
+
+	return numHops, nil
+}
+
+// MaxPayloadCapacity returns the number of payload bytes a sender is able to
+// distribute across a route of numHops hops within a default sized onion
+// packet, which is the size of the routing info less the HMAC of each hop.
+// The varint length prefix of TLV payloads counts towards the capacity, such
+// that a route fits if TotalPayloadSize doesn't exceed the capacity by more
+// than numHops*HMACSize. Zero is returned if no payload fits at all.
+func MaxPayloadCapacity(numHops int) int {
+	capacity := routingInfoSize - numHops*HMACSize
+	if numHops <= 0 || capacity < 0 {
+		return 0
+	}
+
+	return capacity
+}
+
+// ReverseRoute returns copies of the passed route and its payloads in reverse
+// order, such that payloads[i] remains paired with route[i]. This allows a
+// return path onion to be constructed over the nodes of the forward route.
+// The passed slices are left untouched, while the payloads themselves aren't
+// copied. An error wrapping ErrInvalidRoute is returned if route and payloads
+// differ in length, as they can't be reversed in lockstep.
+func ReverseRoute(route []*btcec.PublicKey,
+	payloads [][]byte) ([]*btcec.PublicKey, [][]byte, error) {
+
+	if len(route) != len(payloads) {
+		return nil, nil, fmt.Errorf("%w: route of %d hops has %d "+
+			"payloads", ErrInvalidRoute, len(route), len(payloads))
+	}
+
+	var (
+		reversedRoute    = make([]*btcec.PublicKey, len(route))
+		reversedPayloads = make([][]byte, len(payloads))
+	)
+	for i := range route {
+		reversedRoute[len(route)-1-i] = route[i]
+		reversedPayloads[len(payloads)-1-i] = payloads[i]
+	}
+
+	return reversedRoute, reversedPayloads, nil
+}
+
+// TotalPayloadSize returns the sum of the size of each payload in the "true"
+// route.
+func (p *PaymentPath) TotalPayloadSize() int {
+	var totalSize int
+	for _, hop := range p {
+		if hop.IsEmpty() {
+			continue
+		}
+
+		totalSize += hop.HopPayload.NumBytes()
+	}
+
+	return totalSize
+}
@@ -0,0 +1,278 @@
+package sphinx
+
+import (
+	"crypto/elliptic"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// RendezvousType is the TLV type of the record carrying the junction of a
+// spliced onion within the payload of the rendezvous node. Its value is the
+// compressed ephemeral key of the partial onion, followed by its reserved size
+// as a big endian uint16. As a rendezvous node ignoring the record would
+// forward a packet none of the following hops can process, the type is even.
+const RendezvousType uint64 = 66104
+
+// rendezvousRecordSize is the size of the value of a rendezvous record.
+const rendezvousRecordSize = btcec.PubKeyBytesLenCompressed + 2
+
+// PartialOnion is the second leg of an onion packet, pre-built by the
+// recipient for the route from the node following the rendezvous node to
+// itself. A sender splices its own route to the rendezvous node onto it using
+// NewSplicedOnionPacket, without learning the route of the second leg.
+//
+// The last ReservedSize bytes of the routing info are zero, and are left for
+// the sender's leg. The rendezvous node zeroes the same bytes of the packet it
+// forwards, overwriting the filler left by the sender's leg, such that the
+// packet matches the partial onion exactly.
+type PartialOnion struct {
+	// EphemeralKey is the ephemeral key the node following the rendezvous
+	// node is to derive its shared secret with.
+	EphemeralKey *btcec.PublicKey
+
+	// RoutingInfo is the routing info for the node following the
+	// rendezvous node, of which the last ReservedSize bytes are zero.
+	RoutingInfo []byte
+
+	// HeaderMAC is the HMAC of the routing info, which the rendezvous
+	// node hands to the node following it.
+	HeaderMAC [HMACSize]byte
+
+	// ReservedSize is the number of bytes at the end of the routing info
+	// that are left for the sender's leg, which must fit the payloads and
+	// HMACs of all hops up to and including the rendezvous node.
+	ReservedSize int
+}
+
+// NewPartialOnion creates the second leg of an onion packet for the passed
+// route, which starts at the node following the rendezvous node, leaving
+// reservedSize bytes of the routing info for the sender's leg. The session
+// key, associated data and options are used exactly like NewOnionPacket does,
+// and the associated data must match the one the sender uses, as it's covered
+// by the HMAC of every layer of both legs.
+//
+// As the reserved bytes are only zero at the first hop of the leg, the
+// initial contents of the routing info are chosen such that layering the hops
+// onto it yields zeroes there. An error is returned if the route and the
+// reserved bytes exceed the routing info.
+func NewPartialOnion(paymentPath *PaymentPath, sessionKey *btcec.PrivateKey,
+	assocData []byte, reservedSize int,
+	opts ...OnionPacketOption) (*PartialOnion, error) {
+
+	cfg := newOnionPacketCfg(opts)
+	if err := cfg.packetCfg.Validate(); err != nil {
+		return nil, err
+	}
+	routingInfoLen := cfg.packetCfg.RoutingInfoSize()
+
+	numHops, err := paymentPath.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	// Each hop shifts the routing info by the size of its payload, so the
+	// reserved bytes of the outermost layer originate from the routing
+	// info that many bytes earlier.
+	shift := paymentPath.TotalPayloadSize()
+	if cfg.finalPayloadSize != 0 {
+		finalPayload := paymentPath[numHops-1].HopPayload
+		paddedPayload, err := padHopPayload(
+			finalPayload, cfg.finalPayloadSize,
+		)
+		if err != nil {
+			return nil, err
+		}
+		shift += paddedPayload.NumBytes() - finalPayload.NumBytes()
+	}
+
+	switch {
+	case reservedSize <= 0 || reservedSize > math.MaxUint16:
+		return nil, fmt.Errorf("reserved size of %d bytes must be "+
+			"between 1 and %d", reservedSize, math.MaxUint16)
+
+	case shift+reservedSize > routingInfoLen:
+		return nil, fmt.Errorf("%w: payloads of %d bytes and %d "+
+			"reserved bytes exceed routing info",
+			ErrMaxRoutingInfoSizeExceeded, shift, reservedSize)
+	}
+
+	// Layering the hops onto zeroes yields the keystream the reserved
+	// bytes are encrypted with. As the layers are XOR'ed onto the routing
+	// info, starting out with that keystream instead cancels it out.
+	pad := make([]byte, routingInfoLen)
+	pkt, err := newOnionPacketWithSeed(
+		paymentPath, sessionKey, assocData, pad, opts...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for i := routingInfoLen - reservedSize; i < routingInfoLen; i++ {
+		pad[i-shift] = pkt.RoutingInfo[i]
+	}
+
+	pkt, err = newOnionPacketWithSeed(
+		paymentPath, sessionKey, assocData, pad, opts...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PartialOnion{
+		EphemeralKey: pkt.EphemeralKey,
+		RoutingInfo:  pkt.RoutingInfo,
+		HeaderMAC:    pkt.HeaderMAC,
+		ReservedSize: reservedSize,
+	}, nil
+}
+
+// NewSplicedOnionPacket creates a new onion packet exactly like
+// NewOnionPacket, for the sender's route to the rendezvous node, which is the
+// last hop of the passed path, spliced onto the partial onion pre-built by the
+// recipient. The payload of the rendezvous node must be a TLV payload, and is
+// extended with a RendezvousType record. Upon processing the packet, the
+// rendezvous node switches to the ephemeral key of the partial onion, and
+// forwards it to the node following it.
+//
+// The routing info for the rendezvous node is seeded with the routing info of
+// the partial onion, such that peeling off the layer of the rendezvous node
+// reveals it. An error wrapping ErrMaxRoutingInfoSizeExceeded is returned if
+// the payloads of the path exceed the bytes reserved by the partial onion.
+func NewSplicedOnionPacket(paymentPath *PaymentPath, partial *PartialOnion,
+	sessionKey *btcec.PrivateKey, assocData []byte,
+	opts ...OnionPacketOption) (*OnionPacket, error) {
+
+	cfg := newOnionPacketCfg(opts)
+	if err := cfg.packetCfg.Validate(); err != nil {
+		return nil, err
+	}
+	routingInfoLen := cfg.packetCfg.RoutingInfoSize()
+
+	switch {
+	case partial == nil || partial.EphemeralKey == nil:
+		return nil, fmt.Errorf("partial onion lacks an ephemeral key")
+
+	case len(partial.RoutingInfo) != routingInfoLen:
+		return nil, fmt.Errorf("partial onion routing info of %d "+
+			"bytes doesn't match routing info size of %d bytes",
+			len(partial.RoutingInfo), routingInfoLen)
+
+	case partial.ReservedSize <= 0 ||
+		partial.ReservedSize > routingInfoLen ||
+		partial.ReservedSize > math.MaxUint16:
+
+		return nil, fmt.Errorf("invalid partial onion reserved size "+
+			"of %d bytes", partial.ReservedSize)
+
+	case cfg.finalPayloadSize != 0:
+		return nil, fmt.Errorf("payload of rendezvous node can't " +
+			"be padded")
+	}
+
+	path := *paymentPath
+	numHops, err := path.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	// Extend the payload of the rendezvous node with the junction record,
+	// telling it how to continue into the partial onion.
+	rendezvous := &path[numHops-1].HopPayload
+	hopData, err := rendezvous.TLVHopData()
+	if err != nil {
+		return nil, err
+	}
+	if hopData == nil {
+		return nil, fmt.Errorf("%w: rendezvous node must have a TLV "+
+			"payload", ErrInvalidRoute)
+	}
+	if _, ok := hopData.ExtraRecords[RendezvousType]; ok {
+		return nil, fmt.Errorf("payload of rendezvous node already " +
+			"carries a rendezvous record")
+	}
+
+	record := make([]byte, rendezvousRecordSize)
+	serializeCompressed(record, partial.EphemeralKey)
+	binary.BigEndian.PutUint16(
+		record[btcec.PubKeyBytesLenCompressed:],
+		uint16(partial.ReservedSize),
+	)
+
+	records := make(map[uint64][]byte, len(hopData.ExtraRecords)+1)
+	for typ, value := range hopData.ExtraRecords {
+		records[typ] = value
+	}
+	records[RendezvousType] = record
+	hopData.ExtraRecords = records
+
+	*rendezvous, err = NewTLVHopPayload(hopData)
+	if err != nil {
+		return nil, err
+	}
+
+	// The filler left by the sender's leg ends up within the reserved
+	// bytes, which the rendezvous node zeroes, so all payloads up to and
+	// including its own must fit within them.
+	if size := path.TotalPayloadSize(); size > partial.ReservedSize {
+		return nil, fmt.Errorf("%w: payloads of %d bytes exceed the "+
+			"%d bytes reserved by the partial onion",
+			ErrMaxRoutingInfoSizeExceeded, size,
+			partial.ReservedSize)
+	}
+
+	headerMAC := partial.HeaderMAC
+	opts = append(opts[:len(opts):len(opts)], withFinalHMAC(&headerMAC))
+
+	return newOnionPacketWithSeed(
+		&path, sessionKey, assocData, partial.RoutingInfo, opts...,
+	)
+}
+
+// spliceRendezvous switches the packet for the next hop over to the partial
+// onion, if the passed hop payload carries a rendezvous record, by replacing
+// its ephemeral key, which lies on the passed curve, and zeroing the bytes
+// reserved by the partial onion. An error wrapping ErrInvalidRendezvous is
+// returned if the record is malformed.
+func spliceRendezvous(curve elliptic.Curve, payload *HopPayload,
+	nextPkt *OnionPacket) error {
+
+	if payload.Type != PayloadTLV {
+		return nil
+	}
+
+	// Malformed TLV payloads are left to be rejected according to the
+	// TLV strictness of the router.
+	hopData, err := payload.TLVHopData()
+	if err != nil {
+		return nil
+	}
+	record, ok := hopData.ExtraRecords[RendezvousType]
+	if !ok {
+		return nil
+	}
+
+	if len(record) != rendezvousRecordSize {
+		return fmt.Errorf("%w: record of %d bytes, expected %d",
+			ErrInvalidRendezvous, len(record), rendezvousRecordSize)
+	}
+	ephemeralKey, err := parseEphemeralKey(
+		record[:btcec.PubKeyBytesLenCompressed], curve,
+	)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRendezvous, err)
+	}
+	reservedSize := int(binary.BigEndian.Uint16(
+		record[btcec.PubKeyBytesLenCompressed:],
+	))
+	if reservedSize == 0 || reservedSize > len(nextPkt.RoutingInfo) {
+		return fmt.Errorf("%w: reserved size of %d bytes",
+			ErrInvalidRendezvous, reservedSize)
+	}
+
+	nextPkt.EphemeralKey = ephemeralKey
+	zero(nextPkt.RoutingInfo[len(nextPkt.RoutingInfo)-reservedSize:])
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package sphinx
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// newRendezvousTestPath returns a path through the passed nodes, each with a
+// TLV payload forwarding to the next one.
+func newRendezvousTestPath(t *testing.T, nodes []*Router) *PaymentPath {
+	t.Helper()
+
+	var path PaymentPath
+	for i, node := range nodes {
+		var scid [AddressSize]byte
+		scid[0] = byte(i + 1)
+
+		payload, err := NewTLVHopPayload(&TLVHopData{
+			ForwardAmount: uint64(1000 - i),
+			OutgoingCltv:  uint32(100 - i),
+			NextAddress:   &scid,
+		})
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+		path[i] = OnionHop{
+			NodePub:    *node.onionPub,
+			HopPayload: payload,
+		}
+	}
+
+	return &path
+}
+
+// TestSphinxSplicedOnion asserts that a packet spliced onto a partial onion
+// pre-built by the recipient is processed by the hops of both legs, with the
+// rendezvous node continuing into the recipient's leg.
+func TestSphinxSplicedOnion(t *testing.T) {
+	nodes, _, _, _, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	senderNodes, recipientNodes := nodes[:3], nodes[3:]
+	assocData := bytes.Repeat([]byte{'B'}, 32)
+
+	// The recipient builds its leg from the node following the rendezvous
+	// node, with its own session key.
+	recipientPath := newRendezvousTestPath(t, recipientNodes)
+	recipientKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+	partial, err := NewPartialOnion(
+		recipientPath, recipientKey, assocData, 500,
+	)
+	if err != nil {
+		t.Fatalf("unable to create partial onion: %v", err)
+	}
+	tail := partial.RoutingInfo[len(partial.RoutingInfo)-500:]
+	if !bytes.Equal(tail, make([]byte, 500)) {
+		t.Fatalf("reserved bytes of partial onion aren't zero")
+	}
+
+	// The sender splices its route to the rendezvous node onto it.
+	senderPath := newRendezvousTestPath(t, senderNodes)
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	pkt, err := NewSplicedOnionPacket(
+		senderPath, partial, sessionKey, assocData,
+	)
+	if err != nil {
+		t.Fatalf("unable to create spliced onion: %v", err)
+	}
+
+	processed, err := SimulateRoute(nodes, pkt, assocData)
+	if err != nil {
+		t.Fatalf("unable to process spliced onion: %v", err)
+	}
+
+	// The rendezvous node forwards the partial onion verbatim.
+	rendezvous := processed[len(senderNodes)-1].NextPacket
+	expected := &OnionPacket{
+		Version:      baseVersion,
+		EphemeralKey: partial.EphemeralKey,
+		RoutingInfo:  partial.RoutingInfo,
+		HeaderMAC:    partial.HeaderMAC,
+	}
+	if !rendezvous.Equal(expected) {
+		t.Fatalf("rendezvous node doesn't forward the partial onion")
+	}
+
+	// Each hop of the recipient's leg recovers its own payload, and the
+	// last one is the exit hop.
+	for i := range recipientNodes {
+		p := processed[len(senderNodes)+i]
+		if !bytes.Equal(
+			p.Payload.Payload, recipientPath[i].HopPayload.Payload,
+		) {
+			t.Fatalf("recipient hop %d: payload mismatch", i)
+		}
+	}
+	if processed[len(processed)-1].Action != ExitNode {
+		t.Fatalf("last hop isn't the exit hop")
+	}
+
+	// A sender leg exceeding the reserved bytes is rejected.
+	small, err := NewPartialOnion(
+		recipientPath, recipientKey, assocData, 50,
+	)
+	if err != nil {
+		t.Fatalf("unable to create partial onion: %v", err)
+	}
+	_, err = NewSplicedOnionPacket(senderPath, small, sessionKey, assocData)
+	if !errors.Is(err, ErrMaxRoutingInfoSizeExceeded) {
+		t.Fatalf("expected ErrMaxRoutingInfoSizeExceeded, got: %v", err)
+	}
+
+	// So is a partial onion leaving no room for its reserved bytes.
+	_, err = NewPartialOnion(
+		recipientPath, recipientKey, assocData, routingInfoSize,
+	)
+	if !errors.Is(err, ErrMaxRoutingInfoSizeExceeded) {
+		t.Fatalf("expected ErrMaxRoutingInfoSizeExceeded, got: %v", err)
+	}
+}
+
+// TestSphinxInvalidRendezvousRecord asserts that a rendezvous node rejects a
+// malformed rendezvous record within its payload.
+func TestSphinxInvalidRendezvousRecord(t *testing.T) {
+	nodes, _, _, _, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	var path PaymentPath
+	for i, node := range nodes {
+		hopData := &TLVHopData{ForwardAmount: 1}
+		if i == 0 {
+			hopData.ExtraRecords = map[uint64][]byte{
+				RendezvousType: {0x01, 0x02},
+			}
+		}
+		payload, err := NewTLVHopPayload(hopData)
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+		path[i] = OnionHop{
+			NodePub:    *node.onionPub,
+			HopPayload: payload,
+		}
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	pkt, err := NewOnionPacket(&path, sessionKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	_, err = nodes[0].ReconstructOnionPacket(pkt, nil)
+	if !errors.Is(err, ErrInvalidRendezvous) {
+		t.Fatalf("expected ErrInvalidRendezvous, got: %v", err)
+	}
+	var procErr *ProcessingError
+	if !errors.As(err, &procErr) || procErr.Stage != StagePayload {
+		t.Fatalf("expected payload stage error, got: %v", err)
+	}
+}
@@ -1,15 +1,24 @@
 package sphinx
 
 import (
-	"crypto/sha256"
 	"errors"
+	"fmt"
+	"hash"
+	"math"
+	"sync"
 )
 
 const (
 	// HashPrefixSize is the size in bytes of the keys we will be storing
 	// in the ReplayLog. It represents the first 20 bytes of a truncated
-	// sha-256 hash of a secret generated by ECDH.
+	// hash of a secret generated by ECDH, which is sha-256 unless the
+	// router is configured using WithReplayHash.
 	HashPrefixSize = 20
+
+	// migrateBatchSize is the maximum number of entries MigrateReplayLog
+	// writes to the destination log within a single batch, as the
+	// entries of a batch are identified by a 16-bit sequence number.
+	migrateBatchSize = math.MaxUint16 + 1
 )
 
 // HashPrefix is a statically size, 20-byte array containing the prefix
@@ -26,11 +35,12 @@ var errReplayLogAlreadyStarted error = errors.New(
 var errReplayLogNotStarted error = errors.New(
 	"Replay log has not been started")
 
-// hashSharedSecret Sha-256 hashes the shared secret and returns the first
-// HashPrefixSize bytes of the hash.
-func hashSharedSecret(sharedSecret *Hash256) *HashPrefix {
-	// Sha256 hash of sharedSecret
-	h := sha256.New()
+// hashSharedSecret hashes the shared secret using the passed hash function,
+// and returns the first HashPrefixSize bytes of the hash.
+func hashSharedSecret(newHash func() hash.Hash,
+	sharedSecret *Hash256) *HashPrefix {
+
+	h := newHash()
 	h.Write(sharedSecret[:])
 
 	var sharedHash HashPrefix
@@ -64,18 +74,129 @@ type ReplayLog interface {
 	// Delete deletes an entry from the log given its hash prefix.
 	Delete(*HashPrefix) error
 
+	// DeleteStale deletes all entries from the log of which the stored
+	// CLTV expiry is below the passed height. It returns the number of
+	// entries deleted. The replay sets recorded for committed batches are
+	// deleted along with the last of their entries, but aren't counted.
+	DeleteStale(height uint32) (int, error)
+
 	// PutBatch stores a batch of sphinx packets into the log given their hash
 	// prefixes and accompanying values. Returns the set of entries in the batch
 	// that are replays and an error if one occurs.
 	PutBatch(*Batch) (*ReplaySet, error)
+
+	// Stats returns the number of entries stored in the log, along with
+	// the lowest CLTV expiry among them, which is zero if the log is
+	// empty. This allows operators to monitor the size of the log, and
+	// how soon its oldest entry becomes stale.
+	Stats() (count int, oldestCLTV uint32, err error)
+
+	// ForEach calls the passed function with the hash prefix and CLTV
+	// expiry of each entry stored in the log, in no particular order,
+	// stopping at the first error it returns, which is passed through.
+	// The function must not call back into the log.
+	ForEach(func(hash *HashPrefix, cltv uint32) error) error
+}
+
+// MigrateReplayLog copies all entries of the src log, along with their CLTV
+// expiries, into the dst log, such as when moving from a FileReplayLog to a
+// BoltReplayLog, and returns the number of entries migrated. Both logs must
+// be started. Entries already present in dst are left as they are and aren't
+// counted, so an interrupted migration can simply be run again.
+//
+// The entries of src are read in full before any of them are written, in
+// batches, to dst. The source must be quiescent while migrating, as packets
+// recorded in it after the entries have been read are not migrated, and
+// would thus be accepted again by a router switched over to dst.
+func MigrateReplayLog(src, dst ReplayLog) (int, error) {
+	if src == dst {
+		return 0, fmt.Errorf("unable to migrate replay log into itself")
+	}
+
+	type entry struct {
+		hash HashPrefix
+		cltv uint32
+	}
+	var entries []entry
+	err := src.ForEach(func(hash *HashPrefix, cltv uint32) error {
+		entries = append(entries, entry{hash: *hash, cltv: cltv})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var migrated int
+	for len(entries) > 0 {
+		numEntries := len(entries)
+		if numEntries > migrateBatchSize {
+			numEntries = migrateBatchSize
+		}
+
+		batch := NewBatch(nil)
+		for i, entry := range entries[:numEntries] {
+			err := batch.Put(uint16(i), &entry.hash, entry.cltv)
+			if err != nil {
+				return migrated, err
+			}
+		}
+
+		// Entries already present in dst are reported as replays.
+		replays, err := dst.PutBatch(batch)
+		if err != nil {
+			return migrated, err
+		}
+		migrated += numEntries - replays.Size()
+
+		entries = entries[numEntries:]
+	}
+
+	return migrated, nil
+}
+
+// entryStats returns the number of passed entries, along with the lowest CLTV
+// expiry among them, or zero if there are none.
+func entryStats(entries map[HashPrefix]uint32) (int, uint32) {
+	var (
+		oldestCLTV uint32
+		first      = true
+	)
+	for _, cltv := range entries {
+		if first || cltv < oldestCLTV {
+			oldestCLTV = cltv
+			first = false
+		}
+	}
+
+	return len(entries), oldestCLTV
+}
+
+// batchRecord is the replay set recorded for a committed batch, along with the
+// highest CLTV expiry among its entries.
+type batchRecord struct {
+	replays *ReplaySet
+	expiry  uint32
+}
+
+// deleteStaleBatches deletes the records of the passed batches of which the
+// expiry is below the passed height, as all of their entries are stale.
+func deleteStaleBatches(batches map[string]batchRecord, height uint32) {
+	for id, record := range batches {
+		if record.expiry < height {
+			delete(batches, id)
+		}
+	}
 }
 
 // MemoryReplayLog is a simple ReplayLog implementation that stores all added
 // sphinx packets and processed batches in memory with no persistence.
 //
-// This is designed for use just in testing.
+// This is designed for use just in testing. Like any ReplayLog, it is safe for
+// concurrent access.
 type MemoryReplayLog struct {
-	batches map[string]*ReplaySet
+	mu sync.Mutex
+
+	batches map[string]batchRecord
 	entries map[HashPrefix]uint32
 }
 
@@ -86,13 +207,19 @@ func NewMemoryReplayLog() *MemoryReplayLog {
 
 // Start initializes the log and must be called before any other methods.
 func (rl *MemoryReplayLog) Start() error {
-	rl.batches = make(map[string]*ReplaySet)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.batches = make(map[string]batchRecord)
 	rl.entries = make(map[HashPrefix]uint32)
 	return nil
 }
 
 // Stop wipes the state of the log.
 func (rl *MemoryReplayLog) Stop() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
 	if rl.entries == nil || rl.batches == nil {
 		return errReplayLogNotStarted
 	}
@@ -106,6 +233,9 @@ func (rl *MemoryReplayLog) Stop() error {
 // value stored and an error if one occurs. It returns ErrLogEntryNotFound
 // if the entry is not in the log.
 func (rl *MemoryReplayLog) Get(hash *HashPrefix) (uint32, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
 	if rl.entries == nil || rl.batches == nil {
 		return 0, errReplayLogNotStarted
 	}
@@ -122,10 +252,21 @@ func (rl *MemoryReplayLog) Get(hash *HashPrefix) (uint32, error) {
 // purposefully general type. It returns ErrReplayedPacket if the provided hash
 // prefix already exists in the log.
 func (rl *MemoryReplayLog) Put(hash *HashPrefix, cltv uint32) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
 	if rl.entries == nil || rl.batches == nil {
 		return errReplayLogNotStarted
 	}
 
+	return rl.put(hash, cltv)
+}
+
+// put stores an entry into the log, returning ErrReplayedPacket if the hash
+// prefix already exists in the log.
+//
+// NOTE: This method must be called with the log's mutex held.
+func (rl *MemoryReplayLog) put(hash *HashPrefix, cltv uint32) error {
 	_, exists := rl.entries[*hash]
 	if exists {
 		return ErrReplayedPacket
@@ -137,6 +278,9 @@ func (rl *MemoryReplayLog) Put(hash *HashPrefix, cltv uint32) error {
 
 // Delete deletes an entry from the log given its hash prefix.
 func (rl *MemoryReplayLog) Delete(hash *HashPrefix) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
 	if rl.entries == nil || rl.batches == nil {
 		return errReplayLogNotStarted
 	}
@@ -145,22 +289,54 @@ func (rl *MemoryReplayLog) Delete(hash *HashPrefix) error {
 	return nil
 }
 
+// DeleteStale deletes all entries from the log of which the stored CLTV expiry
+// is below the passed height, along with the batches all of whose entries are
+// stale. It returns the number of entries deleted.
+func (rl *MemoryReplayLog) DeleteStale(height uint32) (int, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.entries == nil || rl.batches == nil {
+		return 0, errReplayLogNotStarted
+	}
+
+	var numDeleted int
+	for hash, cltv := range rl.entries {
+		if cltv < height {
+			delete(rl.entries, hash)
+			numDeleted++
+		}
+	}
+	deleteStaleBatches(rl.batches, height)
+
+	return numDeleted, nil
+}
+
 // PutBatch stores a batch of sphinx packets into the log given their hash
 // prefixes and accompanying values. Returns the set of entries in the batch
 // that are replays and an error if one occurs.
 func (rl *MemoryReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
 	if rl.entries == nil || rl.batches == nil {
 		return nil, errReplayLogNotStarted
 	}
 
 	// Return the result when the batch was first processed to provide
-	// idempotence.
-	replays, exists := rl.batches[string(batch.ID)]
+	// idempotence. Batches without an ID can't be looked up again, so
+	// they're never recorded.
+	record, exists := rl.batches[string(batch.ID)]
+	if len(batch.ID) == 0 {
+		exists = false
+	}
+
+	replays := record.replays
 
 	if !exists {
 		replays = NewReplaySet()
 		err := batch.ForEach(func(seqNum uint16, hashPrefix *HashPrefix, cltv uint32) error {
-			err := rl.Put(hashPrefix, cltv)
+			err := rl.put(hashPrefix, cltv)
 			if err == ErrReplayedPacket {
 				replays.Add(seqNum)
 				return nil
@@ -175,7 +351,12 @@ func (rl *MemoryReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
 		}
 
 		replays.Merge(batch.ReplaySet)
-		rl.batches[string(batch.ID)] = replays
+		if len(batch.ID) != 0 {
+			rl.batches[string(batch.ID)] = batchRecord{
+				replays: replays,
+				expiry:  batch.expiry(),
+			}
+		}
 	}
 
 	batch.ReplaySet = replays
@@ -184,5 +365,117 @@ func (rl *MemoryReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
 	return replays, nil
 }
 
+// Stats returns the number of entries stored in the log, along with the lowest
+// CLTV expiry among them.
+func (rl *MemoryReplayLog) Stats() (int, uint32, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.entries == nil || rl.batches == nil {
+		return 0, 0, errReplayLogNotStarted
+	}
+
+	count, oldestCLTV := entryStats(rl.entries)
+	return count, oldestCLTV, nil
+}
+
+// ForEach calls the passed function with the hash prefix and CLTV expiry of
+// each entry stored in the log, stopping at the first error it returns.
+func (rl *MemoryReplayLog) ForEach(fn func(hash *HashPrefix,
+	cltv uint32) error) error {
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.entries == nil || rl.batches == nil {
+		return errReplayLogNotStarted
+	}
+
+	return forEachEntry(rl.entries, fn)
+}
+
+// forEachEntry calls the passed function with each of the passed entries,
+// stopping at the first error it returns.
+func forEachEntry(entries map[HashPrefix]uint32,
+	fn func(hash *HashPrefix, cltv uint32) error) error {
+
+	for hash, cltv := range entries {
+		hash := hash
+		if err := fn(&hash, cltv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // A compile time asserting *MemoryReplayLog implements the RelayLog interface.
 var _ ReplayLog = (*MemoryReplayLog)(nil)
+
+// NopReplayLog is a ReplayLog which records nothing, and thus never detects a
+// replayed packet. A Router using it processes the same packet any number of
+// times without ever returning ErrReplayedPacket.
+//
+// WARNING: This disables replay protection entirely. It must only be used by
+// deployments which protect against replays by other means, such as stateless
+// relays behind a node that already performs replay checking.
+type NopReplayLog struct{}
+
+// NewNopReplayLog constructs a new NopReplayLog.
+func NewNopReplayLog() *NopReplayLog {
+	return &NopReplayLog{}
+}
+
+// Start is a no-op.
+func (*NopReplayLog) Start() error {
+	return nil
+}
+
+// Stop is a no-op.
+func (*NopReplayLog) Stop() error {
+	return nil
+}
+
+// Get always returns ErrLogEntryNotFound, as no entries are ever stored.
+func (*NopReplayLog) Get(*HashPrefix) (uint32, error) {
+	return 0, ErrLogEntryNotFound
+}
+
+// Put discards the entry, and never returns ErrReplayedPacket.
+func (*NopReplayLog) Put(*HashPrefix, uint32) error {
+	return nil
+}
+
+// Delete is a no-op.
+func (*NopReplayLog) Delete(*HashPrefix) error {
+	return nil
+}
+
+// DeleteStale is a no-op, as there are never any entries to delete.
+func (*NopReplayLog) DeleteStale(uint32) (int, error) {
+	return 0, nil
+}
+
+// PutBatch discards the entries of the batch, and always returns an empty
+// replay set, even if the batch itself contains duplicate packets.
+func (*NopReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	replays := NewReplaySet()
+
+	batch.ReplaySet = replays
+	batch.IsCommitted = true
+
+	return replays, nil
+}
+
+// Stats always reports an empty log, as no entries are ever stored.
+func (*NopReplayLog) Stats() (int, uint32, error) {
+	return 0, 0, nil
+}
+
+// ForEach never calls the passed function, as no entries are ever stored.
+func (*NopReplayLog) ForEach(func(hash *HashPrefix, cltv uint32) error) error {
+	return nil
+}
+
+// A compile time asserting *NopReplayLog implements the RelayLog interface.
+var _ ReplayLog = (*NopReplayLog)(nil)
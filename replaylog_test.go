@@ -130,3 +130,291 @@ func TestMemoryReplayLogPutBatch(t *testing.T) {
 		t.Fatalf("Unexpected replay set after adding batch 2 to log: %v", err)
 	}
 }
+
+// testReplayLogDeleteStale asserts that DeleteStale on the passed, started,
+// replay log only removes the entries with a CLTV below the given height.
+func testReplayLogDeleteStale(t *testing.T, rl ReplayLog) {
+	var hashPrefixes [4]HashPrefix
+	for i := range hashPrefixes {
+		hashPrefixes[i][0] = byte(i)
+		if err := rl.Put(&hashPrefixes[i], uint32(i)*10); err != nil {
+			t.Fatalf("unable to put entry %d: %v", i, err)
+		}
+	}
+
+	// Only the entries with a CLTV of 0 and 10 lie below height 20.
+	numDeleted, err := rl.DeleteStale(20)
+	if err != nil {
+		t.Fatalf("unable to delete stale entries: %v", err)
+	}
+	if numDeleted != 2 {
+		t.Fatalf("expected 2 deleted entries, got %d", numDeleted)
+	}
+
+	for i := range hashPrefixes {
+		_, err := rl.Get(&hashPrefixes[i])
+		switch {
+		case i < 2 && err != ErrLogEntryNotFound:
+			t.Fatalf("entry %d should have been deleted: %v", i, err)
+		case i >= 2 && err != nil:
+			t.Fatalf("entry %d should have been kept: %v", i, err)
+		}
+	}
+
+	// Deleting again at the same height should be a no-op.
+	numDeleted, err = rl.DeleteStale(20)
+	if err != nil {
+		t.Fatalf("unable to delete stale entries: %v", err)
+	}
+	if numDeleted != 0 {
+		t.Fatalf("expected no deleted entries, got %d", numDeleted)
+	}
+}
+
+// TestMemoryReplayLogDeleteStale tests that stale entries are pruned from a
+// MemoryReplayLog by their CLTV expiry.
+func TestMemoryReplayLogDeleteStale(t *testing.T) {
+	rl := NewMemoryReplayLog()
+	rl.Start()
+	defer rl.Stop()
+
+	testReplayLogDeleteStale(t, rl)
+}
+
+// testReplayLogDeleteStaleBatches asserts that DeleteStale on the passed,
+// started, replay log drops the replay set recorded for a batch once all of
+// its entries are stale, while keeping those of batches with live entries.
+func testReplayLogDeleteStaleBatches(t *testing.T, rl ReplayLog) {
+	var hashPrefixes [4]HashPrefix
+	for i := range hashPrefixes {
+		hashPrefixes[i][0] = byte(i)
+	}
+
+	commit := func(id string, entries ...batchEntry) *ReplaySet {
+		t.Helper()
+
+		batch := NewBatch([]byte(id))
+		for i, e := range entries {
+			err := batch.Put(uint16(i), &e.hashPrefix, e.cltv)
+			if err != nil {
+				t.Fatalf("unable to add entry to batch: %v", err)
+			}
+		}
+
+		replays, err := rl.PutBatch(batch)
+		if err != nil {
+			t.Fatalf("unable to put batch: %v", err)
+		}
+
+		return replays
+	}
+
+	// The first batch expires at height 15, the second one at 30.
+	commit(
+		"stale", batchEntry{hashPrefixes[0], 5},
+		batchEntry{hashPrefixes[1], 15},
+	)
+	commit("live", batchEntry{hashPrefixes[2], 30})
+
+	if _, err := rl.DeleteStale(20); err != nil {
+		t.Fatalf("unable to delete stale entries: %v", err)
+	}
+
+	// Once a packet is recorded outside of the batches, committing them
+	// again only detects it as a replay if the batch's replay set was
+	// dropped, rather than returned as recorded.
+	if err := rl.Put(&hashPrefixes[3], 50); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+
+	replays := commit("stale", batchEntry{hashPrefixes[3], 50})
+	if !replays.Contains(0) {
+		t.Fatalf("expected replay set of stale batch to be dropped")
+	}
+
+	replays = commit("live", batchEntry{hashPrefixes[3], 50})
+	if replays.Size() != 0 {
+		t.Fatalf("expected replay set of live batch to be kept")
+	}
+}
+
+// TestMemoryReplayLogDeleteStaleBatches tests that the replay sets of expired
+// batches are pruned from a MemoryReplayLog.
+func TestMemoryReplayLogDeleteStaleBatches(t *testing.T) {
+	rl := NewMemoryReplayLog()
+	rl.Start()
+	defer rl.Stop()
+
+	testReplayLogDeleteStaleBatches(t, rl)
+}
+
+// testReplayLogStats asserts that the stats of the passed, started, replay log
+// track the number of entries and the lowest CLTV expiry among them as
+// entries are added and removed.
+func testReplayLogStats(t *testing.T, rl ReplayLog) {
+	assertStats := func(expectedCount int, expectedCLTV uint32) {
+		t.Helper()
+
+		count, oldestCLTV, err := rl.Stats()
+		if err != nil {
+			t.Fatalf("unable to query stats: %v", err)
+		}
+		if count != expectedCount || oldestCLTV != expectedCLTV {
+			t.Fatalf("expected %d entries with oldest cltv %d, "+
+				"got %d with oldest cltv %d", expectedCount,
+				expectedCLTV, count, oldestCLTV)
+		}
+	}
+
+	assertStats(0, 0)
+
+	cltvs := []uint32{300, 100, 200}
+	hashPrefixes := make([]HashPrefix, len(cltvs))
+	for i, cltv := range cltvs {
+		hashPrefixes[i][0] = byte(i)
+		if err := rl.Put(&hashPrefixes[i], cltv); err != nil {
+			t.Fatalf("unable to put entry %d: %v", i, err)
+		}
+	}
+	assertStats(3, 100)
+
+	// Entries added as part of a batch are accounted for as well.
+	batch := NewBatch([]byte("batch"))
+	var batchPrefix HashPrefix
+	batchPrefix[0] = 0xff
+	if err := batch.Put(0, &batchPrefix, 400); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	if _, err := rl.PutBatch(batch); err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+	assertStats(4, 100)
+
+	// Removing the oldest entry moves the oldest expiry forward.
+	if err := rl.Delete(&hashPrefixes[1]); err != nil {
+		t.Fatalf("unable to delete entry: %v", err)
+	}
+	assertStats(3, 200)
+
+	if _, err := rl.DeleteStale(350); err != nil {
+		t.Fatalf("unable to delete stale entries: %v", err)
+	}
+	assertStats(1, 400)
+}
+
+// testReplayLogMigration asserts that MigrateReplayLog copies all entries of
+// the passed, started, src log into the dst log along with their CLTV expiry,
+// leaving entries already present in dst untouched.
+func testReplayLogMigration(t *testing.T, src, dst ReplayLog) {
+	cltvs := []uint32{300, 100, 200, 400}
+	hashPrefixes := make([]HashPrefix, len(cltvs))
+	for i, cltv := range cltvs[:3] {
+		hashPrefixes[i][0] = byte(i)
+		if err := src.Put(&hashPrefixes[i], cltv); err != nil {
+			t.Fatalf("unable to put entry %d: %v", i, err)
+		}
+	}
+
+	// Entries added as part of a batch are migrated as well.
+	batch := NewBatch([]byte("batch"))
+	hashPrefixes[3][0] = 0xff
+	if err := batch.Put(0, &hashPrefixes[3], cltvs[3]); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	if _, err := src.PutBatch(batch); err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+
+	// The destination already holds one of the entries, with another
+	// expiry, which is kept.
+	if err := dst.Put(&hashPrefixes[0], 500); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+
+	migrated, err := MigrateReplayLog(src, dst)
+	if err != nil {
+		t.Fatalf("unable to migrate replay log: %v", err)
+	}
+	if migrated != len(cltvs)-1 {
+		t.Fatalf("expected %d entries migrated, got %d", len(cltvs)-1,
+			migrated)
+	}
+
+	for i, expectedCLTV := range append([]uint32{500}, cltvs[1:]...) {
+		cltv, err := dst.Get(&hashPrefixes[i])
+		if err != nil {
+			t.Fatalf("entry %d wasn't migrated: %v", i, err)
+		}
+		if cltv != expectedCLTV {
+			t.Fatalf("entry %d: expected cltv %d, got %d", i,
+				expectedCLTV, cltv)
+		}
+
+		err = dst.Put(&hashPrefixes[i], expectedCLTV)
+		if err != ErrReplayedPacket {
+			t.Fatalf("expected migrated entry %d to be a replay, "+
+				"got: %v", i, err)
+		}
+	}
+
+	// Migrating again finds all entries already present.
+	migrated, err = MigrateReplayLog(src, dst)
+	if err != nil {
+		t.Fatalf("unable to migrate replay log: %v", err)
+	}
+	if migrated != 0 {
+		t.Fatalf("expected no entries migrated, got %d", migrated)
+	}
+
+	if _, err := MigrateReplayLog(src, src); err == nil {
+		t.Fatalf("expected migrating a log into itself to fail")
+	}
+}
+
+// TestMemoryReplayLogMigration tests migrating between two MemoryReplayLogs,
+// including one holding more entries than fit within a single batch.
+func TestMemoryReplayLogMigration(t *testing.T) {
+	src := NewMemoryReplayLog()
+	src.Start()
+	defer src.Stop()
+
+	dst := NewMemoryReplayLog()
+	dst.Start()
+	defer dst.Stop()
+
+	testReplayLogMigration(t, src, dst)
+
+	large := NewMemoryReplayLog()
+	large.Start()
+	defer large.Stop()
+
+	const numEntries = migrateBatchSize + 100
+	for i := 0; i < numEntries; i++ {
+		var hashPrefix HashPrefix
+		hashPrefix[0] = 0x80
+		hashPrefix[1] = byte(i >> 16)
+		hashPrefix[2] = byte(i >> 8)
+		hashPrefix[3] = byte(i)
+		if err := large.Put(&hashPrefix, uint32(i)); err != nil {
+			t.Fatalf("unable to put entry %d: %v", i, err)
+		}
+	}
+
+	migrated, err := MigrateReplayLog(large, dst)
+	if err != nil {
+		t.Fatalf("unable to migrate replay log: %v", err)
+	}
+	if migrated != numEntries {
+		t.Fatalf("expected %d entries migrated, got %d", numEntries,
+			migrated)
+	}
+}
+
+// TestMemoryReplayLogStats tests the stats reported by a MemoryReplayLog.
+func TestMemoryReplayLogStats(t *testing.T) {
+	rl := NewMemoryReplayLog()
+	rl.Start()
+	defer rl.Stop()
+
+	testReplayLogStats(t, rl)
+}
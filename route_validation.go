@@ -0,0 +1,155 @@
+package sphinx
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// ValidateRoute checks that the passed onion packet, constructed using the
+// passed session key, routes through the nodes of route in order, and
+// delivers payloads[i] to the i-th of them. It peels the packet layer by
+// layer using the shared secrets of the route, exactly like the hops will,
+// and compares the payload each of them recovers. Any options the packet was
+// constructed with that alter its key derivation or exit payload, such as
+// WithPacketKeyTags or WithPaddedFinalPayload, must be passed in as well.
+//
+// This allows a sender to catch bugs in building the route before sending the
+// packet. An error wrapping ErrRouteMismatch, describing the first hop that
+// diverges, is returned if the packet doesn't match.
+//
+// NOTE: As the associated data isn't needed, the HMAC of each layer isn't
+// verified. Only the payloads, and whether the final payload is marked as
+// such, are compared.
+func ValidateRoute(packet *OnionPacket, route []*btcec.PublicKey,
+	sessionKey *btcec.PrivateKey, payloads [][]byte,
+	opts ...OnionPacketOption) error {
+
+	if len(payloads) != len(route) {
+		return fmt.Errorf("route of %d hops has %d payloads",
+			len(route), len(payloads))
+	}
+
+	sharedSecrets, err := GenerateSharedSecrets(route, sessionKey)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range sharedSecrets {
+			zero(sharedSecrets[i][:])
+		}
+	}()
+
+	if packet.EphemeralKey == nil ||
+		!packet.EphemeralKey.IsEqual(sessionKey.PubKey()) {
+
+		return fmt.Errorf("%w: ephemeral key doesn't match session key",
+			ErrRouteMismatch)
+	}
+
+	cfg := newOnionPacketCfg(opts)
+	var (
+		routeInfo = append([]byte(nil), packet.RoutingInfo...)
+		hopInfo   = make([]byte, 2*len(routeInfo))
+	)
+	for i := range route {
+		// Peel off the layer of this hop, revealing its payload and
+		// the routing info for the next hop.
+		rhoKey := generateKey(cfg.keyTags.Rho, &sharedSecrets[i])
+		copy(hopInfo, routeInfo)
+		zero(hopInfo[len(routeInfo):])
+		xorCipherStream(hopInfo, hopInfo, rhoKey)
+		zero(rhoKey[:])
+
+		var hopPayload HopPayload
+		err := hopPayload.Decode(bytes.NewReader(hopInfo))
+		if err != nil {
+			return fmt.Errorf("%w: unable to decode payload of "+
+				"hop %d: %v", ErrRouteMismatch, i, err)
+		}
+		if hopPayload.NumBytes() > len(routeInfo) {
+			return fmt.Errorf("%w: payload of hop %d exceeds the "+
+				"routing info", ErrRouteMismatch, i)
+		}
+
+		isExit := isTerminalHMAC(&hopPayload.HMAC)
+		switch {
+		case isExit && i != len(route)-1:
+			return fmt.Errorf("%w: packet terminates at hop %d of "+
+				"%d", ErrRouteMismatch, i, len(route))
+
+		case !isExit && i == len(route)-1:
+			return fmt.Errorf("%w: packet continues past the "+
+				"final hop", ErrRouteMismatch)
+		}
+
+		payload := hopPayload.Payload
+		if isExit && cfg.finalPayloadSize > 0 {
+			payload, err = unpadPayload(payload)
+			if err != nil {
+				return fmt.Errorf("%w: invalid padding of the "+
+					"final payload: %v", ErrRouteMismatch,
+					err)
+			}
+		}
+		if !bytes.Equal(payload, payloads[i]) {
+			return fmt.Errorf("%w: hop %d recovers payload %x, "+
+				"expected %x", ErrRouteMismatch, i, payload,
+				payloads[i])
+		}
+
+		copy(routeInfo, hopInfo[hopPayload.NumBytes():])
+	}
+
+	return nil
+}
+
+// SimulateRoute runs the passed onion packet through each of the routers in
+// order, exactly like the hops of its route will, and returns the packet each
+// of them processed. This allows test networks, where the onion keys of all
+// hops are at hand, to verify that the HMAC of every layer checks out before
+// sending the packet, using the same associated data at every hop.
+//
+// Processing stops at the first router which fails to process the packet, in
+// which case the packets processed up to that point are returned along with
+// an error identifying the hop. If the packet terminates before the last
+// router, or continues past it, an error wrapping ErrRouteMismatch is
+// returned.
+//
+// NOTE: The packets are processed using ReconstructOnionPacket, so they're
+// neither checked against, nor recorded in, the replay logs of the routers,
+// which don't need to be started.
+func SimulateRoute(nodes []*Router, packet *OnionPacket, assocData []byte,
+	opts ...ProcessOnionOpt) ([]*ProcessedPacket, error) {
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("route of length zero passed in")
+	}
+
+	processed := make([]*ProcessedPacket, 0, len(nodes))
+	for i, node := range nodes {
+		pkt, err := node.ReconstructOnionPacket(
+			packet, assocData, opts...,
+		)
+		if err != nil {
+			return processed, fmt.Errorf("hop %d unable to process "+
+				"packet: %w", i, err)
+		}
+		processed = append(processed, pkt)
+
+		switch {
+		case pkt.Action == ExitNode && i != len(nodes)-1:
+			return processed, fmt.Errorf("%w: packet terminates at "+
+				"hop %d of %d", ErrRouteMismatch, i, len(nodes))
+
+		case pkt.Action != ExitNode && i == len(nodes)-1:
+			return processed, fmt.Errorf("%w: packet continues "+
+				"past the final hop", ErrRouteMismatch)
+		}
+
+		packet = pkt.NextPacket
+	}
+
+	return processed, nil
+}
@@ -0,0 +1,162 @@
+package sphinx
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// TestValidateRoute asserts that a packet validates against the route it was
+// constructed for, while mutated payloads and routes are reported as a
+// mismatch.
+func TestValidateRoute(t *testing.T) {
+	_, route, _, _, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		route[i].HopPayload, err = NewHopPayload(
+			nil, bytes.Repeat([]byte{byte(i + 1)}, 10+i),
+		)
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+	}
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+	packet, err := NewOnionPacket(
+		route, sessionKey, nil, WithPaddedFinalPayload(100),
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	nodeKeys := route.NodeKeys()
+	payloads := make([][]byte, len(nodeKeys))
+	for i := range payloads {
+		payloads[i] = route[i].HopPayload.Payload
+	}
+
+	err = ValidateRoute(
+		packet, nodeKeys, sessionKey, payloads,
+		WithPaddedFinalPayload(100),
+	)
+	if err != nil {
+		t.Fatalf("unable to validate route: %v", err)
+	}
+
+	// Mutating any one of the payloads must be detected.
+	for i := range payloads {
+		mutated := make([][]byte, len(payloads))
+		copy(mutated, payloads)
+		mutated[i] = append([]byte(nil), payloads[i]...)
+		mutated[i][0] ^= 0xff
+
+		err := ValidateRoute(
+			packet, nodeKeys, sessionKey, mutated,
+			WithPaddedFinalPayload(100),
+		)
+		if !errors.Is(err, ErrRouteMismatch) {
+			t.Fatalf("hop %d: expected route mismatch, got %v",
+				i, err)
+		}
+	}
+
+	// As must routes through other nodes, or of a different length.
+	swapped := []*btcec.PublicKey{nodeKeys[1], nodeKeys[0], nodeKeys[2]}
+	tests := []struct {
+		name     string
+		route    []*btcec.PublicKey
+		payloads [][]byte
+	}{
+		{
+			name:     "swapped nodes",
+			route:    swapped,
+			payloads: payloads,
+		},
+		{
+			name:     "shorter route",
+			route:    nodeKeys[:2],
+			payloads: payloads[:2],
+		},
+	}
+	for _, test := range tests {
+		err := ValidateRoute(
+			packet, test.route, sessionKey, test.payloads,
+			WithPaddedFinalPayload(100),
+		)
+		if !errors.Is(err, ErrRouteMismatch) {
+			t.Fatalf("%s: expected route mismatch, got %v",
+				test.name, err)
+		}
+	}
+
+	// Finally, a packet built with another session key doesn't validate.
+	otherKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+	err = ValidateRoute(
+		packet, nodeKeys, otherKey, payloads,
+		WithPaddedFinalPayload(100),
+	)
+	if !errors.Is(err, ErrRouteMismatch) {
+		t.Fatalf("expected route mismatch, got %v", err)
+	}
+}
+
+// TestSimulateRoute asserts that a packet is run through every router of its
+// route, and that the first hop to fail, as well as a route which doesn't end
+// where the packet does, is reported.
+func TestSimulateRoute(t *testing.T) {
+	nodes, _, hopDatas, fwdMsg, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	processed, err := SimulateRoute(nodes, fwdMsg, nil)
+	if err != nil {
+		t.Fatalf("unable to simulate route: %v", err)
+	}
+	if len(processed) != len(nodes) {
+		t.Fatalf("expected %d processed packets, got %d", len(nodes),
+			len(processed))
+	}
+	for i, pkt := range processed {
+		if *pkt.ForwardingInstructions != (*hopDatas)[i] {
+			t.Fatalf("hop %d received wrong hop data", i)
+		}
+	}
+	if processed[len(nodes)-1].Action != ExitNode {
+		t.Fatalf("expected final hop to be the exit node")
+	}
+
+	// Mismatching associated data fails the HMAC check at the first hop.
+	processed, err = SimulateRoute(nodes, fwdMsg, []byte("assoc"))
+	if !errors.Is(err, ErrInvalidOnionHMAC) || len(processed) != 0 {
+		t.Fatalf("expected ErrInvalidOnionHMAC at first hop, got %d "+
+			"packets and: %v", len(processed), err)
+	}
+
+	// A router missing from the route fails at the hop it's skipped at.
+	skipped := append(append([]*Router(nil), nodes[:2]...), nodes[3:]...)
+	processed, err = SimulateRoute(skipped, fwdMsg, nil)
+	if !errors.Is(err, ErrInvalidOnionHMAC) || len(processed) != 2 {
+		t.Fatalf("expected ErrInvalidOnionHMAC at hop 2, got %d "+
+			"packets and: %v", len(processed), err)
+	}
+
+	// Routes ending before or after the packet are a mismatch.
+	for _, route := range [][]*Router{nodes[:4], append(nodes, nodes[0])} {
+		_, err := SimulateRoute(route, fwdMsg, nil)
+		if !errors.Is(err, ErrRouteMismatch) {
+			t.Fatalf("route of %d hops: expected route mismatch, "+
+				"got %v", len(route), err)
+		}
+	}
+}
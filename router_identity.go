@@ -0,0 +1,77 @@
+package sphinx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil"
+)
+
+// RouterIdentitySize is the size of a serialized RouterIdentity: the node ID
+// followed by the compressed onion public key.
+const RouterIdentitySize = AddressSize + btcec.PubKeyBytesLenCompressed
+
+// RouterIdentity is the public identity of a Router, which clients need in
+// order to include the router in the routes they construct.
+type RouterIdentity struct {
+	// NodeID is the identifier of the router, which is derived from its
+	// onion public key.
+	NodeID [AddressSize]byte
+
+	// PubKey is the onion public key of the router, with which the shared
+	// secret for its hop is derived.
+	PubKey *btcec.PublicKey
+}
+
+// PublicKey returns the onion public key of the router, which clients use to
+// construct packets it's able to process.
+func (r *Router) PublicKey() *btcec.PublicKey {
+	return r.onionPub
+}
+
+// EncodeIdentity writes the public identity of the router to the passed
+// io.Writer, as the node ID followed by the compressed onion public key. The
+// identity can be read back using DecodeRouterIdentity.
+func (r *Router) EncodeIdentity(w io.Writer) error {
+	var b [RouterIdentitySize]byte
+	copy(b[:AddressSize], r.nodeID[:])
+	serializeCompressed(b[AddressSize:], r.onionPub)
+
+	_, err := w.Write(b[:])
+	return err
+}
+
+// DecodeRouterIdentity reads the public identity of a router, as written by
+// Router.EncodeIdentity, from the passed io.Reader. An identity of which the
+// node ID doesn't match the onion public key is rejected.
+func DecodeRouterIdentity(r io.Reader) (*RouterIdentity, error) {
+	var identity RouterIdentity
+	if _, err := io.ReadFull(r, identity.NodeID[:]); err != nil {
+		return nil, err
+	}
+
+	pubKey, err := readPubKey(r)
+	if err != nil {
+		return nil, err
+	}
+	identity.PubKey = pubKey
+
+	nodeID := btcutil.Hash160(pubKey.SerializeCompressed())
+	if !bytes.Equal(identity.NodeID[:], nodeID[:AddressSize]) {
+		return nil, fmt.Errorf("node id %x doesn't match onion "+
+			"public key", identity.NodeID)
+	}
+
+	return &identity, nil
+}
+
+// OnionHop returns the entry for the router within a route, which delivers
+// the passed payload to it.
+func (i *RouterIdentity) OnionHop(payload HopPayload) OnionHop {
+	return OnionHop{
+		NodePub:    *i.PubKey,
+		HopPayload: payload,
+	}
+}
@@ -0,0 +1,77 @@
+package sphinx
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestRouterIdentity asserts that a route built from the encoded identities of
+// a set of routers can be processed by them, and that malformed identities are
+// rejected.
+func TestRouterIdentity(t *testing.T) {
+	nodes, route, _, _, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	var (
+		identities  [][]byte
+		clientRoute PaymentPath
+	)
+	for i, node := range nodes {
+		if !node.PublicKey().IsEqual(&route[i].NodePub) {
+			t.Fatalf("node %d exposes wrong public key", i)
+		}
+
+		var b bytes.Buffer
+		if err := node.EncodeIdentity(&b); err != nil {
+			t.Fatalf("unable to encode identity: %v", err)
+		}
+		if b.Len() != RouterIdentitySize {
+			t.Fatalf("expected identity of %d bytes, got %d",
+				RouterIdentitySize, b.Len())
+		}
+		identities = append(identities, b.Bytes())
+
+		identity, err := DecodeRouterIdentity(&b)
+		if err != nil {
+			t.Fatalf("unable to decode identity: %v", err)
+		}
+		if identity.NodeID != node.nodeID {
+			t.Fatalf("node %d: expected node id %x, got %x", i,
+				node.nodeID, identity.NodeID)
+		}
+		clientRoute[i] = identity.OnionHop(route[i].HopPayload)
+	}
+
+	// The route built from the identities must be processable by the
+	// routers they belong to.
+	fwdMsg, _, err := NewOnionPacketWithRandomSession(&clientRoute, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	for i, node := range nodes {
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+		fwdMsg = pkt.NextPacket
+	}
+
+	// An identity with a node ID not matching the public key is rejected.
+	badIdentity := append([]byte(nil), identities[0]...)
+	badIdentity[0] ^= 0x01
+	_, err = DecodeRouterIdentity(bytes.NewReader(badIdentity))
+	if err == nil {
+		t.Fatalf("expected mismatching node id to be rejected")
+	}
+
+	// As is a truncated one.
+	_, err = DecodeRouterIdentity(
+		bytes.NewReader(identities[0][:RouterIdentitySize-1]),
+	)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+}
@@ -2,16 +2,27 @@ package sphinx
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
-	"crypto/hmac"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"math"
 	"math/big"
+	"sync"
+	"time"
 
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcutil"
+	"golang.org/x/crypto/hkdf"
 )
 
 const (
@@ -20,6 +31,10 @@ const (
 	// as 8 byte channel_id.
 	AddressSize = 8
 
+	// PaymentHashSize is the size of the payment hash onion packets are
+	// commonly bound to as their associated data.
+	PaymentHashSize = 32
+
 	// RealmByteSize is the number of bytes that the realm byte occupies.
 	RealmByteSize = 1
 
@@ -37,28 +52,56 @@ const (
 	// utilize this space to pack in the unrolled bytes.
 	NumPaddingBytes = 12
 
-	// HopDataSize is the fixed size of hop_data. BOLT 04 currently
+	// LegacyHopDataSize is the fixed size of legacy hop_data. BOLT 04
 	// specifies this to be 1 byte realm, 8 byte channel_id, 8 byte amount
 	// to forward, 4 byte outgoing CLTV value, 12 bytes padding and 32
 	// bytes HMAC for a total of 65 bytes per hop.
-	HopDataSize = (RealmByteSize + AddressSize + AmtForwardSize +
+	LegacyHopDataSize = (RealmByteSize + AddressSize + AmtForwardSize +
 		OutgoingCLTVSize + NumPaddingBytes + HMACSize)
 
+	// MaxPayloadSize is the maximum size a payload for a single hop can
+	// be. This is the worst case scenario of a single hop, consuming all
+	// available space. We need to know this in order to generate a
+	// sufficiently long stream of pseudo-random bytes when
+	// encrypting/decrypting the payload.
+	MaxPayloadSize = routingInfoSize
+
 	// sharedSecretSize is the size in bytes of the shared secrets.
 	sharedSecretSize = 32
 
 	// routingInfoSize is the fixed size of the the routing info. This
-	// consists of a addressSize byte address and a HMACSize byte HMAC for
+	// consists of the variable length payload and HMACSize byte HMAC for
 	// each hop of the route, the first pair in cleartext and the following
-	// pairs increasingly obfuscated. In case fewer than numMaxHops are
-	// used, then the remainder is padded with null-bytes, also obfuscated.
-	routingInfoSize = NumMaxHops * HopDataSize
+	// pairs increasingly obfuscated. If not all space is used up, the
+	// remainder is padded with null-bytes, also obfuscated.
+	routingInfoSize = 1300
+
+	// OnionPacketSize is the size of a serialized onion packet of the
+	// default geometry: the version byte, the compressed ephemeral key, the
+	// routing info and the HMAC. The size of packets of other geometries
+	// is given by OnionPacketConfig.PacketSize.
+	OnionPacketSize = 1 + btcec.PubKeyBytesLenCompressed +
+		routingInfoSize + HMACSize
+
+	// DefaultMaxHops is the maximum number of legacy hops that fit within
+	// the routing info of a default sized onion packet. Packets with a
+	// different geometry can be constructed and processed by configuring a
+	// different maximum hop count, see WithMaxHops and WithPacketMaxHops,
+	// or a different OnionPacketConfig altogether.
+	DefaultMaxHops = routingInfoSize / LegacyHopDataSize
+
+	// DefaultStaleEntryDelta is the default number of blocks past their
+	// CLTV expiry that replay log entries are retained for, which guards
+	// against removing entries that may become valid again after a
+	// shallow reorg.
+	DefaultStaleEntryDelta = 6
 
 	// numStreamBytes is the number of bytes produced by our CSPRG for the
 	// key stream implementing our stream cipher to encrypt/decrypt the mix
-	// header. The last hopDataSize bytes are only used in order to
-	// generate/check the MAC over the header.
-	numStreamBytes = routingInfoSize + HopDataSize
+	// header. The MaxPayloadSize bytes at the end are used to
+	// encrypt/decrypt the fillers when processing the packet or generating
+	// the HMACs when creating the packet.
+	numStreamBytes = routingInfoSize + MaxPayloadSize
 
 	// keyLen is the length of the keys used to generate cipher streams and
 	// encrypt payloads. Since we use SHA256 to generate the keys, the
@@ -79,6 +122,9 @@ const (
 // re-randomize the ephemeral key for the next node in the path. This per-hop
 // re-randomization allows us to only propagate a single group element through
 // the onion route.
+//
+// All fields are exported, so callers can read the version and ephemeral key
+// of a packet directly, e.g. to key packets by their ephemeral point.
 type OnionPacket struct {
 	// Version denotes the version of this onion packet. The version
 	// indicates how a receiver of the packet should interpret the bytes
@@ -94,8 +140,9 @@ type OnionPacket struct {
 
 	// RoutingInfo is the full routing information for this onion packet.
 	// This encodes all the forwarding instructions for this current hop
-	// and all the hops in the route.
-	RoutingInfo [routingInfoSize]byte
+	// and all the hops in the route. Its length is determined by the
+	// maximum number of hops the packet was constructed for.
+	RoutingInfo []byte
 
 	// HeaderMAC is an HMAC computed with the shared secret of the routing
 	// data and the associated data for this route. Including the
@@ -104,12 +151,11 @@ type OnionPacket struct {
 	HeaderMAC [HMACSize]byte
 }
 
-// HopData is the information destined for individual hops. It is a fixed size
-// 64 bytes, prefixed with a 1 byte realm that indicates how to interpret it.
-// For now we simply assume it's the bitcoin realm (0x00) and hence the format
-// is fixed. The last 32 bytes are always the HMAC to be passed to the next
-// hop, or zero if this is the packet is not to be forwarded, since this is the
-// last hop.
+// HopData is the information destined for individual hops within a legacy
+// payload. It is a fixed size 33 bytes, prefixed with a 1 byte realm that
+// indicates how to interpret it. For now we simply assume it's the bitcoin
+// realm (0x00) and hence the format is fixed. Within the routing info, it is
+// followed by the HMAC to be passed to the next hop.
 type HopData struct {
 	// Realm denotes the "real" of target chain of the next hop. For
 	// bitcoin, this value will be 0x00.
@@ -136,10 +182,6 @@ type HopData struct {
 	//
 	// TODO(roasbeef): rename to padding bytes?
 	ExtraBytes [NumPaddingBytes]byte
-
-	// HMAC is an HMAC computed over the entire per-hop payload that also
-	// includes the higher-level (optional) associated data bytes.
-	HMAC [HMACSize]byte
 }
 
 // Encode writes the serialized version of the target HopData into the passed
@@ -165,10 +207,6 @@ func (hd *HopData) Encode(w io.Writer) error {
 		return err
 	}
 
-	if _, err := w.Write(hd.HMAC[:]); err != nil {
-		return err
-	}
-
 	return nil
 }
 
@@ -195,11 +233,32 @@ func (hd *HopData) Decode(r io.Reader) error {
 		return err
 	}
 
-	if _, err := io.ReadFull(r, hd.HMAC[:]); err != nil {
-		return err
+	return nil
+}
+
+// GenerateSharedSecrets re-derives the shared secrets of each hop in the
+// route, in order, exactly as they were derived when constructing an onion
+// packet for the route using the passed session key. This allows the sender
+// to recover the keys needed to decrypt an error returned for the packet,
+// without retaining them from the call to NewOnionPacket.
+func GenerateSharedSecrets(route []*btcec.PublicKey,
+	sessionKey *btcec.PrivateKey) ([]Hash256, error) {
+
+	switch {
+	case len(route) == 0:
+		return nil, fmt.Errorf("route of length zero passed in")
+
+	case sessionKey == nil:
+		return nil, fmt.Errorf("no session key passed in")
 	}
 
-	return nil
+	for i, nodePub := range route {
+		if nodePub == nil {
+			return nil, fmt.Errorf("node key of hop %d is nil", i)
+		}
+	}
+
+	return generateSharedSecrets(route, sessionKey), nil
 }
 
 // generateSharedSecrets by the given nodes pubkeys, generates the shared
@@ -215,6 +274,10 @@ func generateSharedSecrets(paymentPath []*btcec.PublicKey,
 	numHops := len(paymentPath)
 	hopSharedSecrets := make([]Hash256, numHops)
 
+	// All group operations are performed over the curve of the session
+	// key, which must match the curve of the node keys in the path.
+	curve := sessionKey.Curve
+
 	// Compute the triplet for the first hop outside of the main loop.
 	// Within the loop each new triplet will be computed recursively based
 	// off of the blinding factor of the last hop.
@@ -242,19 +305,21 @@ func generateSharedSecrets(paymentPath []*btcec.PublicKey,
 		// Update the cached blinding factor with b_{i-1}.
 		nextBlindingFactor.SetBytes(lastBlindingFactor[:])
 		cachedBlindingFactor.Mul(&cachedBlindingFactor, &nextBlindingFactor)
-		cachedBlindingFactor.Mod(&cachedBlindingFactor, btcec.S256().Params().N)
+		cachedBlindingFactor.Mod(&cachedBlindingFactor, curve.Params().N)
 
 		// a_i = g ^ c_i
 		//     = g^( x * b_0 * ... * b_{i-1} )
 		//     = X^( b_0 * ... * b_{i-1} )
 		// X_our_session_pub_key x all prev blinding factors
-		lastEphemeralPubKey = blindBaseElement(cachedBlindingFactor.Bytes())
+		lastEphemeralPubKey = blindBaseElement(
+			curve, cachedBlindingFactor.Bytes(),
+		)
 
 		// e_i = Y_i ^ c_i
 		//     = ( Y_i ^ x )^( b_0 * ... * b_{i-1} )
 		// (Y_their_pub_key x x_our_priv) x all prev blinding factors
 		hopBlindedPubKey := blindGroupElement(
-			paymentPath[i], cachedBlindingFactor.Bytes(),
+			curve, paymentPath[i], cachedBlindingFactor.Bytes(),
 		)
 
 		// s_i = sha256( e_i )
@@ -275,29 +340,593 @@ func generateSharedSecrets(paymentPath []*btcec.PublicKey,
 	return hopSharedSecrets
 }
 
+// OnionPacketConfig describes the geometry of an onion packet: the number of
+// hops it is able to carry, and the number of bytes reserved for the payload
+// of each of them. The routing info, and with it the filler generated when
+// constructing the packet, is sized accordingly. Both the sender and all
+// routers in the path must agree on the routing info size of a packet.
+type OnionPacketConfig struct {
+	// NumMaxHops is the maximum number of hops the packet can carry. It
+	// must be between 1 and NumMaxHops.
+	NumMaxHops int
+
+	// HopPayloadSize is the number of payload bytes reserved for each
+	// hop, excluding its HMAC, but including the varint length prefix of
+	// TLV payloads. Legacy payloads occupy LegacyHopDataSize - HMACSize
+	// bytes.
+	HopPayloadSize int
+}
+
+// defaultOnionPacketConfig is the geometry of the onion packets defined by
+// BOLT 4: 20 legacy hop payloads for a total of 1300 bytes of routing info.
+var defaultOnionPacketConfig = OnionPacketConfig{
+	NumMaxHops:     DefaultMaxHops,
+	HopPayloadSize: LegacyHopDataSize - HMACSize,
+}
+
+// RoutingInfoSize returns the size of the routing info of onion packets
+// using this config.
+func (c OnionPacketConfig) RoutingInfoSize() int {
+	return c.NumMaxHops * (c.HopPayloadSize + HMACSize)
+}
+
+// PacketSize returns the size of serialized onion packets using this config.
+func (c OnionPacketConfig) PacketSize() int {
+	return 1 + btcec.PubKeyBytesLenCompressed + c.RoutingInfoSize() +
+		HMACSize
+}
+
+// Validate returns an error if the config doesn't describe a valid geometry.
+func (c OnionPacketConfig) Validate() error {
+	switch {
+	case c.NumMaxHops < 1 || c.NumMaxHops > NumMaxHops:
+		return fmt.Errorf("max hop count of %d must be between 1 "+
+			"and %d", c.NumMaxHops, NumMaxHops)
+
+	case c.HopPayloadSize < 1 || c.HopPayloadSize > MaxPayloadSize:
+		return fmt.Errorf("hop payload size of %d must be between 1 "+
+			"and %d", c.HopPayloadSize, MaxPayloadSize)
+	}
+
+	return nil
+}
+
+// legacyOnionPacketConfig returns the config of onion packets able to carry
+// numMaxHops legacy hop payloads.
+func legacyOnionPacketConfig(numMaxHops int) OnionPacketConfig {
+	return OnionPacketConfig{
+		NumMaxHops:     numMaxHops,
+		HopPayloadSize: LegacyHopDataSize - HMACSize,
+	}
+}
+
+// isCustom reports whether the config reserves a payload size other than that
+// of a legacy payload for each hop. The geometry of legacy packets follows
+// from their routing info size, but custom ones may share it with a different
+// geometry. Their geometry is therefore bound into the HMAC of every layer,
+// and the payload of each hop must fit within the bytes reserved for it.
+func (c OnionPacketConfig) isCustom() bool {
+	return c.HopPayloadSize != LegacyHopDataSize-HMACSize
+}
+
+// bindKeyTags returns the passed key tags, of which the mu tag is extended
+// with the geometry of the packet if the config is custom.
+func (c OnionPacketConfig) bindKeyTags(tags KeyTags) KeyTags {
+	if c.isCustom() {
+		tags.Mu = fmt.Sprintf("%s/%d/%d", tags.Mu, c.NumMaxHops,
+			c.HopPayloadSize)
+	}
+
+	return tags
+}
+
+// checkHopPayload returns an error wrapping ErrHopPayloadTooLarge if the
+// config is custom, and the passed payload exceeds the bytes it reserves for
+// a single hop.
+func (c OnionPacketConfig) checkHopPayload(payload *HopPayload) error {
+	if !c.isCustom() {
+		return nil
+	}
+
+	maxSize := c.HopPayloadSize + HMACSize
+	if size := payload.NumBytes(); size > maxSize {
+		return fmt.Errorf("%w: %d bytes, expected at most %d",
+			ErrHopPayloadTooLarge, size, maxSize)
+	}
+
+	return nil
+}
+
+// onionPacketCfg is the set of optional parameters that alter the way an
+// onion packet is constructed.
+type onionPacketCfg struct {
+	packetCfg        OnionPacketConfig
+	keyTags          KeyTags
+	finalPayloadSize int
+	paymentHash      *[PaymentHashSize]byte
+	probeHop         *int
+	rand             io.Reader
+
+	// finalHMAC is the HMAC handed to the last hop of the path, which is
+	// only set when splicing onto a partial onion. The last hop is the
+	// exit hop otherwise.
+	finalHMAC *[HMACSize]byte
+}
+
+// newOnionPacketCfg applies the passed set of options on top of the default
+// construction configuration.
+func newOnionPacketCfg(opts []OnionPacketOption) *onionPacketCfg {
+	cfg := &onionPacketCfg{
+		packetCfg: defaultOnionPacketConfig,
+		keyTags:   defaultKeyTags,
+		rand:      rand.Reader,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	cfg.keyTags = cfg.packetCfg.bindKeyTags(cfg.keyTags)
+
+	return cfg
+}
+
+// OnionPacketOption is a functional option that can be passed in when
+// constructing an onion packet.
+type OnionPacketOption func(*onionPacketCfg)
+
+// withFinalHMAC is a functional option that hands the passed HMAC to the last
+// hop of the path, rather than the zero HMAC marking it as the exit hop.
+func withFinalHMAC(mac *[HMACSize]byte) OnionPacketOption {
+	return func(cfg *onionPacketCfg) {
+		cfg.finalHMAC = mac
+	}
+}
+
+// WithPacketMaxHops is a functional option that sizes the routing info of the
+// constructed onion packet to fit numMaxHops legacy hop payloads, instead of
+// the DefaultMaxHops. Only routers configured with the same maximum hop count
+// using WithMaxHops are able to process the resulting packet.
+func WithPacketMaxHops(numMaxHops int) OnionPacketOption {
+	return func(cfg *onionPacketCfg) {
+		cfg.packetCfg = legacyOnionPacketConfig(numMaxHops)
+	}
+}
+
+// WithPacketConfig is a functional option that sizes the routing info of the
+// constructed onion packet according to the passed config. Only routers
+// configured with the same config, using WithOnionPacketConfig, are able to
+// process the resulting packet. Unless the config reserves the size of a
+// legacy payload for each hop, the route may be at most NumMaxHops long, and
+// each hop payload must fit within HopPayloadSize + HMACSize bytes.
+func WithPacketConfig(packetCfg OnionPacketConfig) OnionPacketOption {
+	return func(cfg *onionPacketCfg) {
+		cfg.packetCfg = packetCfg
+	}
+}
+
+// WithPacketKeyTags is a functional option that derives the keys used to
+// construct the onion packet with the passed personalization strings, rather
+// than those defined by BOLT 4. Only routers configured with the same tags,
+// using WithKeyTags, are able to process the resulting packet.
+func WithPacketKeyTags(tags KeyTags) OnionPacketOption {
+	return func(cfg *onionPacketCfg) {
+		cfg.keyTags = tags
+	}
+}
+
+// WithPaddedFinalPayload is a functional option that pads the payload of the
+// final hop to exactly size bytes, such that its length doesn't reveal the
+// length of the original payload. The final hop must be a TLV payload, and
+// size must leave room for the original payload along with the two bytes
+// encoding its length. Only routers configured using the
+// WithPaddedExitPayloads option strip the padding again.
+func WithPaddedFinalPayload(size int) OnionPacketOption {
+	return func(cfg *onionPacketCfg) {
+		cfg.finalPayloadSize = size
+	}
+}
+
+// WithPaymentHash is a functional option that binds the onion packet to the
+// passed payment hash, by using it as the associated data of the packet. Any
+// associated data passed in alongside it must be empty, or equal to the
+// payment hash. Routers processing the packet should use the
+// ExpectPaymentHash option.
+func WithPaymentHash(paymentHash [PaymentHashSize]byte) OnionPacketOption {
+	return func(cfg *onionPacketCfg) {
+		cfg.paymentHash = &paymentHash
+	}
+}
+
+// WithProbeFailureAt is a functional option that turns the constructed onion
+// packet into a probe, which is deliberately rejected by the hop following
+// the hop with index hop. The HMAC embedded within the payload of that hop is
+// corrupted, so it processes and forwards the packet as usual, while the next
+// hop fails the HMAC check. Decrypting the failure sent back then confirms
+// the probe made it past the hop, without the payment being completed. The
+// index must not be that of the final hop.
+//
+// NOTE: This is meant for diagnostics only, as a probe can never succeed.
+func WithProbeFailureAt(hop int) OnionPacketOption {
+	return func(cfg *onionPacketCfg) {
+		cfg.probeHop = &hop
+	}
+}
+
+// WithRandSource is a functional option that draws the randomness needed to
+// construct an onion packet, which is the session key generated by
+// NewOnionPacketWithRandomSession, from the passed reader rather than from
+// crypto/rand. This allows deterministic packets to be built in tests, and
+// the use of a mandated random number generator in environments requiring
+// one. The reader must be a cryptographically secure source of randomness
+// for the packet to remain private.
+func WithRandSource(r io.Reader) OnionPacketOption {
+	return func(cfg *onionPacketCfg) {
+		cfg.rand = r
+	}
+}
+
 // NewOnionPacket creates a new onion packet which is capable of obliviously
 // routing a message through the mix-net path outline by 'paymentPath'.
+//
+// The associated data is covered by the HMAC of every layer of the packet, so
+// each hop must process the packet using the very same associated data. As
+// the HMACs can only be computed by the sender, a relay is unable to bind the
+// packet it forwards to different associated data, such as the payment hash
+// of another HTLC. Doing so requires the sender to construct a new packet.
+// Nil and empty associated data are equivalent, both meaning that the packet
+// isn't bound to any, and yield identical HMACs.
 func NewOnionPacket(paymentPath *PaymentPath, sessionKey *btcec.PrivateKey,
-	assocData []byte) (*OnionPacket, error) {
+	assocData []byte, opts ...OnionPacketOption) (*OnionPacket, error) {
+
+	return newOnionPacketWithSeed(
+		paymentPath, sessionKey, assocData, nil, opts...,
+	)
+}
+
+// WriteOnionPacket constructs an onion packet exactly like NewOnionPacket, for
+// the route delivering payloads[i] to route[i], and writes its serialization
+// to the passed io.Writer as Encode would. The packet is assembled within a
+// pooled buffer rather than as an OnionPacket, which keeps the memory needed
+// low when constructing many packets that are serialized right away.
+func WriteOnionPacket(w io.Writer, route []*btcec.PublicKey,
+	sessionKey *btcec.PrivateKey, payloads []HopPayload, assocData []byte,
+	opts ...OnionPacketOption) error {
+
+	switch {
+	case len(route) == 0:
+		return fmt.Errorf("%w: route of length zero passed in",
+			ErrInvalidRoute)
+
+	case len(payloads) != len(route):
+		return fmt.Errorf("%w: route of %d hops has %d payloads",
+			ErrInvalidRoute, len(route), len(payloads))
+
+	case len(route) > NumMaxHops:
+		return fmt.Errorf("%w: route of %d hops exceeds the maximum "+
+			"of %d hops", ErrInvalidRoute, len(route), NumMaxHops)
+	}
+
+	var paymentPath PaymentPath
+	for i, nodePub := range route {
+		if nodePub == nil {
+			return fmt.Errorf("%w: node key of hop %d is nil",
+				ErrInvalidRoute, i)
+		}
+
+		paymentPath[i] = OnionHop{
+			NodePub:    *nodePub,
+			HopPayload: payloads[i],
+		}
+	}
+
+	cfg := newOnionPacketCfg(opts)
+	if err := cfg.packetCfg.Validate(); err != nil {
+		return err
+	}
+
+	// The packet is serialized as its version and ephemeral key, followed
+	// by the routing info, which is constructed in place, and the HMAC.
+	const routingInfoOffset = 1 + btcec.PubKeyBytesLenCompressed
+	routingInfoEnd := routingInfoOffset + cfg.packetCfg.RoutingInfoSize()
+
+	buf := getWorkBuf(cfg.packetCfg.PacketSize())
+	defer putWorkBuf(buf)
+	b := *buf
+
+	headerMac, err := layerRoutingInfo(
+		b[routingInfoOffset:routingInfoEnd], &paymentPath, sessionKey,
+		assocData, nil, cfg,
+	)
+	if err != nil {
+		return err
+	}
+
+	b[0] = baseVersion
+	serializeCompressed(b[1:routingInfoOffset], sessionKey.PubKey())
+	copy(b[routingInfoEnd:], headerMac[:])
+
+	_, err = w.Write(b)
+	return err
+}
+
+// NewOnionPacketWithRandomSession creates a new onion packet exactly like
+// NewOnionPacket, but using a freshly generated, cryptographically random
+// session key rather than one passed in by the caller. The session key is
+// returned alongside the packet, such that the sender is still able to derive
+// the shared secrets needed to decrypt errors sent back for the packet. The
+// key is read from crypto/rand, unless another source is passed using the
+// WithRandSource option.
+func NewOnionPacketWithRandomSession(paymentPath *PaymentPath,
+	assocData []byte, opts ...OnionPacketOption) (*OnionPacket,
+	*btcec.PrivateKey, error) {
+
+	sessionKey, err := readSessionKey(newOnionPacketCfg(opts).rand)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pkt, err := NewOnionPacket(paymentPath, sessionKey, assocData, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pkt, sessionKey, nil
+}
+
+// ChannelResolver resolves the short channel ID of a hop within a route to the
+// public key of the node the packet is delivered to over the channel, and the
+// payload to deliver to that node.
+type ChannelResolver func(scid uint64) (*btcec.PublicKey, []byte, error)
+
+// NewOnionPacketFromSCIDs creates a new onion packet exactly like
+// NewOnionPacket, for a route expressed as the short channel IDs over which it
+// reaches each of its hops. The public key and payload of each hop are looked
+// up lazily using the passed resolver, in the order of the route. The payloads
+// are carried as variable length payloads, so each of them must be non-empty.
+// An error wrapping ErrInvalidRoute is returned if the route is empty, or
+// exceeds NumMaxHops, while the error of the resolver is returned wrapped if
+// any of the hops fails to resolve.
+func NewOnionPacketFromSCIDs(scids []uint64, resolve ChannelResolver,
+	sessionKey *btcec.PrivateKey, assocData []byte,
+	opts ...OnionPacketOption) (*OnionPacket, error) {
+
+	switch {
+	case len(scids) == 0:
+		return nil, fmt.Errorf("%w: route of length zero passed in",
+			ErrInvalidRoute)
+
+	case len(scids) > NumMaxHops:
+		return nil, fmt.Errorf("%w: route of %d hops exceeds maximum "+
+			"of %d", ErrInvalidRoute, len(scids), NumMaxHops)
+	}
+
+	var route PaymentPath
+	for i, scid := range scids {
+		nodePub, payload, err := resolve(scid)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve hop %d with "+
+				"scid %d: %w", i, scid, err)
+		}
+		if nodePub == nil {
+			return nil, fmt.Errorf("%w: hop %d with scid %d "+
+				"resolved without a node key", ErrInvalidRoute,
+				i, scid)
+		}
+
+		hopPayload, err := NewHopPayload(nil, payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload for hop %d "+
+				"with scid %d: %w", i, scid, err)
+		}
+
+		route[i] = OnionHop{
+			NodePub:    *nodePub,
+			HopPayload: hopPayload,
+		}
+	}
 
-	numHops := paymentPath.TrueRouteLength()
+	return NewOnionPacket(&route, sessionKey, assocData, opts...)
+}
+
+// DeriveSessionKey deterministically derives the session key for a payment
+// attempt from the passed seed and payment hash using HKDF-SHA256, such that
+// the same inputs always yield the same key. This allows a wallet to
+// reproduce the packet of a previous attempt, for instance to retry it.
+//
+// NOTE: Reusing a session key for packets sent along different routes allows
+// the hops shared between them to link the packets, as their ephemeral keys
+// and shared secrets coincide. Wallets should mix an attempt counter into the
+// seed if the derived key is to be used for more than a single route.
+func DeriveSessionKey(seed [32]byte, paymentHash [32]byte) *btcec.PrivateKey {
+	kdf := hkdf.New(
+		sha256.New, seed[:], paymentHash[:], []byte("sphinx-session-key"),
+	)
+
+	// The key stream is only exhausted after 255 invalid candidates in a
+	// row.
+	sessionKey, err := readSessionKey(kdf)
+	if err != nil {
+		panic(fmt.Sprintf("unable to derive session key: %v", err))
+	}
+
+	return sessionKey
+}
+
+// readSessionKey reads a session key from the passed source of randomness. A
+// candidate outside of the range of valid scalars is astronomically unlikely,
+// but we'll simply read the next one from the source in that case, which
+// keeps the result deterministic for deterministic sources.
+func readSessionKey(r io.Reader) (*btcec.PrivateKey, error) {
+	var candidate [32]byte
+	defer zero(candidate[:])
+	for {
+		if _, err := io.ReadFull(r, candidate[:]); err != nil {
+			return nil, err
+		}
+
+		d := new(big.Int).SetBytes(candidate[:])
+		if d.Sign() == 0 || d.Cmp(btcec.S256().N) >= 0 {
+			continue
+		}
+
+		sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), candidate[:])
+		return sessionKey, nil
+	}
+}
+
+// newOnionPacketWithSeed creates a new onion packet exactly like
+// NewOnionPacket, but initializes the routing info with the passed pad bytes
+// before the hop payloads are layered on top of it, rather than with zeroes.
+// This lets tests build packets with fully known routing info contents. A nil
+// pad results in the zero initialized routing info used by NewOnionPacket,
+// otherwise the pad must be exactly as long as the routing info.
+func newOnionPacketWithSeed(paymentPath *PaymentPath,
+	sessionKey *btcec.PrivateKey, assocData, pad []byte,
+	opts ...OnionPacketOption) (*OnionPacket, error) {
+
+	cfg := newOnionPacketCfg(opts)
+	if err := cfg.packetCfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	mixHeader := make([]byte, cfg.packetCfg.RoutingInfoSize())
+	headerMac, err := layerRoutingInfo(
+		mixHeader, paymentPath, sessionKey, assocData, pad, cfg,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OnionPacket{
+		Version:      baseVersion,
+		EphemeralKey: sessionKey.PubKey(),
+		RoutingInfo:  mixHeader,
+		HeaderMAC:    headerMac,
+	}, nil
+}
+
+// layerRoutingInfo constructs the routing info of an onion packet for the
+// passed route within mixHeader, which must be sized according to the packet
+// config, and returns the HMAC of the packet. The contents of mixHeader are
+// overwritten.
+func layerRoutingInfo(mixHeader []byte, paymentPath *PaymentPath,
+	sessionKey *btcec.PrivateKey, assocData, pad []byte,
+	cfg *onionPacketCfg) ([HMACSize]byte, error) {
+
+	var nextHmac [HMACSize]byte
+	if err := cfg.keyTags.Validate(); err != nil {
+		return nextHmac, err
+	}
+	if cfg.paymentHash != nil {
+		if len(assocData) != 0 &&
+			!bytes.Equal(assocData, cfg.paymentHash[:]) {
+
+			return nextHmac, fmt.Errorf("associated data " +
+				"conflicts with payment hash")
+		}
+		assocData = cfg.paymentHash[:]
+	}
+	routingInfoLen := cfg.packetCfg.RoutingInfoSize()
+
+	// If we don't actually have a well formed, partially populated route,
+	// then we'll exit early.
+	numHops, err := paymentPath.validate()
+	if err != nil {
+		return nextHmac, err
+	}
+	if cfg.probeHop != nil &&
+		(*cfg.probeHop < 0 || *cfg.probeHop >= numHops-1) {
+
+		return nextHmac, fmt.Errorf("probe failure hop %d must be "+
+			"between 0 and %d", *cfg.probeHop, numHops-2)
+	}
+
+	// If requested, the payload of the final hop is padded, which only
+	// affects the total payload size. As the final hop doesn't contribute
+	// to the filler, its padded payload is only needed when layering it
+	// onto the routing info below.
+	totalPayloadSize := paymentPath.TotalPayloadSize()
+	finalPayload := paymentPath[numHops-1].HopPayload
+	if cfg.finalPayloadSize != 0 {
+		paddedPayload, err := padHopPayload(
+			finalPayload, cfg.finalPayloadSize,
+		)
+		if err != nil {
+			return nextHmac, err
+		}
+
+		totalPayloadSize += paddedPayload.NumBytes() -
+			finalPayload.NumBytes()
+		finalPayload = paddedPayload
+	}
+
+	// Check whether total payload size doesn't exceed the hard maximum.
+	if totalPayloadSize > routingInfoLen {
+		return nextHmac, ErrMaxRoutingInfoSizeExceeded
+	}
+
+	// Custom geometries must be adhered to by each hop as well.
+	if cfg.packetCfg.isCustom() && numHops > cfg.packetCfg.NumMaxHops {
+		return nextHmac, fmt.Errorf("%w: route of %d hops exceeds max "+
+			"hop count of %d", ErrInvalidRoute, numHops,
+			cfg.packetCfg.NumMaxHops)
+	}
+	for i := 0; i < numHops; i++ {
+		payload := &paymentPath[i].HopPayload
+		if i == numHops-1 {
+			payload = &finalPayload
+		}
+		if err := cfg.packetCfg.checkHopPayload(payload); err != nil {
+			return nextHmac, fmt.Errorf("hop %d: %w", i, err)
+		}
+	}
 
 	hopSharedSecrets := generateSharedSecrets(
 		paymentPath.NodeKeys(), sessionKey,
 	)
+	defer func() {
+		for i := range hopSharedSecrets {
+			zero(hopSharedSecrets[i][:])
+		}
+	}()
 
 	// Generate the padding, called "filler strings" in the paper.
 	filler := generateHeaderPadding(
-		"rho", numHops, HopDataSize, hopSharedSecrets,
+		cfg.keyTags.Rho, paymentPath, hopSharedSecrets,
+		routingInfoLen,
 	)
 
-	// Allocate zero'd out byte slices to store the final mix header packet
-	// and the hmac for each hop.
-	var (
-		mixHeader  [routingInfoSize]byte
-		nextHmac   [HMACSize]byte
-		hopDataBuf bytes.Buffer
-	)
+	if pad != nil && len(pad) != routingInfoLen {
+		return nextHmac, fmt.Errorf("pad of %d bytes doesn't match "+
+			"routing info size of %d bytes", len(pad),
+			routingInfoLen)
+	}
+
+	// The mix header starts out zeroed, or as a copy of the pad if one was
+	// given. Otherwise, if a pad tag is set, it starts out as the cipher
+	// stream of the pad key derived from the session key.
+	switch {
+	case pad != nil:
+		copy(mixHeader, pad)
+
+	case cfg.keyTags.Pad != "":
+		var sessionSecret Hash256
+		sessionKey.D.FillBytes(sessionSecret[:])
+		padKey := generateKey(cfg.keyTags.Pad, &sessionSecret)
+		zero(sessionSecret[:])
+
+		zero(mixHeader)
+		xorCipherStream(mixHeader, mixHeader, padKey)
+		zero(padKey[:])
+
+	default:
+		zero(mixHeader)
+	}
+
+	// Unless we're splicing onto a partial onion, the final hop is handed
+	// the zero HMAC.
+	if cfg.finalHMAC != nil {
+		nextHmac = *cfg.finalHMAC
+	}
 
 	// Now we compute the routing information for each hop, along with a
 	// MAC of the routing info using the shared key for that hop.
@@ -305,37 +934,41 @@ func NewOnionPacket(paymentPath *PaymentPath, sessionKey *btcec.PrivateKey,
 		// We'll derive the two keys we need for each hop in order to:
 		// generate our stream cipher bytes for the mixHeader, and
 		// calculate the MAC over the entire constructed packet.
-		rhoKey := generateKey("rho", &hopSharedSecrets[i])
-		muKey := generateKey("mu", &hopSharedSecrets[i])
+		rhoKey := generateKey(cfg.keyTags.Rho, &hopSharedSecrets[i])
+		muKey := generateKey(cfg.keyTags.Mu, &hopSharedSecrets[i])
 
 		// The HMAC for the final hop is simply zeroes. This allows the
 		// last hop to recognize that it is the destination for a
 		// particular payment.
-		paymentPath[i].HopData.HMAC = nextHmac
+		paymentPath[i].HopPayload.HMAC = nextHmac
 
-		// Next, using the key dedicated for our stream cipher, we'll
-		// generate enough bytes to obfuscate this layer of the onion
-		// packet.
-		streamBytes := generateCipherStream(rhoKey, numStreamBytes)
+		payload := paymentPath[i].HopPayload
+		if i == numHops-1 {
+			payload = finalPayload
+			payload.HMAC = nextHmac
+		}
+
+		// If this hop is where the probe should fail, corrupt the HMAC
+		// it hands to the next hop.
+		if cfg.probeHop != nil && i == *cfg.probeHop {
+			payload.HMAC[0] ^= 0xff
+		}
 
 		// Before we assemble the packet, we'll shift the current
-		// mix-header to the write in order to make room for this next
-		// per-hop data.
-		rightShift(mixHeader[:], HopDataSize)
+		// mix-header to the right in order to make room for this next
+		// per-hop payload.
+		rightShift(mixHeader, payload.NumBytes())
 
 		// With the mix header right-shifted, we'll encode the current
-		// hop data into a buffer we'll re-use during the packet
-		// construction.
-		err := paymentPath[i].HopData.Encode(&hopDataBuf)
-		if err != nil {
-			return nil, err
-		}
-		copy(mixHeader[:], hopDataBuf.Bytes())
+		// hop payload directly into the space freed up at its front,
+		// such that the routing info is assembled in place.
+		payload.encodeTo(mixHeader)
 
 		// Once the packet for this hop has been assembled, we'll
-		// re-encrypt the packet by XOR'ing with a stream of bytes
-		// generated using our shared secret.
-		xor(mixHeader[:], mixHeader[:], streamBytes[:routingInfoSize])
+		// re-encrypt the packet in place by XOR'ing it with a stream
+		// of bytes generated using the key dedicated for our stream
+		// cipher.
+		xorCipherStream(mixHeader, mixHeader, rhoKey)
 
 		// If this is the "last" hop, then we'll override the tail of
 		// the hop data.
@@ -347,72 +980,179 @@ func NewOnionPacket(paymentPath *PaymentPath, sessionKey *btcec.PrivateKey,
 		// calculating the MAC, we'll also include the optional
 		// associated data which can allow higher level applications to
 		// prevent replay attacks.
-		packet := append(mixHeader[:], assocData...)
-		nextHmac = calcMac(muKey, packet)
+		nextHmac = calcHeaderMac(muKey, mixHeader, assocData)
 
-		hopDataBuf.Reset()
+		// The keys for this hop are no longer needed, so we'll wipe
+		// them before moving on to the next one.
+		zero(rhoKey[:])
+		zero(muKey[:])
 	}
 
-	return &OnionPacket{
-		Version:      baseVersion,
-		EphemeralKey: sessionKey.PubKey(),
-		RoutingInfo:  mixHeader,
-		HeaderMAC:    nextHmac,
-	}, nil
+	return nextHmac, nil
 }
 
 // rightShift shifts the byte-slice by the given number of bytes to the right
 // and 0-fill the resulting gap.
 func rightShift(slice []byte, num int) {
-	for i := len(slice) - num - 1; i >= 0; i-- {
-		slice[num+i] = slice[i]
-	}
-
-	for i := 0; i < num; i++ {
-		slice[i] = 0
-	}
+	// As copy handles overlapping slices, this moves the bytes in a single
+	// pass.
+	copy(slice[num:], slice[:len(slice)-num])
+	zero(slice[:num])
 }
 
 // generateHeaderPadding derives the bytes for padding the mix header to ensure
 // it remains fixed sized throughout route transit. At each step, we add
-// 'hopSize' padding of zeroes, concatenate it to the previous filler, then
-// decrypt it (XOR) with the secret key of the current hop. When encrypting the
-// mix header we essentially do the reverse of this operation: we "encrypt" the
-// padding, and drop 'hopSize' number of zeroes. As nodes process the mix
-// header they add the padding ('hopSize') in order to check the MAC and
-// decrypt the next routing information eventually leaving only the original
-// "filler" bytes produced by this function at the last hop. Using this
-// methodology, the size of the field stays constant at each hop.
-func generateHeaderPadding(key string, numHops int, hopSize int,
-	sharedSecrets []Hash256) []byte {
-
-	filler := make([]byte, (numHops-1)*hopSize)
-	for i := 1; i < numHops; i++ {
-		totalFillerSize := ((NumMaxHops - i) + 1) * hopSize
-
-		streamKey := generateKey(key, &sharedSecrets[i-1])
-		streamBytes := generateCipherStream(streamKey, numStreamBytes)
-
-		xor(filler, filler, streamBytes[totalFillerSize:totalFillerSize+i*hopSize])
+// padding of zeroes the size of the current hop's payload, concatenate it to
+// the previous filler, then decrypt it (XOR) with the secret key of the current
+// hop. When encrypting the mix header we essentially do the reverse of this
+// operation: we "encrypt" the padding, and drop the hop's payload number of
+// zeroes. As nodes process the mix header they add the padding in order to
+// check the MAC and decrypt the next routing information eventually leaving
+// only the original "filler" bytes produced by this function at the last hop.
+// Using this methodology, the size of the field stays constant at each hop.
+func generateHeaderPadding(key string, path *PaymentPath,
+	sharedSecrets []Hash256, routingInfoLen int) []byte {
+
+	numHops := path.TrueRouteLength()
+
+	var payloadSizes [NumMaxHops]int
+	for i := 0; i < numHops; i++ {
+		payloadSizes[i] = path[i].HopPayload.NumBytes()
+	}
+
+	return generateFiller(
+		key, payloadSizes[:numHops], sharedSecrets, routingInfoLen,
+	)
+}
+
+// generateFiller derives the filler for a route of which the payloads of the
+// hops, including their HMACs, occupy the passed number of bytes, as described
+// for generateHeaderPadding.
+func generateFiller(key string, payloadSizes []int, sharedSecrets []Hash256,
+	routingInfoLen int) []byte {
+
+	numHops := len(payloadSizes)
+
+	// We have to generate a filler that matches all but the last hop (the
+	// last hop won't generate an HMAC).
+	var fillerSize int
+	for _, size := range payloadSizes[:numHops-1] {
+		fillerSize += size
+	}
+	filler := make([]byte, fillerSize)
+
+	// The stream for each hop is generated into a single pooled work
+	// buffer, which is wiped once the filler is complete.
+	workBuf := getWorkBuf(2 * routingInfoLen)
+	defer putWorkBuf(workBuf)
+
+	for i := 0; i < numHops-1; i++ {
+		// Sum up how many bytes were used by prior hops.
+		fillerStart := routingInfoLen
+		for _, size := range payloadSizes[:i] {
+			fillerStart -= size
+		}
+
+		// The filler is the part dangling off of the end of the
+		// routingInfo, so offset it from there, and use the current
+		// hop's payload size as its size.
+		fillerEnd := routingInfoLen + payloadSizes[i]
+
+		streamKey := generateKey(key, &sharedSecrets[i])
+		streamBytes := (*workBuf)[:fillerEnd]
+		fillCipherStream(streamBytes, streamKey)
+
+		xor(filler, filler, streamBytes[fillerStart:fillerEnd])
+
+		zero(streamKey[:])
 	}
+
 	return filler
 }
 
+// GenerateFiller derives the filler that packet construction generates for a
+// route of numHops hops within an onion packet of the passed geometry, such as
+// the one of the packets constructed using WithPacketConfig, with the payload
+// of each hop, including its HMAC, occupying hopSize bytes, such as
+// LegacyHopDataSize. The shared secrets are those of the hops, in order, of
+// which the one of the final hop is unused, and key is the personalization
+// string of the stream cipher, which is "rho" unless packets are constructed
+// using WithPacketKeyTags. The filler ends up as the tail of the routing info
+// received by the final hop.
+//
+// NOTE: This is for debugging only, to compare the filler byte by byte with
+// the one another implementation generates when diagnosing interoperability
+// failures. An error is returned if the geometry is invalid, if the route
+// can't be constructed within it, or if fewer than numHops-1 shared secrets
+// are passed.
+func GenerateFiller(key string, packetCfg OnionPacketConfig, numHops,
+	hopSize int, sharedSecrets [][32]byte) ([]byte, error) {
+
+	if err := packetCfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	routingInfoLen := packetCfg.RoutingInfoSize()
+	switch {
+	case numHops < 1 || hopSize < 1:
+		return nil, fmt.Errorf("%w: route of %d hops of %d bytes",
+			ErrInvalidRoute, numHops, hopSize)
+
+	case numHops*hopSize > routingInfoLen:
+		return nil, fmt.Errorf("%w: route of %d hops of %d bytes "+
+			"doesn't fit within %d bytes of routing info",
+			ErrMaxRoutingInfoSizeExceeded, numHops, hopSize,
+			routingInfoLen)
+
+	case packetCfg.isCustom() && numHops > packetCfg.NumMaxHops:
+		return nil, fmt.Errorf("%w: route of %d hops exceeds max hop "+
+			"count of %d", ErrInvalidRoute, numHops,
+			packetCfg.NumMaxHops)
+
+	case packetCfg.isCustom() &&
+		hopSize > packetCfg.HopPayloadSize+HMACSize:
+
+		return nil, fmt.Errorf("%w: %d bytes, expected at most %d",
+			ErrHopPayloadTooLarge, hopSize,
+			packetCfg.HopPayloadSize+HMACSize)
+
+	case len(sharedSecrets) < numHops-1:
+		return nil, fmt.Errorf("route of %d hops has %d shared "+
+			"secrets", numHops, len(sharedSecrets))
+	}
+
+	payloadSizes := make([]int, numHops)
+	secrets := make([]Hash256, len(sharedSecrets))
+	for i := range payloadSizes {
+		payloadSizes[i] = hopSize
+	}
+	for i := range sharedSecrets {
+		secrets[i] = sharedSecrets[i]
+	}
+	defer func() {
+		for i := range secrets {
+			zero(secrets[i][:])
+		}
+	}()
+
+	return generateFiller(key, payloadSizes, secrets, routingInfoLen), nil
+}
+
 // Encode serializes the raw bytes of the onion packet into the passed
 // io.Writer. The form encoded within the passed io.Writer is suitable for
-// either storing on disk, or sending over the network.
+// either storing on disk, or sending over the network. The fields are written
+// to the writer in sequence, using a small fixed size scratch buffer for the
+// version and ephemeral key, such that the packet is never assembled in full.
 func (f *OnionPacket) Encode(w io.Writer) error {
-	ephemeral := f.EphemeralKey.SerializeCompressed()
-
-	if _, err := w.Write([]byte{f.Version}); err != nil {
-		return err
-	}
+	var scratch [1 + btcec.PubKeyBytesLenCompressed]byte
+	scratch[0] = f.Version
+	serializeCompressed(scratch[1:], f.EphemeralKey)
 
-	if _, err := w.Write(ephemeral); err != nil {
+	if _, err := w.Write(scratch[:]); err != nil {
 		return err
 	}
 
-	if _, err := w.Write(f.RoutingInfo[:]); err != nil {
+	if _, err := w.Write(f.RoutingInfo); err != nil {
 		return err
 	}
 
@@ -423,45 +1163,333 @@ func (f *OnionPacket) Encode(w io.Writer) error {
 	return nil
 }
 
+// serializeCompressed writes the compressed serialization of the public key
+// into the passed buffer, which must be btcec.PubKeyBytesLenCompressed bytes
+// long. Unlike btcec.PublicKey.SerializeCompressed, no new slice is allocated.
+func serializeCompressed(b []byte, pub *btcec.PublicKey) {
+	b[0] = 0x02
+	if pub.Y.Bit(0) == 1 {
+		b[0] = 0x03
+	}
+	pub.X.FillBytes(b[1:btcec.PubKeyBytesLenCompressed])
+}
+
 // Decode fully populates the target ForwardingMessage from the raw bytes
 // encoded within the io.Reader. In the case of any decoding errors, an error
 // will be returned. If the method success, then the new OnionPacket is ready
-// to be processed by an instance of SphinxNode.
+// to be processed by an instance of SphinxNode. An error wrapping
+// ErrPacketTooSmall is returned if the reader doesn't supply a full packet,
+// and one wrapping ErrPacketWrongSize if a reader exposing its remaining
+// length, such as a bytes.Reader, holds more. Both report the expected and
+// actual number of bytes.
 func (f *OnionPacket) Decode(r io.Reader) error {
-	var err error
+	return f.DecodeWithMaxHops(r, DefaultMaxHops)
+}
 
-	var buf [1]byte
-	if _, err := io.ReadFull(r, buf[:]); err != nil {
-		return err
-	}
-	f.Version = buf[0]
+// DecodeWithMaxHops is identical to Decode, but expects the routing info of
+// the encoded packet to be sized for numMaxHops legacy hop payloads, as
+// produced by NewOnionPacket using the WithPacketMaxHops option.
+func (f *OnionPacket) DecodeWithMaxHops(r io.Reader, numMaxHops int) error {
+	return f.DecodeWithConfig(r, legacyOnionPacketConfig(numMaxHops))
+}
 
-	// If version of the onion packet protocol unknown for us than in might
-	// lead to improperly decoded data.
-	if f.Version != baseVersion {
-		return ErrInvalidOnionVersion
-	}
+// DecodeWithConfig is identical to Decode, but expects the routing info of
+// the encoded packet to be sized according to the passed config, as produced
+// by NewOnionPacket using the WithPacketConfig option.
+func (f *OnionPacket) DecodeWithConfig(r io.Reader,
+	packetCfg OnionPacketConfig) error {
 
-	var ephemeral [33]byte
-	if _, err := io.ReadFull(r, ephemeral[:]); err != nil {
+	if err := packetCfg.Validate(); err != nil {
 		return err
 	}
-	f.EphemeralKey, err = btcec.ParsePubKey(ephemeral[:], btcec.S256())
-	if err != nil {
-		return ErrInvalidOnionKey
-	}
 
-	if _, err := io.ReadFull(r, f.RoutingInfo[:]); err != nil {
+	b := make([]byte, packetCfg.PacketSize())
+	if err := readPacket(r, b); err != nil {
 		return err
 	}
 
-	if _, err := io.ReadFull(r, f.HeaderMAC[:]); err != nil {
+	return f.decodeFields(b, packetCfg.RoutingInfoSize(), btcec.S256())
+}
+
+// DecodeWithCurve is identical to DecodeWithConfig, but parses the ephemeral
+// key of the encoded packet as a point on the passed curve rather than
+// secp256k1, for packets processed by routers of which the onion key lies on
+// another curve, or which are configured using the WithCurve option. Keys that
+// don't lie on the curve are rejected with ErrInvalidOnionKey.
+func (f *OnionPacket) DecodeWithCurve(r io.Reader,
+	packetCfg OnionPacketConfig, curve elliptic.Curve) error {
+
+	if err := packetCfg.Validate(); err != nil {
+		return err
+	}
+
+	b := make([]byte, packetCfg.PacketSize())
+	if err := readPacket(r, b); err != nil {
+		return err
+	}
+
+	return f.decodeFields(b, packetCfg.RoutingInfoSize(), curve)
+}
+
+// EncodeCompact serializes the onion packet into the passed io.Writer exactly
+// like Encode, but omits the leading version byte. This is only meant for
+// contexts in which the version is negotiated out of band, such that it's
+// known to the decoder, which must then use DecodeCompact. The resulting
+// encoding is a single byte shorter than the one of Encode.
+func (f *OnionPacket) EncodeCompact(w io.Writer) error {
+	var scratch [btcec.PubKeyBytesLenCompressed]byte
+	serializeCompressed(scratch[:], f.EphemeralKey)
+
+	if _, err := w.Write(scratch[:]); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(f.RoutingInfo); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(f.HeaderMAC[:]); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// DecodeCompact populates the target onion packet from a packet of the default
+// size encoded using EncodeCompact, with the version byte omitted from the
+// encoding supplied by the caller instead. As with Decode, the version must be
+// one we know of, otherwise ErrInvalidOnionVersion is returned.
+func (f *OnionPacket) DecodeCompact(r io.Reader, version byte) error {
+	b := make([]byte, defaultOnionPacketConfig.PacketSize())
+	if err := readPacket(r, b[1:]); err != nil {
+		return err
+	}
+	b[0] = version
+
+	return f.decodeFields(
+		b, defaultOnionPacketConfig.RoutingInfoSize(), btcec.S256(),
+	)
+}
+
+// readPacket reads a serialized onion packet from the passed io.Reader into b,
+// which must be sized to hold exactly one packet. The packet is read in full
+// up front, such that truncated packets are rejected before any of its fields
+// are parsed.
+func readPacket(r io.Reader, b []byte) error {
+	switch n, err := io.ReadFull(r, b); {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return fmt.Errorf("%w: expected %d bytes, got %d",
+			ErrPacketTooSmall, len(b), n)
+
+	case err != nil:
+		return err
+	}
+
+	// If the reader is able to tell us how many bytes remain, we'll also
+	// ensure it doesn't hold any trailing data, as that would indicate the
+	// packet was encoded with a different geometry.
+	if lr, ok := r.(interface{ Len() int }); ok && lr.Len() != 0 {
+		return fmt.Errorf("%w: expected %d bytes, got %d",
+			ErrPacketWrongSize, len(b), len(b)+lr.Len())
+	}
+
+	return nil
+}
+
+// decodeFields populates the target onion packet from the passed buffer,
+// which must hold exactly one serialized packet with a routing info of the
+// passed length. The routing info of the packet references the buffer.
+func (f *OnionPacket) decodeFields(b []byte, routingInfoLen int,
+	curve elliptic.Curve) error {
+
+	// If version of the onion packet protocol unknown for us than in might
+	// lead to improperly decoded data.
+	f.Version = b[0]
+	if f.Version != baseVersion {
+		return ErrInvalidOnionVersion
+	}
+	b = b[1:]
+
+	var err error
+	f.EphemeralKey, err = parseEphemeralKey(
+		b[:btcec.PubKeyBytesLenCompressed], curve,
+	)
+	if err != nil {
+		return ErrInvalidOnionKey
+	}
+	b = b[btcec.PubKeyBytesLenCompressed:]
+
+	f.RoutingInfo = b[:routingInfoLen:routingInfoLen]
+	copy(f.HeaderMAC[:], b[routingInfoLen:])
+
+	return nil
+}
+
+// parseEphemeralKey parses the passed compressed public key as a point on the
+// passed curve. Curves other than secp256k1 are decompressed using their
+// generic parameters.
+func parseEphemeralKey(b []byte, curve elliptic.Curve) (*btcec.PublicKey,
+	error) {
+
+	if koblitz, ok := curve.(*btcec.KoblitzCurve); ok {
+		return btcec.ParsePubKey(b, koblitz)
+	}
+
+	x, y := elliptic.UnmarshalCompressed(curve, b)
+	if x == nil {
+		return nil, ErrInvalidOnionKey
+	}
+
+	return &btcec.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// DecodeOnionPackets reads exactly n onion packets of the default size, which
+// are encoded back to back, from the passed io.Reader. Unlike Decode, the
+// reader may hold further data following the packets, which is left unread.
+// If the reader doesn't supply n full packets, or one of them fails to
+// decode, then the packets decoded up to that point are returned along with
+// the error. As with Decode, a short read yields an error wrapping
+// ErrPacketTooSmall.
+func DecodeOnionPackets(r io.Reader, n int) ([]*OnionPacket, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("invalid packet count of %d", n)
+	}
+
+	var (
+		packetSize     = defaultOnionPacketConfig.PacketSize()
+		routingInfoLen = defaultOnionPacketConfig.RoutingInfoSize()
+		packets        = make([]*OnionPacket, 0, n)
+	)
+	for i := 0; i < n; i++ {
+		b := make([]byte, packetSize)
+		switch read, err := io.ReadFull(r, b); {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return packets, fmt.Errorf("%w: packet %d of %d: "+
+				"expected %d bytes, got %d", ErrPacketTooSmall,
+				i, n, packetSize, read)
+
+		case err != nil:
+			return packets, err
+		}
+
+		packet := &OnionPacket{}
+		err := packet.decodeFields(b, routingInfoLen, btcec.S256())
+		if err != nil {
+			return packets, fmt.Errorf("packet %d of %d: %w", i, n,
+				err)
+		}
+		packets = append(packets, packet)
+	}
+
+	return packets, nil
+}
+
+// SerializedSize returns the number of bytes the onion packet occupies once
+// serialized using Encode, which depends on the size of its routing info.
+func (f *OnionPacket) SerializedSize() int {
+	return 1 + btcec.PubKeyBytesLenCompressed + len(f.RoutingInfo) +
+		HMACSize
+}
+
+// Equal returns whether the onion packet is identical to the other packet,
+// comparing their versions, ephemeral keys, routing info and HMACs. The
+// ephemeral keys are compared in their serialized form, so the comparison
+// doesn't depend on the internal representation of the curve points, unlike
+// reflect.DeepEqual.
+func (f *OnionPacket) Equal(other *OnionPacket) bool {
+	if f == nil || other == nil {
+		return f == other
+	}
+
+	switch {
+	case f.EphemeralKey == nil || other.EphemeralKey == nil:
+		if f.EphemeralKey != other.EphemeralKey {
+			return false
+		}
+
+	case !bytes.Equal(f.EphemeralKey.SerializeCompressed(),
+		other.EphemeralKey.SerializeCompressed()):
+
+		return false
+	}
+
+	return f.Version == other.Version &&
+		bytes.Equal(f.RoutingInfo, other.RoutingInfo) &&
+		f.HeaderMAC == other.HeaderMAC
+}
+
+// RoutingInfoRows splits the routing info of the packet into one row per hop
+// slot of the passed geometry, each HopPayloadSize+HMACSize bytes long. As the
+// routing info is encrypted in layers, the rows only line up with the hop
+// payloads once decrypted, but they show how the layers are stacked, which is
+// useful when debugging the construction of a packet. The rows are copies, so
+// the packet itself is left untouched.
+func (f *OnionPacket) RoutingInfoRows(
+	packetCfg OnionPacketConfig) ([][]byte, error) {
+
+	if err := packetCfg.Validate(); err != nil {
+		return nil, err
+	}
+	if len(f.RoutingInfo) != packetCfg.RoutingInfoSize() {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d",
+			ErrInvalidRoutingInfoSize, packetCfg.RoutingInfoSize(),
+			len(f.RoutingInfo))
+	}
+
+	stride := packetCfg.HopPayloadSize + HMACSize
+	rows := make([][]byte, packetCfg.NumMaxHops)
+	for i := range rows {
+		rows[i] = make([]byte, stride)
+		copy(rows[i], f.RoutingInfo[i*stride:])
+	}
+
+	return rows, nil
+}
+
+// MarshalBinary serializes the onion packet exactly like Encode, returning the
+// raw bytes. This implements the encoding.BinaryMarshaler interface.
+func (f *OnionPacket) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	b.Grow(f.SerializedSize())
+	if err := f.Encode(&b); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary populates the target onion packet from the passed raw bytes
+// exactly like Decode, such that the bytes must hold a single packet with a
+// routing info of the default size. The bytes aren't retained, so they may be
+// modified afterwards. This implements the encoding.BinaryUnmarshaler
+// interface.
+func (f *OnionPacket) UnmarshalBinary(data []byte) error {
+	return f.Decode(bytes.NewReader(data))
+}
+
+// A compile time assertion that *OnionPacket implements the binary
+// marshaling interfaces of the encoding package.
+var (
+	_ encoding.BinaryMarshaler   = (*OnionPacket)(nil)
+	_ encoding.BinaryUnmarshaler = (*OnionPacket)(nil)
+)
+
+// DescribeOnionPacket returns a human readable summary of the cleartext fields
+// of the passed onion packet: its version, ephemeral key and header MAC. No
+// private key is needed, as the routing info isn't decrypted, making this
+// suitable for tooling which needs to inspect packets seen on the wire.
+func DescribeOnionPacket(p *OnionPacket) string {
+	var ephemeral string
+	if p.EphemeralKey != nil {
+		ephemeral = hex.EncodeToString(
+			p.EphemeralKey.SerializeCompressed(),
+		)
+	}
+
+	return fmt.Sprintf("version=%d ephemeral_key=%s header_mac=%x",
+		p.Version, ephemeral, p.HeaderMAC[:])
+}
+
 // ProcessCode is an enum-like type which describes to the high-level package
 // user which action should be taken after processing a Sphinx packet.
 type ProcessCode int
@@ -472,8 +1500,8 @@ const (
 	ExitNode = iota
 
 	// MoreHops indicates that there are additional hops left within the
-	// route. Therefore the caller should forward the packet to the node
-	// denoted as the "NextHop".
+	// route. Therefore the caller should forward the packet over the
+	// channel denoted by the NextChannelID of the processed packet.
 	MoreHops
 
 	// Failure indicates that a failure occurred during packet processing.
@@ -492,115 +1520,1089 @@ func (p ProcessCode) String() string {
 	default:
 		return "Unknown"
 	}
-}
+}
+
+// ProcessedPacket encapsulates the resulting state generated after processing
+// an OnionPacket. A processed packet communicates to the caller what action
+// should be taken after processing.
+//
+// NOTE: A processed packet doesn't reveal how many hops preceded the router,
+// nor how many remain after it, and by design this can't be derived. The
+// routing info is of a fixed size at every hop, and once decrypted, the part
+// beyond the hop's own payload is indistinguishable from random bytes: the
+// remaining layers are encrypted for the keys of the following hops, and the
+// filler the sender appended is made up of cipher stream bytes. Only the
+// all-zero HMAC of the final hop is recognizable, which is what the ExitNode
+// action is based on. Relays wishing to bound the length of routes must
+// rely on the payloads, for instance the CLTV delta and fees they imply.
+type ProcessedPacket struct {
+	// Action represents the action the caller should take after processing
+	// the packet.
+	Action ProcessCode
+
+	// ForwardingInstructions is the per-hop payload recovered from the
+	// initial encrypted onion packet. It details how the packet should be
+	// forwarded and also includes information that allows the processor of
+	// the packet to authenticate the information passed within the HTLC.
+	//
+	// NOTE: This field will only be populated iff the hop payload is of the
+	// legacy type.
+	ForwardingInstructions *HopData
+
+	// Payload is the raw payload as extracted from the packet. Its Type
+	// denotes which format the sender used: a legacy payload starting with
+	// the 0x00 realm byte, or a TLV payload starting with its varint
+	// length. In the latter case the ForwardingInstructions field above is
+	// nil, and the records can be parsed using Payload.TLVHopData.
+	//
+	// NOTE: This field is populated for all actions, so for ExitNode it
+	// holds the full decrypted payload the sender intended for the final
+	// hop. Its HMAC is then all zeroes.
+	Payload HopPayload
+
+	// NextPacket is the onion packet that should be forwarded to the next
+	// hop as denoted by the ForwardingInstructions field. Its HMAC covers
+	// the associated data the sender constructed the packet with, so the
+	// next hop only accepts it along with the same associated data we
+	// processed it with, and it can't be rebound to any other.
+	//
+	// NOTE: This field will only be populated iff the above Action is
+	// MoreHops.
+	NextPacket *OnionPacket
+
+	// NextChannelID is the short channel ID of the channel over which
+	// NextPacket should be forwarded, as parsed from the forwarding
+	// instructions of either a legacy or a TLV payload.
+	//
+	// NOTE: This field will only be populated iff the above Action is
+	// MoreHops. It's left all zeroes if a TLV payload doesn't carry a
+	// valid short channel ID record, as is the case within blinded paths.
+	// Use ForwardingInfo to have such payloads rejected instead.
+	NextChannelID [AddressSize]byte
+
+	// Delay is the time the sender asks us to hold the packet for before
+	// acting on it, as carried by the mix delay record of a TLV payload,
+	// see TLVHopData.Delay. It's zero if the payload doesn't carry such a
+	// record, or isn't a valid TLV payload.
+	Delay time.Duration
+
+	// PaymentMetadata is the payment metadata the sender placed within the
+	// TLV payload of the exit hop, see TLVHopData.PaymentMetadata, which
+	// should be handed to the recipient verbatim.
+	//
+	// NOTE: This field will only be populated iff the above Action is
+	// ExitNode, and the payload is a valid TLV payload carrying the
+	// record.
+	PaymentMetadata []byte
+
+	// SharedSecret is the shared secret that was derived from the packet's
+	// ephemeral key and used to peel off this layer of the onion. It can
+	// be used to encrypt a failure back to the sender, without having to
+	// perform the ECDH operation again, see
+	// NewOnionErrorEncrypterFromSecret.
+	//
+	// NOTE: The router wipes its own copy of the secret once processing
+	// completes, so callers retaining this value are responsible for it.
+	SharedSecret Hash256
+
+	// NextBlindingPoint is the blinding point that should be handed to the
+	// next hop alongside NextPacket, such that it's able to process the
+	// packet as part of a blinded path.
+	//
+	// NOTE: This field will only be populated iff the packet was processed
+	// using the WithBlindingPoint option.
+	NextBlindingPoint *btcec.PublicKey
+
+	// PeelDetails exposes the raw routing info and HMAC making up the
+	// packet for the next hop.
+	//
+	// NOTE: This field will only be populated iff the packet was processed
+	// using the WithPeelDetails option.
+	PeelDetails *PeelDetails
+}
+
+// ForwardingInfo is the information a node needs to forward an HTLC to the
+// next hop, as parsed from either a legacy or a TLV hop payload.
+type ForwardingInfo struct {
+	// NextAddress is the short channel ID of the channel the HTLC should
+	// be forwarded over.
+	NextAddress [AddressSize]byte
+
+	// AmountToForward is the amount the HTLC forwarded to the next hop
+	// should carry.
+	AmountToForward uint64
+
+	// OutgoingCltv is the absolute time-lock of the HTLC forwarded to the
+	// next hop.
+	OutgoingCltv uint32
+}
+
+// ForwardingInfo parses the information needed to forward the HTLC carrying
+// the packet from its payload, regardless of the payload's format. For the
+// ExitNode action, nil is returned, as there is no next hop. The payload
+// itself, which holds the terminal instructions, is available as Payload.
+func (p *ProcessedPacket) ForwardingInfo() (*ForwardingInfo, error) {
+	if p.Action != MoreHops {
+		return nil, nil
+	}
+
+	switch p.Payload.Type {
+	case PayloadLegacy:
+		hopData, err := p.Payload.HopData()
+		if err != nil {
+			return nil, err
+		}
+
+		return &ForwardingInfo{
+			NextAddress:     hopData.NextAddress,
+			AmountToForward: hopData.ForwardAmount,
+			OutgoingCltv:    hopData.OutgoingCltv,
+		}, nil
+
+	case PayloadTLV:
+		hopData, err := p.Payload.TLVHopData()
+		if err != nil {
+			return nil, err
+		}
+		if hopData.NextAddress == nil {
+			return nil, ErrMissingShortChannelID
+		}
+
+		return &ForwardingInfo{
+			NextAddress:     *hopData.NextAddress,
+			AmountToForward: hopData.ForwardAmount,
+			OutgoingCltv:    hopData.OutgoingCltv,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnknownPayloadType,
+			p.Payload.Type)
+	}
+}
+
+// Router is an onion router within the Sphinx network. The router is capable
+// of processing incoming Sphinx onion packets thereby "peeling" a layer off
+// the onion encryption which the packet is wrapped with.
+//
+// Once started, a Router is safe for concurrent use: its configuration isn't
+// modified after construction, and replay protection relies on the ReplayLog,
+// which must itself be safe for concurrent access. Of any number of
+// concurrent calls to ProcessOnionPacket with the same packet, exactly one
+// succeeds while the others fail with ErrReplayedPacket. The ECDHer and the
+// RouterObserver, if set, must be safe for concurrent use as well. A Tx
+// returned by BeginTxn is not, and should only be used by a single goroutine.
+type Router struct {
+	nodeID   [AddressSize]byte
+	nodeAddr *btcutil.AddressPubKeyHash
+
+	// onionPub is the public key of the router's onion key, and onionKey
+	// performs ECDH operations using the matching private key.
+	onionPub *btcec.PublicKey
+	onionKey ECDHer
+
+	// retiredKeys perform ECDH operations using the onion keys the router
+	// rotated away from, which packets still in flight may be addressed
+	// to. They're only tried once the onion key failed to yield a valid
+	// HMAC.
+	retiredKeys []ECDHer
+
+	// packetCfg is the geometry of the packets this router accepts for
+	// processing.
+	packetCfg OnionPacketConfig
+
+	// curve is the elliptic curve the onion key and the ephemeral keys of
+	// the packets this router processes lie on. Unless set using
+	// WithCurve, it's the curve of the onion key.
+	curve elliptic.Curve
+
+	// keyTags are the personalization strings used to derive the keys
+	// that process each packet from its shared secret.
+	keyTags KeyTags
+
+	// paddedExitPayloads signals whether the payloads of the packets for
+	// which we're the exit node were padded using the
+	// WithPaddedFinalPayload option.
+	paddedExitPayloads bool
+
+	// rejectAmbiguousPayloads signals whether packets with a hop payload
+	// that parses both as a legacy and as a TLV payload are rejected.
+	rejectAmbiguousPayloads bool
+
+	// detectSelfLoops signals whether packets of which the packet for the
+	// next hop is addressed to ourselves are rejected.
+	detectSelfLoops bool
+
+	// isolateBatchFailures signals whether a packet failing processing
+	// within a batch is skipped rather than failing the entire batch.
+	isolateBatchFailures bool
+
+	// tlvStrictness is the extent to which the TLV payloads of the
+	// processed packets are validated.
+	tlvStrictness TLVStrictness
+
+	// knownTLVTypes is the set of even TLV record types accepted at the
+	// TLVStrict level.
+	knownTLVTypes map[uint64]struct{}
+
+	// observer, if set, is notified of the outcome of packet processing.
+	observer RouterObserver
+
+	// onProcessDuration, if set, is called with the time spent in each
+	// call to ProcessOnionPacket.
+	onProcessDuration func(d time.Duration)
+
+	// staleEntryDelta is the number of blocks past their CLTV expiry that
+	// replay log entries are retained for by DeleteStaleEntries.
+	staleEntryDelta uint32
+
+	// replayHash creates the hash function the shared secrets of the
+	// processed packets are hashed with, to derive the keys they're
+	// recorded under in the replay log.
+	replayHash func() hash.Hash
+
+	// optErr is the error of the first invalid option the router was
+	// created with, which fails starting it and processing packets.
+	optErr error
+
+	// stopMtx guards stopped. Processing holds it for reading, such that
+	// Stop waits for any packets in flight before closing the log.
+	stopMtx sync.RWMutex
+
+	// stopped is set once the router is stopped, and cleared again upon
+	// starting it.
+	stopped bool
+
+	log ReplayLog
+}
+
+// RouterObserver is an interface which allows callers to observe the outcome
+// of the packets processed by a Router, for instance to export them as
+// metrics. All methods must be safe for concurrent use.
+type RouterObserver interface {
+	// OnPacketProcessed is called after a packet was successfully
+	// processed, with the action the caller should take next.
+	OnPacketProcessed(action ProcessCode)
+
+	// OnReplayRejected is called whenever a packet is rejected for being
+	// a replay of a previously processed packet.
+	OnReplayRejected()
+
+	// OnHMACFailure is called whenever a packet is rejected because its
+	// HMAC didn't match the one we computed.
+	OnHMACFailure()
+}
+
+// RouterOption is a functional option that can be passed in when creating a
+// new Router.
+type RouterOption func(*Router)
+
+// WithMaxHops is a functional option that configures the router to process
+// onion packets sized for numMaxHops legacy hop payloads, rather than the
+// DefaultMaxHops. Packets of any other size are rejected with
+// ErrInvalidRoutingInfoSize. The value must be between 1 and NumMaxHops, any
+// other value fails starting the router, as well as processing packets using
+// it, with ErrInvalidRouterOption.
+func WithMaxHops(numMaxHops int) RouterOption {
+	return func(r *Router) {
+		packetCfg := legacyOnionPacketConfig(numMaxHops)
+		if err := packetCfg.Validate(); err != nil {
+			r.rejectOption(fmt.Errorf("max hops: %w", err))
+			return
+		}
+
+		r.packetCfg = packetCfg
+	}
+}
+
+// WithOnionPacketConfig is a functional option that configures the router to
+// process onion packets of the passed geometry, as constructed using the
+// WithPacketConfig option. Packets of any other size are rejected with
+// ErrInvalidRoutingInfoSize. Unless the config reserves the size of a legacy
+// payload for each hop, packets of a different geometry with the same size
+// fail with ErrInvalidOnionHMAC, and hop payloads exceeding the bytes reserved
+// for them with ErrHopPayloadTooLarge. An invalid config, see
+// OnionPacketConfig.Validate, fails starting the router, as well as
+// processing packets using it, with ErrInvalidRouterOption.
+func WithOnionPacketConfig(packetCfg OnionPacketConfig) RouterOption {
+	return func(r *Router) {
+		if err := packetCfg.Validate(); err != nil {
+			r.rejectOption(fmt.Errorf("onion packet config: %w",
+				err))
+			return
+		}
+
+		r.packetCfg = packetCfg
+	}
+}
+
+// WithCurve is a functional option that configures the router to perform all
+// group operations over the passed curve, rather than the curve of its onion
+// key. As packets encode their ephemeral key in compressed form, the curve
+// must be defined over a 256-bit field.
+//
+// NOTE: This is intended for experimentation only. OnionPacket.Decode parses
+// the ephemeral key as a secp256k1 point, so packets using any other curve
+// must be read from the wire using OnionPacket.DecodeWithCurve.
+func WithCurve(curve elliptic.Curve) RouterOption {
+	return func(r *Router) {
+		r.curve = curve
+	}
+}
+
+// WithKeyTags is a functional option that configures the router to derive the
+// keys used to process packets with the passed personalization strings, rather
+// than those defined by BOLT 4. Only packets constructed using the
+// WithPacketKeyTags option with the same tags can be processed, all others
+// fail with ErrInvalidOnionHMAC. Errors encrypted using NewOnionErrorEncrypter,
+// and the blinded hop data decrypted using DecryptBlindedHopData, use the tags
+// as well. Invalid tags, see KeyTags.Validate, fail starting the router, as
+// well as processing packets using it, with ErrInvalidRouterOption.
+func WithKeyTags(tags KeyTags) RouterOption {
+	return func(r *Router) {
+		if err := tags.Validate(); err != nil {
+			r.rejectOption(fmt.Errorf("key tags: %w", err))
+			return
+		}
+
+		r.keyTags = tags
+	}
+}
+
+// WithPaddedExitPayloads is a functional option that configures the router to
+// strip the padding added by the WithPaddedFinalPayload option from the
+// payloads of the packets for which it's the exit node, such that
+// ProcessedPacket.Payload holds the original payload. Exit payloads which
+// weren't padded are rejected.
+func WithPaddedExitPayloads() RouterOption {
+	return func(r *Router) {
+		r.paddedExitPayloads = true
+	}
+}
+
+// WithAmbiguousPayloadRejection is a functional option that configures the
+// router to reject packets of which the hop payload parses both as a legacy
+// payload and as an empty TLV payload, with a ProcessingError wrapping
+// ErrAmbiguousPayload. The two interpretations disagree on whether the packet
+// is to be forwarded, so this prevents a malformed payload from being silently
+// forwarded, at the cost of rejecting legacy payloads consisting of zeroes
+// only. As these are valid according to the legacy format, such as within the
+// BOLT 4 test vector, they are accepted by default.
+func WithAmbiguousPayloadRejection() RouterOption {
+	return func(r *Router) {
+		r.rejectAmbiguousPayloads = true
+	}
+}
+
+// WithSelfLoopDetection is a functional option that configures the router to
+// reject packets of which the packet for the next hop is addressed to itself,
+// with a ProcessingError wrapping ErrSelfLoop, rather than forwarding them to
+// itself in a loop. As the next hop is only identified by a short channel ID,
+// which can't be compared to the router's own identity, the packet for the
+// next hop is checked by verifying its HMAC using the shared secret the router
+// derives for it, using its current and retired onion keys. This costs an
+// additional ECDH operation per key for every packet forwarded, so it's
+// disabled by default.
+//
+// NOTE: Loops within a blinded path aren't detected, as the packet for the
+// next hop is addressed to our blinded node ID.
+func WithSelfLoopDetection() RouterOption {
+	return func(r *Router) {
+		r.detectSelfLoops = true
+	}
+}
+
+// WithIsolatedBatchFailures is a functional option that configures the router
+// to skip packets failing processing within a batch passed to
+// ProcessOnionPackets, rather than rejecting the entire batch. The remaining
+// packets are processed and committed to the replay log as usual, while the
+// entries of the failed packets are nil, and a *BatchError holding the error
+// of each of them is returned along with the result.
+func WithIsolatedBatchFailures() RouterOption {
+	return func(r *Router) {
+		r.isolateBatchFailures = true
+	}
+}
+
+// TLVStrictness denotes the extent to which a router validates the TLV
+// payloads of the packets it processes.
+type TLVStrictness uint8
+
+const (
+	// TLVUnchecked leaves TLV payloads unchecked, as they're opaque to
+	// this package. This is the default.
+	TLVUnchecked TLVStrictness = iota
+
+	// TLVWellFormed rejects TLV payloads which aren't well formed TLV
+	// streams, such as ones of which the records aren't sorted by type,
+	// with a ProcessingError wrapping ErrInvalidTLVPayload.
+	TLVWellFormed
+
+	// TLVStrict additionally rejects TLV payloads carrying a record of an
+	// even type which is unknown, with a ProcessingError wrapping
+	// ErrUnknownEvenTLVType.
+	TLVStrict
+)
+
+// WithTLVStrictness is a functional option that configures the router to
+// validate the TLV payloads of the packets it processes at the passed level,
+// once their HMAC checked out. This allows a node to fail the HTLC of a packet
+// with a malformed payload using the invalid_onion_payload failure of BOLT 4,
+// before acting on the payload. At the TLVStrict level, the even types known
+// to the router are the ones of the records parsed by this package, those
+// defined by BOLT 4 for higher layers to handle, such as the payment data of
+// an exit hop and the records of blinded paths, and the passed knownTypes,
+// which must include any other even records higher layers handle.
+//
+// NOTE: Only the structure of the payloads is validated, not whether they
+// carry the records a hop requires.
+func WithTLVStrictness(level TLVStrictness,
+	knownTypes ...uint64) RouterOption {
+
+	return func(r *Router) {
+		r.tlvStrictness = level
+		r.knownTLVTypes = map[uint64]struct{}{
+			amtToForwardType:    {},
+			outgoingCltvType:    {},
+			shortChannelIDType:  {},
+			paymentDataType:     {},
+			encryptedDataType:   {},
+			blindingPointType:   {},
+			paymentMetadataType: {},
+			totalAmountType:     {},
+			NestedPacketType:    {},
+			MessagePartType:     {},
+			RendezvousType:      {},
+		}
+		for _, typ := range knownTypes {
+			r.knownTLVTypes[typ] = struct{}{}
+		}
+	}
+}
+
+// WithRetiredOnionKeys is a functional option that registers the onion keys
+// the router rotated away from, which allows it to process packets still
+// addressed to them while migrating to its current onion key. Packets are
+// processed using the current onion key first, falling back to the retired
+// keys in the passed order if its shared secret doesn't yield a valid HMAC, at
+// the cost of an additional ECDH operation and HMAC check per retired key
+// tried. Replay protection is unaffected, as packets are recorded by their
+// shared secret regardless of the key that matched.
+//
+// NOTE: NewOnionErrorEncrypter only uses the current onion key. Errors for
+// packets addressed to a retired key must be encrypted using the shared
+// secret returned within the ProcessedPacket, using
+// NewOnionErrorEncrypterFromSecret.
+func WithRetiredOnionKeys(keys ...ECDHer) RouterOption {
+	return func(r *Router) {
+		r.retiredKeys = keys
+	}
+}
+
+// WithObserver is a functional option that registers an observer which is
+// notified of the outcome of each call to ProcessOnionPacket. By default no
+// observer is set.
+func WithObserver(observer RouterObserver) RouterOption {
+	return func(r *Router) {
+		r.observer = observer
+	}
+}
+
+// WithProcessDuration is a functional option that registers a callback which
+// is called with the wall-clock time spent in each call to ProcessOnionPacket,
+// regardless of its outcome. As the ECDH operation and the HMAC check dominate
+// the cost of processing, this allows operators to detect degradation, such
+// as a slow HSM performing the ECDH. The callback is called synchronously, so
+// it must be cheap, such as recording the duration in a histogram. By default
+// no callback is set, in which case processing isn't timed at all.
+func WithProcessDuration(onProcessDuration func(d time.Duration)) RouterOption {
+	return func(r *Router) {
+		r.onProcessDuration = onProcessDuration
+	}
+}
+
+// WithStaleEntryDelta is a functional option that sets the number of blocks
+// past their CLTV expiry that replay log entries are retained for by
+// DeleteStaleEntries, rather than the DefaultStaleEntryDelta.
+func WithStaleEntryDelta(delta uint32) RouterOption {
+	return func(r *Router) {
+		r.staleEntryDelta = delta
+	}
+}
+
+// WithReplayHash is a functional option that replaces the sha-256 hash of the
+// shared secret of a packet, as defined by BOLT 4, with the passed hash
+// function, when deriving the key the packet is recorded under in the replay
+// log. The first HashPrefixSize bytes of the digest are used, so it must be at
+// least that long, and starting the router fails with ErrInvalidRouterOption
+// otherwise. As the keys of the packets already recorded depend on it, the
+// hash function of a router must not change while it's using the same replay
+// log.
+func WithReplayHash(newHash func() hash.Hash) RouterOption {
+	return func(r *Router) {
+		if size := newHash().Size(); size < HashPrefixSize {
+			r.rejectOption(fmt.Errorf("replay hash: digest of %d "+
+				"bytes is shorter than the hash prefix of %d "+
+				"bytes", size, HashPrefixSize))
+			return
+		}
+
+		r.replayHash = newHash
+	}
+}
+
+// NewRouter creates a new instance of a Sphinx onion Router given the node's
+// currently advertised onion private key, and the target Bitcoin network.
+func NewRouter(nodeKey *btcec.PrivateKey, net *chaincfg.Params, log ReplayLog,
+	opts ...RouterOption) *Router {
+
+	// Unless the key already specifies a curve, we'll assume it's a
+	// secp256k1 key.
+	curve := nodeKey.Curve
+	if curve == nil {
+		curve = btcec.S256()
+	}
+
+	onionKey := &btcec.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: curve,
+			X:     nodeKey.X,
+			Y:     nodeKey.Y,
+		},
+		D: nodeKey.D,
+	}
+
+	return NewRouterWithECDH(
+		onionKey.PubKey(), &PrivKeyECDH{PrivKey: onionKey}, net, log,
+		opts...,
+	)
+}
+
+// NewRouterWithECDH creates a new instance of a Sphinx onion Router given the
+// public key of the node's currently advertised onion key, and an ECDHer which
+// performs ECDH operations using the matching private key. This allows the
+// private key to reside outside of the process, for instance within an HSM or
+// a remote signer.
+func NewRouterWithECDH(nodePub *btcec.PublicKey, onionKey ECDHer,
+	net *chaincfg.Params, log ReplayLog, opts ...RouterOption) *Router {
+
+	var nodeID [AddressSize]byte
+	copy(nodeID[:], btcutil.Hash160(nodePub.SerializeCompressed()))
+
+	// Safe to ignore the error here, nodeID is 20 bytes.
+	nodeAddr, _ := btcutil.NewAddressPubKeyHash(nodeID[:], net)
+
+	// Unless the key already specifies a curve, we'll assume it's a
+	// secp256k1 key.
+	curve := nodePub.Curve
+	if curve == nil {
+		curve = btcec.S256()
+	}
+
+	r := &Router{
+		nodeID:          nodeID,
+		nodeAddr:        nodeAddr,
+		onionPub:        nodePub,
+		onionKey:        onionKey,
+		packetCfg:       defaultOnionPacketConfig,
+		curve:           curve,
+		keyTags:         defaultKeyTags,
+		staleEntryDelta: DefaultStaleEntryDelta,
+		replayHash:      sha256.New,
+		log:             log,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.keyTags = r.packetCfg.bindKeyTags(r.keyTags)
+
+	return r
+}
+
+// rejectOption records the passed error of an invalid option, unless an
+// earlier option was already rejected.
+func (r *Router) rejectOption(err error) {
+	if r.optErr == nil {
+		r.optErr = fmt.Errorf("%w: %v", ErrInvalidRouterOption, err)
+	}
+}
+
+// Start starts / opens the ReplayLog's channeldb and its accompanying
+// garbage collector goroutine. A router that was stopped can be started again.
+func (r *Router) Start() error {
+	if r.optErr != nil {
+		return r.optErr
+	}
+
+	r.stopMtx.Lock()
+	defer r.stopMtx.Unlock()
+
+	if err := r.log.Start(); err != nil {
+		return err
+	}
+	r.stopped = false
+
+	return nil
+}
+
+// Stop stops / closes the ReplayLog's channeldb and its accompanying
+// garbage collector goroutine. It waits for any packets being processed to
+// be recorded, after which the log is stopped, which flushes any writes it
+// buffered and closes its backend. Processing packets after the router was
+// stopped fails with ErrRouterStopped.
+func (r *Router) Stop() error {
+	r.stopMtx.Lock()
+	defer r.stopMtx.Unlock()
+
+	if r.stopped {
+		return ErrRouterStopped
+	}
+	r.stopped = true
+
+	return r.log.Stop()
+}
+
+// beginProcessing marks the start of an operation using the replay log,
+// during which the router can't be stopped. If the router is already stopped,
+// ErrRouterStopped is returned. Otherwise, the returned closure must be called
+// once the operation completes. Routers created with an invalid option can't
+// begin any operation.
+func (r *Router) beginProcessing() (func(), error) {
+	if r.optErr != nil {
+		return nil, r.optErr
+	}
+
+	r.stopMtx.RLock()
+	if r.stopped {
+		r.stopMtx.RUnlock()
+		return nil, ErrRouterStopped
+	}
+
+	return r.stopMtx.RUnlock, nil
+}
+
+// DeleteStaleEntries removes all entries from the replay log of which the
+// CLTV expiry lies more than the router's stale entry delta below the current
+// block height. As the HTLCs of such packets have expired, they can't be
+// validly replayed, so there's no need to remember them. The number of
+// deleted entries is returned.
+func (r *Router) DeleteStaleEntries(currentHeight uint32) (int, error) {
+	done, err := r.beginProcessing()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	if currentHeight <= r.staleEntryDelta {
+		return 0, nil
+	}
+
+	return r.log.DeleteStale(currentHeight - r.staleEntryDelta)
+}
+
+// processOnionCfg is the set of optional parameters that alter the way an
+// onion packet is processed.
+type processOnionCfg struct {
+	blindingPoint     *btcec.PublicKey
+	expectPaymentHash bool
+	peelDetails       bool
+}
+
+// newProcessOnionCfg applies the passed set of options on top of the default
+// processing configuration.
+func newProcessOnionCfg(opts []ProcessOnionOpt) *processOnionCfg {
+	cfg := &processOnionCfg{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
+
+// ProcessOnionOpt is a functional option that can be passed in when
+// processing an onion packet.
+type ProcessOnionOpt func(*processOnionCfg)
+
+// WithBlindingPoint is a functional option that signals that the onion packet
+// is being forwarded as part of a blinded path, along with the blinding point
+// handed to us by the previous hop. The shared secret is then derived using
+// our onion key tweaked by the blinding point, and the blinding point for the
+// next hop is returned in ProcessedPacket.NextBlindingPoint.
+func WithBlindingPoint(blindingPoint *btcec.PublicKey) ProcessOnionOpt {
+	return func(cfg *processOnionCfg) {
+		cfg.blindingPoint = blindingPoint
+	}
+}
+
+// ExpectPaymentHash is a functional option that signals that the associated
+// data passed in is the payment hash the packet is bound to, as constructed
+// using the WithPaymentHash option. Associated data of any length other than
+// PaymentHashSize is then rejected with a ProcessingError of the StageVersion
+// stage wrapping ErrInvalidPaymentHashLength, before the packet is processed.
+func ExpectPaymentHash() ProcessOnionOpt {
+	return func(cfg *processOnionCfg) {
+		cfg.expectPaymentHash = true
+	}
+}
+
+// WithPeelDetails is a functional option that requests the internals of the
+// peeled layer to be exposed in ProcessedPacket.PeelDetails, which is useful
+// for simulators and visualizations of the processing of an onion packet. It
+// doesn't alter the way the packet is processed.
+func WithPeelDetails() ProcessOnionOpt {
+	return func(cfg *processOnionCfg) {
+		cfg.peelDetails = true
+	}
+}
+
+// PeelDetails exposes the raw components of the packet to be handed to the
+// next hop, as recovered when peeling a layer off an onion packet.
+type PeelDetails struct {
+	// NextRoutingInfo is the decrypted routing info for the next hop, with
+	// the payload of the processing hop stripped and the filler appended.
+	NextRoutingInfo []byte
+
+	// NextHMAC is the HMAC the next hop uses to check the integrity of
+	// NextRoutingInfo, as carried within the payload of the processing
+	// hop. It's all zeroes if the processing hop is the exit node.
+	NextHMAC [HMACSize]byte
+}
+
+// finalize populates the fields of the processed packet that depend upon the
+// processing options, including the blinding point for the next hop.
+func (cfg *processOnionCfg) finalize(packet *ProcessedPacket,
+	nextBlindingPoint *btcec.PublicKey) {
+
+	packet.NextBlindingPoint = nextBlindingPoint
+
+	if cfg.peelDetails {
+		nextRoutingInfo := make([]byte, len(packet.NextPacket.RoutingInfo))
+		copy(nextRoutingInfo, packet.NextPacket.RoutingInfo)
+
+		packet.PeelDetails = &PeelDetails{
+			NextRoutingInfo: nextRoutingInfo,
+			NextHMAC:        packet.Payload.HMAC,
+		}
+	}
+}
+
+// packetSharedSecret derives the shared secret for the passed onion packet,
+// taking into account the set of processing options. If the packet is part of
+// a blinded path, the blinding point for the next hop is returned as well.
+// Packets of an unknown version, or which don't match the geometry the router
+// is configured for, are rejected before performing any ECDH.
+func (r *Router) packetSharedSecret(onionPkt *OnionPacket, assocData []byte,
+	cfg *processOnionCfg) (Hash256, *btcec.PublicKey, error) {
+
+	if err := r.checkProcessing(onionPkt, assocData, cfg); err != nil {
+		return Hash256{}, nil, err
+	}
+
+	return r.deriveSharedSecret(onionPkt, assocData, cfg)
+}
+
+// deriveSharedSecret derives the shared secret for the passed onion packet
+// using the onion key of the router. Should that not yield a valid HMAC, the
+// retired onion keys are tried in turn, and the shared secret of the first one
+// that does is returned instead. If none of them match, the shared secret
+// derived using the onion key is returned, such that processing the packet
+// fails the HMAC check as usual.
+func (r *Router) deriveSharedSecret(onionPkt *OnionPacket, assocData []byte,
+	cfg *processOnionCfg) (Hash256, *btcec.PublicKey, error) {
+
+	sharedSecret, nextBlindingPoint, err := r.sharedSecretWithKey(
+		r.onionKey, onionPkt, cfg,
+	)
+	if err != nil {
+		return Hash256{}, nil, &ProcessingError{Stage: StageECDH, Err: err}
+	}
+	if len(r.retiredKeys) == 0 ||
+		r.matchesHMAC(onionPkt, &sharedSecret, assocData) {
+
+		return sharedSecret, nextBlindingPoint, nil
+	}
+
+	for _, retiredKey := range r.retiredKeys {
+		secret, blindingPoint, err := r.sharedSecretWithKey(
+			retiredKey, onionPkt, cfg,
+		)
+		if err != nil {
+			zero(sharedSecret[:])
+			return Hash256{}, nil, &ProcessingError{
+				Stage: StageECDH, Err: err,
+			}
+		}
+
+		if r.matchesHMAC(onionPkt, &secret, assocData) {
+			zero(sharedSecret[:])
+			return secret, blindingPoint, nil
+		}
+		zero(secret[:])
+	}
+
+	return sharedSecret, nextBlindingPoint, nil
+}
+
+// sharedSecretWithKey derives the shared secret for the passed onion packet
+// using the passed onion key, taking into account the set of processing
+// options. If the packet is part of a blinded path, the blinding point for the
+// next hop is returned as well.
+func (r *Router) sharedSecretWithKey(onionKey ECDHer, onionPkt *OnionPacket,
+	cfg *processOnionCfg) (Hash256, *btcec.PublicKey, error) {
+
+	if cfg.blindingPoint != nil {
+		return r.generateBlindedSharedSecret(
+			onionKey, onionPkt.EphemeralKey, cfg.blindingPoint,
+		)
+	}
 
-// ProcessedPacket encapsulates the resulting state generated after processing
-// an OnionPacket. A processed packet communicates to the caller what action
-// should be taken after processing.
-type ProcessedPacket struct {
-	// Action represents the action the caller should take after processing
-	// the packet.
-	Action ProcessCode
+	dhKey := onionPkt.EphemeralKey
+	if err := validateEphemeralKey(r.curve, dhKey); err != nil {
+		return Hash256{}, nil, err
+	}
+	sharedSecret, err := onionKey.ECDH(dhKey)
 
-	// ForwardingInstructions is the per-hop payload recovered from the
-	// initial encrypted onion packet. It details how the packet should be
-	// forwarded and also includes information that allows the processor of
-	// the packet to authenticate the information passed within the HTLC.
-	//
-	// NOTE: This field will only be populated iff the above Action is
-	// MoreHops.
-	ForwardingInstructions HopData
+	return sharedSecret, nil, err
+}
 
-	// NextPacket is the onion packet that should be forwarded to the next
-	// hop as denoted by the ForwardingInstructions field.
-	//
-	// NOTE: This field will only be populated iff the above Action is
-	// MoreHops.
-	NextPacket *OnionPacket
+// matchesHMAC returns whether the passed shared secret yields a valid HMAC for
+// the onion packet, which signals that the packet is addressed to the onion
+// key the shared secret was derived with.
+func (r *Router) matchesHMAC(onionPkt *OnionPacket, sharedSecret *Hash256,
+	assocData []byte) bool {
+
+	return verifyHMAC(
+		r.keyTags.Mu, sharedSecret, onionPkt.RoutingInfo, assocData,
+		onionPkt.HeaderMAC,
+	)
 }
 
-// Router is an onion router within the Sphinx network. The router is capable
-// of processing incoming Sphinx onion packets thereby "peeling" a layer off
-// the onion encryption which the packet is wrapped with.
-type Router struct {
-	nodeID   [AddressSize]byte
-	nodeAddr *btcutil.AddressPubKeyHash
+// isAddressedToSelf returns whether the passed onion packet is addressed to the
+// current or one of the retired onion keys of the router, which is the case
+// if the shared secret derived using any of them yields a valid HMAC.
+func (r *Router) isAddressedToSelf(onionPkt *OnionPacket,
+	assocData []byte) (bool, error) {
+
+	keys := append([]ECDHer{r.onionKey}, r.retiredKeys...)
+	for _, key := range keys {
+		sharedSecret, _, err := r.sharedSecretWithKey(
+			key, onionPkt, &processOnionCfg{},
+		)
+		if err != nil {
+			return false, err
+		}
 
-	onionKey *btcec.PrivateKey
+		matches := r.matchesHMAC(onionPkt, &sharedSecret, assocData)
+		zero(sharedSecret[:])
+		if matches {
+			return true, nil
+		}
+	}
 
-	log ReplayLog
+	return false, nil
 }
 
-// NewRouter creates a new instance of a Sphinx onion Router given the node's
-// currently advertised onion private key, and the target Bitcoin network.
-func NewRouter(nodeKey *btcec.PrivateKey, net *chaincfg.Params, log ReplayLog) *Router {
-	var nodeID [AddressSize]byte
-	copy(nodeID[:], btcutil.Hash160(nodeKey.PubKey().SerializeCompressed()))
+// checkProcessing performs the checks preceding the derivation of the shared
+// secret for the passed onion packet, taking into account the set of
+// processing options.
+func (r *Router) checkProcessing(onionPkt *OnionPacket, assocData []byte,
+	cfg *processOnionCfg) error {
 
-	// Safe to ignore the error here, nodeID is 20 bytes.
-	nodeAddr, _ := btcutil.NewAddressPubKeyHash(nodeID[:], net)
+	if r.optErr != nil {
+		return r.optErr
+	}
 
-	return &Router{
-		nodeID:   nodeID,
-		nodeAddr: nodeAddr,
-		onionKey: &btcec.PrivateKey{
-			PublicKey: ecdsa.PublicKey{
-				Curve: btcec.S256(),
-				X:     nodeKey.X,
-				Y:     nodeKey.Y,
-			},
-			D: nodeKey.D,
-		},
-		log: log,
+	if cfg.expectPaymentHash && len(assocData) != PaymentHashSize {
+		return &ProcessingError{
+			Stage: StageVersion,
+			Err: fmt.Errorf("%w: expected %d bytes, got %d",
+				ErrInvalidPaymentHashLength, PaymentHashSize,
+				len(assocData)),
+		}
 	}
-}
 
-// Start starts / opens the ReplayLog's channeldb and its accompanying
-// garbage collector goroutine.
-func (r *Router) Start() error {
-	return r.log.Start()
+	if err := r.checkPacket(onionPkt); err != nil {
+		return &ProcessingError{Stage: StageVersion, Err: err}
+	}
+
+	return nil
 }
 
-// Stop stops / closes the ReplayLog's channeldb and its accompanying
-// garbage collector goroutine.
-func (r *Router) Stop() {
-	r.log.Stop()
+// checkPacket performs the cheap sanity checks on the passed packet: it must
+// be of a version we understand, and its routing info must be of the size the
+// router is configured for.
+func (r *Router) checkPacket(onionPkt *OnionPacket) error {
+	if onionPkt.Version != baseVersion {
+		return ErrInvalidOnionVersion
+	}
+
+	routingInfoLen := r.packetCfg.RoutingInfoSize()
+	if len(onionPkt.RoutingInfo) != routingInfoLen {
+		return fmt.Errorf("%w: expected %d bytes, got %d",
+			ErrInvalidRoutingInfoSize, routingInfoLen,
+			len(onionPkt.RoutingInfo))
+	}
+
+	return nil
 }
 
 // ProcessOnionPacket processes an incoming onion packet which has been forward
 // to the target Sphinx router. If the encoded ephemeral key isn't on the
 // target Elliptic Curve, then the packet is rejected. Similarly, if the
 // derived shared secret has been seen before the packet is rejected.  Finally
-// if the MAC doesn't check the packet is again rejected.
+// if the MAC doesn't check the packet is again rejected. The MAC is checked in
+// constant time, so the time taken to reject a packet with an invalid MAC
+// doesn't reveal how much of it was correct. Rejected packets result in a
+// *ProcessingError, which identifies the stage at which processing failed.
 //
 // In the case of a successful packet processing, and ProcessedPacket struct is
 // returned which houses the newly parsed packet, along with instructions on
-// what to do next.
+// what to do next. The packet is only returned once it has been recorded in
+// the replay log. If writing to the log fails for any reason, including an I/O
+// error of a persistent log, the error is returned instead, such that the
+// caller never forwards a packet that could later be replayed.
 func (r *Router) ProcessOnionPacket(onionPkt *OnionPacket,
-	assocData []byte, incomingCltv uint32) (*ProcessedPacket, error) {
+	assocData []byte, incomingCltv uint32,
+	opts ...ProcessOnionOpt) (*ProcessedPacket, error) {
+
+	if r.onProcessDuration != nil {
+		start := time.Now()
+		defer func() {
+			r.onProcessDuration(time.Since(start))
+		}()
+	}
+
+	done, err := r.beginProcessing()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 
 	// Compute the shared secret for this onion packet.
-	sharedSecret, err := r.generateSharedSecret(onionPkt.EphemeralKey)
+	cfg := newProcessOnionCfg(opts)
+	sharedSecret, nextBlindingPoint, err := r.packetSharedSecret(
+		onionPkt, assocData, cfg,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(sharedSecret[:])
+
+	return r.processAndLog(
+		onionPkt, assocData, incomingCltv, &sharedSecret,
+		nextBlindingPoint, cfg,
+	)
+}
+
+// ProcessAndEncode processes an incoming onion packet exactly like
+// ProcessOnionPacket, including replay protection, and returns the packet for
+// the next hop already serialized, ready to be forwarded over the channel
+// with the returned short channel ID. This suits relays that only forward
+// packets, sparing them from encoding the next packet themselves.
+//
+// NOTE: For the ExitNode action no wire bytes are returned, and neither is
+// the payload of the exit hop, even though the packet is consumed. Routers
+// that may be the final recipient of a packet should use ProcessOnionPacket
+// instead, or check IsExitHop first.
+func (r *Router) ProcessAndEncode(onionPkt *OnionPacket, assocData []byte,
+	incomingCltv uint32, opts ...ProcessOnionOpt) (ProcessCode,
+	[AddressSize]byte, []byte, error) {
+
+	packet, err := r.ProcessOnionPacket(
+		onionPkt, assocData, incomingCltv, opts...,
+	)
+	if err != nil {
+		return Failure, [AddressSize]byte{}, nil, err
+	}
+	if packet.Action != MoreHops {
+		return packet.Action, [AddressSize]byte{}, nil, nil
+	}
+
+	wire, err := packet.NextPacket.MarshalBinary()
 	if err != nil {
+		return Failure, [AddressSize]byte{}, nil, err
+	}
+
+	return packet.Action, packet.NextChannelID, wire, nil
+}
+
+// ProcessOnionPacketWithSharedSecret processes an incoming onion packet
+// exactly like ProcessOnionPacket, including replay protection, but using the
+// passed shared secret rather than deriving it through an ECDH operation with
+// the router's onion key. This allows the ECDH to be performed elsewhere, for
+// instance by a remote signer, after which the secret is used for the key
+// derivation, the HMAC check and the peeling of the layer.
+//
+// NOTE: As the blinding point for the next hop can't be derived without the
+// onion key, the WithBlindingPoint option isn't supported.
+func (r *Router) ProcessOnionPacketWithSharedSecret(onionPkt *OnionPacket,
+	assocData []byte, sharedSecret [32]byte, incomingCltv uint32,
+	opts ...ProcessOnionOpt) (*ProcessedPacket, error) {
+
+	done, err := r.beginProcessing()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	cfg := newProcessOnionCfg(opts)
+	if cfg.blindingPoint != nil {
+		return nil, fmt.Errorf("blinding point can't be used with a " +
+			"precomputed shared secret")
+	}
+	if err := r.checkProcessing(onionPkt, assocData, cfg); err != nil {
 		return nil, err
 	}
 
+	// Although no ECDH is performed, the ephemeral key is still blinded
+	// to derive the one for the next hop, so it must be valid.
+	err = validateEphemeralKey(r.curve, onionPkt.EphemeralKey)
+	if err != nil {
+		return nil, &ProcessingError{Stage: StageECDH, Err: err}
+	}
+
+	secret := Hash256(sharedSecret)
+	defer zero(secret[:])
+
+	return r.processAndLog(
+		onionPkt, assocData, incomingCltv, &secret, nil, cfg,
+	)
+}
+
+// processAndLog peels a layer off the passed onion packet using its shared
+// secret, after which the packet is recorded in the replay log. The processed
+// packet is only returned if it wasn't detected as a replay.
+func (r *Router) processAndLog(onionPkt *OnionPacket, assocData []byte,
+	incomingCltv uint32, sharedSecret *Hash256,
+	nextBlindingPoint *btcec.PublicKey,
+	cfg *processOnionCfg) (*ProcessedPacket, error) {
+
 	// Additionally, compute the hash prefix of the shared secret, which
 	// will serve as an identifier for detecting replayed packets.
-	hashPrefix := hashSharedSecret(&sharedSecret)
+	hashPrefix := hashSharedSecret(r.replayHash, sharedSecret)
 
 	// Continue to optimistically process this packet, deferring replay
 	// protection until the end to reduce the penalty of multiple IO
 	// operations.
-	packet, err := processOnionPacket(onionPkt, &sharedSecret, assocData, r)
+	packet, err := r.processOnionPacket(onionPkt, sharedSecret, assocData)
 	if err != nil {
+		if errors.Is(err, ErrInvalidOnionHMAC) && r.observer != nil {
+			r.observer.OnHMACFailure()
+		}
 		return nil, err
 	}
+	cfg.finalize(packet, nextBlindingPoint)
 
 	// Atomically compare this hash prefix with the contents of the on-disk
 	// log, persisting it only if this entry was not detected as a replay.
 	if err := r.log.Put(hashPrefix, incomingCltv); err != nil {
-		return nil, err
+		if errors.Is(err, ErrReplayedPacket) && r.observer != nil {
+			r.observer.OnReplayRejected()
+		}
+		return nil, &ProcessingError{Stage: StageReplay, Err: err}
+	}
+
+	if r.observer != nil {
+		r.observer.OnPacketProcessed(packet.Action)
 	}
 
 	return packet, nil
@@ -611,24 +2613,135 @@ func (r *Router) ProcessOnionPacket(onionPkt *OnionPacket,
 // NOTE: This method does not do any sort of replay protection, and should only
 // be used to reconstruct packets that were successfully processed previously.
 func (r *Router) ReconstructOnionPacket(onionPkt *OnionPacket,
-	assocData []byte) (*ProcessedPacket, error) {
+	assocData []byte, opts ...ProcessOnionOpt) (*ProcessedPacket, error) {
 
 	// Compute the shared secret for this onion packet.
-	sharedSecret, err := r.generateSharedSecret(onionPkt.EphemeralKey)
+	cfg := newProcessOnionCfg(opts)
+	sharedSecret, nextBlindingPoint, err := r.packetSharedSecret(
+		onionPkt, assocData, cfg,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(sharedSecret[:])
+
+	packet, err := r.processOnionPacket(onionPkt, &sharedSecret, assocData)
 	if err != nil {
 		return nil, err
 	}
+	cfg.finalize(packet, nextBlindingPoint)
+
+	return packet, nil
+}
+
+// IsExitHop reports whether the router is the final recipient of the passed
+// onion packet. It derives the shared secret for the packet, verifies its
+// HMAC, and peels off a single layer to check whether the HMAC handed to the
+// next hop is the all-zero terminal marker. This allows a node to branch its
+// handling of a packet early, without the cost of fully processing it.
+//
+// NOTE: The packet is neither checked against, nor recorded in, the replay
+// log, so it isn't consumed. It must still be processed using
+// ProcessOnionPacket, or as part of a batch, before acting on it.
+func (r *Router) IsExitHop(onionPkt *OnionPacket, assocData []byte,
+	opts ...ProcessOnionOpt) (bool, error) {
+
+	cfg := newProcessOnionCfg(opts)
+	sharedSecret, _, err := r.packetSharedSecret(onionPkt, assocData, cfg)
+	if err != nil {
+		return false, err
+	}
+	defer zero(sharedSecret[:])
+
+	_, hopPayload, err := unwrapPacket(
+		r.curve, r.keyTags, onionPkt, &sharedSecret, assocData,
+	)
+	switch {
+	case errors.Is(err, ErrInvalidOnionHMAC):
+		return false, &ProcessingError{Stage: StageHMAC, Err: err}
+
+	case err != nil:
+		return false, &ProcessingError{Stage: StagePayload, Err: err}
+	}
+	if err := r.packetCfg.checkHopPayload(hopPayload); err != nil {
+		return false, &ProcessingError{Stage: StagePayload, Err: err}
+	}
+
+	return isTerminalHMAC(&hopPayload.HMAC), nil
+}
+
+// ReplayPrefix returns the hash prefix of the shared secret of the passed
+// onion packet, under which processing the packet records it in the replay
+// log. Only the shared secret is derived, which allows a node to query the
+// replay log directly before fully processing the packet, for instance to
+// deduplicate packets pending within a batch.
+//
+// NOTE: The HMAC of the packet isn't verified, so a prefix is returned for
+// packets that ProcessOnionPacket would reject as well.
+func (r *Router) ReplayPrefix(onionPkt *OnionPacket, assocData []byte,
+	opts ...ProcessOnionOpt) (HashPrefix, error) {
+
+	cfg := newProcessOnionCfg(opts)
+	sharedSecret, _, err := r.packetSharedSecret(onionPkt, assocData, cfg)
+	if err != nil {
+		return HashPrefix{}, err
+	}
+	defer zero(sharedSecret[:])
 
-	return processOnionPacket(onionPkt, &sharedSecret, assocData, r)
+	return *hashSharedSecret(r.replayHash, &sharedSecret), nil
+}
+
+// PeekOnionPacket fully decrypts the passed onion packet and validates its
+// HMAC, returning what processing the packet would result in, without
+// consuming it. This allows tooling to inspect packets, for instance when
+// probing routes or diagnosing failures.
+//
+// NOTE: The packet is neither checked against, nor recorded in, the replay
+// log. This method bypasses replay protection entirely, and MUST NOT be used
+// to decide whether to forward a packet. Use ProcessOnionPacket instead.
+func (r *Router) PeekOnionPacket(onionPkt *OnionPacket,
+	assocData []byte, opts ...ProcessOnionOpt) (*ProcessedPacket, error) {
+
+	return r.ReconstructOnionPacket(onionPkt, assocData, opts...)
+}
+
+// workBufPool is a pool of the work buffers used to peel a layer off an onion
+// packet, which are twice the size of the routing info. Pooling them avoids
+// allocating a large buffer for every processed packet.
+var workBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 2*routingInfoSize)
+		return &b
+	},
+}
+
+// getWorkBuf returns a work buffer of exactly n bytes from the pool. Its
+// contents are undefined.
+func getWorkBuf(n int) *[]byte {
+	b := workBufPool.Get().(*[]byte)
+	if cap(*b) < n {
+		*b = make([]byte, n)
+	}
+	*b = (*b)[:n]
+
+	return b
+}
+
+// putWorkBuf wipes the passed work buffer and returns it to the pool. The
+// buffer must not be used afterwards.
+func putWorkBuf(b *[]byte) {
+	zero(*b)
+	workBufPool.Put(b)
 }
 
 // unwrapPacket wraps a layer of the passed onion packet using the specified
 // shared secret and associated data. The associated data will be used to check
 // the HMAC at each hop to ensure the same data is passed along with the onion
 // packet. This function returns the next inner onion packet layer, along with
-// the hop data extracted from the outer onion packet.
-func unwrapPacket(onionPkt *OnionPacket, sharedSecret *Hash256,
-	assocData []byte) (*OnionPacket, *HopData, error) {
+// the hop payload extracted from the outer onion packet.
+func unwrapPacket(curve elliptic.Curve, tags KeyTags, onionPkt *OnionPacket,
+	sharedSecret *Hash256, assocData []byte) (*OnionPacket, *HopPayload,
+	error) {
 
 	dhKey := onionPkt.EphemeralKey
 	routeInfo := onionPkt.RoutingInfo
@@ -637,58 +2750,62 @@ func unwrapPacket(onionPkt *OnionPacket, sharedSecret *Hash256,
 	// Using the derived shared secret, ensure the integrity of the routing
 	// information by checking the attached MAC without leaking timing
 	// information.
-	message := append(routeInfo[:], assocData...)
-	calculatedMac := calcMac(generateKey("mu", sharedSecret), message)
-	if !hmac.Equal(headerMac[:], calculatedMac[:]) {
+	if !verifyHMAC(tags.Mu, sharedSecret, routeInfo, assocData, headerMac) {
 		return nil, nil, ErrInvalidOnionHMAC
 	}
 
 	// Attach the padding zeroes in order to properly strip an encryption
 	// layer off the routing info revealing the routing information for the
 	// next hop.
-	streamBytes := generateCipherStream(
-		generateKey("rho", sharedSecret),
-		numStreamBytes,
-	)
-	zeroBytes := bytes.Repeat([]byte{0}, HopDataSize)
-	headerWithPadding := append(routeInfo[:], zeroBytes...)
+	rhoKey := generateKey(tags.Rho, sharedSecret)
+	defer zero(rhoKey[:])
+
+	// The routing info and its zero padding are assembled within a pooled
+	// work buffer, which is then decrypted in place.
+	workBuf := getWorkBuf(2 * len(routeInfo))
+	defer putWorkBuf(workBuf)
 
-	var hopInfo [numStreamBytes]byte
-	xor(hopInfo[:], headerWithPadding, streamBytes)
+	hopInfo := *workBuf
+	copy(hopInfo, routeInfo)
+	zero(hopInfo[len(routeInfo):])
+	xorCipherStream(hopInfo, hopInfo, rhoKey)
 
 	// Randomize the DH group element for the next hop using the
 	// deterministic blinding factor.
 	blindingFactor := computeBlindingFactor(dhKey, sharedSecret[:])
-	nextDHKey := blindGroupElement(dhKey, blindingFactor[:])
+	nextDHKey := blindGroupElement(curve, dhKey, blindingFactor[:])
 
 	// With the MAC checked, and the payload decrypted, we can now parse
-	// out the per-hop data so we can derive the specified forwarding
+	// out the payload so we can derive the specified forwarding
 	// instructions.
-	var hopData HopData
-	if err := hopData.Decode(bytes.NewReader(hopInfo[:])); err != nil {
+	var hopPayload HopPayload
+	if err := hopPayload.Decode(bytes.NewReader(hopInfo)); err != nil {
 		return nil, nil, err
 	}
+	if hopPayload.NumBytes() > len(routeInfo) {
+		return nil, nil, ErrPayloadTooLarge
+	}
 
 	// With the necessary items extracted, we'll copy of the onion packet
 	// for the next node, snipping off our per-hop data.
-	var nextMixHeader [routingInfoSize]byte
-	copy(nextMixHeader[:], hopInfo[HopDataSize:])
+	nextMixHeader := make([]byte, len(routeInfo))
+	copy(nextMixHeader, hopInfo[hopPayload.NumBytes():])
 	innerPkt := &OnionPacket{
 		Version:      onionPkt.Version,
 		EphemeralKey: nextDHKey,
 		RoutingInfo:  nextMixHeader,
-		HeaderMAC:    hopData.HMAC,
+		HeaderMAC:    hopPayload.HMAC,
 	}
 
-	return innerPkt, &hopData, nil
+	return innerPkt, &hopPayload, nil
 }
 
 // processOnionPacket performs the primary key derivation and handling of onion
-// packets. The processed packets returned from this method should only be used
-// if the packet was not flagged as a replayed packet.
-func processOnionPacket(onionPkt *OnionPacket, sharedSecret *Hash256,
-	assocData []byte,
-	sharedSecretGen sharedSecretGenerator) (*ProcessedPacket, error) {
+// packets, according to the configuration of the router. The processed packets
+// returned from this method should only be used if the packet was not flagged
+// as a replayed packet.
+func (r *Router) processOnionPacket(onionPkt *OnionPacket,
+	sharedSecret *Hash256, assocData []byte) (*ProcessedPacket, error) {
 
 	// First, we'll unwrap an initial layer of the onion packet. Typically,
 	// we'll only have a single layer to unwrap, However, if the sender has
@@ -697,31 +2814,181 @@ func processOnionPacket(onionPkt *OnionPacket, sharedSecret *Hash256,
 	// mix header is the one that we'll want to pass onto the next hop so
 	// they can properly check the HMAC and unwrap a layer for their
 	// handoff hop.
-	innerPkt, outerHopData, err := unwrapPacket(
-		onionPkt, sharedSecret, assocData,
+	innerPkt, outerHopPayload, err := unwrapPacket(
+		r.curve, r.keyTags, onionPkt, sharedSecret, assocData,
 	)
-	if err != nil {
-		return nil, err
+	switch {
+	case errors.Is(err, ErrInvalidOnionHMAC):
+		return nil, &ProcessingError{Stage: StageHMAC, Err: err}
+
+	case err != nil:
+		return nil, &ProcessingError{Stage: StagePayload, Err: err}
+	}
+
+	// Custom geometries reserve a fixed number of bytes for each hop, which
+	// our payload mustn't exceed.
+	if err := r.packetCfg.checkHopPayload(outerHopPayload); err != nil {
+		return nil, &ProcessingError{Stage: StagePayload, Err: err}
+	}
+
+	// If the payload could just as well be an empty TLV payload marking us
+	// as the exit hop, we'll leave it to the caller how to proceed rather
+	// than guessing, if configured to do so.
+	if r.rejectAmbiguousPayloads && outerHopPayload.isAmbiguous() {
+		return nil, &ProcessingError{
+			Stage: StagePayload,
+			Err:   ErrAmbiguousPayload,
+		}
 	}
 
 	// By default we'll assume that there are additional hops in the route.
 	// However if the uncovered 'nextMac' is all zeroes, then this
 	// indicates that we're the final hop in the route.
 	var action ProcessCode = MoreHops
-	if bytes.Compare(zeroHMAC[:], outerHopData.HMAC[:]) == 0 {
+	if isTerminalHMAC(&outerHopPayload.HMAC) {
 		action = ExitNode
 	}
 
+	// If we're the rendezvous node of a spliced onion, the packet for the
+	// next hop continues into the partial onion of the recipient.
+	if action == MoreHops {
+		err := spliceRendezvous(r.curve, outerHopPayload, innerPkt)
+		if err != nil {
+			return nil, &ProcessingError{
+				Stage: StagePayload,
+				Err:   err,
+			}
+		}
+	}
+
+	// If configured to do so, we'll ensure the packet for the next hop
+	// isn't addressed to ourselves.
+	if action == MoreHops && r.detectSelfLoops {
+		loops, err := r.isAddressedToSelf(innerPkt, assocData)
+		if err != nil {
+			return nil, &ProcessingError{Stage: StageECDH, Err: err}
+		}
+		if loops {
+			return nil, &ProcessingError{
+				Stage: StagePayload,
+				Err:   ErrSelfLoop,
+			}
+		}
+	}
+
+	// If the sender padded the payload of the final hop, we'll strip the
+	// padding to recover the original payload.
+	if action == ExitNode && r.paddedExitPayloads {
+		outerHopPayload.Payload, err = unpadPayload(
+			outerHopPayload.Payload,
+		)
+		if err != nil {
+			return nil, &ProcessingError{Stage: StagePayload, Err: err}
+		}
+	}
+
+	// If configured to do so, we'll ensure a TLV payload is well formed
+	// before handing it to the caller.
+	if err := r.validateTLVPayload(outerHopPayload); err != nil {
+		return nil, &ProcessingError{Stage: StagePayload, Err: err}
+	}
+
+	// If this is a legacy payload, we'll also parse out the forwarding
+	// instructions it contains.
+	hopData, err := outerHopPayload.HopData()
+	if err != nil {
+		return nil, &ProcessingError{Stage: StagePayload, Err: err}
+	}
+
 	// Finally, we'll return a fully processed packet with the outer most
 	// hop data (where the primary forwarding instructions lie) and the
 	// inner most onion packet that we unwrapped.
 	return &ProcessedPacket{
 		Action:                 action,
-		ForwardingInstructions: *outerHopData,
+		ForwardingInstructions: hopData,
+		Payload:                *outerHopPayload,
 		NextPacket:             innerPkt,
+		NextChannelID:          nextChannelID(action, outerHopPayload),
+		Delay:                  mixDelay(outerHopPayload),
+		PaymentMetadata:        paymentMetadata(action, outerHopPayload),
+		SharedSecret:           *sharedSecret,
 	}, nil
 }
 
+// validateTLVPayload validates the passed hop payload according to the TLV
+// strictness of the router. Legacy payloads are left unchecked.
+func (r *Router) validateTLVPayload(payload *HopPayload) error {
+	if payload.Type != PayloadTLV {
+		return nil
+	}
+
+	switch r.tlvStrictness {
+	case TLVWellFormed:
+		return validateTLVStream(payload.Payload, nil)
+
+	case TLVStrict:
+		return validateTLVStream(payload.Payload, r.knownTLVTypes)
+
+	default:
+		return nil
+	}
+}
+
+// nextChannelID returns the short channel ID of the next hop, as carried by
+// the passed hop payload. All zeroes are returned if there is no next hop, or
+// if the payload doesn't carry a valid short channel ID.
+func nextChannelID(action ProcessCode,
+	payload *HopPayload) [AddressSize]byte {
+
+	var channelID [AddressSize]byte
+	if action != MoreHops {
+		return channelID
+	}
+
+	switch payload.Type {
+	case PayloadLegacy:
+		hopData, err := payload.HopData()
+		if err == nil {
+			channelID = hopData.NextAddress
+		}
+
+	case PayloadTLV:
+		hopData, err := payload.TLVHopData()
+		if err == nil && hopData.NextAddress != nil {
+			channelID = *hopData.NextAddress
+		}
+	}
+
+	return channelID
+}
+
+// mixDelay returns the mix delay carried by the passed hop payload. Zero is
+// returned if it isn't a TLV payload carrying a valid mix delay record.
+func mixDelay(payload *HopPayload) time.Duration {
+	hopData, err := payload.TLVHopData()
+	if err != nil || hopData == nil {
+		return 0
+	}
+
+	return hopData.Delay
+}
+
+// paymentMetadata returns the payment metadata carried by the passed hop
+// payload of the exit hop. Nil is returned if we aren't the exit hop, or if it
+// isn't a TLV payload carrying a valid payment metadata record.
+func paymentMetadata(action ProcessCode, payload *HopPayload) []byte {
+	if action != ExitNode {
+		return nil
+	}
+
+	hopData, err := payload.TLVHopData()
+	if err != nil || hopData == nil {
+		return nil
+	}
+
+	return hopData.PaymentMetadata
+}
+
 // Tx is a transaction consisting of a number of sphinx packets to be atomically
 // written to the replay log. This structure helps to coordinate construction of
 // the underlying Batch object, and to ensure that the result of the processing
@@ -767,29 +3034,32 @@ func (r *Router) BeginTxn(id []byte, nels int) *Tx {
 // returned which houses the newly parsed packet, along with instructions on
 // what to do next.
 func (t *Tx) ProcessOnionPacket(seqNum uint16, onionPkt *OnionPacket,
-	assocData []byte, incomingCltv uint32) error {
+	assocData []byte, incomingCltv uint32, opts ...ProcessOnionOpt) error {
 
 	// Compute the shared secret for this onion packet.
-	sharedSecret, err := t.router.generateSharedSecret(
-		onionPkt.EphemeralKey,
+	cfg := newProcessOnionCfg(opts)
+	sharedSecret, nextBlindingPoint, err := t.router.packetSharedSecret(
+		onionPkt, assocData, cfg,
 	)
 	if err != nil {
 		return err
 	}
+	defer zero(sharedSecret[:])
 
 	// Additionally, compute the hash prefix of the shared secret, which
 	// will serve as an identifier for detecting replayed packets.
-	hashPrefix := hashSharedSecret(&sharedSecret)
+	hashPrefix := hashSharedSecret(t.router.replayHash, &sharedSecret)
 
 	// Continue to optimistically process this packet, deferring replay
 	// protection until the end to reduce the penalty of multiple IO
 	// operations.
-	packet, err := processOnionPacket(
-		onionPkt, &sharedSecret, assocData, t.router,
+	packet, err := t.router.processOnionPacket(
+		onionPkt, &sharedSecret, assocData,
 	)
 	if err != nil {
 		return err
 	}
+	cfg.finalize(packet, nextBlindingPoint)
 
 	// Add the hash prefix to pending batch of shared secrets that will be
 	// written later via Commit().
@@ -808,13 +3078,193 @@ func (t *Tx) ProcessOnionPacket(seqNum uint16, onionPkt *OnionPacket,
 }
 
 // Commit writes this transaction's batch of sphinx packets to the replay log,
-// performing a final check against the log for replays.
+// performing a final check against the log for replays. If the batch can't be
+// written, no packets are returned, as none of them were recorded.
 func (t *Tx) Commit() ([]ProcessedPacket, *ReplaySet, error) {
 	if t.batch.IsCommitted {
 		return t.packets, t.batch.ReplaySet, nil
 	}
 
+	done, err := t.router.beginProcessing()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer done()
+
 	rs, err := t.router.log.PutBatch(t.batch)
+	if err != nil {
+		return nil, nil, &ProcessingError{Stage: StageReplay, Err: err}
+	}
+
+	return t.packets, rs, nil
+}
+
+// ProcessOnionPackets processes a batch of incoming onion packets, such as
+// those received within a single commitment update. The ECDH operations for
+// the entire batch are performed up front, after which each packet is peeled
+// and its hash prefix added to a single Batch that is written to the replay
+// log at the very end. The write is atomic, such that either all packets or
+// none of them are recorded.
+//
+// The i-th entry of assocData and incomingCltvs is used for the i-th packet.
+// The returned slice is always index-aligned with pkts, such that the i-th
+// entry is the result of processing the i-th packet, with entries for packets
+// that were detected as replays set to nil. Their indexes are also included in
+// the returned ReplaySet. If any packet fails processing, nothing is written to
+// the replay log and an error is returned, unless the router is configured
+// using WithIsolatedBatchFailures, in which case only the failed packets are
+// skipped, and their errors are returned within a *BatchError.
+func (r *Router) ProcessOnionPackets(id []byte, pkts []*OnionPacket,
+	assocData [][]byte, incomingCltvs []uint32) ([]*ProcessedPacket,
+	*ReplaySet, error) {
+
+	return r.ProcessOnionPacketsContext(
+		context.Background(), id, pkts, assocData, incomingCltvs,
+	)
+}
+
+// ProcessOnionPacketsContext is identical to ProcessOnionPackets, but allows
+// the batch to be cancelled through the passed context, which is checked
+// between packets.
+//
+// If the context is cancelled before any packet has been peeled, nothing is
+// written to the replay log. Otherwise, the packets peeled so far are
+// committed to the replay log in a single atomic write, and returned along
+// with the context's error; the entries of the remaining packets are nil, and
+// none of them are recorded. As the batch is incomplete, it's committed
+// without an ID, so a later attempt to process the full batch under the same
+// ID treats the packets committed here as replays rather than returning the
+// partial result. The context's error takes precedence over a *BatchError.
+func (r *Router) ProcessOnionPacketsContext(ctx context.Context, id []byte,
+	pkts []*OnionPacket, assocData [][]byte,
+	incomingCltvs []uint32) ([]*ProcessedPacket, *ReplaySet, error) {
+
+	if len(assocData) != len(pkts) || len(incomingCltvs) != len(pkts) {
+		return nil, nil, fmt.Errorf("%w: %d packets have %d "+
+			"associated data entries and %d incoming cltvs",
+			ErrInvalidBatch, len(pkts), len(assocData),
+			len(incomingCltvs))
+	}
+	if len(pkts) > math.MaxUint16+1 {
+		return nil, nil, fmt.Errorf("%w: %d packets exceed "+
+			"maximum of %d", ErrInvalidBatch, len(pkts),
+			math.MaxUint16+1)
+	}
+
+	done, err := r.beginProcessing()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer done()
+
+	// First, we'll derive the shared secret for every packet in the
+	// batch. If any of the ephemeral keys are invalid, we're able to bail
+	// out before doing any of the remaining work.
+	//
+	// If we're to isolate failures, the error of each failed packet is
+	// instead recorded, and the packet skipped from here on.
+	var (
+		sharedSecrets = make([]Hash256, len(pkts))
+		pktErrs       = make([]error, len(pkts))
+		numFailed     int
+	)
+	defer func() {
+		for i := range sharedSecrets {
+			zero(sharedSecrets[i][:])
+		}
+	}()
+	fail := func(i int, err error) error {
+		if !r.isolateBatchFailures {
+			return err
+		}
+
+		pktErrs[i] = err
+		numFailed++
+
+		return nil
+	}
+	for i, pkt := range pkts {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		if err := r.checkPacket(pkt); err != nil {
+			err = fail(i, &ProcessingError{
+				Stage: StageVersion,
+				Err:   err,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		sharedSecret, _, err := r.deriveSharedSecret(
+			pkt, assocData[i], &processOnionCfg{},
+		)
+		if err != nil {
+			if err := fail(i, err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		sharedSecrets[i] = sharedSecret
+	}
+
+	// With all secrets derived, peel a layer off each packet and add its
+	// hash prefix to the pending batch. Should we be cancelled midway, the
+	// batch is cut short and committed without an ID.
+	batch := NewBatch(id)
+	packets := make([]*ProcessedPacket, len(pkts))
+	var ctxErr error
+	for i, pkt := range pkts {
+		if ctxErr = ctx.Err(); ctxErr != nil {
+			if i == 0 {
+				return nil, nil, ctxErr
+			}
+			batch.ID = nil
+			break
+		}
+		if pktErrs[i] != nil {
+			continue
+		}
+
+		packet, err := r.processOnionPacket(
+			pkt, &sharedSecrets[i], assocData[i],
+		)
+		if err != nil {
+			if err := fail(i, err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		hashPrefix := hashSharedSecret(r.replayHash, &sharedSecrets[i])
+		err = batch.Put(uint16(i), hashPrefix, incomingCltvs[i])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		packets[i] = packet
+	}
+
+	// Commit the entire batch to the replay log in a single write.
+	replays, err := r.log.PutBatch(batch)
+	if err != nil {
+		return nil, nil, &ProcessingError{Stage: StageReplay, Err: err}
+	}
+
+	// Finally, remove any packets that were found to be replays, so the
+	// caller can't mistakenly act upon them.
+	for i := range packets {
+		if replays.Contains(uint16(i)) {
+			packets[i] = nil
+		}
+	}
+
+	if ctxErr == nil && numFailed > 0 {
+		return packets, replays, &BatchError{Errors: pktErrs}
+	}
 
-	return t.packets, rs, err
+	return packets, replays, ctxErr
 }
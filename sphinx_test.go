@@ -2,10 +2,24 @@ package sphinx
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
@@ -23,6 +37,16 @@ var (
 		"02edabbd16b41c8371b92ef2f04c1185b4f03b6dcd52ba9b78d9d7c89c8f221145",
 	}
 
+	// bolt4HopSharedSecrets are the expected shared secrets between the
+	// session key and each of the hops in the route.
+	bolt4HopSharedSecrets = []string{
+		"53eb63ea8a3fec3b3cd433b85cd62a4b145e1dda09391b348c4e1cd36a03ea66",
+		"a6519e98832a0b179f62123b3567c106db99ee37bef036e783263602f3488fae",
+		"3a6b412548762f0dbccce5c7ae7bb8147d1caf9b5471c34120b30bc9c04891cc",
+		"21e13c2d7cfe7e18836df50872466117a295783ab8aab0e7ecc8c725503ad02d",
+		"b5756b9b542727dbafc6765a49488b023a725d631af688fc031217e90770c328",
+	}
+
 	// bolt4SessionKey is the session private key.
 	bolt4SessionKey = bytes.Repeat([]byte{'A'}, 32)
 
@@ -86,6 +110,11 @@ var (
 		"baaa7d63ad64199f4664813b955cff954949076dcf"
 )
 
+// testLegacyRouteNumHops is the maximum number of hops of a route that only
+// uses legacy hop payloads, as each of them occupies LegacyHopDataSize bytes of
+// the routing info.
+const testLegacyRouteNumHops = 20
+
 func newTestRoute(numHops int) ([]*Router, *PaymentPath, *[]HopData, *OnionPacket, error) {
 	nodes := make([]*Router, numHops)
 
@@ -104,7 +133,8 @@ func newTestRoute(numHops int) ([]*Router, *PaymentPath, *[]HopData, *OnionPacke
 
 	// Gather all the pub keys in the path.
 	var (
-		route PaymentPath
+		route    PaymentPath
+		hopsData []HopData
 	)
 	for i := 0; i < len(nodes); i++ {
 		hopData := HopData{
@@ -115,10 +145,18 @@ func newTestRoute(numHops int) ([]*Router, *PaymentPath, *[]HopData, *OnionPacke
 
 		copy(hopData.NextAddress[:], bytes.Repeat([]byte{byte(i)}, 8))
 
+		hopPayload, err := NewHopPayload(&hopData, nil)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("unable to "+
+				"create new hop payload: %v", err)
+		}
+
 		route[i] = OnionHop{
-			NodePub: *nodes[i].onionKey.PubKey(),
-			HopData: hopData,
+			NodePub:    *nodes[i].onionPub,
+			HopPayload: hopPayload,
 		}
+
+		hopsData = append(hopsData, hopData)
 	}
 
 	// Generate a forwarding message to route to the final node via the
@@ -133,11 +171,6 @@ func newTestRoute(numHops int) ([]*Router, *PaymentPath, *[]HopData, *OnionPacke
 			"forwarding message: %#v", err)
 	}
 
-	var hopsData []HopData
-	for i := 0; i < len(nodes); i++ {
-		hopsData = append(hopsData, route[i].HopData)
-	}
-
 	return nodes, &route, &hopsData, fwdMsg, nil
 }
 
@@ -165,11 +198,16 @@ func TestBolt4Packet(t *testing.T) {
 		copy(hopData.NextAddress[:], bytes.Repeat([]byte{byte(i)}, 8))
 		hopsData = append(hopsData, hopData)
 
+		hopPayload, err := NewHopPayload(&hopData, nil)
+		if err != nil {
+			t.Fatalf("unable to make hop payload: %v", err)
+		}
+
 		pubKey.Curve = nil
 
 		route[i] = OnionHop{
-			NodePub: *pubKey,
-			HopData: hopData,
+			NodePub:    *pubKey,
+			HopPayload: hopPayload,
 		}
 	}
 
@@ -197,8 +235,81 @@ func TestBolt4Packet(t *testing.T) {
 	}
 }
 
+// TestBolt4PacketProcessing tests that each hop of the BOLT 4 test vector
+// route derives the expected shared secret, and recovers the expected hop
+// data when processing the reference packet. The private key of the i-th hop
+// consists of 32 repetitions of the byte 0x41+i.
+func TestBolt4PacketProcessing(t *testing.T) {
+	finalPacket, err := hex.DecodeString(bolt4FinalPacketHex)
+	if err != nil {
+		t.Fatalf("unable to decode BOLT 4 final onion packet from hex: "+
+			"%v", err)
+	}
+
+	var fwdMsg OnionPacket
+	if err := fwdMsg.Decode(bytes.NewReader(finalPacket)); err != nil {
+		t.Fatalf("unable to decode BOLT 4 onion packet: %v", err)
+	}
+
+	for i, pubKeyHex := range bolt4PubKeys {
+		privKey, pubKey := btcec.PrivKeyFromBytes(
+			btcec.S256(), bytes.Repeat([]byte{byte(0x41 + i)}, 32),
+		)
+		if hex.EncodeToString(pubKey.SerializeCompressed()) != pubKeyHex {
+			t.Fatalf("BOLT 4 private key #%d doesn't match pubkey", i)
+		}
+
+		router := NewRouter(
+			privKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+		)
+		router.Start()
+		defer router.Stop()
+
+		pkt, err := router.ProcessOnionPacket(
+			&fwdMsg, bolt4AssocData, uint32(i),
+		)
+		if err != nil {
+			t.Fatalf("hop #%d unable to process BOLT 4 packet: %v",
+				i, err)
+		}
+
+		sharedSecret := hex.EncodeToString(pkt.SharedSecret[:])
+		if sharedSecret != bolt4HopSharedSecrets[i] {
+			t.Fatalf("hop #%d derived wrong shared secret: want %v, "+
+				"got %v", i, bolt4HopSharedSecrets[i], sharedSecret)
+		}
+
+		expectedHopData := HopData{
+			Realm:         [1]byte{0x00},
+			ForwardAmount: uint64(i),
+			OutgoingCltv:  uint32(i),
+		}
+		copy(expectedHopData.NextAddress[:], bytes.Repeat(
+			[]byte{byte(i)}, 8,
+		))
+		if !reflect.DeepEqual(
+			*pkt.ForwardingInstructions, expectedHopData,
+		) {
+			t.Fatalf("hop #%d recovered wrong hop data: want %v, "+
+				"got %v", i, spew.Sdump(expectedHopData),
+				spew.Sdump(pkt.ForwardingInstructions))
+		}
+
+		expectedAction := ProcessCode(MoreHops)
+		if i == len(bolt4PubKeys)-1 {
+			expectedAction = ExitNode
+		}
+		if pkt.Action != expectedAction {
+			t.Fatalf("hop #%d expected action %v, got %v", i,
+				expectedAction, pkt.Action)
+		}
+
+		fwdMsg = *pkt.NextPacket
+	}
+}
+
 func TestSphinxCorrectness(t *testing.T) {
-	nodes, _, hopDatas, fwdMsg, err := newTestRoute(NumMaxHops)
+	nodes, _, hopDatas, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
 	if err != nil {
 		t.Fatalf("unable to create random onion packet: %v", err)
 	}
@@ -222,7 +333,7 @@ func TestSphinxCorrectness(t *testing.T) {
 		// The hop data for this hop should *exactly* match what was
 		// initially used to construct the packet.
 		expectedHopData := (*hopDatas)[i]
-		if !reflect.DeepEqual(onionPacket.ForwardingInstructions, expectedHopData) {
+		if !reflect.DeepEqual(*onionPacket.ForwardingInstructions, expectedHopData) {
 			t.Fatalf("hop data doesn't match: expected %v, got %v",
 				spew.Sdump(expectedHopData),
 				spew.Sdump(onionPacket.ForwardingInstructions))
@@ -291,7 +402,7 @@ func TestSphinxSingleHop(t *testing.T) {
 func TestSphinxNodeRelpay(t *testing.T) {
 	// We'd like to ensure that the sphinx node itself rejects all replayed
 	// packets which share the same shared secret.
-	nodes, _, _, fwdMsg, err := newTestRoute(NumMaxHops)
+	nodes, _, _, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
 	if err != nil {
 		t.Fatalf("unable to create test route: %v", err)
 	}
@@ -308,7 +419,7 @@ func TestSphinxNodeRelpay(t *testing.T) {
 
 	// Now, force the node to process the packet a second time, this should
 	// fail with a detected replay error.
-	if _, err := nodes[0].ProcessOnionPacket(fwdMsg, nil, 1); err != ErrReplayedPacket {
+	if _, err := nodes[0].ProcessOnionPacket(fwdMsg, nil, 1); !errors.Is(err, ErrReplayedPacket) {
 		t.Fatalf("sphinx packet replay should be rejected, instead error is %v", err)
 	}
 }
@@ -316,7 +427,7 @@ func TestSphinxNodeRelpay(t *testing.T) {
 func TestSphinxNodeRelpaySameBatch(t *testing.T) {
 	// We'd like to ensure that the sphinx node itself rejects all replayed
 	// packets which share the same shared secret.
-	nodes, _, _, fwdMsg, err := newTestRoute(NumMaxHops)
+	nodes, _, _, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
 	if err != nil {
 		t.Fatalf("unable to create test route: %v", err)
 	}
@@ -362,7 +473,7 @@ func TestSphinxNodeRelpaySameBatch(t *testing.T) {
 func TestSphinxNodeRelpayLaterBatch(t *testing.T) {
 	// We'd like to ensure that the sphinx node itself rejects all replayed
 	// packets which share the same shared secret.
-	nodes, _, _, fwdMsg, err := newTestRoute(NumMaxHops)
+	nodes, _, _, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
 	if err != nil {
 		t.Fatalf("unable to create test route: %v", err)
 	}
@@ -407,7 +518,7 @@ func TestSphinxNodeRelpayLaterBatch(t *testing.T) {
 func TestSphinxNodeReplayBatchIdempotency(t *testing.T) {
 	// We'd like to ensure that the sphinx node itself rejects all replayed
 	// packets which share the same shared secret.
-	nodes, _, _, fwdMsg, err := newTestRoute(NumMaxHops)
+	nodes, _, _, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
 	if err != nil {
 		t.Fatalf("unable to create test route: %v", err)
 	}
@@ -474,31 +585,4951 @@ func TestSphinxAssocData(t *testing.T) {
 
 }
 
-func TestSphinxEncodeDecode(t *testing.T) {
-	// Create some test data with a randomly populated, yet valid onion
-	// forwarding message.
-	_, _, _, fwdMsg, err := newTestRoute(5)
+// TestSphinxEmptyAssocData asserts that nil and empty associated data are
+// equivalent, such that a packet constructed using either of them is
+// processed using the other one, and binding a packet to a payment hash
+// accepts both.
+func TestSphinxEmptyAssocData(t *testing.T) {
+	nodes, route, _, _, err := newTestRoute(3)
 	if err != nil {
-		t.Fatalf("unable to create random onion packet: %v", err)
+		t.Fatalf("unable to create test route: %v", err)
 	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
 
-	// Encode the created onion packet into an empty buffer. This should
-	// succeeed without any errors.
-	var b bytes.Buffer
-	if err := fwdMsg.Encode(&b); err != nil {
-		t.Fatalf("unable to encode message: %v", err)
+	tests := []struct {
+		name               string
+		constructAssocData []byte
+		processAssocData   []byte
+	}{
+		{
+			name:               "nil then empty",
+			constructAssocData: nil,
+			processAssocData:   []byte{},
+		},
+		{
+			name:               "empty then nil",
+			constructAssocData: []byte{},
+			processAssocData:   nil,
+		},
 	}
+	for _, test := range tests {
+		fwdMsg, err := NewOnionPacket(
+			route, sessionKey, test.constructAssocData,
+		)
+		if err != nil {
+			t.Fatalf("%s: unable to create packet: %v", test.name,
+				err)
+		}
 
-	// Now decode the bytes encoded above. Again, this should succeeed
-	// without any errors.
-	newFwdMsg := &OnionPacket{}
-	if err := newFwdMsg.Decode(&b); err != nil {
-		t.Fatalf("unable to decode message: %v", err)
+		_, err = SimulateRoute(nodes, fwdMsg, test.processAssocData)
+		if err != nil {
+			t.Fatalf("%s: unable to process packet: %v", test.name,
+				err)
+		}
 	}
 
-	// The two forwarding messages should now be identical.
-	if !reflect.DeepEqual(fwdMsg, newFwdMsg) {
-		t.Fatalf("forwarding messages don't match, %v vs %v",
-			spew.Sdump(fwdMsg), spew.Sdump(newFwdMsg))
+	nilMsg, err := NewOnionPacket(route, sessionKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create packet: %v", err)
+	}
+	emptyMsg, err := NewOnionPacket(route, sessionKey, []byte{})
+	if err != nil {
+		t.Fatalf("unable to create packet: %v", err)
+	}
+	if !nilMsg.Equal(emptyMsg) {
+		t.Fatalf("nil and empty associated data yield different packets")
+	}
+
+	var paymentHash [PaymentHashSize]byte
+	paymentHash[0] = 1
+	for _, assocData := range [][]byte{nil, {}} {
+		_, err := NewOnionPacket(
+			route, sessionKey, assocData,
+			WithPaymentHash(paymentHash),
+		)
+		if err != nil {
+			t.Fatalf("unable to bind packet with associated data "+
+				"%#v to payment hash: %v", assocData, err)
+		}
+	}
+}
+
+// TestSphinxLargeAssocData tests that a packet bound to associated data far
+// larger than a single HMAC block can be processed along its entire route,
+// and that altering the last byte of the associated data is detected.
+func TestSphinxLargeAssocData(t *testing.T) {
+	nodes, route, _, _, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	assocData := make([]byte, 4<<20)
+	if _, err := rand.Read(assocData); err != nil {
+		t.Fatalf("unable to generate assoc data: %v", err)
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	fwdMsg, err := NewOnionPacket(route, sessionKey, assocData)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	tamperedData := make([]byte, len(assocData))
+	copy(tamperedData, assocData)
+	tamperedData[len(tamperedData)-1] ^= 1
+
+	_, err = nodes[0].ReconstructOnionPacket(fwdMsg, tamperedData)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected ErrInvalidOnionHMAC for altered assoc "+
+			"data, got %v", err)
+	}
+
+	for i, node := range nodes {
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, assocData)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		wantAction := ProcessCode(MoreHops)
+		if i == len(nodes)-1 {
+			wantAction = ExitNode
+		}
+		if pkt.Action != wantAction {
+			t.Fatalf("node %d: expected action %v, got %v", i,
+				wantAction, pkt.Action)
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+}
+
+// TestSphinxExitPayload tests that the exit node recovers the exact payload
+// the sender created for the final hop, for both payload formats.
+func TestSphinxExitPayload(t *testing.T) {
+	exitPayload := bytes.Repeat([]byte{0xab}, 300)
+
+	tests := []struct {
+		name        string
+		payload     []byte
+		payloadType PayloadType
+	}{
+		{
+			name:        "legacy",
+			payload:     nil,
+			payloadType: PayloadLegacy,
+		},
+		{
+			name:        "tlv",
+			payload:     exitPayload,
+			payloadType: PayloadTLV,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			nodes, route, fwdMsg, err := newTestVarSizeRoute(
+				[][]byte{nil, nil, test.payload},
+			)
+			if err != nil {
+				t.Fatalf("unable to create test route: %v", err)
+			}
+
+			var pkt *ProcessedPacket
+			for i, node := range nodes {
+				pkt, err = node.ReconstructOnionPacket(fwdMsg, nil)
+				if err != nil {
+					t.Fatalf("node %d unable to process "+
+						"packet: %v", i, err)
+				}
+				fwdMsg = pkt.NextPacket
+			}
+
+			if pkt.Action != ExitNode {
+				t.Fatalf("expected ExitNode, got %v", pkt.Action)
+			}
+			if pkt.Payload.Type != test.payloadType {
+				t.Fatalf("expected payload type %v, got %v",
+					test.payloadType, pkt.Payload.Type)
+			}
+			if pkt.Payload.HMAC != zeroHMAC {
+				t.Fatalf("expected zero HMAC for exit payload")
+			}
+
+			sentPayload := route[len(nodes)-1].HopPayload.Payload
+			if !bytes.Equal(pkt.Payload.Payload, sentPayload) {
+				t.Fatalf("exit payload mismatch: expected %x, "+
+					"got %x", sentPayload, pkt.Payload.Payload)
+			}
+		})
+	}
+}
+
+// TestExportedBlindingHelpers tests that chaining the ephemeral keys along a
+// route using ComputeBlindingFactor and BlindGroupElement yields the same keys
+// the routers in the route hand to each other.
+func TestExportedBlindingHelpers(t *testing.T) {
+	nodes, route, _, fwdMsg, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	sharedSecrets, err := GenerateSharedSecrets(
+		route.NodeKeys(), sessionKey,
+	)
+	if err != nil {
+		t.Fatalf("unable to generate shared secrets: %v", err)
+	}
+
+	ephemeralKey := sessionKey.PubKey()
+	for i, node := range nodes {
+		if !ephemeralKey.IsEqual(fwdMsg.EphemeralKey) {
+			t.Fatalf("ephemeral key of hop %d mismatch", i)
+		}
+
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		blindingFactor := ComputeBlindingFactor(
+			ephemeralKey, sharedSecrets[i],
+		)
+		internalFactor := computeBlindingFactor(
+			ephemeralKey, pkt.SharedSecret[:],
+		)
+		if blindingFactor != internalFactor {
+			t.Fatalf("blinding factor of hop %d mismatch", i)
+		}
+
+		ephemeralKey = BlindGroupElement(ephemeralKey, blindingFactor)
+		if !ephemeralKey.IsEqual(pkt.NextPacket.EphemeralKey) {
+			t.Fatalf("next ephemeral key of hop %d mismatch", i)
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+
+	// A public key without a curve is assumed to lie on secp256k1.
+	var factor [32]byte
+	factor[31] = 2
+	pub := sessionKey.PubKey()
+	noCurve := &btcec.PublicKey{X: pub.X, Y: pub.Y}
+	if !BlindGroupElement(noCurve, factor).IsEqual(
+		BlindGroupElement(pub, factor),
+	) {
+		t.Fatalf("blinding a key without a curve should use secp256k1")
+	}
+}
+
+// faultyReplayLog is a ReplayLog which fails every write with errLogWrite,
+// simulating an I/O error of a persistent replay log.
+type faultyReplayLog struct {
+	*MemoryReplayLog
+}
+
+// errLogWrite is the error returned by all writes to a faultyReplayLog.
+var errLogWrite = errors.New("replay log write failed")
+
+// Put fails with errLogWrite.
+func (f *faultyReplayLog) Put(*HashPrefix, uint32) error {
+	return errLogWrite
+}
+
+// PutBatch fails with errLogWrite.
+func (f *faultyReplayLog) PutBatch(*Batch) (*ReplaySet, error) {
+	return nil, errLogWrite
+}
+
+// TestSphinxReplayLogWriteFailure tests that no processed packet is returned
+// when the replay log fails to record it, for all ways of processing packets.
+func TestSphinxReplayLogWriteFailure(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	router := NewRouterWithECDH(
+		nodes[0].onionPub, nodes[0].onionKey, &chaincfg.MainNetParams,
+		&faultyReplayLog{NewMemoryReplayLog()},
+	)
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router: %v", err)
+	}
+	defer router.Stop()
+
+	assertLogWriteErr := func(err error) {
+		t.Helper()
+
+		if !errors.Is(err, errLogWrite) {
+			t.Fatalf("expected log write error, got %v", err)
+		}
+		var procErr *ProcessingError
+		if !errors.As(err, &procErr) || procErr.Stage != StageReplay {
+			t.Fatalf("expected error at replay stage, got %v", err)
+		}
+	}
+
+	pkt, err := router.ProcessOnionPacket(fwdMsg, nil, 1)
+	assertLogWriteErr(err)
+	if pkt != nil {
+		t.Fatalf("expected no packet on log write failure")
+	}
+
+	pkts, replays, err := router.ProcessOnionPackets(
+		[]byte("batch"), []*OnionPacket{fwdMsg}, [][]byte{nil},
+		[]uint32{1},
+	)
+	assertLogWriteErr(err)
+	if pkts != nil || replays != nil {
+		t.Fatalf("expected no packets on log write failure")
+	}
+
+	tx := router.BeginTxn([]byte("tx"), 1)
+	if err := tx.ProcessOnionPacket(0, fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process packet in tx: %v", err)
+	}
+	txPkts, replays, err := tx.Commit()
+	assertLogWriteErr(err)
+	if txPkts != nil || replays != nil {
+		t.Fatalf("expected no packets on log write failure")
+	}
+}
+
+// TestSphinxNopReplayLog tests that a router using a NopReplayLog never
+// rejects a packet as a replay, whether processed on its own or in a batch.
+func TestSphinxNopReplayLog(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	router := NewRouterWithECDH(
+		nodes[0].onionPub, nodes[0].onionKey, &chaincfg.MainNetParams,
+		NewNopReplayLog(),
+	)
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router: %v", err)
+	}
+	defer router.Stop()
+
+	for i := 0; i < 2; i++ {
+		if _, err := router.ProcessOnionPacket(fwdMsg, nil, 1); err != nil {
+			t.Fatalf("attempt %d unable to process packet: %v", i,
+				err)
+		}
+	}
+
+	pkts := []*OnionPacket{fwdMsg, fwdMsg}
+	packets, replays, err := router.ProcessOnionPackets(
+		[]byte("batch"), pkts, [][]byte{nil, nil}, []uint32{1, 1},
+	)
+	if err != nil {
+		t.Fatalf("unable to process batch: %v", err)
+	}
+	if replays.Size() != 0 {
+		t.Fatalf("expected no replays, got %d", replays.Size())
+	}
+	for i, packet := range packets {
+		if packet == nil {
+			t.Fatalf("expected packet %d to be returned", i)
+		}
+	}
+}
+
+// TestSphinxPaddedFinalPayload tests that a padded final payload fills the
+// same number of bytes regardless of its original length, and that the exit
+// node recovers the exact original payload.
+func TestSphinxPaddedFinalPayload(t *testing.T) {
+	const paddedSize = 300
+
+	for _, payloadLen := range []int{1, 10, 100, paddedSize - 2} {
+		exitPayload := bytes.Repeat([]byte{0xab}, payloadLen)
+		nodes, route, _, err := newTestVarSizeRoute(
+			[][]byte{nil, nil, exitPayload},
+		)
+		if err != nil {
+			t.Fatalf("unable to create test route: %v", err)
+		}
+
+		sessionKey, _ := btcec.PrivKeyFromBytes(
+			btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+		)
+		fwdMsg, err := NewOnionPacket(
+			route, sessionKey, nil,
+			WithPaddedFinalPayload(paddedSize),
+		)
+		if err != nil {
+			t.Fatalf("unable to create onion packet: %v", err)
+		}
+
+		exitNode := nodes[len(nodes)-1]
+		paddingRouter := NewRouterWithECDH(
+			exitNode.onionPub, exitNode.onionKey,
+			&chaincfg.MainNetParams, NewMemoryReplayLog(),
+			WithPaddedExitPayloads(),
+		)
+
+		for _, node := range nodes[:len(nodes)-1] {
+			pkt, err := node.ReconstructOnionPacket(fwdMsg, nil)
+			if err != nil {
+				t.Fatalf("unable to process packet: %v", err)
+			}
+			fwdMsg = pkt.NextPacket
+		}
+
+		// A router that isn't aware of the padding sees the full
+		// padded payload.
+		pkt, err := exitNode.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("unable to process packet: %v", err)
+		}
+		if len(pkt.Payload.Payload) != paddedSize {
+			t.Fatalf("expected padded payload of %d bytes, got %d",
+				paddedSize, len(pkt.Payload.Payload))
+		}
+
+		pkt, err = paddingRouter.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("unable to process padded packet: %v", err)
+		}
+		if pkt.Action != ExitNode {
+			t.Fatalf("expected ExitNode, got %v", pkt.Action)
+		}
+		if !bytes.Equal(pkt.Payload.Payload, exitPayload) {
+			t.Fatalf("payload of %d bytes mismatch after "+
+				"stripping padding: got %x", payloadLen,
+				pkt.Payload.Payload)
+		}
+	}
+}
+
+// TestSphinxPaddedFinalPayloadInvalid tests that invalid padding parameters
+// are rejected during construction, and that a router expecting padded exit
+// payloads rejects payloads which weren't padded.
+func TestSphinxPaddedFinalPayloadInvalid(t *testing.T) {
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+
+	nodes, route, fwdMsg, err := newTestVarSizeRoute(
+		[][]byte{[]byte("unpadded")},
+	)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	// The padded size must leave room for the payload and its length.
+	_, err = NewOnionPacket(
+		route, sessionKey, nil, WithPaddedFinalPayload(9),
+	)
+	if err == nil {
+		t.Fatalf("expected error for too small padded size")
+	}
+
+	// Legacy payloads are of a fixed size, and can't be padded.
+	_, legacyRoute, _, _, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	_, err = NewOnionPacket(
+		legacyRoute, sessionKey, nil, WithPaddedFinalPayload(100),
+	)
+	if err == nil {
+		t.Fatalf("expected error padding legacy payload")
+	}
+
+	paddingRouter := NewRouterWithECDH(
+		nodes[0].onionPub, nodes[0].onionKey, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(), WithPaddedExitPayloads(),
+	)
+	_, err = paddingRouter.ReconstructOnionPacket(fwdMsg, nil)
+	var procErr *ProcessingError
+	if !errors.As(err, &procErr) || procErr.Stage != StagePayload {
+		t.Fatalf("expected payload stage error for unpadded payload, "+
+			"got %v", err)
+	}
+}
+
+// TestSphinxForwardingInfo tests that the forwarding info of intermediate hops
+// is parsed from both legacy and TLV payloads, and that none is returned for
+// the exit node.
+func TestSphinxForwardingInfo(t *testing.T) {
+	// Create a route with realistic TLV payloads, in which each hop
+	// forwards slightly less, with an earlier time-lock, than it receives.
+	const numHops = 4
+	hopDatas := make([]TLVHopData, numHops)
+	payloads := make([][]byte, numHops)
+	for i := range hopDatas {
+		hopDatas[i] = TLVHopData{
+			ForwardAmount: 100000000 - uint64(i)*1000,
+			OutgoingCltv:  600000 - uint32(i)*40,
+		}
+		if i != numHops-1 {
+			scid := [AddressSize]byte{
+				0x00, 0x09, 0x27, 0xc0, 0x00, 0x0a, 0x00,
+				byte(i),
+			}
+			hopDatas[i].NextAddress = &scid
+		}
+
+		var b bytes.Buffer
+		if err := hopDatas[i].Encode(&b); err != nil {
+			t.Fatalf("unable to encode hop data: %v", err)
+		}
+		payloads[i] = b.Bytes()
+	}
+
+	nodes, _, fwdMsg, err := newTestVarSizeRoute(payloads)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	for i, node := range nodes {
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		fwdInfo, err := pkt.ForwardingInfo()
+		if err != nil {
+			t.Fatalf("node %d unable to parse forwarding info: %v",
+				i, err)
+		}
+
+		if i == numHops-1 {
+			if fwdInfo != nil {
+				t.Fatalf("expected no forwarding info for exit "+
+					"node, got %v", spew.Sdump(fwdInfo))
+			}
+			break
+		}
+
+		expectedInfo := &ForwardingInfo{
+			NextAddress:     *hopDatas[i].NextAddress,
+			AmountToForward: hopDatas[i].ForwardAmount,
+			OutgoingCltv:    hopDatas[i].OutgoingCltv,
+		}
+		if !reflect.DeepEqual(fwdInfo, expectedInfo) {
+			t.Fatalf("node %d forwarding info mismatch: expected "+
+				"%v, got %v", i, spew.Sdump(expectedInfo),
+				spew.Sdump(fwdInfo))
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+
+	// Legacy payloads yield the same information.
+	legacyNodes, _, legacyHopDatas, fwdMsg, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	pkt, err := legacyNodes[0].ReconstructOnionPacket(fwdMsg, nil)
+	if err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	fwdInfo, err := pkt.ForwardingInfo()
+	if err != nil {
+		t.Fatalf("unable to parse forwarding info: %v", err)
+	}
+	legacyHopData := (*legacyHopDatas)[0]
+	expectedInfo := &ForwardingInfo{
+		NextAddress:     legacyHopData.NextAddress,
+		AmountToForward: legacyHopData.ForwardAmount,
+		OutgoingCltv:    legacyHopData.OutgoingCltv,
+	}
+	if !reflect.DeepEqual(fwdInfo, expectedInfo) {
+		t.Fatalf("legacy forwarding info mismatch: expected %v, got %v",
+			spew.Sdump(expectedInfo), spew.Sdump(fwdInfo))
+	}
+}
+
+// TestSphinxNextChannelID tests that the short channel ID of the next hop is
+// exposed by processed packets of intermediate hops, for both TLV and legacy
+// payloads, and that it's left zero for the exit node and for TLV payloads
+// lacking one.
+func TestSphinxNextChannelID(t *testing.T) {
+	// The short channel ID 700000x1234x1, i.e. the second output of
+	// transaction 1234 within block 700000.
+	scid := [AddressSize]byte{
+		0x0a, 0xae, 0x60, 0x00, 0x04, 0xd2, 0x00, 0x01,
+	}
+
+	hopDatas := []TLVHopData{
+		{
+			ForwardAmount: 1000,
+			OutgoingCltv:  600000,
+			NextAddress:   &scid,
+		},
+		{
+			ForwardAmount: 1000,
+			OutgoingCltv:  600000,
+		},
+		{
+			ForwardAmount: 1000,
+			OutgoingCltv:  600000,
+		},
+	}
+	payloads := make([][]byte, len(hopDatas))
+	for i := range hopDatas {
+		var b bytes.Buffer
+		if err := hopDatas[i].Encode(&b); err != nil {
+			t.Fatalf("unable to encode hop data: %v", err)
+		}
+		payloads[i] = b.Bytes()
+	}
+
+	nodes, _, fwdMsg, err := newTestVarSizeRoute(payloads)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	// The first hop carries the short channel ID, while the second one,
+	// though forwarding the packet, lacks it, and the exit node has no next
+	// hop at all.
+	expectedIDs := [][AddressSize]byte{scid, {}, {}}
+	for i, node := range nodes {
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		if pkt.NextChannelID != expectedIDs[i] {
+			t.Fatalf("node %d: expected next channel id %x, got %x",
+				i, expectedIDs[i], pkt.NextChannelID)
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+
+	// Legacy payloads always carry the short channel ID.
+	legacyNodes, _, legacyHopDatas, fwdMsg, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	pkt, err := legacyNodes[0].ReconstructOnionPacket(fwdMsg, nil)
+	if err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	expectedID := (*legacyHopDatas)[0].NextAddress
+	if pkt.NextChannelID != expectedID {
+		t.Fatalf("expected legacy next channel id %x, got %x",
+			expectedID, pkt.NextChannelID)
+	}
+}
+
+// TestNewOnionPacketWithRandomSession tests that each packet is created with a
+// distinct session key, which is returned such that the sender can derive the
+// same shared secrets as the hops in the route.
+func TestNewOnionPacketWithRandomSession(t *testing.T) {
+	nodes, route, _, _, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	pkt1, sessionKey1, err := NewOnionPacketWithRandomSession(route, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	pkt2, sessionKey2, err := NewOnionPacketWithRandomSession(route, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	if pkt1.EphemeralKey.IsEqual(pkt2.EphemeralKey) {
+		t.Fatalf("packets share the same ephemeral key")
+	}
+	if !pkt1.EphemeralKey.IsEqual(sessionKey1.PubKey()) ||
+		!pkt2.EphemeralKey.IsEqual(sessionKey2.PubKey()) {
+
+		t.Fatalf("returned session key doesn't match packet")
+	}
+
+	sharedSecrets, err := GenerateSharedSecrets(
+		route.NodeKeys(), sessionKey1,
+	)
+	if err != nil {
+		t.Fatalf("unable to generate shared secrets: %v", err)
+	}
+	processed, err := nodes[0].ReconstructOnionPacket(pkt1, nil)
+	if err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	if processed.SharedSecret != sharedSecrets[0] {
+		t.Fatalf("shared secret mismatch")
+	}
+}
+
+// TestNewOnionPacketWithRandSource tests that packets built with a fixed
+// source of randomness are reproducible, that invalid session key candidates
+// read from the source are skipped, and that a failing source is reported.
+func TestNewOnionPacketWithRandSource(t *testing.T) {
+	_, route, _, _, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	// The first candidate is zero, and thus not a valid scalar, so the
+	// session key is made up of the next 32 bytes.
+	seed := append(make([]byte, 32), bytes.Repeat([]byte{0x42}, 32)...)
+	expectedKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), seed[32:])
+
+	var encoded [][]byte
+	for i := 0; i < 2; i++ {
+		pkt, sessionKey, err := NewOnionPacketWithRandomSession(
+			route, nil, WithRandSource(bytes.NewReader(seed)),
+		)
+		if err != nil {
+			t.Fatalf("unable to create onion packet: %v", err)
+		}
+		if !bytes.Equal(
+			sessionKey.Serialize(), expectedKey.Serialize(),
+		) {
+
+			t.Fatalf("expected session key %x, got %x",
+				expectedKey.Serialize(), sessionKey.Serialize())
+		}
+
+		var b bytes.Buffer
+		if err := pkt.Encode(&b); err != nil {
+			t.Fatalf("unable to encode packet: %v", err)
+		}
+		encoded = append(encoded, b.Bytes())
+	}
+	if !bytes.Equal(encoded[0], encoded[1]) {
+		t.Fatalf("packets built from the same source differ")
+	}
+
+	// The packet must match one built with the session key directly.
+	pkt, err := NewOnionPacket(route, expectedKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	var b bytes.Buffer
+	if err := pkt.Encode(&b); err != nil {
+		t.Fatalf("unable to encode packet: %v", err)
+	}
+	if !bytes.Equal(b.Bytes(), encoded[0]) {
+		t.Fatalf("packet doesn't match the one built with the session " +
+			"key")
+	}
+
+	// An exhausted source must be reported rather than yield a packet.
+	_, _, err = NewOnionPacketWithRandomSession(
+		route, nil, WithRandSource(bytes.NewReader(seed[:40])),
+	)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+}
+
+// TestSphinxPaymentHash tests that a packet bound to a payment hash is only
+// processed given that payment hash, and that associated data of the wrong
+// length is rejected when a payment hash is expected.
+func TestSphinxPaymentHash(t *testing.T) {
+	nodes, route, _, _, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+
+	var paymentHash [PaymentHashSize]byte
+	copy(paymentHash[:], bytes.Repeat([]byte{0x42}, PaymentHashSize))
+
+	fwdMsg, err := NewOnionPacket(
+		route, sessionKey, nil, WithPaymentHash(paymentHash),
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	// Passing the payment hash as associated data as well yields the
+	// exact same packet, while any other associated data is refused.
+	samePkt, err := NewOnionPacket(
+		route, sessionKey, paymentHash[:], WithPaymentHash(paymentHash),
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	if !samePkt.Equal(fwdMsg) {
+		t.Fatalf("packets bound to the same payment hash differ")
+	}
+	_, err = NewOnionPacket(
+		route, sessionKey, []byte("other"), WithPaymentHash(paymentHash),
+	)
+	if err == nil {
+		t.Fatalf("expected error for conflicting associated data")
+	}
+
+	router := nodes[0]
+	_, err = router.ReconstructOnionPacket(
+		fwdMsg, paymentHash[:PaymentHashSize-1], ExpectPaymentHash(),
+	)
+	if !errors.Is(err, ErrInvalidPaymentHashLength) {
+		t.Fatalf("expected ErrInvalidPaymentHashLength, got %v", err)
+	}
+	var procErr *ProcessingError
+	if !errors.As(err, &procErr) || procErr.Stage != StageVersion {
+		t.Fatalf("expected version stage error, got %v", err)
+	}
+
+	var otherHash [PaymentHashSize]byte
+	_, err = router.ReconstructOnionPacket(
+		fwdMsg, otherHash[:], ExpectPaymentHash(),
+	)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected ErrInvalidOnionHMAC, got %v", err)
+	}
+
+	_, err = router.ReconstructOnionPacket(
+		fwdMsg, paymentHash[:], ExpectPaymentHash(),
+	)
+	if err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+}
+
+// TestGenerateSharedSecrets tests that the shared secrets re-derived by the
+// sender from the session key and route match the ones each router derives
+// while processing the packet.
+func TestGenerateSharedSecrets(t *testing.T) {
+	nodes, route, _, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	sharedSecrets, err := GenerateSharedSecrets(
+		route.NodeKeys(), sessionKey,
+	)
+	if err != nil {
+		t.Fatalf("unable to generate shared secrets: %v", err)
+	}
+	if len(sharedSecrets) != len(nodes) {
+		t.Fatalf("expected %d shared secrets, got %d", len(nodes),
+			len(sharedSecrets))
+	}
+
+	for i, node := range nodes {
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+		if pkt.SharedSecret != sharedSecrets[i] {
+			t.Fatalf("shared secret of hop %d mismatch: expected "+
+				"%x, got %x", i, sharedSecrets[i],
+				pkt.SharedSecret)
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+
+	if _, err := GenerateSharedSecrets(nil, sessionKey); err == nil {
+		t.Fatalf("expected error for empty route")
+	}
+	if _, err := GenerateSharedSecrets(route.NodeKeys(), nil); err == nil {
+		t.Fatalf("expected error for missing session key")
+	}
+}
+
+func TestSphinxEncodeDecode(t *testing.T) {
+	// Create some test data with a randomly populated, yet valid onion
+	// forwarding message.
+	_, _, _, fwdMsg, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create random onion packet: %v", err)
+	}
+
+	// Encode the created onion packet into an empty buffer. This should
+	// succeeed without any errors.
+	var b bytes.Buffer
+	if err := fwdMsg.Encode(&b); err != nil {
+		t.Fatalf("unable to encode message: %v", err)
+	}
+
+	// Now decode the bytes encoded above. Again, this should succeeed
+	// without any errors.
+	newFwdMsg := &OnionPacket{}
+	if err := newFwdMsg.Decode(&b); err != nil {
+		t.Fatalf("unable to decode message: %v", err)
+	}
+
+	// The two forwarding messages should now be identical.
+	if !fwdMsg.Equal(newFwdMsg) {
+		t.Fatalf("forwarding messages don't match, %v vs %v",
+			spew.Sdump(fwdMsg), spew.Sdump(newFwdMsg))
+	}
+}
+
+// TestSphinxEncodeDecodeCompact tests that the compact encoding of a packet
+// is exactly one byte shorter than its regular encoding, lacking only the
+// version byte, and round trips given the version out of band.
+func TestSphinxEncodeDecodeCompact(t *testing.T) {
+	_, _, _, fwdMsg, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create random onion packet: %v", err)
+	}
+
+	var full, compact bytes.Buffer
+	if err := fwdMsg.Encode(&full); err != nil {
+		t.Fatalf("unable to encode packet: %v", err)
+	}
+	if err := fwdMsg.EncodeCompact(&compact); err != nil {
+		t.Fatalf("unable to encode compact packet: %v", err)
+	}
+	if compact.Len() != full.Len()-1 {
+		t.Fatalf("expected compact packet of %d bytes, got %d",
+			full.Len()-1, compact.Len())
+	}
+	if !bytes.Equal(compact.Bytes(), full.Bytes()[1:]) {
+		t.Fatalf("compact packet isn't the packet without its version")
+	}
+
+	var decoded OnionPacket
+	err = decoded.DecodeCompact(
+		bytes.NewReader(compact.Bytes()), fwdMsg.Version,
+	)
+	if err != nil {
+		t.Fatalf("unable to decode compact packet: %v", err)
+	}
+	if !decoded.Equal(fwdMsg) {
+		t.Fatalf("decoded packet doesn't match original")
+	}
+
+	// An unknown version is rejected, as are truncated and oversized
+	// encodings.
+	err = decoded.DecodeCompact(bytes.NewReader(compact.Bytes()), 1)
+	if err != ErrInvalidOnionVersion {
+		t.Fatalf("expected ErrInvalidOnionVersion, got: %v", err)
+	}
+
+	truncated := compact.Bytes()[:compact.Len()-1]
+	err = decoded.DecodeCompact(bytes.NewReader(truncated), baseVersion)
+	if !errors.Is(err, ErrPacketTooSmall) {
+		t.Fatalf("expected ErrPacketTooSmall, got: %v", err)
+	}
+
+	err = decoded.DecodeCompact(bytes.NewReader(full.Bytes()), baseVersion)
+	if !errors.Is(err, ErrPacketWrongSize) {
+		t.Fatalf("expected ErrPacketWrongSize, got: %v", err)
+	}
+}
+
+// TestDecodeOnionPackets tests that packets encoded back to back are decoded
+// one by one, and that the packets decoded before a short read or an invalid
+// packet are returned along with the error.
+func TestDecodeOnionPackets(t *testing.T) {
+	const numPackets = 3
+
+	var (
+		packets []*OnionPacket
+		encoded bytes.Buffer
+	)
+	for i := 0; i < numPackets; i++ {
+		_, _, _, fwdMsg, err := newTestRoute(2)
+		if err != nil {
+			t.Fatalf("unable to create random onion packet: %v", err)
+		}
+		if err := fwdMsg.Encode(&encoded); err != nil {
+			t.Fatalf("unable to encode packet: %v", err)
+		}
+		packets = append(packets, fwdMsg)
+	}
+	raw := encoded.Bytes()
+	packetSize := len(raw) / numPackets
+
+	assertPackets := func(name string, decoded []*OnionPacket, n int) {
+		t.Helper()
+
+		if len(decoded) != n {
+			t.Fatalf("%s: expected %d packets, got %d", name, n,
+				len(decoded))
+		}
+		for i := range decoded {
+			if !decoded[i].Equal(packets[i]) {
+				t.Fatalf("%s: packet %d doesn't match", name, i)
+			}
+		}
+	}
+
+	// Reading exactly the encoded packets leaves any trailing data
+	// unread.
+	r := bytes.NewReader(append(raw[:len(raw):len(raw)], 0xff))
+	decoded, err := DecodeOnionPackets(r, numPackets)
+	if err != nil {
+		t.Fatalf("unable to decode packets: %v", err)
+	}
+	assertPackets("exact", decoded, numPackets)
+	if r.Len() != 1 {
+		t.Fatalf("expected trailing byte to be left unread")
+	}
+
+	// A short read returns the packets read in full.
+	r = bytes.NewReader(raw[:len(raw)-packetSize/2])
+	decoded, err = DecodeOnionPackets(r, numPackets)
+	if !errors.Is(err, ErrPacketTooSmall) {
+		t.Fatalf("expected ErrPacketTooSmall, got: %v", err)
+	}
+	assertPackets("short", decoded, numPackets-1)
+
+	// As does an invalid packet.
+	invalid := append([]byte(nil), raw...)
+	invalid[packetSize] = 0x01
+	decoded, err = DecodeOnionPackets(bytes.NewReader(invalid), numPackets)
+	if !errors.Is(err, ErrInvalidOnionVersion) {
+		t.Fatalf("expected ErrInvalidOnionVersion, got: %v", err)
+	}
+	assertPackets("invalid", decoded, 1)
+
+	// Reading zero packets consumes nothing.
+	r = bytes.NewReader(raw)
+	decoded, err = DecodeOnionPackets(r, 0)
+	if err != nil {
+		t.Fatalf("unable to decode zero packets: %v", err)
+	}
+	assertPackets("zero", decoded, 0)
+	if r.Len() != len(raw) {
+		t.Fatalf("expected no bytes to be read")
+	}
+
+	if _, err := DecodeOnionPackets(r, -1); err == nil {
+		t.Fatalf("expected negative packet count to be rejected")
+	}
+}
+
+// TestWriteOnionPacket tests that the packet streamed by WriteOnionPacket is
+// identical to the one constructed by NewOnionPacket, and decodes to an equal
+// packet.
+func TestWriteOnionPacket(t *testing.T) {
+	_, route, _, fwdMsg, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create random onion packet: %v", err)
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+
+	numHops := route.TrueRouteLength()
+	payloads := make([]HopPayload, numHops)
+	for i := range payloads {
+		payloads[i] = route[i].HopPayload
+	}
+
+	var b bytes.Buffer
+	err = WriteOnionPacket(&b, route.NodeKeys(), sessionKey, payloads, nil)
+	if err != nil {
+		t.Fatalf("unable to write packet: %v", err)
+	}
+
+	var expected bytes.Buffer
+	if err := fwdMsg.Encode(&expected); err != nil {
+		t.Fatalf("unable to encode packet: %v", err)
+	}
+	if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+		t.Fatalf("streamed packet doesn't match encoded packet")
+	}
+
+	var decoded OnionPacket
+	if err := decoded.Decode(&b); err != nil {
+		t.Fatalf("unable to decode streamed packet: %v", err)
+	}
+	if !decoded.Equal(fwdMsg) {
+		t.Fatalf("decoded packet doesn't match original")
+	}
+
+	// Options altering the construction are applied as well.
+	packetCfg := OnionPacketConfig{NumMaxHops: 8, HopPayloadSize: 65}
+	b.Reset()
+	err = WriteOnionPacket(
+		&b, route.NodeKeys(), sessionKey, payloads, nil,
+		WithPacketConfig(packetCfg),
+	)
+	if err != nil {
+		t.Fatalf("unable to write packet: %v", err)
+	}
+	if b.Len() != packetCfg.PacketSize() {
+		t.Fatalf("expected packet of %d bytes, got %d",
+			packetCfg.PacketSize(), b.Len())
+	}
+
+	// The route and its payloads must line up.
+	err = WriteOnionPacket(
+		&b, route.NodeKeys(), sessionKey, payloads[1:], nil,
+	)
+	if err == nil {
+		t.Fatalf("expected mismatching payloads to be rejected")
+	}
+}
+
+// TestSphinxInvalidRoute asserts that constructing an onion packet for an
+// empty or oversized route, or one of which the hops and payloads don't line
+// up, fails with ErrInvalidRoute rather than producing a degenerate packet.
+func TestSphinxInvalidRoute(t *testing.T) {
+	_, route, _, _, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+
+	// A hop following an empty one, which would otherwise be dropped
+	// silently, as well as a payload without a node key are rejected.
+	gapRoute := *route
+	gapRoute[4] = gapRoute[1]
+	gapRoute[1] = OnionHop{}
+
+	payloadRoute := *route
+	payloadRoute[3].HopPayload = route[0].HopPayload
+
+	paths := []struct {
+		name string
+		path *PaymentPath
+	}{
+		{name: "nil path"},
+		{name: "empty path", path: &PaymentPath{}},
+		{name: "hop after gap", path: &gapRoute},
+		{name: "excess payload", path: &payloadRoute},
+	}
+	for _, test := range paths {
+		_, err := NewOnionPacket(test.path, sessionKey, nil)
+		if !errors.Is(err, ErrInvalidRoute) {
+			t.Fatalf("%s: expected ErrInvalidRoute, got: %v",
+				test.name, err)
+		}
+	}
+
+	nodeKeys := route.NodeKeys()
+	payloads := make([]HopPayload, len(nodeKeys))
+	for i := range payloads {
+		payloads[i] = route[i].HopPayload
+	}
+	tooLong := make([]*btcec.PublicKey, NumMaxHops+1)
+	for i := range tooLong {
+		tooLong[i] = nodeKeys[0]
+	}
+
+	streams := []struct {
+		name     string
+		route    []*btcec.PublicKey
+		payloads []HopPayload
+	}{
+		{name: "empty route"},
+		{
+			name:     "missing payload",
+			route:    nodeKeys,
+			payloads: payloads[1:],
+		},
+		{
+			name:     "excess payload",
+			route:    nodeKeys[1:],
+			payloads: payloads,
+		},
+		{
+			name:     "too many hops",
+			route:    tooLong,
+			payloads: make([]HopPayload, len(tooLong)),
+		},
+		{
+			name:     "nil node key",
+			route:    []*btcec.PublicKey{nil},
+			payloads: payloads[:1],
+		},
+	}
+	for _, test := range streams {
+		err := WriteOnionPacket(
+			ioutil.Discard, test.route, sessionKey, test.payloads,
+			nil,
+		)
+		if !errors.Is(err, ErrInvalidRoute) {
+			t.Fatalf("%s: expected ErrInvalidRoute, got: %v",
+				test.name, err)
+		}
+	}
+}
+
+// TestOnionPacketEqual asserts that OnionPacket.Equal compares packets by
+// their serialized contents, such that packets of which the ephemeral keys
+// differ only in their internal representation are equal.
+func TestOnionPacketEqual(t *testing.T) {
+	_, _, _, fwdMsg, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create random onion packet: %v", err)
+	}
+
+	// Carry the same point along with the bare parameters of its curve,
+	// which reflect.DeepEqual tells apart from the original key.
+	samePkt := *fwdMsg
+	samePkt.RoutingInfo = append([]byte(nil), fwdMsg.RoutingInfo...)
+	samePkt.EphemeralKey = &btcec.PublicKey{
+		Curve: btcec.S256().CurveParams,
+		X:     new(big.Int).Set(fwdMsg.EphemeralKey.X),
+		Y:     new(big.Int).Set(fwdMsg.EphemeralKey.Y),
+	}
+	if reflect.DeepEqual(fwdMsg, &samePkt) {
+		t.Fatalf("expected internal key representations to differ")
+	}
+	if !fwdMsg.Equal(&samePkt) || !samePkt.Equal(fwdMsg) {
+		t.Fatalf("expected semantically equal packets to be equal")
+	}
+
+	// Changing any of the fields makes the packets differ.
+	otherKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	mutations := []func(pkt *OnionPacket){
+		func(pkt *OnionPacket) { pkt.Version ^= 0x01 },
+		func(pkt *OnionPacket) { pkt.EphemeralKey = otherKey.PubKey() },
+		func(pkt *OnionPacket) { pkt.EphemeralKey = nil },
+		func(pkt *OnionPacket) { pkt.RoutingInfo[0] ^= 0x01 },
+		func(pkt *OnionPacket) { pkt.RoutingInfo = pkt.RoutingInfo[1:] },
+		func(pkt *OnionPacket) { pkt.HeaderMAC[0] ^= 0x01 },
+	}
+	for i, mutate := range mutations {
+		pkt := samePkt
+		pkt.RoutingInfo = append([]byte(nil), samePkt.RoutingInfo...)
+		mutate(&pkt)
+
+		if fwdMsg.Equal(&pkt) || pkt.Equal(fwdMsg) {
+			t.Fatalf("mutation %d: expected packets to differ", i)
+		}
+	}
+
+	if fwdMsg.Equal(nil) {
+		t.Fatalf("expected packet to differ from nil")
+	}
+	if !(*OnionPacket)(nil).Equal(nil) {
+		t.Fatalf("expected nil packets to be equal")
+	}
+}
+
+// TestSphinxMarshalBinary tests that MarshalBinary and UnmarshalBinary round
+// trip a packet, producing the same bytes as Encode and Decode.
+func TestSphinxMarshalBinary(t *testing.T) {
+	_, _, _, fwdMsg, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create random onion packet: %v", err)
+	}
+
+	var b bytes.Buffer
+	if err := fwdMsg.Encode(&b); err != nil {
+		t.Fatalf("unable to encode packet: %v", err)
+	}
+
+	data, err := fwdMsg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unable to marshal packet: %v", err)
+	}
+	if !bytes.Equal(data, b.Bytes()) {
+		t.Fatalf("marshaled packet doesn't match encoded packet")
+	}
+
+	var unmarshaled, decoded OnionPacket
+	if err := unmarshaled.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unable to unmarshal packet: %v", err)
+	}
+	if err := decoded.Decode(&b); err != nil {
+		t.Fatalf("unable to decode packet: %v", err)
+	}
+	if !unmarshaled.Equal(&decoded) {
+		t.Fatalf("unmarshaled packet doesn't match decoded packet, "+
+			"%v vs %v", spew.Sdump(unmarshaled), spew.Sdump(decoded))
+	}
+	if !unmarshaled.Equal(fwdMsg) {
+		t.Fatalf("unmarshaled packet doesn't match original packet")
+	}
+
+	// The unmarshaled packet mustn't reference the passed bytes.
+	for i := range data {
+		data[i] = 0
+	}
+	if !unmarshaled.Equal(fwdMsg) {
+		t.Fatalf("unmarshaled packet changed with its input bytes")
+	}
+
+	if err := unmarshaled.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Fatalf("expected error unmarshaling truncated packet")
+	}
+}
+
+// TestOnionPacketSize tests that the serialized size of packets matches the
+// number of bytes written by Encode, for both the default and a custom packet
+// geometry.
+func TestOnionPacketSize(t *testing.T) {
+	if OnionPacketSize != 1366 {
+		t.Fatalf("expected packet size of 1366 bytes, got %d",
+			OnionPacketSize)
+	}
+	if defaultOnionPacketConfig.PacketSize() != OnionPacketSize {
+		t.Fatalf("default config packet size of %d bytes doesn't "+
+			"match OnionPacketSize",
+			defaultOnionPacketConfig.PacketSize())
+	}
+
+	_, route, _, _, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+
+	customCfg := OnionPacketConfig{NumMaxHops: 5, HopPayloadSize: 100}
+	for _, packetCfg := range []OnionPacketConfig{
+		defaultOnionPacketConfig, customCfg,
+	} {
+		pkt, err := NewOnionPacket(
+			route, sessionKey, nil, WithPacketConfig(packetCfg),
+		)
+		if err != nil {
+			t.Fatalf("unable to create onion packet: %v", err)
+		}
+
+		var b bytes.Buffer
+		if err := pkt.Encode(&b); err != nil {
+			t.Fatalf("unable to encode packet: %v", err)
+		}
+		if pkt.SerializedSize() != b.Len() {
+			t.Fatalf("%v: serialized size of %d bytes doesn't "+
+				"match encoded size of %d bytes", packetCfg,
+				pkt.SerializedSize(), b.Len())
+		}
+		if packetCfg.PacketSize() != b.Len() {
+			t.Fatalf("%v: config packet size of %d bytes doesn't "+
+				"match encoded size of %d bytes", packetCfg,
+				packetCfg.PacketSize(), b.Len())
+		}
+	}
+}
+
+// TestSphinxDecodeWrongSize tests that decoding a packet from a reader which
+// doesn't hold exactly one full packet fails, instead of panicking or
+// accepting the trailing bytes.
+func TestSphinxDecodeWrongSize(t *testing.T) {
+	_, _, _, fwdMsg, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create random onion packet: %v", err)
+	}
+
+	var b bytes.Buffer
+	if err := fwdMsg.Encode(&b); err != nil {
+		t.Fatalf("unable to encode message: %v", err)
+	}
+	encoded := b.Bytes()
+
+	tests := []struct {
+		name string
+		raw  []byte
+		err  error
+	}{
+		{
+			name: "empty",
+			raw:  nil,
+			err:  ErrPacketTooSmall,
+		},
+		{
+			name: "single byte",
+			raw:  []byte{baseVersion},
+			err:  ErrPacketTooSmall,
+		},
+		{
+			name: "truncated mac",
+			raw:  encoded[:len(encoded)-1],
+			err:  ErrPacketTooSmall,
+		},
+		{
+			name: "trailing byte",
+			raw:  append(append([]byte{}, encoded...), 0x00),
+			err:  ErrPacketWrongSize,
+		},
+		{
+			name: "exact",
+			raw:  encoded,
+			err:  nil,
+		},
+	}
+
+	for _, test := range tests {
+		var pkt OnionPacket
+		err := pkt.Decode(bytes.NewReader(test.raw))
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%s: expected error %v, got %v", test.name,
+				test.err, err)
+		}
+		if err == nil {
+			continue
+		}
+
+		// The error should report both the expected size and the
+		// number of bytes actually supplied.
+		sizes := fmt.Sprintf("expected %d bytes, got %d", len(encoded),
+			len(test.raw))
+		if !strings.Contains(err.Error(), sizes) {
+			t.Fatalf("%s: error %q doesn't contain %q", test.name,
+				err, sizes)
+		}
+	}
+}
+
+// newTestSingleHopPacket creates a single hop onion packet destined to the
+// passed router, using a freshly generated session key.
+func newTestSingleHopPacket(router *Router) (*OnionPacket, error) {
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+
+	hopPayload, err := NewHopPayload(&HopData{
+		Realm:         [1]byte{0x00},
+		ForwardAmount: 1,
+		OutgoingCltv:  1,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var route PaymentPath
+	route[0] = OnionHop{
+		NodePub:    *router.onionPub,
+		HopPayload: hopPayload,
+	}
+
+	return NewOnionPacket(&route, sessionKey, nil)
+}
+
+func TestSphinxProcessOnionPackets(t *testing.T) {
+	nodes, _, _, _, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	router := nodes[0]
+
+	// Start the ReplayLog and defer shutdown
+	router.log.Start()
+	defer router.log.Stop()
+
+	pkt1, err := newTestSingleHopPacket(router)
+	if err != nil {
+		t.Fatalf("unable to create packet: %v", err)
+	}
+	pkt2, err := newTestSingleHopPacket(router)
+	if err != nil {
+		t.Fatalf("unable to create packet: %v", err)
+	}
+
+	// Process a batch containing two distinct packets, and a duplicate of
+	// the first one.
+	pkts := []*OnionPacket{pkt1, pkt2, pkt1}
+	assocData := [][]byte{nil, nil, nil}
+	cltvs := []uint32{1, 2, 3}
+
+	packets, replays, err := router.ProcessOnionPackets(
+		[]byte("0"), pkts, assocData, cltvs,
+	)
+	if err != nil {
+		t.Fatalf("unable to process batch: %v", err)
+	}
+
+	if replays.Size() != 1 || !replays.Contains(2) {
+		t.Fatalf("expected replay set to only contain index 2")
+	}
+	if packets[0] == nil || packets[1] == nil {
+		t.Fatalf("expected non-replayed packets to be returned")
+	}
+	if packets[2] != nil {
+		t.Fatalf("expected replayed packet to be omitted")
+	}
+	for i := 0; i < 2; i++ {
+		if packets[i].Action != ExitNode {
+			t.Fatalf("expected packet %d to be for the exit node", i)
+		}
+	}
+
+	// Both packets should now be recorded in the replay log, so a later
+	// batch including the second packet should flag it as a replay.
+	pkt3, err := newTestSingleHopPacket(router)
+	if err != nil {
+		t.Fatalf("unable to create packet: %v", err)
+	}
+	packets, replays, err = router.ProcessOnionPackets(
+		[]byte("1"), []*OnionPacket{pkt3, pkt2}, [][]byte{nil, nil},
+		[]uint32{1, 1},
+	)
+	if err != nil {
+		t.Fatalf("unable to process batch: %v", err)
+	}
+	if replays.Size() != 1 || !replays.Contains(1) {
+		t.Fatalf("expected replay set to only contain index 1")
+	}
+	if packets[0] == nil || packets[1] != nil {
+		t.Fatalf("unexpected set of returned packets")
+	}
+
+	// A batch that fails processing for any packet shouldn't have any of
+	// its packets written to the replay log.
+	pkt4, err := newTestSingleHopPacket(router)
+	if err != nil {
+		t.Fatalf("unable to create packet: %v", err)
+	}
+	_, _, err = router.ProcessOnionPackets(
+		[]byte("2"), []*OnionPacket{pkt4, pkt3},
+		[][]byte{nil, []byte("somethingelse")}, []uint32{1, 1},
+	)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected invalid hmac error, got: %v", err)
+	}
+	if _, err := router.ProcessOnionPacket(pkt4, nil, 1); err != nil {
+		t.Fatalf("packet from failed batch should not be recorded: %v",
+			err)
+	}
+
+	// Finally, mismatched input lengths should be rejected.
+	_, _, err = router.ProcessOnionPackets(
+		[]byte("3"), []*OnionPacket{pkt1}, nil, []uint32{1},
+	)
+	if !errors.Is(err, ErrInvalidBatch) {
+		t.Fatalf("expected mismatched batch lengths to be rejected, "+
+			"got: %v", err)
+	}
+}
+
+// cancelAfterContext is a context which reports itself as cancelled once its
+// Err method has been called more than a set number of times.
+type cancelAfterContext struct {
+	context.Context
+
+	calls int
+}
+
+// Err returns context.Canceled once the remaining number of calls ran out.
+func (c *cancelAfterContext) Err() error {
+	if c.calls <= 0 {
+		return context.Canceled
+	}
+	c.calls--
+
+	return nil
+}
+
+// TestSphinxProcessOnionPacketsCancel asserts that cancelling a batch midway
+// commits exactly the packets processed so far, and none of the others.
+func TestSphinxProcessOnionPacketsCancel(t *testing.T) {
+	nodes, _, _, _, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	router := nodes[0]
+
+	router.log.Start()
+	defer router.log.Stop()
+
+	pkts := make([]*OnionPacket, 3)
+	for i := range pkts {
+		pkts[i], err = newTestSingleHopPacket(router)
+		if err != nil {
+			t.Fatalf("unable to create packet: %v", err)
+		}
+	}
+	assocData := [][]byte{nil, nil, nil}
+	cltvs := []uint32{1, 1, 1}
+
+	// A batch cancelled before any packet was peeled shouldn't return nor
+	// record anything.
+	ctx := &cancelAfterContext{Context: context.Background(), calls: 1}
+	packets, _, err := router.ProcessOnionPacketsContext(
+		ctx, []byte("0"), pkts, assocData, cltvs,
+	)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context cancelled error, got: %v", err)
+	}
+	if packets != nil {
+		t.Fatalf("expected no packets to be returned")
+	}
+
+	// Cancel the batch after the shared secrets were derived, and two of
+	// the packets were peeled.
+	ctx = &cancelAfterContext{
+		Context: context.Background(), calls: len(pkts) + 2,
+	}
+	packets, replays, err := router.ProcessOnionPacketsContext(
+		ctx, []byte("1"), pkts, assocData, cltvs,
+	)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context cancelled error, got: %v", err)
+	}
+	if replays.Size() != 0 {
+		t.Fatalf("expected no replays, got %d", replays.Size())
+	}
+	if packets[0] == nil || packets[1] == nil || packets[2] != nil {
+		t.Fatalf("expected only the first two packets to be returned")
+	}
+
+	// Reprocessing the full batch under the same ID should flag exactly
+	// the two committed packets as replays, while the third one was never
+	// recorded.
+	packets, replays, err = router.ProcessOnionPackets(
+		[]byte("1"), pkts, assocData, cltvs,
+	)
+	if err != nil {
+		t.Fatalf("unable to process batch: %v", err)
+	}
+	if replays.Size() != 2 || !replays.Contains(0) || !replays.Contains(1) {
+		t.Fatalf("expected replay set to contain indexes 0 and 1")
+	}
+	if packets[2] == nil {
+		t.Fatalf("expected uncommitted packet to be processed")
+	}
+}
+
+// TestSphinxProcessOnionPacketsIsolated asserts that the result of a batch is
+// index-aligned with its packets, and that a router configured to isolate
+// failures only skips the packets failing processing.
+func TestSphinxProcessOnionPacketsIsolated(t *testing.T) {
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate onion key: %v", err)
+	}
+	router := NewRouter(
+		privKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+		WithIsolatedBatchFailures(),
+	)
+	router.log.Start()
+	defer router.log.Stop()
+
+	pkts := make([]*OnionPacket, 6)
+	for i := range pkts[:4] {
+		pkts[i], err = newTestSingleHopPacket(router)
+		if err != nil {
+			t.Fatalf("unable to create packet: %v", err)
+		}
+	}
+
+	// Record the second packet, such that it's a replay within the batch,
+	// and have the fifth one duplicate the first.
+	if _, err := router.ProcessOnionPacket(pkts[1], nil, 1); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	pkts[4] = pkts[0]
+
+	// The fourth packet fails its HMAC check, and the sixth carries an
+	// invalid version.
+	invalidVersion := *pkts[3]
+	invalidVersion.Version = 0x01
+	pkts[5] = &invalidVersion
+	assocData := [][]byte{nil, nil, nil, []byte("somethingelse"), nil, nil}
+	cltvs := []uint32{1, 2, 3, 4, 5, 6}
+
+	packets, replays, err := router.ProcessOnionPackets(
+		[]byte("0"), pkts, assocData, cltvs,
+	)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected BatchError, got: %v", err)
+	}
+	if len(packets) != len(pkts) || len(batchErr.Errors) != len(pkts) {
+		t.Fatalf("result isn't aligned with the batch")
+	}
+	if !errors.Is(batchErr.Errors[3], ErrInvalidOnionHMAC) {
+		t.Fatalf("expected ErrInvalidOnionHMAC, got: %v",
+			batchErr.Errors[3])
+	}
+	if !errors.Is(batchErr.Errors[5], ErrInvalidOnionVersion) {
+		t.Fatalf("expected ErrInvalidOnionVersion, got: %v",
+			batchErr.Errors[5])
+	}
+	if replays.Size() != 2 || !replays.Contains(1) || !replays.Contains(4) {
+		t.Fatalf("expected replay set to contain indexes 1 and 4")
+	}
+
+	for i, packet := range packets {
+		valid := i == 0 || i == 2
+		if (packet != nil) != valid {
+			t.Fatalf("packet %d: expected result %v", i, valid)
+		}
+		if valid && batchErr.Errors[i] != nil {
+			t.Fatalf("packet %d: unexpected error: %v", i,
+				batchErr.Errors[i])
+		}
+		if !valid {
+			continue
+		}
+
+		// Each result belongs to the packet at its index.
+		expected, err := router.ReconstructOnionPacket(pkts[i], nil)
+		if err != nil {
+			t.Fatalf("unable to reconstruct packet %d: %v", i, err)
+		}
+		if packet.SharedSecret != expected.SharedSecret {
+			t.Fatalf("packet %d: result belongs to another packet",
+				i)
+		}
+	}
+
+	// The valid packets were recorded, while the one failing its HMAC
+	// check is still accepted.
+	if _, err := router.ProcessOnionPacket(pkts[2], nil, 1); !errors.Is(
+		err, ErrReplayedPacket,
+	) {
+		t.Fatalf("expected ErrReplayedPacket, got: %v", err)
+	}
+	if _, err := router.ProcessOnionPacket(pkts[3], nil, 1); err != nil {
+		t.Fatalf("failed packet should not be recorded: %v", err)
+	}
+}
+
+func TestDescribeOnionPacket(t *testing.T) {
+	_, _, _, fwdMsg, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create random onion packet: %v", err)
+	}
+
+	desc := DescribeOnionPacket(fwdMsg)
+
+	ephemeral := hex.EncodeToString(fwdMsg.EphemeralKey.SerializeCompressed())
+	mac := hex.EncodeToString(fwdMsg.HeaderMAC[:])
+	expected := fmt.Sprintf("version=0 ephemeral_key=%s header_mac=%s",
+		ephemeral, mac)
+	if desc != expected {
+		t.Fatalf("unexpected description: expected %v, got %v",
+			expected, desc)
+	}
+
+	// Describing a packet without an ephemeral key shouldn't panic.
+	DescribeOnionPacket(&OnionPacket{})
+}
+
+// newTestVarSizeRoute creates a route of routers with the passed set of hop
+// payloads. A nil payload results in a legacy hop payload being used for that
+// hop.
+func newTestVarSizeRoute(payloads [][]byte) ([]*Router, *PaymentPath,
+	*OnionPacket, error) {
+
+	nodes := make([]*Router, len(payloads))
+
+	var route PaymentPath
+	for i := 0; i < len(payloads); i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("unable to generate "+
+				"random key for sphinx node: %v", err)
+		}
+
+		nodes[i] = NewRouter(
+			privKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+		)
+
+		var hopPayload HopPayload
+		if payloads[i] == nil {
+			hopData := &HopData{
+				Realm:         [1]byte{0x00},
+				ForwardAmount: uint64(i),
+				OutgoingCltv:  uint32(i),
+			}
+			hopPayload, err = NewHopPayload(hopData, nil)
+		} else {
+			hopPayload, err = NewHopPayload(nil, payloads[i])
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("unable to create "+
+				"hop payload: %v", err)
+		}
+
+		route[i] = OnionHop{
+			NodePub:    *privKey.PubKey(),
+			HopPayload: hopPayload,
+		}
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	fwdMsg, err := NewOnionPacket(&route, sessionKey, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return nodes, &route, fwdMsg, nil
+}
+
+// deriveFillers returns the filler bytes the i-th hop of the route is expected
+// to find at the end of the routing info of the packet it receives, for a
+// packet constructed using the passed session key and the default packet
+// config. The first hop receives no filler, later hops receive the filler
+// generated for all hops before them. These are derived using the padding
+// generation of the packet construction itself, such that a test which fails
+// to process a constructed packet can pinpoint the hop at which the filler
+// diverges.
+//
+// NOTE: This is for debugging tests only.
+func deriveFillers(route *PaymentPath,
+	sessionKey *btcec.PrivateKey) ([][]byte, error) {
+
+	sharedSecrets, err := GenerateSharedSecrets(
+		route.NodeKeys(), sessionKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	numHops := route.TrueRouteLength()
+	fillers := make([][]byte, numHops)
+	for i := 0; i < numHops; i++ {
+		// The filler received by the i-th hop is the one generated for
+		// a route ending at that hop.
+		var prefix PaymentPath
+		copy(prefix[:i+1], route[:i+1])
+
+		fillers[i] = generateHeaderPadding(
+			defaultKeyTags.Rho, &prefix, sharedSecrets[:i+1],
+			routingInfoSize,
+		)
+	}
+
+	return fillers, nil
+}
+
+// TestSphinxDeriveFillers tests that each hop of a route with differently
+// sized payloads receives the filler derived for it by deriveFillers.
+func TestSphinxDeriveFillers(t *testing.T) {
+	nodes, route, fwdMsg, err := newTestVarSizeRoute([][]byte{
+		nil, bytes.Repeat([]byte{1}, 100), nil,
+		bytes.Repeat([]byte{2}, 20), bytes.Repeat([]byte{3}, 200),
+	})
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	fillers, err := deriveFillers(route, sessionKey)
+	if err != nil {
+		t.Fatalf("unable to derive fillers: %v", err)
+	}
+	if len(fillers[0]) != 0 {
+		t.Fatalf("expected no filler for the first hop, got %d bytes",
+			len(fillers[0]))
+	}
+
+	for i, node := range nodes {
+		routingInfo := fwdMsg.RoutingInfo
+		tail := routingInfo[len(routingInfo)-len(fillers[i]):]
+		if !bytes.Equal(tail, fillers[i]) {
+			t.Fatalf("filler mismatch at hop %d: expected %x, got %x",
+				i, fillers[i], tail)
+		}
+
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+		fwdMsg = pkt.NextPacket
+	}
+}
+
+// TestGenerateFiller asserts that the exported filler generation matches the
+// filler received by the final hop of a route of legacy payloads, and that it
+// fails for routes which don't fit.
+func TestGenerateFiller(t *testing.T) {
+	nodes, route, _, fwdMsg, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	sharedSecrets, err := GenerateSharedSecrets(
+		route.NodeKeys(), sessionKey,
+	)
+	if err != nil {
+		t.Fatalf("unable to generate shared secrets: %v", err)
+	}
+
+	secrets := make([][32]byte, len(sharedSecrets))
+	for i := range sharedSecrets {
+		secrets[i] = sharedSecrets[i]
+	}
+	filler, err := GenerateFiller(
+		"rho", defaultOnionPacketConfig, len(nodes), LegacyHopDataSize,
+		secrets,
+	)
+	if err != nil {
+		t.Fatalf("unable to generate filler: %v", err)
+	}
+	if len(filler) != (len(nodes)-1)*LegacyHopDataSize {
+		t.Fatalf("expected filler of %d bytes, got %d",
+			(len(nodes)-1)*LegacyHopDataSize, len(filler))
+	}
+
+	processed, err := SimulateRoute(nodes[:len(nodes)-1], fwdMsg, nil)
+	if !errors.Is(err, ErrRouteMismatch) {
+		t.Fatalf("expected packet to continue, got: %v", err)
+	}
+	routingInfo := processed[len(processed)-1].NextPacket.RoutingInfo
+	if !bytes.HasSuffix(routingInfo, filler) {
+		t.Fatalf("filler doesn't match the final hop's routing info")
+	}
+
+	smallCfg := OnionPacketConfig{NumMaxHops: 4, HopPayloadSize: 32}
+	invalid := []struct {
+		name      string
+		packetCfg OnionPacketConfig
+		numHops   int
+		secrets   [][32]byte
+		err       error
+	}{
+		{
+			name:      "no hops",
+			packetCfg: defaultOnionPacketConfig,
+			err:       ErrInvalidRoute,
+		},
+		{
+			name:      "oversized route",
+			packetCfg: defaultOnionPacketConfig,
+			numHops:   21,
+			secrets:   secrets,
+			err:       ErrMaxRoutingInfoSizeExceeded,
+		},
+		{
+			name:      "oversized hops",
+			packetCfg: smallCfg,
+			numHops:   2,
+			secrets:   secrets,
+			err:       ErrHopPayloadTooLarge,
+		},
+		{
+			name:      "missing secrets",
+			packetCfg: defaultOnionPacketConfig,
+			numHops:   5,
+			secrets:   secrets[:3],
+		},
+		{
+			name:      "invalid geometry",
+			packetCfg: OnionPacketConfig{},
+			numHops:   1,
+		},
+	}
+	for _, test := range invalid {
+		_, err := GenerateFiller(
+			"rho", test.packetCfg, test.numHops, LegacyHopDataSize,
+			test.secrets,
+		)
+		if err == nil || (test.err != nil && !errors.Is(err, test.err)) {
+			t.Fatalf("%s: expected error %v, got: %v", test.name,
+				test.err, err)
+		}
+	}
+}
+
+// TestHopPayloadDecodeFormat tests that the format of a hop payload is
+// detected from its first byte, the legacy realm or the TLV length.
+func TestHopPayloadDecodeFormat(t *testing.T) {
+	legacy := make([]byte, LegacyHopDataSize)
+	legacy[1] = 0x01
+
+	tlv := append([]byte{0x03, 0x02, 0x01, 0x01}, make([]byte, HMACSize)...)
+
+	tests := []struct {
+		name        string
+		raw         []byte
+		payloadType PayloadType
+		payload     []byte
+	}{
+		{
+			name:        "legacy",
+			raw:         legacy,
+			payloadType: PayloadLegacy,
+			payload:     legacy[:LegacyHopDataSize-HMACSize],
+		},
+		{
+			name:        "tlv",
+			raw:         tlv,
+			payloadType: PayloadTLV,
+			payload:     []byte{0x02, 0x01, 0x01},
+		},
+	}
+
+	for _, test := range tests {
+		var hopPayload HopPayload
+		err := hopPayload.Decode(bytes.NewReader(test.raw))
+		if err != nil {
+			t.Fatalf("%s: unable to decode payload: %v", test.name, err)
+		}
+		if hopPayload.Type != test.payloadType {
+			t.Fatalf("%s: expected payload type %v, got %v",
+				test.name, test.payloadType, hopPayload.Type)
+		}
+		if !bytes.Equal(hopPayload.Payload, test.payload) {
+			t.Fatalf("%s: expected payload %x, got %x", test.name,
+				test.payload, hopPayload.Payload)
+		}
+	}
+}
+
+// TestHopPayloadEncodeTo tests that encoding a hop payload directly into a
+// buffer yields the same bytes as encoding it into an io.Writer, for legacy
+// and TLV payloads of which the length takes up differently sized var-ints.
+func TestHopPayloadEncodeTo(t *testing.T) {
+	hopPayloads := []HopPayload{
+		{
+			Type:    PayloadLegacy,
+			Payload: make([]byte, LegacyHopDataSize-HMACSize),
+		},
+		{Type: PayloadTLV, Payload: []byte{}},
+		{Type: PayloadTLV, Payload: bytes.Repeat([]byte{0x01}, 0xfc)},
+		{Type: PayloadTLV, Payload: bytes.Repeat([]byte{0x02}, 0xfd)},
+		{Type: PayloadTLV, Payload: bytes.Repeat([]byte{0x03}, 0x10000)},
+	}
+
+	for i, hopPayload := range hopPayloads {
+		hopPayload.HMAC[0] = byte(i + 1)
+
+		var b bytes.Buffer
+		if err := hopPayload.Encode(&b); err != nil {
+			t.Fatalf("payload %d: unable to encode: %v", i, err)
+		}
+
+		encoded := make([]byte, hopPayload.NumBytes())
+		hopPayload.encodeTo(encoded)
+		if !bytes.Equal(encoded, b.Bytes()) {
+			t.Fatalf("payload %d: encodings differ", i)
+		}
+	}
+}
+
+// TestSphinxVarSizePayloads tests that a route made up of variable sized hop
+// payloads, interleaved with legacy payloads, can be processed by each hop
+// such that it recovers the exact payload it was sent.
+func TestSphinxVarSizePayloads(t *testing.T) {
+	payloads := [][]byte{
+		bytes.Repeat([]byte{0x01}, 10),
+		nil,
+		bytes.Repeat([]byte{0x02}, 300),
+		bytes.Repeat([]byte{0x03}, 1),
+		nil,
+		bytes.Repeat([]byte{0x04}, 42),
+	}
+
+	nodes, _, fwdMsg, err := newTestVarSizeRoute(payloads)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	for i, node := range nodes {
+		node.log.Start()
+		defer node.log.Stop()
+
+		pkt, err := node.ProcessOnionPacket(fwdMsg, nil, uint32(i))
+		if err != nil {
+			t.Fatalf("node %v unable to process packet: %v", i, err)
+		}
+
+		switch {
+		case payloads[i] == nil:
+			if pkt.Payload.Type != PayloadLegacy {
+				t.Fatalf("node %v expected legacy payload", i)
+			}
+			if pkt.ForwardingInstructions == nil ||
+				pkt.ForwardingInstructions.ForwardAmount != uint64(i) {
+
+				t.Fatalf("node %v parsed wrong hop data: %v", i,
+					spew.Sdump(pkt.ForwardingInstructions))
+			}
+
+		default:
+			if pkt.Payload.Type != PayloadTLV {
+				t.Fatalf("node %v expected TLV payload", i)
+			}
+			if pkt.ForwardingInstructions != nil {
+				t.Fatalf("node %v expected no hop data", i)
+			}
+			if !bytes.Equal(pkt.Payload.Payload, payloads[i]) {
+				t.Fatalf("node %v payload mismatch: expected "+
+					"%x, got %x", i, payloads[i],
+					pkt.Payload.Payload)
+			}
+		}
+
+		expectedAction := ProcessCode(MoreHops)
+		if i == len(nodes)-1 {
+			expectedAction = ExitNode
+		}
+		if pkt.Action != expectedAction {
+			t.Fatalf("node %v expected action %v, got %v", i,
+				expectedAction, pkt.Action)
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+}
+
+// TestSphinxMaxRoutingInfoSizeExceeded tests that payloads which don't fit
+// within the routing info are rejected during construction.
+func TestSphinxMaxRoutingInfoSizeExceeded(t *testing.T) {
+	payloads := [][]byte{
+		bytes.Repeat([]byte{0x01}, 700),
+		bytes.Repeat([]byte{0x02}, 700),
+	}
+
+	_, _, _, err := newTestVarSizeRoute(payloads)
+	if err != ErrMaxRoutingInfoSizeExceeded {
+		t.Fatalf("expected ErrMaxRoutingInfoSizeExceeded, got: %v", err)
+	}
+}
+
+// TestMaxPayloadCapacity tabulates the payload capacity of routes of up to
+// DefaultMaxHops hops, and asserts that a route filling it exactly can be
+// constructed, while a single byte more can't.
+func TestMaxPayloadCapacity(t *testing.T) {
+	capacities := []int{
+		1268, 1236, 1204, 1172, 1140, 1108, 1076, 1044, 1012, 980,
+		948, 916, 884, 852, 820, 788, 756, 724, 692, 660,
+	}
+	for i, expected := range capacities {
+		numHops := i + 1
+		capacity := MaxPayloadCapacity(numHops)
+		if capacity != expected {
+			t.Fatalf("%d hops: expected capacity %d, got %d",
+				numHops, expected, capacity)
+		}
+	}
+
+	for _, numHops := range []int{-1, 0, routingInfoSize/HMACSize + 1} {
+		if capacity := MaxPayloadCapacity(numHops); capacity != 0 {
+			t.Fatalf("%d hops: expected no capacity, got %d",
+				numHops, capacity)
+		}
+	}
+
+	// Fill the capacity with single byte TLV payloads, each occupying two
+	// bytes along with their length prefix, followed by a final payload
+	// taking up the remainder, less its three byte length prefix.
+	for _, numHops := range []int{1, 2, DefaultMaxHops} {
+		payloads := make([][]byte, numHops)
+		for i := range payloads[:numHops-1] {
+			payloads[i] = []byte{byte(i + 1)}
+		}
+		remainder := MaxPayloadCapacity(numHops) - 2*(numHops-1) - 3
+		payloads[numHops-1] = make([]byte, remainder)
+
+		if _, _, _, err := newTestVarSizeRoute(payloads); err != nil {
+			t.Fatalf("%d hops: unable to fill capacity: %v",
+				numHops, err)
+		}
+
+		payloads[numHops-1] = make([]byte, remainder+1)
+		_, _, _, err := newTestVarSizeRoute(payloads)
+		if err != ErrMaxRoutingInfoSizeExceeded {
+			t.Fatalf("%d hops: expected "+
+				"ErrMaxRoutingInfoSizeExceeded, got: %v",
+				numHops, err)
+		}
+	}
+}
+
+// TestReverseRoute asserts that a route and its payloads are reversed in
+// lockstep, that a packet constructed over the reversed route is processed by
+// the nodes in the reverse order, and that mismatched lengths are rejected.
+func TestReverseRoute(t *testing.T) {
+	nodes, _, _, _, err := newTestRoute(4)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	var (
+		route    = make([]*btcec.PublicKey, len(nodes))
+		payloads = make([][]byte, len(nodes))
+	)
+	for i, node := range nodes {
+		route[i] = node.onionPub
+		payloads[i] = bytes.Repeat([]byte{byte(i + 1)}, 10)
+	}
+
+	reversedRoute, reversedPayloads, err := ReverseRoute(route, payloads)
+	if err != nil {
+		t.Fatalf("unable to reverse route: %v", err)
+	}
+	reversedNodes := make([]*Router, len(nodes))
+	for i := range nodes {
+		j := len(nodes) - 1 - i
+		if reversedRoute[j] != route[i] ||
+			!bytes.Equal(reversedPayloads[j], payloads[i]) {
+
+			t.Fatalf("hop %d not reversed in lockstep", i)
+		}
+		if route[i] != nodes[i].onionPub {
+			t.Fatalf("passed route was modified")
+		}
+		reversedNodes[j] = nodes[i]
+	}
+
+	// Construct a packet over the reversed route, which the nodes process
+	// in the reverse order, each recovering its own payload.
+	var path PaymentPath
+	for i, nodePub := range reversedRoute {
+		path[i] = OnionHop{
+			NodePub: *nodePub,
+			HopPayload: HopPayload{
+				Type:    PayloadTLV,
+				Payload: reversedPayloads[i],
+			},
+		}
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	pkt, err := NewOnionPacket(&path, sessionKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	processed, err := SimulateRoute(reversedNodes, pkt, nil)
+	if err != nil {
+		t.Fatalf("unable to simulate reversed route: %v", err)
+	}
+	for i, p := range processed {
+		if !bytes.Equal(p.Payload.Payload, reversedPayloads[i]) {
+			t.Fatalf("hop %d: payload mismatch", i)
+		}
+	}
+
+	_, _, err = ReverseRoute(route, payloads[1:])
+	if !errors.Is(err, ErrInvalidRoute) {
+		t.Fatalf("expected ErrInvalidRoute, got: %v", err)
+	}
+}
+
+// TestXorCipherStream asserts that XOR'ing the cipher stream in place yields
+// the same result as XOR'ing with the stream generated by
+// generateCipherStream, for both aligned and unaligned lengths.
+func TestXorCipherStream(t *testing.T) {
+	var sharedSecret Hash256
+	for i := range sharedSecret {
+		sharedSecret[i] = byte(i + 1)
+	}
+	rhoKey := generateKey("rho", &sharedSecret)
+
+	for _, n := range []int{0, 1, 63, 64, 65, routingInfoSize} {
+		src := bytes.Repeat([]byte{0x5a}, n)
+
+		expected := make([]byte, n)
+		xor(expected, src, generateCipherStream(rhoKey, uint(n)))
+
+		dst := make([]byte, n)
+		xorCipherStream(dst, src, rhoKey)
+		if !bytes.Equal(dst, expected) {
+			t.Fatalf("length %d: stream mismatch", n)
+		}
+
+		xorCipherStream(src, src, rhoKey)
+		if !bytes.Equal(src, expected) {
+			t.Fatalf("length %d: in place stream mismatch", n)
+		}
+	}
+}
+
+// TestZero asserts that the zero helper wipes the key material it's handed,
+// both for heap allocated slices and for fixed size arrays.
+func TestZero(t *testing.T) {
+	var sharedSecret Hash256
+	for i := range sharedSecret {
+		sharedSecret[i] = byte(i + 1)
+	}
+
+	rhoKey := generateKey("rho", &sharedSecret)
+	streamBytes := generateCipherStream(rhoKey, numStreamBytes)
+
+	zero(sharedSecret[:])
+	zero(rhoKey[:])
+	zero(streamBytes)
+
+	buffers := map[string][]byte{
+		"shared secret": sharedSecret[:],
+		"rho key":       rhoKey[:],
+		"stream bytes":  streamBytes,
+	}
+	for name, b := range buffers {
+		if !bytes.Equal(b, make([]byte, len(b))) {
+			t.Fatalf("%v wasn't zeroed: %x", name, b)
+		}
+	}
+
+	// Wiping the derived keys must not affect subsequent derivations from
+	// a fresh copy of the secret.
+	for i := range sharedSecret {
+		sharedSecret[i] = byte(i + 1)
+	}
+	if generateKey("rho", &sharedSecret) == rhoKey {
+		t.Fatalf("re-derived rho key should not be zero")
+	}
+}
+
+// TestZeroWorkBuf asserts that the pooled work buffer a layer of a packet is
+// peeled in is wiped once processing returns, rather than retaining the
+// decrypted routing info until it's reused.
+func TestZeroWorkBuf(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	nodes[0].log.Start()
+	defer nodes[0].log.Stop()
+
+	if _, err := nodes[0].ProcessOnionPacket(fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+
+	// The buffer used for processing was returned to the pool, so it's
+	// the one handed out next, unless the pool dropped it.
+	buf := getWorkBuf(2 * routingInfoSize)
+	defer putWorkBuf(buf)
+	if !bytes.Equal(*buf, make([]byte, len(*buf))) {
+		t.Fatalf("pooled work buffer wasn't zeroed: %x", *buf)
+	}
+}
+
+// TestSphinxConfigurableMaxHops tests that onion packets constructed for a
+// non-default maximum hop count can be encoded, decoded and processed by
+// routers configured with the same count, while being rejected by routers
+// using a different one.
+func TestSphinxConfigurableMaxHops(t *testing.T) {
+	for _, numMaxHops := range []int{1, 4, DefaultMaxHops, NumMaxHops} {
+		numMaxHops := numMaxHops
+		t.Run(fmt.Sprintf("%d hops", numMaxHops), func(t *testing.T) {
+			testSphinxMaxHops(t, numMaxHops)
+		})
+	}
+}
+
+func testSphinxMaxHops(t *testing.T, numMaxHops int) {
+	var (
+		nodes = make([]*Router, numMaxHops)
+		route PaymentPath
+	)
+	for i := range nodes {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+
+		nodes[i] = NewRouter(
+			privKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+			WithMaxHops(numMaxHops),
+		)
+		nodes[i].log.Start()
+		defer nodes[i].log.Stop()
+
+		hopPayload, err := NewHopPayload(&HopData{
+			ForwardAmount: uint64(i),
+			OutgoingCltv:  uint32(i),
+		}, nil)
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+
+		route[i] = OnionHop{
+			NodePub:    *privKey.PubKey(),
+			HopPayload: hopPayload,
+		}
+	}
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+	fwdMsg, err := NewOnionPacket(
+		&route, sessionKey, nil, WithPacketMaxHops(numMaxHops),
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	if len(fwdMsg.RoutingInfo) != numMaxHops*LegacyHopDataSize {
+		t.Fatalf("expected routing info of %d bytes, got %d",
+			numMaxHops*LegacyHopDataSize, len(fwdMsg.RoutingInfo))
+	}
+
+	// The packet should survive a round trip through the wire format,
+	// given the decoder expects the same geometry.
+	var b bytes.Buffer
+	if err := fwdMsg.Encode(&b); err != nil {
+		t.Fatalf("unable to encode packet: %v", err)
+	}
+	var decoded OnionPacket
+	err = decoded.DecodeWithMaxHops(bytes.NewReader(b.Bytes()), numMaxHops)
+	if err != nil {
+		t.Fatalf("unable to decode packet: %v", err)
+	}
+	if !fwdMsg.Equal(&decoded) {
+		t.Fatalf("decoded packet doesn't match original")
+	}
+
+	// A router expecting a different geometry must reject the packet.
+	otherMaxHops := DefaultMaxHops
+	if numMaxHops == DefaultMaxHops {
+		otherMaxHops = numMaxHops - 1
+	}
+	otherRouter := NewRouter(
+		sessionKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+		WithMaxHops(otherMaxHops),
+	)
+	_, err = otherRouter.ReconstructOnionPacket(fwdMsg, nil)
+	if !errors.Is(err, ErrInvalidRoutingInfoSize) {
+		t.Fatalf("expected ErrInvalidRoutingInfoSize, got: %v", err)
+	}
+	sizes := fmt.Sprintf("expected %d bytes, got %d",
+		legacyOnionPacketConfig(otherMaxHops).RoutingInfoSize(),
+		len(fwdMsg.RoutingInfo))
+	if !strings.Contains(err.Error(), sizes) {
+		t.Fatalf("error %q doesn't contain %q", err, sizes)
+	}
+
+	for i, node := range nodes {
+		pkt, err := node.ProcessOnionPacket(fwdMsg, nil, uint32(i))
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		if pkt.ForwardingInstructions.ForwardAmount != uint64(i) {
+			t.Fatalf("node %d received wrong forwarding "+
+				"instructions: %v", i,
+				spew.Sdump(pkt.ForwardingInstructions))
+		}
+
+		expectedAction := ProcessCode(MoreHops)
+		if i == numMaxHops-1 {
+			expectedAction = ExitNode
+		}
+		if pkt.Action != expectedAction {
+			t.Fatalf("node %d expected action %v, got %v", i,
+				expectedAction, pkt.Action)
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+}
+
+// TestSphinxInvalidMaxHops tests that onion packets can't be constructed,
+// decoded or processed for a maximum hop count outside of the supported range.
+func TestSphinxInvalidMaxHops(t *testing.T) {
+	_, route, _, _, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+
+	// Encode a valid default sized packet, such that decoding can only
+	// fail due to the requested geometry.
+	fwdMsg, err := NewOnionPacket(route, sessionKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	var encoded bytes.Buffer
+	if err := fwdMsg.Encode(&encoded); err != nil {
+		t.Fatalf("unable to encode packet: %v", err)
+	}
+
+	for _, numMaxHops := range []int{0, NumMaxHops + 1} {
+		_, err := NewOnionPacket(
+			route, sessionKey, nil, WithPacketMaxHops(numMaxHops),
+		)
+		if err == nil {
+			t.Fatalf("expected failure constructing packet for %d "+
+				"hops", numMaxHops)
+		}
+
+		var pkt OnionPacket
+		b := bytes.NewReader(encoded.Bytes())
+		err = pkt.DecodeWithMaxHops(b, numMaxHops)
+		if err == nil {
+			t.Fatalf("expected failure decoding packet for %d hops",
+				numMaxHops)
+		}
+
+		router := NewRouter(
+			sessionKey, &chaincfg.MainNetParams,
+			NewMemoryReplayLog(), WithMaxHops(numMaxHops),
+		)
+		err = router.Start()
+		if !errors.Is(err, ErrInvalidRouterOption) {
+			t.Fatalf("expected ErrInvalidRouterOption starting "+
+				"router for %d hops, got: %v", numMaxHops, err)
+		}
+		_, err = router.ReconstructOnionPacket(fwdMsg, nil)
+		if !errors.Is(err, ErrInvalidRouterOption) {
+			t.Fatalf("expected ErrInvalidRouterOption processing "+
+				"packet for %d hops, got: %v", numMaxHops, err)
+		}
+	}
+}
+
+// TestSphinxPacketConfig tests that onion packets of several geometries can
+// be constructed, round tripped through the wire format and processed by
+// routers configured for the same geometry, while routers configured for any
+// other geometry reject them.
+func TestSphinxPacketConfig(t *testing.T) {
+	packetCfgs := []OnionPacketConfig{
+		{NumMaxHops: 4, HopPayloadSize: 32},
+		{NumMaxHops: 2, HopPayloadSize: 2},
+		{NumMaxHops: NumMaxHops, HopPayloadSize: 100},
+		defaultOnionPacketConfig,
+	}
+
+	for i, packetCfg := range packetCfgs {
+		otherCfg := packetCfgs[(i+1)%len(packetCfgs)]
+		testSphinxPacketConfig(t, packetCfg, otherCfg)
+	}
+}
+
+func testSphinxPacketConfig(t *testing.T, packetCfg,
+	otherCfg OnionPacketConfig) {
+
+	var (
+		nodes    = make([]*Router, packetCfg.NumMaxHops)
+		payloads = make([][]byte, packetCfg.NumMaxHops)
+		route    PaymentPath
+	)
+	for i := range nodes {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+
+		nodes[i] = NewRouter(
+			privKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+			WithOnionPacketConfig(packetCfg),
+		)
+		nodes[i].log.Start()
+		defer nodes[i].log.Stop()
+
+		// Fill the space reserved for each hop entirely, leaving a
+		// byte for the varint length of the payload.
+		payloads[i] = bytes.Repeat(
+			[]byte{byte(i + 1)}, packetCfg.HopPayloadSize-1,
+		)
+		hopPayload, err := NewHopPayload(nil, payloads[i])
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+
+		route[i] = OnionHop{
+			NodePub:    *privKey.PubKey(),
+			HopPayload: hopPayload,
+		}
+	}
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+	fwdMsg, err := NewOnionPacket(
+		&route, sessionKey, nil, WithPacketConfig(packetCfg),
+	)
+	if err != nil {
+		t.Fatalf("%v: unable to create onion packet: %v", packetCfg,
+			err)
+	}
+	if len(fwdMsg.RoutingInfo) != packetCfg.RoutingInfoSize() {
+		t.Fatalf("%v: expected routing info of %d bytes, got %d",
+			packetCfg, packetCfg.RoutingInfoSize(),
+			len(fwdMsg.RoutingInfo))
+	}
+
+	var b bytes.Buffer
+	if err := fwdMsg.Encode(&b); err != nil {
+		t.Fatalf("%v: unable to encode packet: %v", packetCfg, err)
+	}
+	var decoded OnionPacket
+	err = decoded.DecodeWithConfig(bytes.NewReader(b.Bytes()), packetCfg)
+	if err != nil {
+		t.Fatalf("%v: unable to decode packet: %v", packetCfg, err)
+	}
+	if !fwdMsg.Equal(&decoded) {
+		t.Fatalf("%v: decoded packet doesn't match original", packetCfg)
+	}
+
+	// Neither the decoder nor a router expecting another geometry should
+	// accept the packet.
+	err = decoded.DecodeWithConfig(bytes.NewReader(b.Bytes()), otherCfg)
+	if !errors.Is(err, ErrPacketTooSmall) &&
+		!errors.Is(err, ErrPacketWrongSize) {
+
+		t.Fatalf("%v: expected size error decoding as %v, got: %v",
+			packetCfg, otherCfg, err)
+	}
+	otherRouter := NewRouter(
+		sessionKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+		WithOnionPacketConfig(otherCfg),
+	)
+	_, err = otherRouter.ReconstructOnionPacket(fwdMsg, nil)
+	if !errors.Is(err, ErrInvalidRoutingInfoSize) {
+		t.Fatalf("%v: expected ErrInvalidRoutingInfoSize, got: %v",
+			packetCfg, err)
+	}
+
+	for i, node := range nodes {
+		pkt, err := node.ProcessOnionPacket(fwdMsg, nil, uint32(i))
+		if err != nil {
+			t.Fatalf("%v: node %d unable to process packet: %v",
+				packetCfg, i, err)
+		}
+		if !bytes.Equal(pkt.Payload.Payload, payloads[i]) {
+			t.Fatalf("%v: node %d payload mismatch", packetCfg, i)
+		}
+
+		expectedAction := ProcessCode(MoreHops)
+		if i == packetCfg.NumMaxHops-1 {
+			expectedAction = ExitNode
+		}
+		if pkt.Action != expectedAction {
+			t.Fatalf("%v: node %d expected action %v, got %v",
+				packetCfg, i, expectedAction, pkt.Action)
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+
+	// Adding a single byte to any payload must overflow the routing info.
+	route[0].HopPayload.Payload = append(payloads[0], 0x00)
+	_, err = NewOnionPacket(
+		&route, sessionKey, nil, WithPacketConfig(packetCfg),
+	)
+	if err != ErrMaxRoutingInfoSizeExceeded {
+		t.Fatalf("%v: expected ErrMaxRoutingInfoSizeExceeded, got: %v",
+			packetCfg, err)
+	}
+
+	// Custom geometries reject a payload overflowing the bytes reserved
+	// for its hop, even if the route fits within the routing info.
+	if !packetCfg.isCustom() {
+		return
+	}
+	_, err = NewOnionPacket(
+		&PaymentPath{route[0]}, sessionKey, nil,
+		WithPacketConfig(packetCfg),
+	)
+	if !errors.Is(err, ErrHopPayloadTooLarge) {
+		t.Fatalf("%v: expected ErrHopPayloadTooLarge, got: %v",
+			packetCfg, err)
+	}
+}
+
+// TestSphinxPacketGeometry tests that a router configured with a custom packet
+// geometry rejects packets of another geometry with the same routing info
+// size, as well as hop payloads exceeding the bytes reserved for them, and
+// that an invalid geometry fails the router.
+func TestSphinxPacketGeometry(t *testing.T) {
+	// Both geometries have routing info of 1300 bytes.
+	packetCfg := OnionPacketConfig{NumMaxHops: 10, HopPayloadSize: 98}
+	if packetCfg.RoutingInfoSize() != routingInfoSize {
+		t.Fatalf("geometry doesn't match default routing info size")
+	}
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	router := NewRouter(
+		privKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+		WithOnionPacketConfig(packetCfg),
+	)
+	router.log.Start()
+	defer router.log.Stop()
+
+	// A router of the custom geometry can't process a default packet
+	// addressed to it.
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	payload, err := NewHopPayload(nil, bytes.Repeat([]byte{1}, 200))
+	if err != nil {
+		t.Fatalf("unable to create hop payload: %v", err)
+	}
+	exitPayload, err := NewHopPayload(nil, []byte{2})
+	if err != nil {
+		t.Fatalf("unable to create hop payload: %v", err)
+	}
+	path := &PaymentPath{
+		{NodePub: *privKey.PubKey(), HopPayload: payload},
+		{NodePub: *sessionKey.PubKey(), HopPayload: exitPayload},
+	}
+	defaultPkt, err := NewOnionPacket(path, sessionKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	_, err = router.ReconstructOnionPacket(defaultPkt, nil)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected ErrInvalidOnionHMAC, got: %v", err)
+	}
+
+	// Nor can it process a packet of which its payload overflows the
+	// bytes reserved for it, even if it's bound to its geometry.
+	overflowPkt, err := NewOnionPacket(
+		path, sessionKey, nil,
+		WithPacketKeyTags(packetCfg.bindKeyTags(defaultKeyTags)),
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	_, err = router.ReconstructOnionPacket(overflowPkt, nil)
+	var procErr *ProcessingError
+	if !errors.As(err, &procErr) || procErr.Stage != StagePayload ||
+		!errors.Is(err, ErrHopPayloadTooLarge) {
+
+		t.Fatalf("expected ErrHopPayloadTooLarge, got: %v", err)
+	}
+
+	// A router configured with an invalid geometry can't be started, nor
+	// process any packets.
+	invalidRouter := NewRouter(
+		privKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+		WithOnionPacketConfig(OnionPacketConfig{NumMaxHops: 0}),
+	)
+	if err := invalidRouter.Start(); !errors.Is(
+		err, ErrInvalidRouterOption,
+	) {
+		t.Fatalf("expected ErrInvalidRouterOption, got: %v", err)
+	}
+	_, err = invalidRouter.ProcessOnionPacket(defaultPkt, nil, 0)
+	if !errors.Is(err, ErrInvalidRouterOption) {
+		t.Fatalf("expected ErrInvalidRouterOption, got: %v", err)
+	}
+}
+
+// TestOnionPacketConfigValidate tests that invalid packet geometries are
+// rejected.
+func TestOnionPacketConfigValidate(t *testing.T) {
+	invalidCfgs := []OnionPacketConfig{
+		{NumMaxHops: 0, HopPayloadSize: 32},
+		{NumMaxHops: NumMaxHops + 1, HopPayloadSize: 32},
+		{NumMaxHops: 4, HopPayloadSize: 0},
+		{NumMaxHops: 4, HopPayloadSize: MaxPayloadSize + 1},
+	}
+	for _, packetCfg := range invalidCfgs {
+		if err := packetCfg.Validate(); err == nil {
+			t.Fatalf("expected config %v to be invalid", packetCfg)
+		}
+	}
+
+	if err := defaultOnionPacketConfig.Validate(); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+	if defaultOnionPacketConfig.RoutingInfoSize() != routingInfoSize {
+		t.Fatalf("default config has routing info of %d bytes, "+
+			"expected %d", defaultOnionPacketConfig.RoutingInfoSize(),
+			routingInfoSize)
+	}
+}
+
+// TestSphinxSharedSecret tests that processed packets carry the shared secret
+// the hop derived, and that it yields the same error encrypter as deriving it
+// from the ephemeral key once again.
+func TestSphinxSharedSecret(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	for i, node := range nodes {
+		node.log.Start()
+		defer node.log.Stop()
+
+		encrypter, err := NewOnionErrorEncrypter(
+			node, fwdMsg.EphemeralKey,
+		)
+		if err != nil {
+			t.Fatalf("unable to create encrypter: %v", err)
+		}
+
+		pkt, err := node.ProcessOnionPacket(fwdMsg, nil, uint32(i))
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		expectedSecret := generateSharedSecret(
+			fwdMsg.EphemeralKey, node.onionKey.(*PrivKeyECDH).PrivKey,
+		)
+		if pkt.SharedSecret != expectedSecret {
+			t.Fatalf("node %d returned wrong shared secret: "+
+				"expected %x, got %x", i, expectedSecret,
+				pkt.SharedSecret)
+		}
+
+		fromSecret := NewOnionErrorEncrypterFromSecret(pkt.SharedSecret)
+		if !reflect.DeepEqual(encrypter, fromSecret) {
+			t.Fatalf("node %d encrypter from shared secret "+
+				"doesn't match", i)
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+}
+
+// TestSphinxEncodeWireCompat asserts that Encode produces exactly the version
+// byte, the compressed ephemeral key, the routing info and the HMAC, for
+// ephemeral keys of both parities.
+func TestSphinxEncodeWireCompat(t *testing.T) {
+	_, _, _, fwdMsg, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	for i := 0; i < 16; i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		fwdMsg.EphemeralKey = privKey.PubKey()
+
+		var expected bytes.Buffer
+		expected.WriteByte(fwdMsg.Version)
+		expected.Write(fwdMsg.EphemeralKey.SerializeCompressed())
+		expected.Write(fwdMsg.RoutingInfo)
+		expected.Write(fwdMsg.HeaderMAC[:])
+
+		var b bytes.Buffer
+		if err := fwdMsg.Encode(&b); err != nil {
+			t.Fatalf("unable to encode packet: %v", err)
+		}
+
+		if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+			t.Fatalf("encoding mismatch: expected %x, got %x",
+				expected.Bytes(), b.Bytes())
+		}
+	}
+}
+
+// TestSphinxConstantTimeMacCheck asserts that VerifyHMAC, which compares the
+// MACs in constant time, rejects a header MAC differing from the valid one in
+// any single byte, exactly like processing the packet does, rather than only
+// inspecting part of it.
+func TestSphinxConstantTimeMacCheck(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	sharedSecret, err := nodes[0].generateSharedSecret(fwdMsg.EphemeralKey)
+	if err != nil {
+		t.Fatalf("unable to generate shared secret: %v", err)
+	}
+
+	if !VerifyHMAC(sharedSecret, fwdMsg.RoutingInfo, nil, fwdMsg.HeaderMAC) {
+		t.Fatalf("valid hmac should verify")
+	}
+
+	for i := 0; i < HMACSize; i++ {
+		forged := *fwdMsg
+		forged.HeaderMAC[i] ^= 1
+
+		if VerifyHMAC(
+			sharedSecret, forged.RoutingInfo, nil, forged.HeaderMAC,
+		) {
+			t.Fatalf("hmac with byte %d flipped verified", i)
+		}
+
+		_, err := nodes[0].ReconstructOnionPacket(&forged, nil)
+		if !errors.Is(err, ErrInvalidOnionHMAC) {
+			t.Fatalf("byte %d: expected ErrInvalidOnionHMAC, got: "+
+				"%v", i, err)
+		}
+	}
+}
+
+// TestIsTerminalHMAC asserts that only the all-zero HMAC is recognized as the
+// terminal marker, regardless of which byte of an HMAC is set.
+func TestIsTerminalHMAC(t *testing.T) {
+	var mac [HMACSize]byte
+	if !isTerminalHMAC(&mac) {
+		t.Fatalf("expected zero hmac to be the terminal marker")
+	}
+
+	for i := 0; i < HMACSize; i++ {
+		for _, b := range []byte{0x01, 0x80, 0xff} {
+			mac = [HMACSize]byte{}
+			mac[i] = b
+			if isTerminalHMAC(&mac) {
+				t.Fatalf("hmac with byte %d set to %x "+
+					"recognized as terminal marker", i, b)
+			}
+		}
+	}
+}
+
+// TestSphinxForgedExitMarker asserts that an intermediate hop can't be made to
+// treat a packet as terminating with it by tampering with the routing info.
+// As the routing info is encrypted using a stream cipher, anyone knowing the
+// HMAC handed to the next hop can flip the routing info bits carrying it to
+// turn it into the terminal marker. Such a packet must be rejected by the
+// header MAC check.
+func TestSphinxForgedExitMarker(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	node := nodes[0]
+	node.log.Start()
+	defer node.log.Stop()
+
+	peeked, err := node.PeekOnionPacket(fwdMsg, nil)
+	if err != nil {
+		t.Fatalf("unable to peek at packet: %v", err)
+	}
+	if peeked.Action != MoreHops {
+		t.Fatalf("expected the packet to be forwarded")
+	}
+
+	// Cancel out the HMAC of the next hop within the routing info, such
+	// that it decrypts to the terminal marker.
+	forged := *fwdMsg
+	forged.RoutingInfo = append([]byte(nil), fwdMsg.RoutingInfo...)
+	offset := peeked.Payload.NumBytes() - HMACSize
+	xor(
+		forged.RoutingInfo[offset:offset+HMACSize],
+		forged.RoutingInfo[offset:offset+HMACSize],
+		peeked.Payload.HMAC[:],
+	)
+
+	// The forged routing info decrypts to the terminal marker, so only
+	// the header MAC check stands in the way of the forgery.
+	sharedSecret, err := node.generateSharedSecret(forged.EphemeralKey)
+	if err != nil {
+		t.Fatalf("unable to generate shared secret: %v", err)
+	}
+	streamBytes := generateCipherStream(
+		generateKey("rho", &sharedSecret), uint(len(forged.RoutingInfo)),
+	)
+	var nextMac [HMACSize]byte
+	xor(
+		nextMac[:], forged.RoutingInfo[offset:offset+HMACSize],
+		streamBytes[offset:offset+HMACSize],
+	)
+	if !isTerminalHMAC(&nextMac) {
+		t.Fatalf("expected forgery to yield the terminal marker")
+	}
+	if VerifyHMAC(sharedSecret, forged.RoutingInfo, nil, forged.HeaderMAC) {
+		t.Fatalf("forged routing info verified")
+	}
+
+	// With it, both processing and the exit hop check reject the packet.
+	_, err = node.ProcessOnionPacket(&forged, nil, 1)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected ErrInvalidOnionHMAC, got: %v", err)
+	}
+	_, err = node.IsExitHop(&forged, nil)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected ErrInvalidOnionHMAC, got: %v", err)
+	}
+
+	// The untampered packet is still processed as before.
+	pkt, err := node.ProcessOnionPacket(fwdMsg, nil, 1)
+	if err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	if pkt.Action != MoreHops {
+		t.Fatalf("expected the packet to be forwarded")
+	}
+}
+
+// testECDHer is an ECDHer that records the number of ECDH operations it has
+// performed, and which can be made to fail them.
+type testECDHer struct {
+	privKey  *btcec.PrivateKey
+	numCalls int
+	err      error
+}
+
+func (e *testECDHer) ECDH(pub *btcec.PublicKey) ([32]byte, error) {
+	e.numCalls++
+	if e.err != nil {
+		return [32]byte{}, e.err
+	}
+
+	return generateSharedSecret(pub, e.privKey), nil
+}
+
+// TestSphinxRetiredOnionKey tests that a router which rotated its onion key
+// still processes packets addressed to its retired key, both individually and
+// as part of a batch, while recording them under the same replay prefix.
+func TestSphinxRetiredOnionKey(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	oldRouter := nodes[0]
+
+	newKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate onion key: %v", err)
+	}
+	newRouter := func(opts ...RouterOption) *Router {
+		router := NewRouter(
+			newKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+			opts...,
+		)
+		router.log.Start()
+
+		return router
+	}
+
+	// Without the retired key, the packet addressed to it is rejected.
+	unrotated := newRouter()
+	defer unrotated.log.Stop()
+	_, err = unrotated.ProcessOnionPacket(fwdMsg, nil, 1)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected ErrInvalidOnionHMAC, got: %v", err)
+	}
+
+	rotated := newRouter(WithRetiredOnionKeys(oldRouter.onionKey))
+	defer rotated.log.Stop()
+	expected, err := oldRouter.ReconstructOnionPacket(fwdMsg, nil)
+	if err != nil {
+		t.Fatalf("unable to process packet with old key: %v", err)
+	}
+	pkt, err := rotated.ProcessOnionPacket(fwdMsg, nil, 1)
+	if err != nil {
+		t.Fatalf("unable to process packet after rotation: %v", err)
+	}
+	if pkt.SharedSecret != expected.SharedSecret ||
+		!pkt.NextPacket.Equal(expected.NextPacket) {
+
+		t.Fatalf("processing after rotation differs")
+	}
+
+	// The packet is recorded by its shared secret, so it's detected as a
+	// replay.
+	_, err = rotated.ProcessOnionPacket(fwdMsg, nil, 1)
+	if !errors.Is(err, ErrReplayedPacket) {
+		t.Fatalf("expected ErrReplayedPacket, got: %v", err)
+	}
+	prefix, err := rotated.ReplayPrefix(fwdMsg, nil)
+	if err != nil {
+		t.Fatalf("unable to compute replay prefix: %v", err)
+	}
+	oldPrefix, err := oldRouter.ReplayPrefix(fwdMsg, nil)
+	if err != nil {
+		t.Fatalf("unable to compute replay prefix: %v", err)
+	}
+	if prefix != oldPrefix {
+		t.Fatalf("replay prefix depends on the matching key")
+	}
+
+	// A packet addressed to the new key is processed using it, also when
+	// batched along with one addressed to the retired key.
+	var route PaymentPath
+	route[0] = OnionHop{NodePub: *newKey.PubKey()}
+	route[0].HopPayload, err = NewHopPayload(nil, []byte{0x01})
+	if err != nil {
+		t.Fatalf("unable to create hop payload: %v", err)
+	}
+	newMsg, _, err := NewOnionPacketWithRandomSession(&route, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	batchRouter := newRouter(WithRetiredOnionKeys(oldRouter.onionKey))
+	defer batchRouter.log.Stop()
+	packets, replays, err := batchRouter.ProcessOnionPackets(
+		[]byte("batch"), []*OnionPacket{newMsg, fwdMsg},
+		[][]byte{nil, nil}, []uint32{1, 1},
+	)
+	if err != nil {
+		t.Fatalf("unable to process batch: %v", err)
+	}
+	if replays.Size() != 0 {
+		t.Fatalf("expected no replays, got %d", replays.Size())
+	}
+	if packets[0].Action != ExitNode {
+		t.Fatalf("expected exit node, got %v", packets[0].Action)
+	}
+	if packets[1].SharedSecret != expected.SharedSecret {
+		t.Fatalf("batched processing after rotation differs")
+	}
+}
+
+// TestSphinxCustomECDH tests that a router created with a custom ECDHer uses
+// it to derive the shared secret, without ever being handed the private key.
+func TestSphinxCustomECDH(t *testing.T) {
+	nodes, _, hopDatas, fwdMsg, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	ecdher := &testECDHer{
+		privKey: nodes[0].onionKey.(*PrivKeyECDH).PrivKey,
+	}
+	router := NewRouterWithECDH(
+		nodes[0].onionPub, ecdher, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(),
+	)
+	if router.nodeID != nodes[0].nodeID {
+		t.Fatalf("router has wrong node ID")
+	}
+
+	router.Start()
+	defer router.Stop()
+
+	pkt, err := router.ProcessOnionPacket(fwdMsg, nil, 1)
+	if err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	if ecdher.numCalls != 1 {
+		t.Fatalf("expected one ECDH operation, got %d",
+			ecdher.numCalls)
+	}
+	if !reflect.DeepEqual(*pkt.ForwardingInstructions, (*hopDatas)[0]) {
+		t.Fatalf("processed wrong forwarding instructions: %v",
+			spew.Sdump(pkt.ForwardingInstructions))
+	}
+
+	// Failures of the ECDHer should be returned to the caller.
+	ecdher.err = fmt.Errorf("hsm unavailable")
+	_, err = router.ReconstructOnionPacket(fwdMsg, nil)
+	if !errors.Is(err, ecdher.err) {
+		t.Fatalf("expected ECDH error, got: %v", err)
+	}
+}
+
+// TestSphinxPacketWithSeed tests that the routing info of packets constructed
+// with a caller supplied pad is fully determined by it, while the packet can
+// still be processed by every hop in the route.
+func TestSphinxPacketWithSeed(t *testing.T) {
+	nodes, route, hopDatas, fwdMsg, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+
+	// A zero pad must result in the very same packet as NewOnionPacket.
+	zeroPad := make([]byte, routingInfoSize)
+	pkt, err := newOnionPacketWithSeed(route, sessionKey, nil, zeroPad)
+	if err != nil {
+		t.Fatalf("unable to create packet: %v", err)
+	}
+	if !pkt.Equal(fwdMsg) {
+		t.Fatalf("zero padded packet doesn't match NewOnionPacket")
+	}
+
+	pad := bytes.Repeat([]byte{0x42}, routingInfoSize)
+	pkt1, err := newOnionPacketWithSeed(route, sessionKey, nil, pad)
+	if err != nil {
+		t.Fatalf("unable to create packet: %v", err)
+	}
+	pkt2, err := newOnionPacketWithSeed(route, sessionKey, nil, pad)
+	if err != nil {
+		t.Fatalf("unable to create packet: %v", err)
+	}
+	if !pkt1.Equal(pkt2) {
+		t.Fatalf("packets with the same pad should be identical")
+	}
+	if bytes.Equal(pkt1.RoutingInfo, fwdMsg.RoutingInfo) {
+		t.Fatalf("pad wasn't applied to the routing info")
+	}
+
+	for i, node := range nodes {
+		node.log.Start()
+		defer node.log.Stop()
+
+		processed, err := node.ProcessOnionPacket(pkt1, nil, uint32(i))
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+		if !reflect.DeepEqual(
+			*processed.ForwardingInstructions, (*hopDatas)[i],
+		) {
+			t.Fatalf("node %d processed wrong forwarding "+
+				"instructions: %v", i,
+				spew.Sdump(processed.ForwardingInstructions))
+		}
+
+		pkt1 = processed.NextPacket
+	}
+
+	_, err = newOnionPacketWithSeed(route, sessionKey, nil, pad[1:])
+	if err == nil {
+		t.Fatalf("expected failure for pad of the wrong size")
+	}
+}
+
+// TestSphinxInvalidVersion tests that packets of an unknown version are
+// rejected by the router before any ECDH or replay log work is done.
+func TestSphinxInvalidVersion(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	ecdher := &testECDHer{
+		privKey: nodes[0].onionKey.(*PrivKeyECDH).PrivKey,
+	}
+	router := NewRouterWithECDH(
+		nodes[0].onionPub, ecdher, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(),
+	)
+	router.Start()
+	defer router.Stop()
+
+	badPkt := *fwdMsg
+	badPkt.Version = 0xFF
+
+	if _, err := router.ProcessOnionPacket(&badPkt, nil, 1); !errors.Is(err, ErrInvalidOnionVersion) {
+		t.Fatalf("expected ErrInvalidOnionVersion, got: %v", err)
+	}
+	if _, err := router.ReconstructOnionPacket(&badPkt, nil); !errors.Is(err, ErrInvalidOnionVersion) {
+		t.Fatalf("expected ErrInvalidOnionVersion, got: %v", err)
+	}
+	if ecdher.numCalls != 0 {
+		t.Fatalf("expected no ECDH operations, got %d", ecdher.numCalls)
+	}
+
+	// As the packet was never logged, the valid packet with the same
+	// ephemeral key should still be accepted.
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process valid packet: %v", err)
+	}
+}
+
+// TestSphinxCustomCurve tests that a packet constructed over a curve other
+// than secp256k1 can be read from the wire and processed by every hop in the
+// route, as long as the routers use the same curve, which they derive from
+// their onion key.
+func TestSphinxCustomCurve(t *testing.T) {
+	const numHops = 3
+
+	curve := elliptic.P256()
+	newKey := func() *btcec.PrivateKey {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		return (*btcec.PrivateKey)(key)
+	}
+
+	var route PaymentPath
+	nodes := make([]*Router, numHops)
+	for i := range nodes {
+		nodes[i] = NewRouter(
+			newKey(), &chaincfg.MainNetParams, NewMemoryReplayLog(),
+		)
+		nodes[i].Start()
+		defer nodes[i].Stop()
+
+		hopPayload, err := NewHopPayload(nil, []byte{byte(i)})
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+		route[i] = OnionHop{
+			NodePub:    *nodes[i].onionPub,
+			HopPayload: hopPayload,
+		}
+	}
+
+	fwdMsg, err := NewOnionPacket(&route, newKey(), nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	// A router using the default curve should refuse the packet, as its
+	// ephemeral key doesn't lie on secp256k1.
+	defaultNodes, _, _, _, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	_, err = defaultNodes[0].ReconstructOnionPacket(fwdMsg, nil)
+	if !errors.Is(err, ErrInvalidOnionKey) {
+		t.Fatalf("expected ErrInvalidOnionKey, got: %v", err)
+	}
+
+	for i, node := range nodes {
+		if node.curve != curve {
+			t.Fatalf("hop %d doesn't use the curve of its key", i)
+		}
+
+		// The packet only round trips if decoded over the same curve.
+		var b bytes.Buffer
+		if err := fwdMsg.Encode(&b); err != nil {
+			t.Fatalf("hop %d unable to encode packet: %v", i, err)
+		}
+		var decoded OnionPacket
+		err := decoded.Decode(bytes.NewReader(b.Bytes()))
+		if err == nil &&
+			decoded.EphemeralKey.IsEqual(fwdMsg.EphemeralKey) {
+
+			t.Fatalf("hop %d packet round trips over secp256k1", i)
+		}
+		err = decoded.DecodeWithCurve(
+			bytes.NewReader(b.Bytes()), defaultOnionPacketConfig,
+			curve,
+		)
+		if err != nil {
+			t.Fatalf("hop %d unable to decode packet: %v", i, err)
+		}
+
+		pkt, err := node.ProcessOnionPacket(&decoded, nil, uint32(i))
+		if err != nil {
+			t.Fatalf("hop %d unable to process packet: %v", i, err)
+		}
+		if !bytes.Equal(pkt.Payload.Payload, []byte{byte(i)}) {
+			t.Fatalf("hop %d processed wrong payload: %x", i,
+				pkt.Payload.Payload)
+		}
+
+		expectedAction := ProcessCode(MoreHops)
+		if i == numHops-1 {
+			expectedAction = ExitNode
+		}
+		if pkt.Action != expectedAction {
+			t.Fatalf("hop %d expected action %v, got %v", i,
+				expectedAction, pkt.Action)
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+}
+
+// testObserver is a RouterObserver which records the calls made to it.
+type testObserver struct {
+	actions      []ProcessCode
+	replays      int
+	hmacFailures int
+}
+
+func (o *testObserver) OnPacketProcessed(action ProcessCode) {
+	o.actions = append(o.actions, action)
+}
+
+func (o *testObserver) OnReplayRejected() {
+	o.replays++
+}
+
+func (o *testObserver) OnHMACFailure() {
+	o.hmacFailures++
+}
+
+// TestSphinxRouterObserver tests that a router notifies its observer of the
+// outcome of each processed packet.
+func TestSphinxRouterObserver(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	observer := &testObserver{}
+	router := NewRouterWithECDH(
+		nodes[0].onionPub, nodes[0].onionKey, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(), WithObserver(observer),
+	)
+	router.Start()
+	defer router.Stop()
+
+	// A packet with a tampered MAC should be reported as an HMAC failure.
+	badPkt := *fwdMsg
+	badPkt.HeaderMAC[0] ^= 0x01
+	if _, err := router.ProcessOnionPacket(&badPkt, nil, 1); !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected ErrInvalidOnionHMAC, got: %v", err)
+	}
+
+	// The valid packet should be processed, then rejected as a replay
+	// when sent a second time.
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil, 1); !errors.Is(err, ErrReplayedPacket) {
+		t.Fatalf("expected ErrReplayedPacket, got: %v", err)
+	}
+
+	if observer.hmacFailures != 1 {
+		t.Fatalf("expected 1 hmac failure, got %d", observer.hmacFailures)
+	}
+	if observer.replays != 1 {
+		t.Fatalf("expected 1 replay, got %d", observer.replays)
+	}
+	if !reflect.DeepEqual(observer.actions, []ProcessCode{ExitNode}) {
+		t.Fatalf("unexpected processed actions: %v", observer.actions)
+	}
+}
+
+// TestSphinxProcessDuration tests that the process duration callback of a
+// router is called once for every call to ProcessOnionPacket, whether or not
+// the packet is accepted.
+func TestSphinxProcessDuration(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	var durations []time.Duration
+	router := NewRouterWithECDH(
+		nodes[0].onionPub, nodes[0].onionKey, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(), WithProcessDuration(func(d time.Duration) {
+			durations = append(durations, d)
+		}),
+	)
+	router.Start()
+	defer router.Stop()
+
+	// Process the packet, a replay of it, and a packet with a tampered
+	// MAC.
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	if len(durations) != 1 {
+		t.Fatalf("expected 1 duration, got %d", len(durations))
+	}
+
+	_, err = router.ProcessOnionPacket(fwdMsg, nil, 1)
+	if !errors.Is(err, ErrReplayedPacket) {
+		t.Fatalf("expected ErrReplayedPacket, got: %v", err)
+	}
+
+	badPkt := *fwdMsg
+	badPkt.HeaderMAC[0] ^= 0x01
+	_, err = router.ProcessOnionPacket(&badPkt, nil, 1)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected ErrInvalidOnionHMAC, got: %v", err)
+	}
+
+	if len(durations) != 3 {
+		t.Fatalf("expected 3 durations, got %d", len(durations))
+	}
+	for i, d := range durations {
+		if d < 0 {
+			t.Fatalf("duration %d is negative: %v", i, d)
+		}
+	}
+
+	// Methods other than ProcessOnionPacket aren't timed.
+	if _, err := router.ReconstructOnionPacket(fwdMsg, nil); err != nil {
+		t.Fatalf("unable to reconstruct packet: %v", err)
+	}
+	if len(durations) != 3 {
+		t.Fatalf("expected 3 durations, got %d", len(durations))
+	}
+}
+
+// TestSphinxDeleteStaleEntries tests that the router only prunes replay log
+// entries which expired more than the stale entry delta ago.
+func TestSphinxDeleteStaleEntries(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	router := NewRouterWithECDH(
+		nodes[0].onionPub, nodes[0].onionKey, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(), WithStaleEntryDelta(10),
+	)
+	router.Start()
+	defer router.Stop()
+
+	const cltv = 100
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil, cltv); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+
+	// Within the delta, the entry should be retained, and the packet
+	// still be detected as a replay.
+	numDeleted, err := router.DeleteStaleEntries(cltv + 10)
+	if err != nil {
+		t.Fatalf("unable to delete stale entries: %v", err)
+	}
+	if numDeleted != 0 {
+		t.Fatalf("expected no deleted entries, got %d", numDeleted)
+	}
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil, cltv); !errors.Is(err, ErrReplayedPacket) {
+		t.Fatalf("expected ErrReplayedPacket, got: %v", err)
+	}
+
+	// Past the delta, the entry should be removed.
+	numDeleted, err = router.DeleteStaleEntries(cltv + 11)
+	if err != nil {
+		t.Fatalf("unable to delete stale entries: %v", err)
+	}
+	if numDeleted != 1 {
+		t.Fatalf("expected 1 deleted entry, got %d", numDeleted)
+	}
+}
+
+// TestSphinxPeekOnionPacket tests that peeking at a packet yields the same
+// result as processing it, while leaving the replay log untouched.
+func TestSphinxPeekOnionPacket(t *testing.T) {
+	nodes, _, hopDatas, fwdMsg, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	router := nodes[0]
+	router.log.Start()
+	defer router.log.Stop()
+
+	// Peeking at the packet repeatedly should never be flagged as a
+	// replay.
+	for i := 0; i < 2; i++ {
+		peeked, err := router.PeekOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("unable to peek at packet: %v", err)
+		}
+		if peeked.Action != MoreHops {
+			t.Fatalf("expected MoreHops, got %v", peeked.Action)
+		}
+		if !reflect.DeepEqual(*peeked.ForwardingInstructions, (*hopDatas)[0]) {
+			t.Fatalf("peeked wrong forwarding instructions: %v",
+				spew.Sdump(peeked.ForwardingInstructions))
+		}
+	}
+
+	// As the packet wasn't consumed, it should still be processed.
+	processed, err := router.ProcessOnionPacket(fwdMsg, nil, 1)
+	if err != nil {
+		t.Fatalf("unable to process packet after peeking: %v", err)
+	}
+
+	// Peeking must still validate the HMAC.
+	badPkt := *processed.NextPacket
+	badPkt.HeaderMAC[0] ^= 0x01
+	if _, err := nodes[1].PeekOnionPacket(&badPkt, nil); !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected ErrInvalidOnionHMAC, got: %v", err)
+	}
+}
+
+// TestSphinxProcessAndEncode tests that the wire bytes returned when
+// processing a packet decode to the packet for the next hop, and that none are
+// returned for the exit node.
+func TestSphinxProcessAndEncode(t *testing.T) {
+	const numHops = 3
+	nodes, _, hopDatas, fwdMsg, err := newTestRoute(numHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	for i, node := range nodes {
+		node.log.Start()
+		defer node.log.Stop()
+
+		expected, err := node.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		action, nextHop, wire, err := node.ProcessAndEncode(
+			fwdMsg, nil, 1,
+		)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+		if action != expected.Action {
+			t.Fatalf("node %d: expected action %v, got %v", i,
+				expected.Action, action)
+		}
+
+		if i == numHops-1 {
+			if wire != nil {
+				t.Fatalf("expected no wire bytes for exit node")
+			}
+			break
+		}
+
+		if nextHop != (*hopDatas)[i].NextAddress {
+			t.Fatalf("node %d: expected next hop %x, got %x", i,
+				(*hopDatas)[i].NextAddress, nextHop)
+		}
+
+		var nextPkt OnionPacket
+		if err := nextPkt.UnmarshalBinary(wire); err != nil {
+			t.Fatalf("node %d: unable to decode wire bytes: %v",
+				i, err)
+		}
+		if !reflect.DeepEqual(&nextPkt, expected.NextPacket) {
+			t.Fatalf("node %d: decoded packet doesn't match next "+
+				"packet", i)
+		}
+
+		// The packet was consumed, so processing it again is rejected
+		// as a replay.
+		action, _, wire, err = node.ProcessAndEncode(fwdMsg, nil, 1)
+		if !errors.Is(err, ErrReplayedPacket) || action != Failure ||
+			wire != nil {
+
+			t.Fatalf("node %d: expected replay, got %v", i, err)
+		}
+
+		fwdMsg = &nextPkt
+	}
+}
+
+// TestSphinxShortRoutes tests that packets for routes shorter than the maximum
+// are of the same size as those for the longest routes, and that each hop of
+// the route forwards them to the intended next hop, while only the final one
+// detects that it's the exit node. As every hop verifies the HMAC over the
+// full routing info, this also asserts the filler of short routes is correct.
+func TestSphinxShortRoutes(t *testing.T) {
+	_, _, _, longPkt, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	for _, numHops := range []int{2, 3, testLegacyRouteNumHops - 1} {
+		nodes, _, hopDatas, fwdMsg, err := newTestRoute(numHops)
+		if err != nil {
+			t.Fatalf("unable to create test route: %v", err)
+		}
+
+		if fwdMsg.SerializedSize() != longPkt.SerializedSize() {
+			t.Fatalf("%d hops: packet of %d bytes differs from "+
+				"the %d bytes of a %d hop packet", numHops,
+				fwdMsg.SerializedSize(),
+				longPkt.SerializedSize(),
+				testLegacyRouteNumHops)
+		}
+
+		for i, node := range nodes {
+			node.log.Start()
+			defer node.log.Stop()
+
+			pkt, err := node.ProcessOnionPacket(fwdMsg, nil, 1)
+			if err != nil {
+				t.Fatalf("%d hops: node %d unable to process "+
+					"packet: %v", numHops, i, err)
+			}
+
+			if i == numHops-1 {
+				if pkt.Action != ExitNode {
+					t.Fatalf("%d hops: expected exit node, "+
+						"got %v", numHops, pkt.Action)
+				}
+				break
+			}
+
+			if pkt.Action != MoreHops {
+				t.Fatalf("%d hops: node %d expected MoreHops, "+
+					"got %v", numHops, i, pkt.Action)
+			}
+			expectedHop := (*hopDatas)[i].NextAddress
+			if pkt.NextChannelID != expectedHop {
+				t.Fatalf("%d hops: node %d expected next hop "+
+					"%x, got %x", numHops, i, expectedHop,
+					pkt.NextChannelID)
+			}
+
+			fwdMsg = pkt.NextPacket
+		}
+	}
+}
+
+// TestSphinxIsExitHop tests that only the final hop of a route is reported as
+// the exit hop, and that checking doesn't consume the packet.
+func TestSphinxIsExitHop(t *testing.T) {
+	const numHops = 3
+	nodes, _, _, fwdMsg, err := newTestRoute(numHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	firstPkt := fwdMsg
+
+	for i, node := range nodes {
+		node.log.Start()
+		defer node.log.Stop()
+
+		// Checking repeatedly must yield the same answer, as the
+		// packet isn't recorded in the replay log.
+		for j := 0; j < 2; j++ {
+			isExit, err := node.IsExitHop(fwdMsg, nil)
+			if err != nil {
+				t.Fatalf("node %d unable to check packet: %v",
+					i, err)
+			}
+			if isExit != (i == numHops-1) {
+				t.Fatalf("node %d: expected exit hop %v, got %v",
+					i, i == numHops-1, isExit)
+			}
+		}
+
+		processed, err := node.ProcessOnionPacket(fwdMsg, nil, 1)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet after "+
+				"checking it: %v", i, err)
+		}
+		fwdMsg = processed.NextPacket
+	}
+
+	// Packets failing the HMAC check are rejected.
+	badPkt := *firstPkt
+	badPkt.HeaderMAC[0] ^= 0x01
+	_, err = nodes[0].IsExitHop(&badPkt, nil)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected ErrInvalidOnionHMAC, got: %v", err)
+	}
+}
+
+// TestSphinxReplayPrefix asserts that the replay prefix of a packet matches
+// the one under which processing records it in the replay log.
+func TestSphinxReplayPrefix(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	for i, node := range nodes {
+		node.log.Start()
+		defer node.log.Stop()
+
+		prefix, err := node.ReplayPrefix(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %d unable to derive replay prefix: %v",
+				i, err)
+		}
+		if _, err := node.log.Get(&prefix); err != ErrLogEntryNotFound {
+			t.Fatalf("node %d: expected prefix to be absent from "+
+				"log, got: %v", i, err)
+		}
+
+		incomingCltv := uint32(100 + i)
+		processed, err := node.ProcessOnionPacket(
+			fwdMsg, nil, incomingCltv,
+		)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		cltv, err := node.log.Get(&prefix)
+		if err != nil {
+			t.Fatalf("node %d: expected prefix in log: %v", i, err)
+		}
+		if cltv != incomingCltv {
+			t.Fatalf("node %d: expected cltv %d, got %d", i,
+				incomingCltv, cltv)
+		}
+
+		fwdMsg = processed.NextPacket
+	}
+
+	// Packets of an unknown version are rejected before the shared secret
+	// is derived.
+	badPkt := *fwdMsg
+	badPkt.Version = 0x01
+	_, err = nodes[0].ReplayPrefix(&badPkt, nil)
+	if !errors.Is(err, ErrInvalidOnionVersion) {
+		t.Fatalf("expected ErrInvalidOnionVersion, got: %v", err)
+	}
+}
+
+// TestSphinxAssocDataForwarding asserts that every hop of a route accepts the
+// packet only along with the associated data the sender constructed it with,
+// such that relays forward it bound to unchanged associated data.
+func TestSphinxAssocDataForwarding(t *testing.T) {
+	const numHops = 5
+
+	nodes, route, _, _, err := newTestRoute(numHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	assocData := bytes.Repeat([]byte{0x42}, 32)
+	otherAssocData := bytes.Repeat([]byte{0x43}, 32)
+	fwdMsg, _, err := NewOnionPacketWithRandomSession(route, assocData)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	for i, node := range nodes {
+		node.log.Start()
+		defer node.log.Stop()
+
+		// Any other associated data, including none at all, fails the
+		// HMAC check of this hop.
+		for _, badAssocData := range [][]byte{
+			otherAssocData, assocData[:31], nil,
+		} {
+			_, err := node.ReconstructOnionPacket(
+				fwdMsg, badAssocData,
+			)
+			if !errors.Is(err, ErrInvalidOnionHMAC) {
+				t.Fatalf("hop %d: expected ErrInvalidOnionHMAC "+
+					"for associated data %x, got: %v", i,
+					badAssocData, err)
+			}
+		}
+
+		pkt, err := node.ProcessOnionPacket(fwdMsg, assocData, 1)
+		if err != nil {
+			t.Fatalf("hop %d unable to process packet: %v", i, err)
+		}
+		if (pkt.Action == ExitNode) != (i == numHops-1) {
+			t.Fatalf("hop %d: unexpected action %v", i, pkt.Action)
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+}
+
+// TestSphinxReplayHash asserts that a router configured with an alternate
+// replay hash records packets under the prefix of that hash, and still
+// detects replays, both when processing packets one by one and in batches.
+func TestSphinxReplayHash(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	node := NewRouterWithECDH(
+		nodes[0].onionPub, nodes[0].onionKey, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(), WithReplayHash(sha512.New),
+	)
+	node.log.Start()
+	defer node.log.Stop()
+
+	prefix, err := node.ReplayPrefix(fwdMsg, nil)
+	if err != nil {
+		t.Fatalf("unable to derive replay prefix: %v", err)
+	}
+	defaultPrefix, err := nodes[0].ReplayPrefix(fwdMsg, nil)
+	if err != nil {
+		t.Fatalf("unable to derive replay prefix: %v", err)
+	}
+	if prefix == defaultPrefix {
+		t.Fatalf("expected replay prefixes of different hashes to " +
+			"differ")
+	}
+
+	pkt, err := node.ProcessOnionPacket(fwdMsg, nil, 1)
+	if err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	if _, err := node.log.Get(&prefix); err != nil {
+		t.Fatalf("expected packet under alternate prefix: %v", err)
+	}
+	sharedSecret := Hash256(pkt.SharedSecret)
+	sha512Prefix := sha512.Sum512(sharedSecret[:])
+	if !bytes.Equal(prefix[:], sha512Prefix[:HashPrefixSize]) {
+		t.Fatalf("expected prefix %x, got %x",
+			sha512Prefix[:HashPrefixSize], prefix)
+	}
+
+	_, err = node.ProcessOnionPacket(fwdMsg, nil, 1)
+	if !errors.Is(err, ErrReplayedPacket) {
+		t.Fatalf("expected ErrReplayedPacket, got: %v", err)
+	}
+
+	tx := node.BeginTxn([]byte("0"), 1)
+	if err := tx.ProcessOnionPacket(0, fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process packet in batch: %v", err)
+	}
+	_, replays, err := tx.Commit()
+	if err != nil {
+		t.Fatalf("unable to commit batch: %v", err)
+	}
+	if !replays.Contains(0) {
+		t.Fatalf("expected batch to detect the replay")
+	}
+
+	// Digests shorter than the hash prefix are refused.
+	shortNode := NewRouterWithECDH(
+		nodes[0].onionPub, nodes[0].onionKey, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(),
+		WithReplayHash(func() hash.Hash { return fnv.New64() }),
+	)
+	err = shortNode.Start()
+	if !errors.Is(err, ErrInvalidRouterOption) {
+		t.Fatalf("expected ErrInvalidRouterOption, got: %v", err)
+	}
+}
+
+// TestSphinxAmbiguousPayload asserts that a legacy payload of zeroes only,
+// which parses just as well as an empty TLV payload marking the exit hop, is
+// rejected with ErrAmbiguousPayload by a router configured to do so, while
+// it's forwarded by default.
+func TestSphinxAmbiguousPayload(t *testing.T) {
+	// The first hop of the test route receives a legacy payload of
+	// zeroes only.
+	nodes, _, hopsData, fwdMsg, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	if (*hopsData)[0] != (HopData{}) {
+		t.Fatalf("expected empty hop data for the first hop")
+	}
+
+	strictNode := NewRouterWithECDH(
+		nodes[0].onionPub, nodes[0].onionKey, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(), WithAmbiguousPayloadRejection(),
+	)
+	strictNode.log.Start()
+	defer strictNode.log.Stop()
+
+	_, err = strictNode.ProcessOnionPacket(fwdMsg, nil, 1)
+	if !errors.Is(err, ErrAmbiguousPayload) {
+		t.Fatalf("expected ErrAmbiguousPayload, got: %v", err)
+	}
+	var procErr *ProcessingError
+	if !errors.As(err, &procErr) || procErr.Stage != StagePayload {
+		t.Fatalf("expected error at payload stage, got: %v", err)
+	}
+
+	// By default, the payload is treated as a legacy payload.
+	nodes[0].log.Start()
+	defer nodes[0].log.Stop()
+
+	processed, err := nodes[0].ProcessOnionPacket(fwdMsg, nil, 1)
+	if err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	if processed.Action != MoreHops {
+		t.Fatalf("expected packet to be forwarded, got %v",
+			processed.Action)
+	}
+
+	// Payloads carrying any forwarding instructions aren't ambiguous.
+	strictNode = NewRouterWithECDH(
+		nodes[1].onionPub, nodes[1].onionKey, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(), WithAmbiguousPayloadRejection(),
+	)
+	strictNode.log.Start()
+	defer strictNode.log.Stop()
+
+	_, err = strictNode.ProcessOnionPacket(processed.NextPacket, nil, 1)
+	if err != nil {
+		t.Fatalf("unable to process unambiguous packet: %v", err)
+	}
+
+	// An empty TLV payload of an exit hop is framed identically.
+	var b bytes.Buffer
+	emptyTLV := HopPayload{Type: PayloadTLV}
+	if err := emptyTLV.Encode(&b); err != nil {
+		t.Fatalf("unable to encode payload: %v", err)
+	}
+	b.Write(bytes.Repeat([]byte{0x01}, HMACSize))
+
+	var hopPayload HopPayload
+	if err := hopPayload.Decode(&b); err != nil {
+		t.Fatalf("unable to decode payload: %v", err)
+	}
+	if !hopPayload.isAmbiguous() {
+		t.Fatalf("expected empty tlv payload to be ambiguous")
+	}
+}
+
+// TestSphinxConcurrentProcessing tests that a single router can process
+// packets from many goroutines at once, with each packet being accepted
+// exactly once even when submitted by several goroutines concurrently.
+func TestSphinxConcurrentProcessing(t *testing.T) {
+	const (
+		numPackets  = 20
+		numReplays  = 3
+		numAttempts = numPackets * (numReplays + 1)
+	)
+
+	nodes, _, _, _, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	router := nodes[0]
+	router.Start()
+	defer router.Stop()
+
+	pkts := make([]*OnionPacket, numPackets)
+	for i := range pkts {
+		pkts[i], err = newTestSingleHopPacket(router)
+		if err != nil {
+			t.Fatalf("unable to create packet: %v", err)
+		}
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		successes = make(map[int]int)
+		replays   = make(map[int]int)
+		errs      []error
+	)
+	for i := 0; i < numAttempts; i++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+
+			_, err := router.ProcessOnionPacket(pkts[idx], nil, 1)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case err == nil:
+				successes[idx]++
+			case errors.Is(err, ErrReplayedPacket):
+				replays[idx]++
+			default:
+				errs = append(errs, err)
+			}
+		}(i % numPackets)
+	}
+	wg.Wait()
+
+	if len(errs) != 0 {
+		t.Fatalf("unexpected processing errors: %v", errs)
+	}
+	for i := range pkts {
+		if successes[i] != 1 {
+			t.Fatalf("packet %d accepted %d times, expected once", i,
+				successes[i])
+		}
+		if replays[i] != numReplays {
+			t.Fatalf("packet %d rejected as replay %d times, "+
+				"expected %d", i, replays[i], numReplays)
+		}
+	}
+}
+
+// TestSphinxProcessingErrorStages tests that packets rejected by the router
+// report the stage of processing at which they failed.
+func TestSphinxProcessingErrorStages(t *testing.T) {
+	nodes, route, _, fwdMsg, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	ecdher := &testECDHer{
+		privKey: nodes[0].onionKey.(*PrivKeyECDH).PrivKey,
+	}
+	router := NewRouterWithECDH(
+		nodes[0].onionPub, ecdher, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(),
+	)
+	router.Start()
+	defer router.Stop()
+
+	// A payload claiming to be larger than the routing info can only be
+	// detected once the packet has been decrypted.
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'B'}, 32),
+	)
+	route[0].HopPayload = HopPayload{
+		Type:    PayloadLegacy,
+		Payload: []byte{0xfd, 0x05, 0x15},
+	}
+	badPayloadPkt, err := NewOnionPacket(route, sessionKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	badVersionPkt := *fwdMsg
+	badVersionPkt.Version = 0xFF
+
+	badMacPkt := *fwdMsg
+	badMacPkt.HeaderMAC[0] ^= 0x01
+
+	tests := []struct {
+		name    string
+		pkt     *OnionPacket
+		ecdhErr error
+		stage   ProcessingStage
+		cause   error
+	}{
+		{
+			name:  "version",
+			pkt:   &badVersionPkt,
+			stage: StageVersion,
+			cause: ErrInvalidOnionVersion,
+		},
+		{
+			name:    "ecdh",
+			pkt:     fwdMsg,
+			ecdhErr: fmt.Errorf("hsm unavailable"),
+			stage:   StageECDH,
+		},
+		{
+			name:  "hmac",
+			pkt:   &badMacPkt,
+			stage: StageHMAC,
+			cause: ErrInvalidOnionHMAC,
+		},
+		{
+			name:  "payload",
+			pkt:   badPayloadPkt,
+			stage: StagePayload,
+			cause: ErrPayloadTooLarge,
+		},
+	}
+
+	for _, test := range tests {
+		ecdher.err = test.ecdhErr
+		_, err := router.ProcessOnionPacket(test.pkt, nil, 1)
+
+		var procErr *ProcessingError
+		if !errors.As(err, &procErr) {
+			t.Fatalf("%s: expected processing error, got: %v",
+				test.name, err)
+		}
+		if procErr.Stage != test.stage {
+			t.Fatalf("%s: expected stage %v, got %v", test.name,
+				test.stage, procErr.Stage)
+		}
+
+		cause := test.cause
+		if cause == nil {
+			cause = test.ecdhErr
+		}
+		if !errors.Is(err, cause) {
+			t.Fatalf("%s: expected cause %v, got: %v", test.name,
+				cause, err)
+		}
+	}
+
+	// Finally, a valid packet should be rejected by the replay log the
+	// second time it's processed.
+	ecdher.err = nil
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	_, err = router.ProcessOnionPacket(fwdMsg, nil, 1)
+
+	var procErr *ProcessingError
+	if !errors.As(err, &procErr) || procErr.Stage != StageReplay ||
+		!errors.Is(err, ErrReplayedPacket) {
+
+		t.Fatalf("expected replay processing error, got: %v", err)
+	}
+}
+
+// processAllocBudget is the maximum number of allocations that peeling a
+// single layer off an onion packet may take. Most of these are made by the
+// elliptic curve arithmetic, while the routing info is processed within a
+// pooled work buffer.
+const processAllocBudget = 120
+
+// TestSphinxProcessAllocs asserts that processing an onion packet stays
+// within its allocation budget.
+func TestSphinxProcessAllocs(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	router := nodes[0]
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_, err := router.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("unable to process packet: %v", err)
+		}
+	})
+	if allocs > processAllocBudget {
+		t.Fatalf("processing packet took %v allocations, budget is %v",
+			allocs, processAllocBudget)
+	}
+}
+
+// newKeyTagsTestRoute creates a route of numHops routers which all derive
+// their keys using the passed tags, along with an onion packet through the
+// route constructed using packetTags.
+func newKeyTagsTestRoute(t *testing.T, numHops int, routerTags,
+	packetTags KeyTags) ([]*Router, *OnionPacket) {
+
+	var (
+		nodes = make([]*Router, numHops)
+		route PaymentPath
+	)
+	for i := range nodes {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+
+		nodes[i] = NewRouter(
+			privKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+			WithKeyTags(routerTags),
+		)
+
+		hopPayload, err := NewHopPayload(nil, []byte{byte(i)})
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+		route[i] = OnionHop{
+			NodePub:    *privKey.PubKey(),
+			HopPayload: hopPayload,
+		}
+	}
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+	fwdMsg, err := NewOnionPacket(
+		&route, sessionKey, nil, WithPacketKeyTags(packetTags),
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	return nodes, fwdMsg
+}
+
+// TestSphinxKeyTags tests that packets constructed with custom key tags can be
+// processed by routers using the same tags, but not by routers using any
+// other tags.
+func TestSphinxKeyTags(t *testing.T) {
+	customTags := KeyTags{
+		Rho:   "experimental-rho",
+		Mu:    "experimental-mu",
+		Um:    "experimental-um",
+		Ammag: "experimental-ammag",
+		Pad:   "experimental-pad",
+	}
+
+	// A packet using the custom tags should be routable along its entire
+	// path through routers that use them too.
+	nodes, fwdMsg := newKeyTagsTestRoute(t, 5, customTags, customTags)
+	for i, node := range nodes {
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+		if !bytes.Equal(pkt.Payload.Payload, []byte{byte(i)}) {
+			t.Fatalf("node %d payload mismatch: got %x", i,
+				pkt.Payload.Payload)
+		}
+		fwdMsg = pkt.NextPacket
+	}
+
+	// Any mismatch between the tags used to construct and process the
+	// packet should cause HMAC verification to fail.
+	mismatches := []struct {
+		name       string
+		routerTags KeyTags
+		packetTags KeyTags
+	}{
+		{
+			name:       "custom packet, default router",
+			routerTags: defaultKeyTags,
+			packetTags: customTags,
+		},
+		{
+			name:       "default packet, custom router",
+			routerTags: customTags,
+			packetTags: defaultKeyTags,
+		},
+		{
+			name:       "mixed tags",
+			routerTags: customTags,
+			packetTags: KeyTags{
+				Rho:   customTags.Rho,
+				Mu:    defaultKeyTags.Mu,
+				Um:    customTags.Um,
+				Ammag: customTags.Ammag,
+			},
+		},
+	}
+	for _, test := range mismatches {
+		nodes, fwdMsg := newKeyTagsTestRoute(
+			t, 2, test.routerTags, test.packetTags,
+		)
+		_, err := nodes[0].ReconstructOnionPacket(fwdMsg, nil)
+		if !errors.Is(err, ErrInvalidOnionHMAC) {
+			t.Fatalf("%v: expected ErrInvalidOnionHMAC, got %v",
+				test.name, err)
+		}
+	}
+
+	// The pad tag only alters the routing info the sender starts out
+	// with, beyond the payload of the single hop.
+	_, route, _, _, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	unpaddedTags := customTags
+	unpaddedTags.Pad = ""
+	padded, err := NewOnionPacket(
+		route, sessionKey, nil, WithPacketKeyTags(customTags),
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	unpadded, err := NewOnionPacket(
+		route, sessionKey, nil, WithPacketKeyTags(unpaddedTags),
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	tail := LegacyHopDataSize
+	if bytes.Equal(padded.RoutingInfo[tail:], unpadded.RoutingInfo[tail:]) {
+		t.Fatalf("pad tag doesn't alter the routing info")
+	}
+}
+
+// TestKeyTagsValidate tests that empty or identical key tags are rejected,
+// both by Validate and when constructing a packet.
+func TestKeyTagsValidate(t *testing.T) {
+	if err := defaultKeyTags.Validate(); err != nil {
+		t.Fatalf("default key tags should be valid: %v", err)
+	}
+
+	invalidTags := []KeyTags{
+		{Rho: "", Mu: "mu", Um: "um", Ammag: "ammag"},
+		{Rho: "rho", Mu: "", Um: "um", Ammag: "ammag"},
+		{Rho: "rho", Mu: "mu", Um: "", Ammag: "ammag"},
+		{Rho: "rho", Mu: "mu", Um: "um", Ammag: ""},
+		{Rho: "same", Mu: "same", Um: "um", Ammag: "ammag"},
+		{Rho: "rho", Mu: "mu", Um: "um", Ammag: "ammag", Pad: "um"},
+	}
+	_, route, _, _, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+	for _, tags := range invalidTags {
+		if err := tags.Validate(); err == nil {
+			t.Fatalf("expected key tags %+v to be invalid", tags)
+		}
+
+		_, err := NewOnionPacket(
+			route, sessionKey, nil, WithPacketKeyTags(tags),
+		)
+		if err == nil {
+			t.Fatalf("expected packet construction with key tags "+
+				"%+v to fail", tags)
+		}
+
+		router := NewRouter(
+			sessionKey, &chaincfg.MainNetParams,
+			NewMemoryReplayLog(), WithKeyTags(tags),
+		)
+		if err := router.Start(); !errors.Is(
+			err, ErrInvalidRouterOption,
+		) {
+			t.Fatalf("expected router with key tags %+v to fail "+
+				"with ErrInvalidRouterOption, got: %v", tags,
+				err)
+		}
+	}
+}
+
+// TestSphinxPeelDetails asserts that the internals exposed through the
+// WithPeelDetails option match the packet handed to the next hop, and that
+// they're omitted by default.
+func TestSphinxPeelDetails(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	for i, node := range nodes {
+		node.log.Start()
+		defer node.log.Stop()
+
+		processed, err := node.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+		if processed.PeelDetails != nil {
+			t.Fatalf("node %d exposed peel details by default", i)
+		}
+
+		processed, err = node.ProcessOnionPacket(
+			fwdMsg, nil, 1, WithPeelDetails(),
+		)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		details := processed.PeelDetails
+		if details == nil {
+			t.Fatalf("node %d didn't expose peel details", i)
+		}
+		if details.NextHMAC != processed.NextPacket.HeaderMAC {
+			t.Fatalf("node %d exposed next hmac %x, packet carries %x",
+				i, details.NextHMAC, processed.NextPacket.HeaderMAC)
+		}
+		if !bytes.Equal(
+			details.NextRoutingInfo, processed.NextPacket.RoutingInfo,
+		) {
+			t.Fatalf("node %d exposed mismatched routing info", i)
+		}
+
+		fwdMsg = processed.NextPacket
+	}
+}
+
+// TestSphinxInvalidEphemeralKey asserts that packets carrying a missing,
+// identity or otherwise invalid ephemeral key are rejected before performing
+// any ECDH.
+func TestSphinxInvalidEphemeralKey(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	router := nodes[0]
+
+	router.log.Start()
+	defer router.log.Stop()
+
+	curve := btcec.S256()
+	offCurveY := new(big.Int).Add(fwdMsg.EphemeralKey.Y, big.NewInt(1))
+	outOfFieldX := new(big.Int).Add(
+		fwdMsg.EphemeralKey.X, curve.Params().P,
+	)
+	invalidKeys := []struct {
+		name string
+		key  *btcec.PublicKey
+	}{
+		{
+			name: "nil key",
+			key:  nil,
+		},
+		{
+			name: "nil coordinates",
+			key:  &btcec.PublicKey{Curve: curve},
+		},
+		{
+			name: "identity",
+			key: &btcec.PublicKey{
+				Curve: curve, X: new(big.Int), Y: new(big.Int),
+			},
+		},
+		{
+			name: "off curve",
+			key: &btcec.PublicKey{
+				Curve: curve, X: fwdMsg.EphemeralKey.X,
+				Y: offCurveY,
+			},
+		},
+		{
+			name: "out of field",
+			key: &btcec.PublicKey{
+				Curve: curve, X: outOfFieldX,
+				Y: fwdMsg.EphemeralKey.Y,
+			},
+		},
+	}
+
+	for _, test := range invalidKeys {
+		pkt := *fwdMsg
+		pkt.EphemeralKey = test.key
+
+		_, err := router.ProcessOnionPacket(&pkt, nil, 1)
+		if !errors.Is(err, ErrInvalidEphemeralKey) {
+			t.Fatalf("%s: expected ErrInvalidEphemeralKey, got: %v",
+				test.name, err)
+		}
+		if !errors.Is(err, ErrInvalidOnionKey) {
+			t.Fatalf("%s: expected ErrInvalidOnionKey, got: %v",
+				test.name, err)
+		}
+
+		var procErr *ProcessingError
+		if !errors.As(err, &procErr) || procErr.Stage != StageECDH {
+			t.Fatalf("%s: expected rejection at the ECDH stage, "+
+				"got: %v", test.name, err)
+		}
+	}
+
+	// The unmodified packet should still be accepted.
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+}
+
+// TestDeriveSessionKey asserts that session keys derived from the same seed
+// and payment hash are identical, while changing either input yields a
+// different, valid, key.
+func TestDeriveSessionKey(t *testing.T) {
+	var seed, paymentHash [32]byte
+	copy(seed[:], bytes.Repeat([]byte{'S'}, 32))
+	copy(paymentHash[:], bytes.Repeat([]byte{'H'}, 32))
+
+	key1 := DeriveSessionKey(seed, paymentHash)
+	key2 := DeriveSessionKey(seed, paymentHash)
+	if !bytes.Equal(key1.Serialize(), key2.Serialize()) {
+		t.Fatalf("same inputs yielded different session keys")
+	}
+
+	otherSeed := seed
+	otherSeed[0] ^= 1
+	otherHash := paymentHash
+	otherHash[0] ^= 1
+
+	for _, key := range []*btcec.PrivateKey{
+		DeriveSessionKey(otherSeed, paymentHash),
+		DeriveSessionKey(seed, otherHash),
+	} {
+		if bytes.Equal(key.Serialize(), key1.Serialize()) {
+			t.Fatalf("distinct inputs yielded the same session key")
+		}
+	}
+
+	for _, key := range []*btcec.PrivateKey{key1, key2} {
+		if key.D.Sign() <= 0 || key.D.Cmp(btcec.S256().N) >= 0 {
+			t.Fatalf("derived session key isn't a valid scalar")
+		}
+	}
+
+	// The derived key should be usable to construct a packet.
+	_, route, _, _, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	if _, err := NewOnionPacket(route, key1, paymentHash[:]); err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+}
+
+// TestVerifyHMAC asserts that VerifyHMAC accepts the HMAC of each layer of a
+// packet given the matching shared secret, while rejecting any tampering.
+func TestVerifyHMAC(t *testing.T) {
+	nodes, route, _, _, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	sharedSecrets, err := GenerateSharedSecrets(
+		route.NodeKeys(), sessionKey,
+	)
+	if err != nil {
+		t.Fatalf("unable to generate shared secrets: %v", err)
+	}
+
+	assocData := []byte("assoc")
+	fwdMsg, err := NewOnionPacket(route, sessionKey, assocData)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	for i, node := range nodes {
+		ok := VerifyHMAC(
+			sharedSecrets[i], fwdMsg.RoutingInfo, assocData,
+			fwdMsg.HeaderMAC,
+		)
+		if !ok {
+			t.Fatalf("hop %d hmac should verify", i)
+		}
+
+		// Any change to the associated data, routing info or HMAC
+		// should cause the check to fail.
+		if VerifyHMAC(
+			sharedSecrets[i], fwdMsg.RoutingInfo, nil,
+			fwdMsg.HeaderMAC,
+		) {
+			t.Fatalf("hop %d hmac verified for wrong assoc data", i)
+		}
+
+		routingInfo := append([]byte(nil), fwdMsg.RoutingInfo...)
+		routingInfo[0] ^= 1
+		if VerifyHMAC(
+			sharedSecrets[i], routingInfo, assocData,
+			fwdMsg.HeaderMAC,
+		) {
+			t.Fatalf("hop %d hmac verified for tampered routing "+
+				"info", i)
+		}
+
+		mac := fwdMsg.HeaderMAC
+		mac[HMACSize-1] ^= 1
+		if VerifyHMAC(
+			sharedSecrets[i], fwdMsg.RoutingInfo, assocData, mac,
+		) {
+			t.Fatalf("hop %d tampered hmac verified", i)
+		}
+
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, assocData)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+		fwdMsg = pkt.NextPacket
+	}
+}
+
+// TestSphinxProcessWithSharedSecret asserts that processing a packet using a
+// shared secret derived outside of the router yields the same result as the
+// regular processing path, including replay protection.
+func TestSphinxProcessWithSharedSecret(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	for i, node := range nodes {
+		node.log.Start()
+		defer node.log.Stop()
+
+		expected, err := node.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+
+		// Derive the shared secret as a remote signer would, using the
+		// node's onion key directly.
+		sharedSecret, err := node.onionKey.ECDH(fwdMsg.EphemeralKey)
+		if err != nil {
+			t.Fatalf("node %d unable to derive secret: %v", i, err)
+		}
+		if sharedSecret != expected.SharedSecret {
+			t.Fatalf("node %d shared secret mismatch", i)
+		}
+
+		processed, err := node.ProcessOnionPacketWithSharedSecret(
+			fwdMsg, nil, sharedSecret, 1,
+		)
+		if err != nil {
+			t.Fatalf("node %d unable to process packet: %v", i, err)
+		}
+		if !reflect.DeepEqual(processed, expected) {
+			t.Fatalf("node %d processed packet mismatch", i)
+		}
+
+		// The packet should now be recorded, regardless of the path
+		// used to process it.
+		_, err = node.ProcessOnionPacket(fwdMsg, nil, 1)
+		if !errors.Is(err, ErrReplayedPacket) {
+			t.Fatalf("node %d expected replay, got: %v", i, err)
+		}
+
+		// A wrong secret should be caught by the HMAC check.
+		wrongSecret := sharedSecret
+		wrongSecret[0] ^= 1
+		_, err = node.ProcessOnionPacketWithSharedSecret(
+			fwdMsg, nil, wrongSecret, 1,
+		)
+		if !errors.Is(err, ErrInvalidOnionHMAC) {
+			t.Fatalf("node %d expected invalid hmac, got: %v", i,
+				err)
+		}
+
+		fwdMsg = processed.NextPacket
+	}
+}
+
+// TestOnionPacketRoutingInfoRows asserts that the routing info of a packet is
+// split into one row per hop slot of its geometry.
+func TestOnionPacketRoutingInfoRows(t *testing.T) {
+	_, route, _, fwdMsg, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	// A packet using the default geometry has a row for each of its
+	// DefaultMaxHops slots, regardless of the length of the route.
+	rows, err := fwdMsg.RoutingInfoRows(defaultOnionPacketConfig)
+	if err != nil {
+		t.Fatalf("unable to split routing info: %v", err)
+	}
+	if len(rows) != DefaultMaxHops {
+		t.Fatalf("expected %d rows, got %d", DefaultMaxHops, len(rows))
+	}
+	if !bytes.Equal(bytes.Join(rows, nil), fwdMsg.RoutingInfo) {
+		t.Fatalf("rows don't make up the routing info")
+	}
+
+	// A packet sized for exactly the five hops of the route has a row per
+	// hop instead.
+	packetCfg := legacyOnionPacketConfig(5)
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	fwdMsg, err = NewOnionPacket(
+		route, sessionKey, nil, WithPacketConfig(packetCfg),
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	rows, err = fwdMsg.RoutingInfoRows(packetCfg)
+	if err != nil {
+		t.Fatalf("unable to split routing info: %v", err)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("expected 5 rows, got %d", len(rows))
+	}
+	for i, row := range rows {
+		if len(row) != LegacyHopDataSize {
+			t.Fatalf("row %d is %d bytes, expected %d", i, len(row),
+				LegacyHopDataSize)
+		}
+	}
+
+	// Modifying a row shouldn't affect the packet.
+	rows[0][0] ^= 1
+	if bytes.Equal(bytes.Join(rows, nil), fwdMsg.RoutingInfo) {
+		t.Fatalf("rows alias the routing info of the packet")
+	}
+
+	// Splitting using a mismatched geometry should fail.
+	_, err = fwdMsg.RoutingInfoRows(defaultOnionPacketConfig)
+	if !errors.Is(err, ErrInvalidRoutingInfoSize) {
+		t.Fatalf("expected ErrInvalidRoutingInfoSize, got: %v", err)
+	}
+}
+
+// TestSphinxProbeFailure asserts that a probe constructed using the
+// WithProbeFailureAt option is processed by every hop up to and including the
+// chosen one, while the next hop rejects it, and that the sender is able to
+// attribute the failure sent back.
+func TestSphinxProbeFailure(t *testing.T) {
+	const probeHop = 2
+
+	nodes, route, _, _, err := newTestRoute(5)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	fwdMsg, err := NewOnionPacket(
+		route, sessionKey, nil, WithProbeFailureAt(probeHop),
+	)
+	if err != nil {
+		t.Fatalf("unable to create probe: %v", err)
+	}
+
+	for i := 0; i <= probeHop; i++ {
+		processed, err := nodes[i].ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("hop %d unable to process probe: %v", i, err)
+		}
+		if processed.Action != MoreHops {
+			t.Fatalf("hop %d should forward the probe", i)
+		}
+		fwdMsg = processed.NextPacket
+	}
+
+	failingNode := nodes[probeHop+1]
+	_, err = failingNode.ReconstructOnionPacket(fwdMsg, nil)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected probe to fail hmac check, got: %v", err)
+	}
+
+	// The failing hop sends back an error, which the sender should be
+	// able to attribute to it.
+	encrypter, err := NewOnionErrorEncrypter(
+		failingNode, fwdMsg.EphemeralKey,
+	)
+	if err != nil {
+		t.Fatalf("unable to create error encrypter: %v", err)
+	}
+	failureData := bytes.Repeat([]byte{'P'}, onionErrorLength-HMACSize)
+	failure := encrypter.EncryptError(true, failureData)
+
+	sharedSecrets, err := GenerateSharedSecrets(
+		route.NodeKeys(), sessionKey,
+	)
+	if err != nil {
+		t.Fatalf("unable to generate shared secrets: %v", err)
+	}
+	for i := probeHop; i >= 0; i-- {
+		encrypter := NewOnionErrorEncrypterFromSecret(sharedSecrets[i])
+		failure = encrypter.EncryptError(false, failure)
+	}
+
+	decrypter := NewOnionErrorDecrypter(&Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: route.NodeKeys(),
+	})
+	source, msg, err := decrypter.DecryptError(failure)
+	if err != nil {
+		t.Fatalf("unable to decrypt failure: %v", err)
+	}
+	if !source.IsEqual(failingNode.onionPub) {
+		t.Fatalf("failure attributed to the wrong hop")
+	}
+	if !bytes.Equal(msg, failureData) {
+		t.Fatalf("unexpected failure message %x", msg)
+	}
+
+	// Probing the final hop isn't possible.
+	_, err = NewOnionPacket(
+		route, sessionKey, nil, WithProbeFailureAt(4),
+	)
+	if err == nil {
+		t.Fatalf("expected probe at the final hop to be rejected")
+	}
+}
+
+// TestSphinxSelfLoop asserts that a router configured to detect self loops
+// rejects a packet of which the packet for the next hop is addressed to
+// itself.
+func TestSphinxSelfLoop(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate onion key: %v", err)
+	}
+	newRouter := func(opts ...RouterOption) *Router {
+		router := NewRouter(
+			privKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+			opts...,
+		)
+		router.log.Start()
+
+		return router
+	}
+
+	// Construct a route which visits our node twice in a row.
+	var route PaymentPath
+	keys := []*btcec.PublicKey{
+		privKey.PubKey(), privKey.PubKey(), nodes[1].onionPub,
+	}
+	for i, key := range keys {
+		hopData := HopData{
+			Realm:         [1]byte{0x00},
+			ForwardAmount: uint64(i),
+			OutgoingCltv:  uint32(i),
+		}
+		hopPayload, err := NewHopPayload(&hopData, nil)
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+		route[i] = OnionHop{
+			NodePub:    *key,
+			HopPayload: hopPayload,
+		}
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	loopMsg, err := NewOnionPacket(&route, sessionKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	// By default, the loop isn't detected.
+	router := newRouter()
+	defer router.log.Stop()
+	if _, err := router.ProcessOnionPacket(loopMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+
+	detector := newRouter(WithSelfLoopDetection())
+	defer detector.log.Stop()
+	_, err = detector.ProcessOnionPacket(loopMsg, nil, 1)
+	if !errors.Is(err, ErrSelfLoop) {
+		t.Fatalf("expected ErrSelfLoop, got: %v", err)
+	}
+	var procErr *ProcessingError
+	if !errors.As(err, &procErr) || procErr.Stage != StagePayload {
+		t.Fatalf("expected payload stage error, got: %v", err)
+	}
+
+	// The rejected packet isn't recorded, so it's rejected for the same
+	// reason once more.
+	_, err = detector.ProcessOnionPacket(loopMsg, nil, 1)
+	if !errors.Is(err, ErrSelfLoop) {
+		t.Fatalf("expected ErrSelfLoop, got: %v", err)
+	}
+
+	// A packet forwarded to another node is still processed.
+	nodes[0].log.Start()
+	defer nodes[0].log.Stop()
+	WithSelfLoopDetection()(nodes[0])
+	pkt, err := nodes[0].ProcessOnionPacket(fwdMsg, nil, 1)
+	if err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	if pkt.Action != MoreHops {
+		t.Fatalf("expected MoreHops, got: %v", pkt.Action)
+	}
+}
+
+// TestSphinxOnionPacketFromSCIDs asserts that a packet constructed for a route
+// of short channel IDs is identical to one constructed for the route they
+// resolve to.
+func TestSphinxOnionPacketFromSCIDs(t *testing.T) {
+	nodes, _, _, _, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+
+	// Set up an in-memory resolver, and the route its channels resolve
+	// to.
+	type channel struct {
+		nodePub *btcec.PublicKey
+		payload []byte
+	}
+	var (
+		channels = make(map[uint64]channel)
+		scids    = make([]uint64, len(nodes))
+		route    PaymentPath
+	)
+	for i, node := range nodes {
+		scids[i] = uint64(1000 + i)
+		payload := bytes.Repeat([]byte{byte(i + 1)}, 10)
+		channels[scids[i]] = channel{
+			nodePub: node.onionPub,
+			payload: payload,
+		}
+		route[i] = OnionHop{
+			NodePub: *node.onionPub,
+			HopPayload: HopPayload{
+				Type:    PayloadTLV,
+				Payload: payload,
+			},
+		}
+	}
+	resolve := func(scid uint64) (*btcec.PublicKey, []byte, error) {
+		c, ok := channels[scid]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown channel %d", scid)
+		}
+
+		return c.nodePub, c.payload, nil
+	}
+
+	pkt, err := NewOnionPacketFromSCIDs(scids, resolve, sessionKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	expected, err := NewOnionPacket(&route, sessionKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	if !pkt.Equal(expected) {
+		t.Fatalf("packet differs from the one for the resolved route")
+	}
+
+	processed, err := SimulateRoute(nodes, pkt, nil)
+	if err != nil {
+		t.Fatalf("unable to simulate route: %v", err)
+	}
+	for i, p := range processed {
+		if !bytes.Equal(p.Payload.Payload, channels[scids[i]].payload) {
+			t.Fatalf("hop %d: payload mismatch", i)
+		}
+	}
+
+	// Empty routes are rejected, while the resolver's error is passed
+	// through.
+	_, err = NewOnionPacketFromSCIDs(nil, resolve, sessionKey, nil)
+	if !errors.Is(err, ErrInvalidRoute) {
+		t.Fatalf("expected ErrInvalidRoute, got: %v", err)
+	}
+	errUnknown := fmt.Errorf("unknown channel")
+	_, err = NewOnionPacketFromSCIDs(
+		[]uint64{1}, func(uint64) (*btcec.PublicKey, []byte, error) {
+			return nil, nil, errUnknown
+		}, sessionKey, nil,
+	)
+	if !errors.Is(err, errUnknown) {
+		t.Fatalf("expected resolver error, got: %v", err)
 	}
 }
@@ -0,0 +1,187 @@
+package sphinx
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"github.com/btcsuite/btcd/btcec"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	// errReplyBlockKeysMissing is returned when attempting to open a reply
+	// using a reply block which doesn't hold the originator's layer keys,
+	// such as one handed out to, and decoded by, a responder.
+	errReplyBlockKeysMissing = errors.New("reply block doesn't contain " +
+		"the originator's layer keys")
+)
+
+// ReplyBlock is a single-use reply block (SURB). It allows a responder to send
+// a reply back to an anonymous originator, without learning the route the
+// reply takes. The originator constructs the header of the onion packet for
+// the return route up front, and hands out the first hop, the header and the
+// payload key. The layer keys needed to recover the reply are retained by the
+// originator only.
+type ReplyBlock struct {
+	// FirstHop is the node the responder should send the reply to.
+	FirstHop *btcec.PublicKey
+
+	// Header is the pre-built onion packet routing the reply back to the
+	// originator.
+	Header *OnionPacket
+
+	// PayloadKey is the key the responder uses to encrypt the reply
+	// payload. As the originator authenticates the payload using this key
+	// it's able to detect any hop tampering with the reply.
+	PayloadKey Hash256
+
+	// layerKeys are the shared secrets of each hop in the return route,
+	// which are needed to strip the layers of encryption added to the
+	// reply payload in transit. These are never serialized.
+	layerKeys []Hash256
+}
+
+// ReplyPacket is a reply sent using a ReplyBlock. Alongside the header
+// routing it, it carries the reply payload, to which each hop adds a layer of
+// encryption such that it can't be linked across hops.
+type ReplyPacket struct {
+	// Header is the onion packet that routes the reply.
+	Header *OnionPacket
+
+	// Payload is the encrypted reply payload.
+	Payload []byte
+}
+
+// NewReplyBlock creates a new single-use reply block for the return route
+// denoted by 'route', which should terminate at the originator. The session
+// key must be freshly generated, and not be used for any other packet.
+func NewReplyBlock(route *PaymentPath,
+	sessionKey *btcec.PrivateKey) (*ReplyBlock, error) {
+
+	header, err := NewOnionPacket(route, sessionKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The payload key is derived from the session key, such that it's
+	// unique to this reply block.
+	sessionSecret := Hash256(sha256.Sum256(sessionKey.Serialize()))
+	defer zero(sessionSecret[:])
+
+	return &ReplyBlock{
+		FirstHop:   route.NodeKeys()[0],
+		Header:     header,
+		PayloadKey: generateKey("surb_payload", &sessionSecret),
+		layerKeys: generateSharedSecrets(
+			route.NodeKeys(), sessionKey,
+		),
+	}, nil
+}
+
+// UseReplyBlock encrypts the reply payload using the passed reply block,
+// returning the reply packet to send to the reply block's FirstHop.
+func UseReplyBlock(rb *ReplyBlock, payload []byte) (*ReplyPacket, error) {
+	aead, err := chacha20poly1305.New(rb.PayloadKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// As the payload key is only used for a single reply, a zero nonce can
+	// safely be used.
+	var nonce [chacha20poly1305.NonceSize]byte
+	return &ReplyPacket{
+		Header:  rb.Header,
+		Payload: aead.Seal(nil, nonce[:], payload, nil),
+	}, nil
+}
+
+// OpenReply strips the layers of encryption added by each hop from the reply
+// payload, and authenticates and decrypts it using the payload key.
+//
+// NOTE: This can only be called by the originator, as it requires the layer
+// keys retained when the reply block was created.
+func (rb *ReplyBlock) OpenReply(payload []byte) ([]byte, error) {
+	if len(rb.layerKeys) == 0 {
+		return nil, errReplyBlockKeysMissing
+	}
+
+	cipherText := payload
+	for i := range rb.layerKeys {
+		cipherText = replyEncrypt(&rb.layerKeys[i], cipherText)
+	}
+
+	aead, err := chacha20poly1305.New(rb.PayloadKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Open(nil, nonce[:], cipherText, nil)
+}
+
+// Encode writes the part of the reply block that is handed out to the
+// responder to the passed io.Writer. The layer keys aren't included.
+func (rb *ReplyBlock) Encode(w io.Writer) error {
+	if _, err := w.Write(rb.FirstHop.SerializeCompressed()); err != nil {
+		return err
+	}
+	if _, err := w.Write(rb.PayloadKey[:]); err != nil {
+		return err
+	}
+
+	return rb.Header.Encode(w)
+}
+
+// Decode reads a reply block previously written with Encode from the passed
+// io.Reader. The resulting reply block can be used to send a reply, but not to
+// open one.
+func (rb *ReplyBlock) Decode(r io.Reader) error {
+	var err error
+	if rb.FirstHop, err = readPubKey(r); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, rb.PayloadKey[:]); err != nil {
+		return err
+	}
+
+	rb.Header = &OnionPacket{}
+	return rb.Header.Decode(r)
+}
+
+// ProcessReplyPacket processes a reply packet sent using a reply block. The
+// header is processed exactly like any other onion packet, including replay
+// protection, while a layer of encryption is added to the reply payload. The
+// reply packet to be forwarded to the next hop is returned alongside the
+// processed header.
+func (r *Router) ProcessReplyPacket(pkt *ReplyPacket, assocData []byte,
+	incomingCltv uint32) (*ProcessedPacket, *ReplyPacket, error) {
+
+	processed, err := r.ProcessOnionPacket(
+		pkt.Header, assocData, incomingCltv,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nextReply := &ReplyPacket{
+		Header:  processed.NextPacket,
+		Payload: replyEncrypt(&processed.SharedSecret, pkt.Payload),
+	}
+
+	return processed, nextReply, nil
+}
+
+// replyEncrypt adds, or strips, a layer of encryption to the reply payload
+// using the passed hop shared secret. As with onionEncrypt, the layer is
+// applied using a stream cipher, so applying it twice is a no-op.
+func replyEncrypt(sharedSecret *Hash256, data []byte) []byte {
+	p := make([]byte, len(data))
+
+	surbKey := generateKey("surb", sharedSecret)
+	defer zero(surbKey[:])
+
+	xorCipherStream(p, data, surbKey)
+
+	return p
+}
@@ -0,0 +1,99 @@
+package sphinx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// TestReplyBlock tests that a responder is able to send a reply to the
+// originator of a reply block, with each hop along the return route adding a
+// layer of encryption that is stripped by the originator.
+func TestReplyBlock(t *testing.T) {
+	const numHops = 4
+
+	// The last node in the return route is the originator of the reply
+	// block.
+	nodes, route, _, _, err := newTestRoute(numHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+	replyBlock, err := NewReplyBlock(route, sessionKey)
+	if err != nil {
+		t.Fatalf("unable to create reply block: %v", err)
+	}
+
+	// The reply block is handed to the responder, who only learns the
+	// first hop of the return route.
+	var b bytes.Buffer
+	if err := replyBlock.Encode(&b); err != nil {
+		t.Fatalf("unable to encode reply block: %v", err)
+	}
+	var responderBlock ReplyBlock
+	if err := responderBlock.Decode(&b); err != nil {
+		t.Fatalf("unable to decode reply block: %v", err)
+	}
+	if !responderBlock.FirstHop.IsEqual(&route[0].NodePub) {
+		t.Fatalf("reply block has wrong first hop")
+	}
+
+	replyPayload := []byte("the reply to an anonymous request")
+	reply, err := UseReplyBlock(&responderBlock, replyPayload)
+	if err != nil {
+		t.Fatalf("unable to use reply block: %v", err)
+	}
+
+	// The responder is unable to open its own reply.
+	if _, err := responderBlock.OpenReply(reply.Payload); err == nil {
+		t.Fatalf("responder shouldn't be able to open reply")
+	}
+
+	for i, node := range nodes {
+		node.log.Start()
+		defer node.log.Stop()
+
+		processed, nextReply, err := node.ProcessReplyPacket(
+			reply, nil, uint32(i),
+		)
+		if err != nil {
+			t.Fatalf("node %d unable to process reply: %v", i, err)
+		}
+
+		if bytes.Equal(nextReply.Payload, reply.Payload) {
+			t.Fatalf("node %d didn't add a layer to the payload", i)
+		}
+
+		expectedAction := ProcessCode(MoreHops)
+		if i == numHops-1 {
+			expectedAction = ExitNode
+		}
+		if processed.Action != expectedAction {
+			t.Fatalf("node %d expected action %v, got %v", i,
+				expectedAction, processed.Action)
+		}
+
+		reply = nextReply
+	}
+
+	// Any tampering with the payload is detected by the originator.
+	tampered := append([]byte(nil), reply.Payload...)
+	tampered[0] ^= 1
+	if _, err := replyBlock.OpenReply(tampered); err == nil {
+		t.Fatalf("expected tampered reply to be rejected")
+	}
+
+	plainText, err := replyBlock.OpenReply(reply.Payload)
+	if err != nil {
+		t.Fatalf("unable to open reply: %v", err)
+	}
+	if !bytes.Equal(plainText, replyPayload) {
+		t.Fatalf("reply payload mismatch: expected %q, got %q",
+			replyPayload, plainText)
+	}
+}
@@ -0,0 +1,177 @@
+package sphinx
+
+import "sync"
+
+// ThrottledReplayLog is a ReplayLog which wraps another ReplayLog, and limits
+// the number of writes to it that may be in flight at once. Once the limit is
+// reached, Put and PutBatch fail right away with ErrReplayLogBusy, rather
+// than queueing up behind the writes already in flight. This allows a caller
+// receiving a burst of packets to apply backpressure to its peers, instead of
+// blocking indefinitely on a slow backend.
+//
+// The hash prefixes of in-flight writes are kept in memory, so a packet
+// replayed while its prefix is still being written is rejected as a replay,
+// even if the wrapped log doesn't serialize its writes.
+//
+// NOTE: Rejected writes aren't recorded, so a packet rejected with
+// ErrReplayLogBusy must be processed again to be accepted.
+type ThrottledReplayLog struct {
+	log ReplayLog
+
+	maxInFlight int
+
+	mu       sync.Mutex
+	inFlight map[HashPrefix]uint32
+	writes   int
+}
+
+// NewThrottledReplayLog creates a new ThrottledReplayLog on top of the passed
+// log, which allows at most maxInFlight writes to it to be in flight at once.
+// A non-positive value disables throttling.
+func NewThrottledReplayLog(log ReplayLog,
+	maxInFlight int) *ThrottledReplayLog {
+
+	return &ThrottledReplayLog{
+		log:         log,
+		maxInFlight: maxInFlight,
+		inFlight:    make(map[HashPrefix]uint32),
+	}
+}
+
+// A compile time check to ensure ThrottledReplayLog adheres to the ReplayLog
+// interface.
+var _ ReplayLog = (*ThrottledReplayLog)(nil)
+
+// Start starts the wrapped log.
+func (rl *ThrottledReplayLog) Start() error {
+	return rl.log.Start()
+}
+
+// Stop stops the wrapped log.
+func (rl *ThrottledReplayLog) Stop() error {
+	return rl.log.Stop()
+}
+
+// beginWrite reserves a slot for a write to the wrapped log, returning
+// ErrReplayLogBusy if all of them are taken.
+//
+// NOTE: This method must be called with the log's mutex held.
+func (rl *ThrottledReplayLog) beginWrite() error {
+	if rl.maxInFlight > 0 && rl.writes >= rl.maxInFlight {
+		return ErrReplayLogBusy
+	}
+	rl.writes++
+
+	return nil
+}
+
+// endWrite releases the slot of a write to the wrapped log, along with the
+// passed hash prefixes being written.
+func (rl *ThrottledReplayLog) endWrite(hashes []HashPrefix) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for i := range hashes {
+		delete(rl.inFlight, hashes[i])
+	}
+	rl.writes--
+}
+
+// Get retrieves an entry from the log given its hash prefix, either from the
+// in-flight writes or the wrapped log. It returns ErrLogEntryNotFound if the
+// entry is not in the log.
+func (rl *ThrottledReplayLog) Get(hash *HashPrefix) (uint32, error) {
+	rl.mu.Lock()
+	cltv, ok := rl.inFlight[*hash]
+	rl.mu.Unlock()
+
+	if ok {
+		return cltv, nil
+	}
+
+	return rl.log.Get(hash)
+}
+
+// Put writes the hash prefix to the wrapped log, returning ErrReplayedPacket
+// if it's already being written or present in the wrapped log. If the maximum
+// number of writes is already in flight, ErrReplayLogBusy is returned without
+// writing the prefix.
+func (rl *ThrottledReplayLog) Put(hash *HashPrefix, cltv uint32) error {
+	rl.mu.Lock()
+	if _, ok := rl.inFlight[*hash]; ok {
+		rl.mu.Unlock()
+		return ErrReplayedPacket
+	}
+	if err := rl.beginWrite(); err != nil {
+		rl.mu.Unlock()
+		return err
+	}
+	rl.inFlight[*hash] = cltv
+	rl.mu.Unlock()
+
+	defer rl.endWrite([]HashPrefix{*hash})
+
+	return rl.log.Put(hash, cltv)
+}
+
+// Delete deletes an entry from the wrapped log given its hash prefix.
+func (rl *ThrottledReplayLog) Delete(hash *HashPrefix) error {
+	return rl.log.Delete(hash)
+}
+
+// DeleteStale deletes all entries from the wrapped log of which the stored
+// CLTV expiry is below the passed height. It returns the number of entries
+// deleted.
+func (rl *ThrottledReplayLog) DeleteStale(height uint32) (int, error) {
+	return rl.log.DeleteStale(height)
+}
+
+// PutBatch writes the batch to the wrapped log as a single write, returning
+// ErrReplayLogBusy if the maximum number of writes is already in flight.
+// Entries of which the hash prefix is being written by another write are
+// marked as replays, and not passed on to the wrapped log. Returns the set of
+// entries in the batch that are replays and an error if one occurs.
+func (rl *ThrottledReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	if batch.IsCommitted {
+		return rl.log.PutBatch(batch)
+	}
+
+	rl.mu.Lock()
+	if err := rl.beginWrite(); err != nil {
+		rl.mu.Unlock()
+		return nil, err
+	}
+
+	hashes := make([]HashPrefix, 0, len(batch.entries))
+	for seqNum, entry := range batch.entries {
+		if _, ok := rl.inFlight[entry.hashPrefix]; ok {
+			batch.ReplaySet.Add(seqNum)
+			delete(batch.entries, seqNum)
+			continue
+		}
+
+		rl.inFlight[entry.hashPrefix] = entry.cltv
+		hashes = append(hashes, entry.hashPrefix)
+	}
+	rl.mu.Unlock()
+
+	defer rl.endWrite(hashes)
+
+	return rl.log.PutBatch(batch)
+}
+
+// Stats returns the number of entries stored in the wrapped log, along with
+// the lowest CLTV expiry among them. Entries still being written aren't
+// included.
+func (rl *ThrottledReplayLog) Stats() (int, uint32, error) {
+	return rl.log.Stats()
+}
+
+// ForEach calls the passed function with the hash prefix and CLTV expiry of
+// each entry stored in the wrapped log, stopping at the first error it
+// returns. Entries still being written aren't visited.
+func (rl *ThrottledReplayLog) ForEach(fn func(hash *HashPrefix,
+	cltv uint32) error) error {
+
+	return rl.log.ForEach(fn)
+}
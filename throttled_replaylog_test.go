@@ -0,0 +1,92 @@
+package sphinx
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// slowReplayLog is a MemoryReplayLog of which each write blocks until it's
+// released, simulating a slow backend.
+type slowReplayLog struct {
+	*MemoryReplayLog
+
+	entered chan struct{}
+	release chan struct{}
+}
+
+// Put signals the write was entered, and writes the entry once released.
+func (rl *slowReplayLog) Put(hash *HashPrefix, cltv uint32) error {
+	rl.entered <- struct{}{}
+	<-rl.release
+
+	return rl.MemoryReplayLog.Put(hash, cltv)
+}
+
+// TestThrottledReplayLog asserts that a router using a ThrottledReplayLog
+// rejects packets with ErrReplayLogBusy while a write to a slow backend is in
+// flight, while replays of the packet being written are still caught.
+func TestThrottledReplayLog(t *testing.T) {
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate onion key: %v", err)
+	}
+	backend := &slowReplayLog{
+		MemoryReplayLog: NewMemoryReplayLog(),
+		entered:         make(chan struct{}, 3),
+		release:         make(chan struct{}),
+	}
+	router := NewRouter(
+		privKey, &chaincfg.MainNetParams,
+		NewThrottledReplayLog(backend, 1),
+	)
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router: %v", err)
+	}
+	defer router.Stop()
+
+	pkt1, err := newTestSingleHopPacket(router)
+	if err != nil {
+		t.Fatalf("unable to create packet: %v", err)
+	}
+	pkt2, err := newTestSingleHopPacket(router)
+	if err != nil {
+		t.Fatalf("unable to create packet: %v", err)
+	}
+
+	// Process the first packet, of which the write blocks until released.
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := router.ProcessOnionPacket(pkt1, nil, 1)
+		errChan <- err
+	}()
+	<-backend.entered
+
+	// While the write is in flight, another packet is rejected as the log
+	// is busy, while a replay of the first one is still caught.
+	_, err = router.ProcessOnionPacket(pkt2, nil, 1)
+	if !errors.Is(err, ErrReplayLogBusy) {
+		t.Fatalf("expected ErrReplayLogBusy, got: %v", err)
+	}
+	_, err = router.ProcessOnionPacket(pkt1, nil, 1)
+	if !errors.Is(err, ErrReplayedPacket) {
+		t.Fatalf("expected ErrReplayedPacket, got: %v", err)
+	}
+
+	close(backend.release)
+	if err := <-errChan; err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+
+	// With the write completed, the rejected packet is accepted once it's
+	// processed again, and the first one is caught by the backend.
+	if _, err := router.ProcessOnionPacket(pkt2, nil, 1); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	_, err = router.ProcessOnionPacket(pkt1, nil, 1)
+	if !errors.Is(err, ErrReplayedPacket) {
+		t.Fatalf("expected ErrReplayedPacket, got: %v", err)
+	}
+}
@@ -0,0 +1,398 @@
+package sphinx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// amtToForwardType is the TLV type of the amount to forward record.
+	amtToForwardType uint64 = 2
+
+	// outgoingCltvType is the TLV type of the outgoing CLTV value record.
+	outgoingCltvType uint64 = 4
+
+	// shortChannelIDType is the TLV type of the short channel ID record.
+	shortChannelIDType uint64 = 6
+
+	// paymentDataType is the TLV type of the payment data record, which
+	// carries the payment secret and total amount of the payment to the
+	// exit hop.
+	paymentDataType uint64 = 8
+
+	// encryptedDataType is the TLV type of the record carrying the
+	// encrypted recipient data of a hop within a blinded path.
+	encryptedDataType uint64 = 10
+
+	// blindingPointType is the TLV type of the record handing the blinding
+	// point of a blinded path to its introduction point.
+	blindingPointType uint64 = 12
+
+	// paymentMetadataType is the TLV type of the payment metadata record,
+	// which the exit hop hands back to the recipient verbatim.
+	paymentMetadataType uint64 = 16
+
+	// totalAmountType is the TLV type of the total amount record, which
+	// carries the total amount of the payment to the exit hop of a
+	// blinded path.
+	totalAmountType uint64 = 18
+
+	// mixDelayType is the TLV type of the mix delay record. It lies within
+	// the custom range, and is odd so that nodes not acting as mix relays
+	// may ignore it.
+	mixDelayType uint64 = 65537
+
+	// maxMixDelayMillis is the largest mix delay, in milliseconds, which
+	// can be represented as a time.Duration.
+	maxMixDelayMillis = uint64(math.MaxInt64 / int64(time.Millisecond))
+)
+
+var (
+	// errTLVNotSorted is returned when decoding a TLV stream of which the
+	// record types aren't strictly increasing.
+	errTLVNotSorted = fmt.Errorf("%w: record types must be strictly "+
+		"increasing", ErrInvalidTLVPayload)
+
+	// errTLVNotMinimal is returned when decoding a truncated integer that
+	// wasn't minimally encoded.
+	errTLVNotMinimal = fmt.Errorf("%w: truncated integer isn't "+
+		"minimally encoded", ErrInvalidTLVPayload)
+
+	// errTLVMissingRecord is returned when decoding a TLV hop payload which
+	// lacks one of the required records.
+	errTLVMissingRecord = fmt.Errorf("%w: missing the amount to forward "+
+		"or outgoing cltv", ErrInvalidTLVPayload)
+)
+
+// TLVHopData is the information destined for an individual hop within a TLV
+// payload, as defined in BOLT 4. Unlike HopData, the payload is a stream of
+// type-length-value records, which allows it to omit fields that don't apply
+// to a hop, and to carry additional records.
+type TLVHopData struct {
+	// ForwardAmount is the HTLC amount that the next hop should forward,
+	// or the amount to receive for the exit hop.
+	ForwardAmount uint64
+
+	// OutgoingCltv is the value of the outgoing absolute time-lock that
+	// should be included in the HTLC forwarded.
+	OutgoingCltv uint32
+
+	// NextAddress is the short channel ID of the channel the packet
+	// should be forwarded over. This is nil for the exit hop.
+	NextAddress *[AddressSize]byte
+
+	// Delay is the time a mix relay should hold the packet for before
+	// forwarding it, which allows it to batch and reorder the packets it
+	// handles. It's carried with millisecond precision, with any remainder
+	// truncated, and omitted from the payload if zero.
+	Delay time.Duration
+
+	// PaymentMetadata is the payment metadata of the recipient's invoice,
+	// placed within the payload of the exit hop by the sender, such that
+	// the recipient receives it verbatim. It's nil if the payload doesn't
+	// carry the record, while an empty, non-nil, slice is encoded as an
+	// empty record.
+	PaymentMetadata []byte
+
+	// ExtraRecords houses all records other than the ones above, keyed by
+	// their type. Whether unknown records can be safely ignored is
+	// determined by the higher layers parsing them.
+	ExtraRecords map[uint64][]byte
+}
+
+// Encode writes the TLV stream of the target TLVHopData into the passed
+// io.Writer, with all records sorted by type.
+func (hd *TLVHopData) Encode(w io.Writer) error {
+	if hd.Delay < 0 {
+		return fmt.Errorf("mix delay of %v is negative", hd.Delay)
+	}
+
+	records := make(map[uint64][]byte, len(hd.ExtraRecords)+5)
+	for typ, value := range hd.ExtraRecords {
+		switch typ {
+		case amtToForwardType, outgoingCltvType, shortChannelIDType,
+			paymentMetadataType, mixDelayType:
+
+			return fmt.Errorf("extra record of type %d conflicts "+
+				"with a known record", typ)
+		}
+
+		records[typ] = value
+	}
+
+	var amt [8]byte
+	binary.BigEndian.PutUint64(amt[:], hd.ForwardAmount)
+	records[amtToForwardType] = truncateInt(amt[:])
+
+	var cltv [4]byte
+	binary.BigEndian.PutUint32(cltv[:], hd.OutgoingCltv)
+	records[outgoingCltvType] = truncateInt(cltv[:])
+
+	if hd.NextAddress != nil {
+		records[shortChannelIDType] = hd.NextAddress[:]
+	}
+
+	if hd.PaymentMetadata != nil {
+		records[paymentMetadataType] = hd.PaymentMetadata
+	}
+
+	if delayMillis := hd.Delay / time.Millisecond; delayMillis > 0 {
+		var delay [8]byte
+		binary.BigEndian.PutUint64(delay[:], uint64(delayMillis))
+		records[mixDelayType] = truncateInt(delay[:])
+	}
+
+	types := make([]uint64, 0, len(records))
+	for typ := range records {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+
+	var scratch [8]byte
+	for _, typ := range types {
+		value := records[typ]
+		if err := writeVarInt(w, typ, &scratch); err != nil {
+			return err
+		}
+		err := writeVarInt(w, uint64(len(value)), &scratch)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Decode deserializes the TLV stream contained in the passed io.Reader into
+// the target TLVHopData. The amount to forward and outgoing CLTV records are
+// required, while all records must be sorted by type, and appear only once.
+func (hd *TLVHopData) Decode(r io.Reader) error {
+	*hd = TLVHopData{}
+
+	var (
+		scratch    [8]byte
+		numRecords int
+		lastType   uint64
+		haveAmt    bool
+		haveCltv   bool
+	)
+	for {
+		typ, err := readVarInt(r, &scratch)
+		switch {
+		// The stream may only end at a record boundary.
+		case err == io.EOF:
+			if !haveAmt || !haveCltv {
+				return errTLVMissingRecord
+			}
+			return nil
+
+		case err != nil:
+			return err
+		}
+
+		if numRecords > 0 && typ <= lastType {
+			return errTLVNotSorted
+		}
+		numRecords++
+		lastType = typ
+
+		length, err := readVarInt(r, &scratch)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+
+		switch typ {
+		case amtToForwardType:
+			if length > 8 {
+				return fmt.Errorf("%w: amount to forward of "+
+					"%d bytes exceeds 8 bytes",
+					ErrInvalidTLVPayload, length)
+			}
+			hd.ForwardAmount, err = readTruncatedInt(r, length)
+			if err != nil {
+				return err
+			}
+			haveAmt = true
+
+		case outgoingCltvType:
+			if length > 4 {
+				return fmt.Errorf("%w: outgoing cltv of %d "+
+					"bytes exceeds 4 bytes",
+					ErrInvalidTLVPayload, length)
+			}
+			cltv, err := readTruncatedInt(r, length)
+			if err != nil {
+				return err
+			}
+			hd.OutgoingCltv = uint32(cltv)
+			haveCltv = true
+
+		case shortChannelIDType:
+			if length != AddressSize {
+				return fmt.Errorf("%w: short channel id of %d "+
+					"bytes isn't %d bytes",
+					ErrInvalidTLVPayload, length,
+					AddressSize)
+			}
+			var nextAddress [AddressSize]byte
+			if _, err := io.ReadFull(r, nextAddress[:]); err != nil {
+				return err
+			}
+			hd.NextAddress = &nextAddress
+
+		case paymentMetadataType:
+			if length > MaxPayloadSize {
+				return ErrPayloadTooLarge
+			}
+			hd.PaymentMetadata = make([]byte, length)
+			_, err := io.ReadFull(r, hd.PaymentMetadata)
+			if err != nil {
+				return err
+			}
+
+		case mixDelayType:
+			if length > 8 {
+				return fmt.Errorf("%w: mix delay of %d bytes "+
+					"exceeds 8 bytes",
+					ErrInvalidTLVPayload, length)
+			}
+			delayMillis, err := readTruncatedInt(r, length)
+			if err != nil {
+				return err
+			}
+			if delayMillis > maxMixDelayMillis {
+				return fmt.Errorf("%w: mix delay of %d ms "+
+					"overflows", ErrInvalidTLVPayload,
+					delayMillis)
+			}
+			hd.Delay = time.Duration(delayMillis) * time.Millisecond
+
+		default:
+			// A record can't be larger than the routing info it is
+			// carried in, so we reject such lengths before
+			// allocating a buffer for it.
+			if length > MaxPayloadSize {
+				return ErrPayloadTooLarge
+			}
+			value := make([]byte, length)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return err
+			}
+			if hd.ExtraRecords == nil {
+				hd.ExtraRecords = make(map[uint64][]byte)
+			}
+			hd.ExtraRecords[typ] = value
+		}
+	}
+}
+
+// validateTLVStream checks that the passed payload is a well formed TLV
+// stream: the records must be sorted by strictly increasing type, and each of
+// them must be fully contained within the payload. If knownTypes is non-nil,
+// records of an even type not within it are rejected as well, as an even type
+// signals a record the hop must understand. The values of the records, and
+// whether the records a hop requires are present, aren't checked.
+func validateTLVStream(payload []byte, knownTypes map[uint64]struct{}) error {
+	var (
+		r          = bytes.NewReader(payload)
+		scratch    [8]byte
+		numRecords int
+		lastType   uint64
+	)
+	for {
+		typ, err := readVarInt(r, &scratch)
+		switch {
+		// The stream may only end at a record boundary.
+		case err == io.EOF:
+			return nil
+
+		case err != nil:
+			return fmt.Errorf("%w: invalid record type: %v",
+				ErrInvalidTLVPayload, err)
+		}
+
+		if numRecords > 0 && typ <= lastType {
+			return errTLVNotSorted
+		}
+		numRecords++
+		lastType = typ
+
+		length, err := readVarInt(r, &scratch)
+		if err != nil {
+			return fmt.Errorf("%w: invalid length of record of "+
+				"type %d: %v", ErrInvalidTLVPayload, typ, err)
+		}
+		if length > uint64(r.Len()) {
+			return fmt.Errorf("%w: record of type %d exceeds the "+
+				"payload", ErrInvalidTLVPayload, typ)
+		}
+
+		if knownTypes != nil && typ%2 == 0 {
+			if _, ok := knownTypes[typ]; !ok {
+				return fmt.Errorf("%w: %d",
+					ErrUnknownEvenTLVType, typ)
+			}
+		}
+
+		if _, err := r.Seek(int64(length), io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+}
+
+// truncateInt strips the leading zero bytes from the passed big-endian
+// integer, yielding its minimal encoding.
+func truncateInt(b []byte) []byte {
+	return bytes.TrimLeft(b, "\x00")
+}
+
+// readTruncatedInt reads a minimally encoded big-endian integer of the passed
+// length from the io.Reader.
+func readTruncatedInt(r io.Reader, length uint64) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[8-length:]); err != nil {
+		return 0, err
+	}
+	if length > 0 && b[8-length] == 0 {
+		return 0, errTLVNotMinimal
+	}
+
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+// NewTLVHopPayload creates a new TLV hop payload carrying the passed hop data.
+func NewTLVHopPayload(hopData *TLVHopData) (HopPayload, error) {
+	var b bytes.Buffer
+	if err := hopData.Encode(&b); err != nil {
+		return HopPayload{}, err
+	}
+
+	return NewHopPayload(nil, b.Bytes())
+}
+
+// TLVHopData attempts to parse the TLV records of the target HopPayload. If
+// this isn't a TLV payload, then nil is returned.
+func (hp *HopPayload) TLVHopData() (*TLVHopData, error) {
+	if hp.Type != PayloadTLV {
+		return nil, nil
+	}
+
+	var hd TLVHopData
+	if err := hd.Decode(bytes.NewReader(hp.Payload)); err != nil {
+		return nil, err
+	}
+
+	return &hd, nil
+}
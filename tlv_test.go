@@ -0,0 +1,452 @@
+package sphinx
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/davecgh/go-spew/spew"
+)
+
+// TestTLVHopDataEncodeDecode tests that TLV hop data survives a serialization
+// round trip, both with and without the optional records.
+func TestTLVHopDataEncodeDecode(t *testing.T) {
+	nextAddress := [AddressSize]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	tests := []*TLVHopData{
+		{
+			ForwardAmount: 0,
+			OutgoingCltv:  0,
+		},
+		{
+			ForwardAmount: 1000,
+			OutgoingCltv:  500000,
+			NextAddress:   &nextAddress,
+		},
+		{
+			ForwardAmount: 1000,
+			OutgoingCltv:  500000,
+			NextAddress:   &nextAddress,
+			Delay:         1500 * time.Millisecond,
+		},
+		{
+			ForwardAmount:   1000,
+			OutgoingCltv:    500000,
+			PaymentMetadata: []byte("payment metadata"),
+		},
+		{
+			ForwardAmount:   1000,
+			OutgoingCltv:    500000,
+			PaymentMetadata: []byte{},
+		},
+		{
+			ForwardAmount: 1 << 63,
+			OutgoingCltv:  1 << 31,
+			ExtraRecords: map[uint64][]byte{
+				1:       {0x01},
+				8:       {},
+				1 << 20: bytes.Repeat([]byte{0xaa}, 300),
+			},
+		},
+	}
+
+	for i, hopData := range tests {
+		var b bytes.Buffer
+		if err := hopData.Encode(&b); err != nil {
+			t.Fatalf("test %d: unable to encode hop data: %v", i, err)
+		}
+
+		var decoded TLVHopData
+		if err := decoded.Decode(&b); err != nil {
+			t.Fatalf("test %d: unable to decode hop data: %v", i, err)
+		}
+
+		if !reflect.DeepEqual(hopData, &decoded) {
+			t.Fatalf("test %d: hop data mismatch, expected %v got %v",
+				i, spew.Sdump(hopData), spew.Sdump(decoded))
+		}
+	}
+}
+
+// TestTLVHopDataDecodeInvalid tests that malformed TLV streams are rejected.
+func TestTLVHopDataDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		err  error
+	}{
+		{
+			name: "missing cltv",
+			raw:  []byte{0x02, 0x01, 0x01},
+			err:  errTLVMissingRecord,
+		},
+		{
+			name: "not sorted",
+			raw:  []byte{0x04, 0x01, 0x01, 0x02, 0x01, 0x01},
+			err:  errTLVNotSorted,
+		},
+		{
+			name: "duplicate record",
+			raw:  []byte{0x02, 0x01, 0x01, 0x02, 0x01, 0x01},
+			err:  errTLVNotSorted,
+		},
+		{
+			name: "non minimal amount",
+			raw:  []byte{0x02, 0x02, 0x00, 0x01, 0x04, 0x00},
+			err:  errTLVNotMinimal,
+		},
+		{
+			name: "oversized cltv",
+			raw: []byte{
+				0x02, 0x01, 0x01, 0x04, 0x05, 0x01, 0x02, 0x03,
+				0x04, 0x05,
+			},
+			err: ErrInvalidTLVPayload,
+		},
+		{
+			name: "short channel id too short",
+			raw: []byte{
+				0x02, 0x01, 0x01, 0x04, 0x01, 0x01, 0x06, 0x07,
+				0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+			},
+			err: ErrInvalidTLVPayload,
+		},
+		{
+			name: "overflowing mix delay",
+			raw: []byte{
+				0x02, 0x01, 0x01, 0x04, 0x01, 0x01, 0xfe, 0x00,
+				0x01, 0x00, 0x01, 0x08, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0xff, 0xff, 0xff,
+			},
+			err: ErrInvalidTLVPayload,
+		},
+		{
+			name: "truncated record",
+			raw:  []byte{0x02, 0x01, 0x01, 0x04},
+			err:  io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, test := range tests {
+		var hopData TLVHopData
+		err := hopData.Decode(bytes.NewReader(test.raw))
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%s: expected error %v, got %v", test.name,
+				test.err, err)
+		}
+
+		// All encoding errors can be matched against the shared
+		// sentinel error.
+		if test.err != io.ErrUnexpectedEOF &&
+			!errors.Is(err, ErrInvalidTLVPayload) {
+
+			t.Fatalf("%s: expected %v to wrap %v", test.name, err,
+				ErrInvalidTLVPayload)
+		}
+	}
+}
+
+// TestSphinxTLVHopData tests that the TLV hop data of each hop in a route can
+// be recovered from the processed packets.
+func TestSphinxTLVHopData(t *testing.T) {
+	const numHops = 3
+
+	nodes, route, _, _, err := newTestRoute(numHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	hopDatas := make([]*TLVHopData, numHops)
+	for i := range hopDatas {
+		hopDatas[i] = &TLVHopData{
+			ForwardAmount: uint64(i) * 1000,
+			OutgoingCltv:  uint32(i) + 100,
+		}
+		if i != numHops-1 {
+			var nextAddress [AddressSize]byte
+			nextAddress[0] = byte(i)
+			hopDatas[i].NextAddress = &nextAddress
+		}
+
+		route[i].HopPayload, err = NewTLVHopPayload(hopDatas[i])
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	fwdMsg, err := NewOnionPacket(route, sessionKey, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	for i, node := range nodes {
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("hop %d unable to process packet: %v", i, err)
+		}
+		if pkt.ForwardingInstructions != nil {
+			t.Fatalf("hop %d unexpectedly has legacy forwarding "+
+				"instructions", i)
+		}
+
+		hopData, err := pkt.Payload.TLVHopData()
+		if err != nil {
+			t.Fatalf("hop %d unable to parse tlv hop data: %v", i, err)
+		}
+		if !reflect.DeepEqual(hopData, hopDatas[i]) {
+			t.Fatalf("hop %d hop data mismatch, expected %v got %v",
+				i, spew.Sdump(hopDatas[i]), spew.Sdump(hopData))
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+}
+
+// TestSphinxMixDelay tests that the mix delay of each hop in a route is
+// exposed by the processed packets, and that hops without one are left
+// without a delay.
+func TestSphinxMixDelay(t *testing.T) {
+	const numHops = 3
+
+	nodes, route, _, _, err := newTestRoute(numHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	delays := []time.Duration{
+		250 * time.Millisecond, 0, 3 * time.Second,
+	}
+	for i, delay := range delays {
+		hopData := &TLVHopData{
+			ForwardAmount: 1000,
+			OutgoingCltv:  100,
+			Delay:         delay,
+		}
+		if i != numHops-1 {
+			var nextAddress [AddressSize]byte
+			nextAddress[0] = byte(i)
+			hopData.NextAddress = &nextAddress
+		}
+
+		route[i].HopPayload, err = NewTLVHopPayload(hopData)
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+	}
+
+	fwdMsg, _, err := NewOnionPacketWithRandomSession(route, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	for i, node := range nodes {
+		pkt, err := node.ReconstructOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("hop %d unable to process packet: %v", i, err)
+		}
+		if pkt.Delay != delays[i] {
+			t.Fatalf("hop %d: expected delay %v, got %v", i,
+				delays[i], pkt.Delay)
+		}
+
+		fwdMsg = pkt.NextPacket
+	}
+
+	// Delays are carried with millisecond precision, and can't be
+	// negative.
+	var b bytes.Buffer
+	hopData := &TLVHopData{Delay: time.Millisecond + time.Microsecond}
+	if err := hopData.Encode(&b); err != nil {
+		t.Fatalf("unable to encode hop data: %v", err)
+	}
+	if err := hopData.Decode(&b); err != nil {
+		t.Fatalf("unable to decode hop data: %v", err)
+	}
+	if hopData.Delay != time.Millisecond {
+		t.Fatalf("expected truncated delay of %v, got %v",
+			time.Millisecond, hopData.Delay)
+	}
+
+	hopData = &TLVHopData{Delay: -time.Second}
+	if err := hopData.Encode(&b); err == nil {
+		t.Fatalf("expected negative delay to be rejected")
+	}
+}
+
+// TestSphinxPaymentMetadata tests that the payment metadata placed within the
+// payload of the exit hop is surfaced by it verbatim, while it's absent for
+// exit payloads without the record, and never surfaced by intermediate hops.
+func TestSphinxPaymentMetadata(t *testing.T) {
+	const numHops = 3
+
+	metadata := bytes.Repeat([]byte{0xab}, 300)
+	for _, exitMetadata := range [][]byte{metadata, nil} {
+		nodes, route, _, _, err := newTestRoute(numHops)
+		if err != nil {
+			t.Fatalf("unable to create test route: %v", err)
+		}
+
+		for i := range nodes {
+			hopData := &TLVHopData{
+				ForwardAmount:   1000,
+				OutgoingCltv:    100,
+				PaymentMetadata: exitMetadata,
+			}
+			if i != numHops-1 {
+				var nextAddress [AddressSize]byte
+				nextAddress[0] = byte(i)
+				hopData.NextAddress = &nextAddress
+				hopData.PaymentMetadata = []byte{0x01}
+			}
+
+			route[i].HopPayload, err = NewTLVHopPayload(hopData)
+			if err != nil {
+				t.Fatalf("unable to create hop payload: %v",
+					err)
+			}
+		}
+
+		fwdMsg, _, err := NewOnionPacketWithRandomSession(route, nil)
+		if err != nil {
+			t.Fatalf("unable to create onion packet: %v", err)
+		}
+
+		processed, err := SimulateRoute(nodes, fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("unable to process packet: %v", err)
+		}
+		for i, pkt := range processed[:numHops-1] {
+			if pkt.PaymentMetadata != nil {
+				t.Fatalf("hop %d surfaced payment metadata", i)
+			}
+		}
+
+		exitMetadataRecv := processed[numHops-1].PaymentMetadata
+		if !bytes.Equal(exitMetadataRecv, exitMetadata) ||
+			(exitMetadata == nil) != (exitMetadataRecv == nil) {
+
+			t.Fatalf("expected payment metadata %x, got %x",
+				exitMetadata, exitMetadataRecv)
+		}
+	}
+}
+
+// TestSphinxTLVStrictness tests that a router validates the TLV payloads of
+// the packets it processes according to the configured strictness level.
+func TestSphinxTLVStrictness(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+
+		// errs holds the expected error at each strictness level.
+		errs [3]error
+	}{
+		{
+			name:    "valid",
+			payload: []byte{0x02, 0x01, 0x01, 0x04, 0x01, 0x01},
+		},
+		{
+			name:    "not sorted",
+			payload: []byte{0x04, 0x01, 0x01, 0x02, 0x01, 0x01},
+			errs: [3]error{
+				nil, errTLVNotSorted, errTLVNotSorted,
+			},
+		},
+		{
+			name: "unknown even type",
+			payload: []byte{
+				0x02, 0x01, 0x01, 0x04, 0x01, 0x01, 0x14, 0x00,
+			},
+			errs: [3]error{nil, nil, ErrUnknownEvenTLVType},
+		},
+		{
+			name: "bolt 4 even types",
+			payload: []byte{
+				0x02, 0x01, 0x01, 0x04, 0x01, 0x01, 0x08, 0x00,
+				0x0a, 0x00, 0x0c, 0x00, 0x12, 0x00,
+			},
+		},
+		{
+			name: "unknown odd type",
+			payload: []byte{
+				0x02, 0x01, 0x01, 0x04, 0x01, 0x01, 0x09, 0x00,
+			},
+		},
+		{
+			name:    "truncated record",
+			payload: []byte{0x02, 0x01, 0x01, 0x04, 0x02, 0x01},
+			errs: [3]error{
+				nil, ErrInvalidTLVPayload, ErrInvalidTLVPayload,
+			},
+		},
+	}
+
+	nodes, route, _, _, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	levels := []TLVStrictness{TLVUnchecked, TLVWellFormed, TLVStrict}
+	for _, test := range tests {
+		route[0].HopPayload, err = NewHopPayload(nil, test.payload)
+		if err != nil {
+			t.Fatalf("%s: unable to create hop payload: %v",
+				test.name, err)
+		}
+		fwdMsg, _, err := NewOnionPacketWithRandomSession(route, nil)
+		if err != nil {
+			t.Fatalf("%s: unable to create onion packet: %v",
+				test.name, err)
+		}
+
+		for i, level := range levels {
+			node := NewRouterWithECDH(
+				nodes[0].onionPub, nodes[0].onionKey,
+				&chaincfg.MainNetParams, NewMemoryReplayLog(),
+				WithTLVStrictness(level),
+			)
+
+			_, err := node.ReconstructOnionPacket(fwdMsg, nil)
+			if !errors.Is(err, test.errs[i]) ||
+				(test.errs[i] == nil) != (err == nil) {
+
+				t.Fatalf("%s: level %d: expected error %v, "+
+					"got %v", test.name, level,
+					test.errs[i], err)
+			}
+
+			var procErr *ProcessingError
+			if err != nil && (!errors.As(err, &procErr) ||
+				procErr.Stage != StagePayload) {
+
+				t.Fatalf("%s: expected error at payload "+
+					"stage, got %v", test.name, err)
+			}
+		}
+	}
+
+	// Even types handled by higher layers are accepted once known.
+	route[0].HopPayload, err = NewHopPayload(nil, tests[2].payload)
+	if err != nil {
+		t.Fatalf("unable to create hop payload: %v", err)
+	}
+	fwdMsg, _, err := NewOnionPacketWithRandomSession(route, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	node := NewRouterWithECDH(
+		nodes[0].onionPub, nodes[0].onionKey, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(), WithTLVStrictness(TLVStrict, 20),
+	)
+	if _, err := node.ReconstructOnionPacket(fwdMsg, nil); err != nil {
+		t.Fatalf("unable to process payload with known even type: %v",
+			err)
+	}
+}
@@ -0,0 +1,130 @@
+package sphinx
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// errVarIntNotCanonical is returned when a variable length integer is decoded
+// which wasn't minimally encoded.
+var errVarIntNotCanonical = errors.New("decoded varint is not canonical")
+
+// varIntSize returns the number of bytes it would take to serialize val as a
+// variable length integer.
+func varIntSize(val uint64) int {
+	switch {
+	case val < 0xfd:
+		return 1
+	case val <= 0xffff:
+		return 3
+	case val <= 0xffffffff:
+		return 5
+	default:
+		return 9
+	}
+}
+
+// putVarInt serializes val into b, which must be at least varIntSize(val)
+// bytes long, using the same encoding as writeVarInt. It returns the number of
+// bytes written.
+func putVarInt(b []byte, val uint64) int {
+	switch {
+	case val < 0xfd:
+		b[0] = uint8(val)
+		return 1
+
+	case val <= 0xffff:
+		b[0] = 0xfd
+		binary.BigEndian.PutUint16(b[1:3], uint16(val))
+		return 3
+
+	case val <= 0xffffffff:
+		b[0] = 0xfe
+		binary.BigEndian.PutUint32(b[1:5], uint32(val))
+		return 5
+
+	default:
+		b[0] = 0xff
+		binary.BigEndian.PutUint64(b[1:9], val)
+		return 9
+	}
+}
+
+// writeVarInt serializes val to w using a variable number of bytes depending
+// on its value. The encoding is the BigSize format used throughout the
+// Lightning specification: values below 0xfd are a single byte, while larger
+// values are prefixed by a discriminant byte and written big-endian.
+func writeVarInt(w io.Writer, val uint64, buf *[8]byte) error {
+	var b []byte
+	switch {
+	case val < 0xfd:
+		buf[0] = uint8(val)
+		b = buf[:1]
+
+	case val <= 0xffff:
+		buf[0] = 0xfd
+		binary.BigEndian.PutUint16(buf[1:3], uint16(val))
+		b = buf[:3]
+
+	case val <= 0xffffffff:
+		buf[0] = 0xfe
+		binary.BigEndian.PutUint32(buf[1:5], uint32(val))
+		b = buf[:5]
+
+	default:
+		if _, err := w.Write([]byte{0xff}); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(buf[:], val)
+		b = buf[:]
+	}
+
+	_, err := w.Write(b)
+	return err
+}
+
+// readVarInt reads a variable length integer encoded by writeVarInt from r.
+// Non-canonical encodings are rejected with errVarIntNotCanonical.
+func readVarInt(r io.Reader, buf *[8]byte) (uint64, error) {
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return 0, err
+	}
+	discriminant := buf[0]
+
+	var (
+		val uint64
+		min uint64
+	)
+	switch discriminant {
+	case 0xff:
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return 0, err
+		}
+		val = binary.BigEndian.Uint64(buf[:])
+		min = 0x100000000
+
+	case 0xfe:
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return 0, err
+		}
+		val = uint64(binary.BigEndian.Uint32(buf[:4]))
+		min = 0x10000
+
+	case 0xfd:
+		if _, err := io.ReadFull(r, buf[:2]); err != nil {
+			return 0, err
+		}
+		val = uint64(binary.BigEndian.Uint16(buf[:2]))
+		min = 0xfd
+
+	default:
+		return uint64(discriminant), nil
+	}
+
+	if val < min {
+		return 0, errVarIntNotCanonical
+	}
+
+	return val, nil
+}